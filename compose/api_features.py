@@ -0,0 +1,58 @@
+"""
+The Engine API versions that service options need. Older daemons reject
+some of these options and silently ignore others, so a project that needs
+a newer daemon is refused before anything is created.
+"""
+from collections import namedtuple
+
+from docker.utils import version_lt
+
+Feature = namedtuple('Feature', 'option description api_version')
+
+# `option` is the path of a service option; a feature is needed when the
+# option is set to a true value
+FEATURES = [
+    Feature('pids_limit', 'PID limits', '1.23'),
+    Feature('userns_mode', 'user namespace modes', '1.23'),
+    Feature('isolation', 'isolation technologies', '1.24'),
+    Feature('storage_opt', 'storage options', '1.24'),
+    Feature('sysctls', 'sysctls', '1.24'),
+    Feature('cpus', 'CPU limits', '1.25'),
+    Feature('cpu_rt_period', 'real-time CPU scheduling', '1.25'),
+    Feature('cpu_rt_runtime', 'real-time CPU scheduling', '1.25'),
+    Feature('init', 'init processes', '1.25'),
+    Feature('runtime', 'runtime selection', '1.25'),
+    Feature('device_cgroup_rules', 'device cgroup rules', '1.28'),
+    Feature('healthcheck.start_period', 'healthcheck start periods', '1.29'),
+    Feature('platform', 'platform selection', '1.35'),
+    Feature('device_requests', 'device requests (GPUs)', '1.40'),
+]
+
+
+def option_value(options, path):
+    value = options
+    for key in path.split('.'):
+        if not isinstance(value, dict):
+            return None
+        value = value.get(key)
+    return value
+
+
+def unsupported_features(options, api_version):
+    """The features the service `options` need that API `api_version`
+    lacks.
+    """
+    return [
+        feature for feature in FEATURES
+        if option_value(options, feature.option) and version_lt(api_version, feature.api_version)
+    ]
+
+
+def negotiate_api_version(client):
+    """Lower the API version `client` uses to the daemon's, when that is
+    older, as the Docker CLI does. Returns the version to use.
+    """
+    server_version = client.version(api_version=False).get('ApiVersion')
+    if server_version and version_lt(server_version, client._version):
+        client._version = server_version
+    return client._version
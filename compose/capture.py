@@ -0,0 +1,125 @@
+"""
+A capture of the state of failing services, to attach to bug reports: a
+gzipped tarball with, for each selected service, its resolved config and,
+for each of its containers, running or not:
+
+    <service>/config.yml
+    <service>/<container>/inspect.json
+    <service>/<container>/stdout.log
+    <service>/<container>/stderr.log
+    <service>/<container>/health.json
+
+and the daemon info and the versions of Compose and of the daemon, in
+info.json and version.json.
+
+Everything is only read, and the logs are bounded to the last `tail` lines
+and MAX_LOG_SIZE bytes, so that capturing is safe against production. The
+values of environment variables that look like secrets are masked.
+"""
+import io
+import json
+import logging
+import tarfile
+import time
+
+from docker.errors import NotFound
+
+from . import __version__
+from .config.interpolation import mask_sensitive
+from .config.serialize import denormalize_service_dict
+from .config.serialize import dump_yaml
+from .const import COMPOSE_SPEC
+
+log = logging.getLogger(__name__)
+
+DEFAULT_TAIL = 500
+MAX_LOG_SIZE = 1024 * 1024
+
+
+def mask_environment(environment):
+    """Mask the values of the variables that look like secrets in
+    `environment`, a dict or a list of KEY=VALUE.
+    """
+    if isinstance(environment, dict):
+        return {name: mask_sensitive(name, value) for name, value in environment.items()}
+    masked = []
+    for variable in environment or []:
+        name, sep, value = variable.partition('=')
+        masked.append(name + sep + (mask_sensitive(name, value) or ''))
+    return masked
+
+
+def bounded(data, max_size=MAX_LOG_SIZE):
+    """The last `max_size` bytes of `data`, starting at a line."""
+    if len(data) <= max_size:
+        return data
+    data = data[-max_size:]
+    return data[data.find(b'\n') + 1:]
+
+
+class Capture:
+    def __init__(self, fileobj):
+        self.tar = tarfile.open(fileobj=fileobj, mode='w:gz')
+        self.mtime = time.time()
+
+    def add(self, path, data):
+        if not isinstance(data, bytes):
+            data = data.encode('utf-8')
+        info = tarfile.TarInfo(path)
+        info.size = len(data)
+        info.mtime = self.mtime
+        self.tar.addfile(info, io.BytesIO(data))
+
+    def add_json(self, path, data):
+        self.add(path, json.dumps(data, indent=2, sort_keys=True, default=str))
+
+    def close(self):
+        self.tar.close()
+
+
+def capture_container(capture, container, tail):
+    path = '{}/{}'.format(container.service, container.name)
+    data = container.inspect()
+    if data.get('Config'):
+        data['Config']['Env'] = mask_environment(data['Config'].get('Env'))
+    capture.add_json(path + '/inspect.json', data)
+    for stream in ('stdout', 'stderr'):
+        logs = container.logs(
+            stdout=stream == 'stdout', stderr=stream == 'stderr', timestamps=True, tail=tail,
+        )
+        capture.add('{}/{}.log'.format(path, stream), bounded(logs))
+    health = container.get('State.Health')
+    if health:
+        capture.add_json(path + '/health.json', health.get('Log') or [])
+
+
+def write_capture(project, fileobj, service_names=None, tail=DEFAULT_TAIL):
+    """Write a capture of the services of `project` to `fileobj`. Returns the
+    containers captured; those removed meanwhile are left out.
+    """
+    capture = Capture(fileobj)
+    captured = []
+    try:
+        capture.add_json('info.json', project.client.info())
+        capture.add_json('version.json', {
+            'compose': __version__,
+            'docker': project.client.version(),
+        })
+        for service in project.get_services(service_names):
+            config = denormalize_service_dict(
+                service.resolved_config(), project.config_version or COMPOSE_SPEC,
+            )
+            if 'environment' in config:
+                config['environment'] = mask_environment(config['environment'])
+            capture.add('{}/config.yml'.format(service.name), dump_yaml(config))
+
+        for container in project.containers(service_names, stopped=True):
+            try:
+                capture_container(capture, container, tail)
+            except NotFound:
+                log.debug('Container %s was removed, not capturing it', container.name)
+                continue
+            captured.append(container)
+    finally:
+        capture.close()
+    return captured
@@ -1,15 +1,38 @@
+import atexit
+import ipaddress
+import json
 import logging
 import os
 import re
 
+import yaml
+
 from . import errors
 from .. import config
 from .. import parallel
+from ..config.config import ConfigDetails
+from ..config.config import ConfigFile
 from ..config.environment import Environment
+from ..config.errors import ComposeFileNotFound
+from ..config.errors import ConfigurationError
+from ..config.serialize import serialize_config
+from ..config.types import parse_platform
+from ..const import DEFAULT_SEPARATOR
 from ..const import LABEL_CONFIG_FILES
 from ..const import LABEL_ENVIRONMENT_FILE
+from ..const import LABEL_PROJECT
+from ..const import LABEL_TENANT
 from ..const import LABEL_WORKING_DIR
+from ..const import NAME_SEPARATORS
+from ..credentials import load_auth_configs
+from ..ephemeral import ephemeral_name
+from ..ephemeral import ephemeral_project
+from ..ephemeral import generate_suffix
+from ..progress_server import ProgressServer
 from ..project import Project
+from ..stored_config import load_stored_config
+from ..stored_config import store_config
+from ..warning import Warnings
 from .docker_client import get_client
 from .docker_client import load_context
 from .docker_client import make_context
@@ -32,8 +55,53 @@ SILENT_COMMANDS = {
     'unpause',
 }
 
+# Commands that change resources, whose progress is served on
+# COMPOSE_PROGRESS_SOCKET
+PROGRESS_COMMANDS = {
+    'apply',
+    'build',
+    'create',
+    'down',
+    'kill',
+    'migrate',
+    'pause',
+    'pull',
+    'push',
+    'reload',
+    'restart',
+    'rm',
+    'run',
+    'scale',
+    'start',
+    'stop',
+    'sweep',
+    'unpause',
+    'up',
+}
+
+# Commands that store the configuration of a project started from stdin
+STORE_CONFIG_COMMANDS = {
+    'create',
+    'up',
+}
+
+# Commands that can start an ephemeral instance with a generated suffix
+AUTO_SUFFIX_COMMANDS = {
+    'create',
+    'up',
+}
+
+# Commands that can rebuild a project from the configuration stored when it
+# was started from stdin
+STORED_CONFIG_COMMANDS = {
+    'down',
+    'logs',
+    'restart',
+}
+
 
-def project_from_options(project_dir, options, additional_options=None):
+def project_from_options(project_dir, options, additional_options=None,
+                         negotiate_api_version=True):
     additional_options = additional_options or {}
     override_dir = get_project_dir(options)
     environment_file = options.get('--env-file')
@@ -67,7 +135,12 @@ def project_from_options(project_dir, options, additional_options=None):
         override_dir=override_dir,
         interpolate=(not additional_options.get('--no-interpolate')),
         environment_file=environment_file,
-        enabled_profiles=get_profiles_from_options(options, environment)
+        enabled_profiles=get_profiles_from_options(options, environment),
+        use_stored_config=options.get('COMMAND') in STORED_CONFIG_COMMANDS,
+        store_stdin_config=options.get('COMMAND') in STORE_CONFIG_COMMANDS,
+        serve_progress=options.get('COMMAND') in PROGRESS_COMMANDS,
+        allow_auto_suffix=options.get('COMMAND') in AUTO_SUFFIX_COMMANDS,
+        negotiate_api_version=negotiate_api_version,
     )
 
 
@@ -97,15 +170,27 @@ def get_project_dir(options):
     return options.get('--project-directory') or override_dir
 
 
-def get_config_from_options(base_dir, options, additional_options=None):
-    additional_options = additional_options or {}
+def get_config_details_from_options(base_dir, options):
     override_dir = get_project_dir(options)
     environment_file = options.get('--env-file')
     environment = Environment.from_env_file(override_dir or base_dir, environment_file)
     config_path = get_config_path_from_options(options, environment)
+    return config.find(base_dir, config_path, environment, override_dir)
+
+
+def get_config_from_options(base_dir, options, additional_options=None, report=None):
+    additional_options = additional_options or {}
     return config.load(
-        config.find(base_dir, config_path, environment, override_dir),
-        not additional_options.get('--no-interpolate')
+        get_config_details_from_options(base_dir, options),
+        not additional_options.get('--no-interpolate'),
+        report,
+    )
+
+
+def get_environment_file_path(base_dir, options):
+    """The path of the environment file of the project, if there is one."""
+    return used_environment_file(
+        get_project_dir(options) or base_dir, options.get('--env-file') or None,
     )
 
 
@@ -136,32 +221,241 @@ def get_profiles_from_options(options, environment):
     return []
 
 
+def get_warnings(environment):
+    try:
+        return Warnings.from_environment(environment)
+    except ValueError as e:
+        raise UserError('COMPOSE_IGNORE_WARNINGS: {}'.format(e))
+
+
+def get_auth_configs(environment, auths=None):
+    auth_file = environment.get('COMPOSE_AUTH_FILE')
+    if not auth_file and auths is None:
+        return None
+    try:
+        return load_auth_configs(auth_file, auths)
+    except (OSError, ValueError) as e:
+        raise UserError(
+            'Cannot read the registry credentials in COMPOSE_AUTH_FILE "{}": {}'.format(
+                auth_file, e
+            )
+        )
+
+
+def start_progress_server(environment):
+    path = environment.get('COMPOSE_PROGRESS_SOCKET')
+    if not path:
+        return None
+
+    server = ProgressServer(path)
+    try:
+        server.start()
+    except OSError as e:
+        raise UserError(
+            'Cannot serve progress on COMPOSE_PROGRESS_SOCKET "{}": {}'.format(path, e)
+        )
+    atexit.register(server.close)
+    return server.notify
+
+
+def get_network_driver_opts(environment):
+    value = environment.get('COMPOSE_NETWORK_DRIVER_OPTS')
+    if not value:
+        return None
+
+    driver_opts = {}
+    for option in value.split(','):
+        key, sep, option_value = option.partition('=')
+        if not sep or not key.strip():
+            raise UserError(
+                'COMPOSE_NETWORK_DRIVER_OPTS must be a comma-separated list of key=value '
+                'pairs (found: "{}")'.format(option)
+            )
+        driver_opts[key.strip()] = option_value.strip()
+    return driver_opts
+
+
+def get_default_bind_ip(environment):
+    value = environment.get('COMPOSE_DEFAULT_BIND_IP')
+    if not value:
+        return None
+    try:
+        # IPv6 addresses may be written in brackets, as in a port mapping
+        return str(ipaddress.ip_address(value.strip().strip('[]')))
+    except ValueError:
+        raise UserError(
+            'COMPOSE_DEFAULT_BIND_IP must be an IP address (found: "{}")'.format(value)
+        )
+
+
+def get_name_separator(environment):
+    value = environment.get('COMPOSE_NAME_SEPARATOR') or DEFAULT_SEPARATOR
+    if value not in NAME_SEPARATORS:
+        raise UserError(
+            'COMPOSE_NAME_SEPARATOR must be one of {} (found: "{}")'.format(
+                ', '.join('"{}"'.format(separator) for separator in NAME_SEPARATORS), value
+            )
+        )
+    return value
+
+
+def get_ephemeral_suffix(environment, allow_auto=False):
+    value = environment.get('COMPOSE_EPHEMERAL_SUFFIX')
+    if not value:
+        return None
+    if value == 'auto':
+        # Any other command would act on an instance of its own, never the
+        # one that was started
+        if not allow_auto:
+            raise UserError(
+                'COMPOSE_EPHEMERAL_SUFFIX=auto is only supported by `up` and `create`. '
+                'Set it to the suffix of the instance to manage instead.'
+            )
+        return generate_suffix()
+    try:
+        ephemeral_name('', value)
+    except ConfigurationError as e:
+        raise UserError('COMPOSE_EPHEMERAL_SUFFIX: {}'.format(e.msg))
+    return value
+
+
 def get_project(project_dir, config_path=None, project_name=None, verbose=False,
                 context=None, environment=None, override_dir=None,
-                interpolate=True, environment_file=None, enabled_profiles=None):
+                interpolate=True, environment_file=None, enabled_profiles=None,
+                client=None, use_stored_config=False, auths=None, serve_progress=True,
+                store_stdin_config=False, allow_auto_suffix=False,
+                negotiate_api_version=True):
+    """Load the project in `project_dir`. Programs embedding Compose can pass
+    their own `client`, any object with the `docker.APIClient` interface
+    (custom API version or TLS settings, a test double, ...), instead of the
+    one configured from the environment. Without `negotiate_api_version`,
+    that client doesn't ask the daemon for its API version, so that a project
+    which is only read is loaded without the daemon.
+
+    With `use_stored_config`, a project that was started from a Compose file
+    read from stdin is rebuilt from its stored configuration when no Compose
+    file is found, any other project from the Compose files recorded on its
+    containers if they still exist, and from the labels of its containers
+    otherwise. That configuration is stored with `store_stdin_config`.
+
+    Projects of different tenants sharing a daemon are kept apart by setting
+    COMPOSE_TENANT. Default network driver options are read from
+    COMPOSE_NETWORK_DRIVER_OPTS, as comma-separated `key=value` pairs.
+    Published ports without a host IP are bound to COMPOSE_DEFAULT_BIND_IP,
+    such as 127.0.0.1, when it is set, instead of every interface.
+    COMPOSE_NAME_SEPARATOR, `_` by default, joins the parts of the names
+    Compose generates; `-` makes them valid DNS names.
+    When COMPOSE_EPHEMERAL_SUFFIX is set, the project is the ephemeral
+    instance with that suffix (see compose.ephemeral). With
+    `allow_auto_suffix`, `auto` generates one, which is the project's
+    `ephemeral_suffix`.
+    When COMPOSE_PROGRESS_SOCKET is set, the progress of the operations is
+    served as JSON on a unix socket at that path, unless `serve_progress`
+    is False.
+
+    Classes of warnings are silenced with COMPOSE_IGNORE_WARNINGS (see
+    compose.warning).
+
+    Registry credentials are read from the Docker CLI configuration file at
+    COMPOSE_AUTH_FILE when it is set, instead of the default one. `auths`,
+    credentials by registry, take precedence over those of either file (see
+    credentials.load_auth_configs).
+    """
     if not environment:
-        environment = Environment.from_env_file(project_dir)
-    config_details = config.find(project_dir, config_path, environment, override_dir)
+        environment = Environment.from_env_file(project_dir, environment_file)
+    tenant = environment.get('COMPOSE_TENANT') or None
+    network_driver_opts = get_network_driver_opts(environment)
+    default_bind_ip = get_default_bind_ip(environment)
+    separator = get_name_separator(environment)
+    ephemeral_suffix = get_ephemeral_suffix(environment, allow_auto_suffix)
+    warnings = get_warnings(environment)
+    auth_configs = get_auth_configs(environment, auths)
+    if client is not None and auth_configs is not None:
+        client._auth_configs = auth_configs
+
+    def make_client():
+        api_version = environment.get('COMPOSE_API_VERSION')
+        return get_client(
+            verbose=verbose, version=api_version, context=context, environment=environment,
+            auth_configs=auth_configs, negotiate=negotiate_api_version,
+        )
+
+    try:
+        config_details = config.find(project_dir, config_path, environment, override_dir)
+    except ComposeFileNotFound:
+        if not use_stored_config:
+            raise
+        if client is None:
+            client = make_client()
+        project_name = get_project_name(project_dir, project_name, environment)
+        config_details = get_stored_config_details(
+            client, project_dir, project_name, environment, tenant,
+        ) or get_labelled_config_details(
+            client, project_name, environment, tenant, environment_file,
+        )
+        if config_details is None:
+            with errors.handle_connection_errors(client):
+                project = Project.from_containers(project_name, client, tenant)
+            # An interrupted `down` may have removed every container but left
+            # networks and volumes
+            if not (project.services or project.networks.networks or project.volumes.volumes):
+                raise
+            log.warning(
+                'No Compose file found. Using the state of the existing containers, '
+                'networks and volumes of project "%s".', project_name
+            )
+            return project
+    config_data = config.load(config_details, interpolate)
     project_name = get_project_name(
-        config_details.working_dir, project_name, environment
+        config_details.working_dir, project_name, environment, config_data.name
     )
-    config_data = config.load(config_details, interpolate)
-
-    api_version = environment.get('COMPOSE_API_VERSION')
+    default_platform = environment.get('DOCKER_DEFAULT_PLATFORM')
+    if default_platform:
+        parse_platform(default_platform)
+
+    if client is None:
+        client = make_client()
+
+    extra_labels = execution_context_labels(config_details, environment_file)
+    if store_stdin_config and use_config_from_stdin(config_details):
+        extra_labels += store_config(
+            ephemeral_name(project_name, ephemeral_suffix) if ephemeral_suffix else project_name,
+            client.base_url,
+            serialize_config(config_data),
+        )
 
-    client = get_client(
-        verbose=verbose, version=api_version, context=context, environment=environment
+    options = dict(
+        default_platform=default_platform,
+        extra_labels=extra_labels,
+        enabled_profiles=enabled_profiles,
+        tenant=tenant,
+        network_driver_opts=network_driver_opts,
+        notify=start_progress_server(environment) if serve_progress else None,
+        warnings=warnings,
+        default_bind_ip=default_bind_ip,
+        separator=separator,
     )
+    with errors.handle_connection_errors(client):
+        if ephemeral_suffix:
+            project = ephemeral_project(
+                project_name, config_data, client, ephemeral_suffix, **options
+            )
+            log.info('Using ephemeral project "%s"', project.name)
+            return project
+        return Project.from_config(project_name, config_data, client, **options)
+
 
+def get_stored_config_details(client, project_dir, project_name, environment, tenant=None):
     with errors.handle_connection_errors(client):
-        return Project.from_config(
-            project_name,
-            config_data,
-            client,
-            environment.get('DOCKER_DEFAULT_PLATFORM'),
-            execution_context_labels(config_details, environment_file),
-            enabled_profiles,
-        )
+        config_yaml = load_stored_config(client, project_name, tenant=tenant)
+    if config_yaml is None:
+        return None
+    log.debug('Using the configuration stored for project "%s"', project_name)
+    return ConfigDetails(
+        os.path.abspath(project_dir),
+        [ConfigFile(None, yaml.safe_load(config_yaml))],
+        environment,
+    )
 
 
 def execution_context_labels(config_details, environment_file):
@@ -172,14 +466,23 @@ def execution_context_labels(config_details, environment_file):
     if not use_config_from_stdin(config_details):
         extra_labels.append('{}={}'.format(LABEL_CONFIG_FILES, config_files_label(config_details)))
 
+    environment_file = used_environment_file(config_details.working_dir, environment_file)
     if environment_file is not None:
-        extra_labels.append('{}={}'.format(
-            LABEL_ENVIRONMENT_FILE,
-            os.path.normpath(environment_file))
-            )
+        extra_labels.append('{}={}'.format(LABEL_ENVIRONMENT_FILE, environment_file))
     return extra_labels
 
 
+def used_environment_file(working_dir, environment_file=None):
+    """The absolute path of the environment file that interpolation uses:
+    `environment_file`, relative to the current directory, or the .env file
+    of the working directory if there is one.
+    """
+    if environment_file is not None:
+        return os.path.abspath(environment_file)
+    path = os.path.abspath(os.path.join(working_dir, '.env'))
+    return path if os.path.isfile(path) else None
+
+
 def use_config_from_stdin(config_details):
     for c in config_details.config_files:
         if not c.filename:
@@ -188,18 +491,85 @@ def use_config_from_stdin(config_details):
 
 
 def config_files_label(config_details):
-    return ",".join(
-        os.path.normpath(c.filename) for c in config_details.config_files
+    """The absolute paths of the project's Compose files, joined with commas,
+    or as a JSON array when one of them contains a comma.
+    """
+    filenames = [os.path.abspath(c.filename) for c in config_details.config_files]
+    if any(',' in filename for filename in filenames):
+        return json.dumps(filenames, ensure_ascii=False)
+    return ",".join(filenames)
+
+
+def parse_config_files_label(value):
+    if value.startswith('['):
+        return json.loads(value)
+    return value.split(',')
+
+
+def get_labelled_config_details(client, project_name, environment, tenant=None,
+                                environment_file=None):
+    """The details of the Compose files recorded on the containers of the
+    project, or None when they are not recorded or no longer exist.
+
+    They are interpolated with the environment file recorded too, so that
+    the project is the one that was started wherever it is loaded from,
+    unless `environment_file` overrides it, in which case `environment` is
+    expected to come from it.
+    """
+    labels = ['{}={}'.format(LABEL_PROJECT, project_name)]
+    if tenant:
+        labels.append('{}={}'.format(LABEL_TENANT, tenant))
+    with errors.handle_connection_errors(client):
+        containers = client.containers(all=True, filters={'label': labels})
+    for container in containers:
+        container_labels = container.get('Labels') or {}
+        working_dir = container_labels.get(LABEL_WORKING_DIR)
+        config_files = container_labels.get(LABEL_CONFIG_FILES)
+        if not working_dir or not config_files:
+            continue
+        filenames = parse_config_files_label(config_files)
+        if all(os.path.isfile(os.path.join(working_dir, f)) for f in filenames):
+            log.debug('Using the Compose files of project "%s": %s', project_name, filenames)
+            if environment_file is None:
+                environment = get_labelled_environment(container_labels, project_name, environment)
+            return config.find(working_dir, filenames, environment, override_dir=working_dir)
+    return None
+
+
+def get_labelled_environment(labels, project_name, environment):
+    """The environment the project was started with, from the environment
+    file recorded in `labels`, or the .env file of its working directory
+    for containers that predate the label. Warns, and uses none, when the
+    recorded file no longer exists.
+    """
+    working_dir = labels[LABEL_WORKING_DIR]
+    environment_file = labels.get(LABEL_ENVIRONMENT_FILE)
+    if environment_file:
+        # Older versions recorded --env-file as given
+        environment_file = os.path.join(working_dir, environment_file)
+    if environment_file and not os.path.isfile(environment_file):
+        log.warning(
+            'The environment file "%s" that project "%s" was started with no longer '
+            'exists. Variables are interpolated without it, so the configuration may '
+            'differ. Use --env-file to choose another one.', environment_file, project_name,
         )
+        working_dir = None
+    labelled_environment = Environment.from_env_file(working_dir, environment_file)
+    labelled_environment.silent = environment.silent
+    return labelled_environment
 
 
-def get_project_name(working_dir, project_name=None, environment=None):
+def get_project_name(working_dir, project_name=None, environment=None, config_name=None):
+    """The name of the project, from the first of: the `-p` option
+    (`project_name`), COMPOSE_PROJECT_NAME, the top-level `name` of the
+    Compose file (`config_name`) and the name of the working directory.
+    """
     def normalize_name(name):
         return re.sub(r'[^-_a-z0-9]', '', name.lower())
 
     if not environment:
         environment = Environment.from_env_file(working_dir)
-    project_name = project_name or environment.get('COMPOSE_PROJECT_NAME')
+    project_name = project_name or environment.get('COMPOSE_PROJECT_NAME') or config_name
     if project_name:
         return normalize_name(project_name)
 
@@ -11,9 +11,11 @@ from docker.utils import kwargs_from_env
 from docker.utils.config import home_dir
 
 from . import verbose_proxy
+from ..api_features import negotiate_api_version
 from ..config.environment import Environment
 from ..const import HTTP_TIMEOUT
 from ..utils import unquote_path
+from .errors import handle_connection_errors
 from .errors import UserError
 from .utils import generate_user_agent
 from .utils import get_version_info
@@ -37,11 +39,22 @@ def load_context(name=None):
     return ContextAPI.get_context(name)
 
 
-def get_client(environment, verbose=False, version=None, context=None):
+def get_client(environment, verbose=False, version=None, context=None, auth_configs=None,
+               negotiate=True):
+    """A client for the daemon of `context`, using API `version`, or
+    the version negotiated with the daemon when none is given. Without
+    `negotiate`, it uses the latest version docker-py supports instead, and
+    the daemon isn't contacted.
+    """
     client = docker_client(
         version=version, context=context,
         environment=environment, tls_version=get_tls_version(environment)
     )
+    if not version and negotiate:
+        with handle_connection_errors(client):
+            negotiate_api_version(client)
+    if auth_configs is not None:
+        client._auth_configs = auth_configs
     if verbose:
         version_info = client.version().items()
         log.info(get_version_info('full'))
@@ -0,0 +1,123 @@
+"""
+Writing the logs of each service to a file of its own, such as for bug
+reports. Lines are written as the containers wrote them, without prefix nor
+colors. A file that reaches `max_file_size` bytes is rotated: `web.log` is
+renamed to `web.log.1`, `web.log.1` to `web.log.2` and so on, keeping
+BACKUP_COUNT of them.
+"""
+import os
+import re
+import threading
+
+from .log_printer import STDOUT
+
+BACKUP_COUNT = 5
+
+ANSI_ESCAPE = re.compile(r'\x1b\[[0-9;?]*[ -/]*[@-~]')
+UNSAFE_CHARACTERS = re.compile(r'[^A-Za-z0-9._-]')
+
+
+def log_file_name(name):
+    """A file name for the logs of `name`, a service or container name."""
+    name = UNSAFE_CHARACTERS.sub('_', name).lstrip('.')
+    return (name or '_') + '.log'
+
+
+class LogFile:
+    def __init__(self, path, max_size=None):
+        self.path = path
+        self.max_size = max_size
+        self.file = open(path, 'ab')
+        self.size = self.file.tell()
+
+    def write(self, text):
+        data = text.encode('utf-8', 'replace')
+        if self.max_size and self.size and self.size + len(data) > self.max_size:
+            self.rotate()
+        self.file.write(data)
+        self.file.flush()
+        self.size += len(data)
+
+    def rotate(self):
+        self.close()
+        for index in range(BACKUP_COUNT - 1, 0, -1):
+            older = '{}.{}'.format(self.path, index)
+            if os.path.exists(older):
+                os.replace(older, '{}.{}'.format(self.path, index + 1))
+        os.replace(self.path, self.path + '.1')
+        self.file = open(self.path, 'ab')
+        self.size = 0
+
+    def close(self):
+        self.file.flush()
+        os.fsync(self.file.fileno())
+        self.file.close()
+
+
+class LogFiles:
+    """The log files of the containers of a project in `directory`, one per
+    service, or one per container with `per_replica`.
+    """
+
+    def __init__(self, directory, max_file_size=None, per_replica=False):
+        self.directory = directory
+        self.max_file_size = max_file_size
+        self.per_replica = per_replica
+        self._files = {}
+        self._lock = threading.Lock()
+
+    def _name(self, container):
+        name = container.service or container.name
+        if self.per_replica and container.service:
+            name = '{}-{}'.format(
+                name, container.number if container.number is not None else container.slug,
+            )
+        return name
+
+    def _open(self, name):
+        os.makedirs(self.directory, exist_ok=True)
+        file_name = log_file_name(name)
+        taken = {os.path.basename(f.path) for f in self._files.values()}
+        # Names that only differ by unsafe characters get a suffix
+        stem = file_name[:-len('.log')]
+        count = 1
+        while file_name in taken:
+            count += 1
+            file_name = '{}-{}.log'.format(stem, count)
+        return LogFile(os.path.join(self.directory, file_name), self.max_file_size)
+
+    def write(self, container, line):
+        name = self._name(container)
+        with self._lock:
+            if name not in self._files:
+                self._files[name] = self._open(name)
+            self._files[name].write(ANSI_ESCAPE.sub('', line))
+
+    def close(self):
+        """Close the files, and return their paths, sorted."""
+        with self._lock:
+            files, self._files = self._files, {}
+        for log_file in files.values():
+            log_file.close()
+        return sorted(log_file.path for log_file in files.values())
+
+
+class FileLogPresenter:
+    """Wraps a LogPresenter to also write each line to LogFiles. Lines are
+    only presented for the console when `console`.
+    """
+
+    def __init__(self, presenter, files, console=True):
+        self.presenter = presenter
+        self.files = files
+        self.console = console
+
+    @property
+    def color_func(self):
+        return self.presenter.color_func
+
+    def present(self, container, line, stream=STDOUT):
+        self.files.write(container, line)
+        if not self.console:
+            return None
+        return self.presenter.present(container, line, stream)
@@ -1,5 +1,7 @@
 import _thread as thread
 import sys
+import threading
+import time
 from collections import namedtuple
 from itertools import cycle
 from operator import attrgetter
@@ -11,18 +13,27 @@ from docker.errors import APIError
 
 from . import colors
 from compose.cli.signals import ShutdownException
+from compose.utils import line_splitter
 from compose.utils import split_buffer
 
 
+STDOUT = 'stdout'
+STDERR = 'stderr'
+
+
 class LogPresenter:
 
-    def __init__(self, prefix_width, color_func, keep_prefix=True):
+    def __init__(self, prefix_width, color_func, keep_prefix=True, stderr_func=None):
         self.prefix_width = prefix_width
         self.color_func = color_func
         self.keep_prefix = keep_prefix
+        self.stderr_func = stderr_func
 
-    def present(self, container, line):
+    def present(self, container, line, stream=STDOUT):
         to_log = '{line}'.format(line=line)
+        if stream == STDERR and self.stderr_func:
+            text = to_log.rstrip('\n')
+            to_log = self.stderr_func(text) + to_log[len(text):]
 
         if self.keep_prefix:
             prefix = container.name_without_project.ljust(self.prefix_width)
@@ -41,8 +52,10 @@ def build_log_presenters(service_names, monochrome, keep_prefix=True):
     def no_color(text):
         return text
 
+    # Lines written to stderr are shown in red, unless colors are disabled
+    stderr_func = None if monochrome else colors.red
     for color_func in cycle([no_color] if monochrome else colors.rainbow()):
-        yield LogPresenter(prefix_width, color_func, keep_prefix)
+        yield LogPresenter(prefix_width, color_func, keep_prefix, stderr_func)
 
 
 def max_name_width(service_names, max_index_width=3):
@@ -64,13 +77,15 @@ class LogPrinter:
                  event_stream,
                  output=sys.stdout,
                  cascade_stop=False,
-                 log_args=None):
+                 log_args=None,
+                 restarter=None):
         self.containers = containers
         self.presenters = presenters
         self.event_stream = event_stream
         self.output = output
         self.cascade_stop = cascade_stop
         self.log_args = log_args or {}
+        self.restarter = restarter
 
     def run(self):
         if not self.containers:
@@ -83,10 +98,13 @@ class LogPrinter:
             thread_map,
             self.event_stream,
             self.presenters,
-            thread_args))
+            thread_args,
+            self.restarter))
 
         for line in consume_queue(queue, self.cascade_stop):
-            remove_stopped_threads(thread_map)
+            for container_id in remove_stopped_threads(thread_map):
+                if self.restarter is not None:
+                    self.restarter.logs_ended(container_id)
 
             if self.cascade_stop:
                 matching_container = [cont.name for cont in self.containers if cont.name == line]
@@ -96,7 +114,7 @@ class LogPrinter:
                     return line
 
             if not line:
-                if not thread_map:
+                if not thread_map and (self.restarter is None or self.restarter.settled()):
                     # There are no running containers left to tail, so exit
                     return
                 # We got an empty line because of a timeout, but there are still
@@ -118,9 +136,111 @@ class LogPrinter:
 
 
 def remove_stopped_threads(thread_map):
+    """Remove the threads that stopped, and return their container IDs."""
+    stopped = []
     for container_id, tailer_thread in list(thread_map.items()):
         if not tailer_thread.is_alive():
             thread_map.pop(container_id, None)
+            stopped.append(container_id)
+    return stopped
+
+
+class CrashRestarter:
+    """Restarts the attached containers that crash, on their `die` event,
+    at most `max_retries` times each within `window` seconds. Containers
+    that exit with code 0, that are stopped or killed, or that have a
+    restart policy of their own are left alone.
+    """
+
+    # How long to wait, once the logs of a container ended, for its `die`
+    # event before giving up on restarting it
+    grace = 5
+
+    def __init__(self, max_retries, window, clock=time.monotonic):
+        self.max_retries = max_retries
+        self.window = window
+        self.clock = clock
+        self._restarts = {}
+        self._killed = set()
+        # Containers restarted, until they start and their logs are tailed again
+        self._restarting = set()
+        # Counts of the containers' deaths handled, and of their logs ending
+        self._handled = {}
+        self._ended = {}
+        self._lock = threading.Lock()
+
+    def killed(self, container_id):
+        with self._lock:
+            self._killed.add(container_id)
+
+    def logs_ended(self, container_id):
+        with self._lock:
+            count, _ = self._ended.get(container_id, (0, None))
+            self._ended[container_id] = (count + 1, self.clock())
+
+    def handled(self, container_id):
+        with self._lock:
+            self._restarting.discard(container_id)
+            self._handled[container_id] = self._handled.get(container_id, 0) + 1
+
+    def restarting(self, container_id):
+        with self._lock:
+            return container_id in self._restarting
+
+    def settled(self):
+        """Whether no container is being restarted, nor waiting for its
+        crash to be handled.
+        """
+        now = self.clock()
+        with self._lock:
+            if self._restarting:
+                return False
+            return all(
+                self._handled.get(container_id, 0) >= count or now - since > self.grace
+                for container_id, (count, since) in self._ended.items()
+            )
+
+    def should_restart(self, container, exit_code):
+        policy = container.get('HostConfig.RestartPolicy.Name') or 'no'
+        with self._lock:
+            killed = container.id in self._killed
+            self._killed.discard(container.id)
+        return exit_code != 0 and policy == 'no' and not killed
+
+    def attempt(self, container_id):
+        """Count a restart of the container, and return its number, or None
+        if the container was restarted too often already.
+        """
+        now = self.clock()
+        with self._lock:
+            recent = [t for t in self._restarts.get(container_id, []) if now - t < self.window]
+            if len(recent) >= self.max_retries:
+                self._restarts[container_id] = recent
+                return None
+            recent.append(now)
+            self._restarts[container_id] = recent
+            self._restarting.add(container_id)
+            return len(recent)
+
+    def restart(self, container, exit_code):
+        """Restart the container that died with `exit_code` if it crashed
+        and its budget allows it. Returns the line to show in the logs, if
+        any.
+        """
+        if not self.should_restart(container, exit_code):
+            self.handled(container.id)
+            return None
+        attempt = self.attempt(container.id)
+        if attempt is None:
+            self.handled(container.id)
+            return '{} exited with code {}, not restarting it: it was restarted {} times ' \
+                'within {:g}s\n'.format(container.name, exit_code, self.max_retries, self.window)
+        try:
+            container.start()
+        except APIError as e:
+            self.handled(container.id)
+            return 'Failed to restart {}: {}\n'.format(container.name, e.explanation or e)
+        return '{} restarted (attempt {}/{})\n'.format(container.name, attempt, self.max_retries)
 
 
 def build_thread(container, presenter, queue, log_args):
@@ -159,8 +279,8 @@ class QueueItem(namedtuple('_QueueItem', 'item is_stop exc')):
 
 def tail_container_logs(container, presenter, queue, log_args):
     try:
-        for item in build_log_generator(container, log_args):
-            queue.put(QueueItem.new(presenter.present(container, item)))
+        for stream, item in build_log_generator(container, log_args):
+            queue.put(QueueItem.new(presenter.present(container, item, stream)))
     except Exception as e:
         queue.put(QueueItem.exception(e))
         return
@@ -170,14 +290,95 @@ def tail_container_logs(container, presenter, queue, log_args):
 
 
 def build_log_generator(container, log_args):
+    """Yield a (stream, line) tuple for each line of the container's logs,
+    where stream is the name of the stream the line was written to.
+
+    `log_args` are passed on to the logs API call; its `stdout` and `stderr`
+    arguments select the streams to show.
+    """
     # if the container doesn't have a log_stream we need to attach to container
     # before log printer starts running
-    if container.log_stream is None:
-        stream = container.logs(stdout=True, stderr=True, stream=True, **log_args)
-    else:
-        stream = container.log_stream
+    if container.log_stream is not None:
+        return split_demuxed_buffer(container.log_stream)
+
+    log_args = dict({STDOUT: True, STDERR: True}, **log_args)
+    streams = [name for name in (STDOUT, STDERR) if log_args.pop(name)]
+    # Both streams are replayed in order through a single attachment, unless
+    # the logs are timestamped, or tailed while followed, which only the logs
+    # API does
+    follow, tail = log_args.get('follow'), log_args.get('tail')
+    tailed = isinstance(tail, int) and tail >= 0
+    if len(streams) == 2 and not log_args.get('timestamps') and not (follow and tailed):
+        return split_demuxed_buffer(container.demuxed_logs(follow=bool(follow), tail=tail))
+    return merge_generators([
+        stream_lines(
+            name,
+            container.logs(stdout=name == STDOUT, stderr=name == STDERR, stream=True, **log_args),
+        )
+        for name in streams
+    ])
+
+
+def stream_lines(name, stream):
+    for line in split_buffer(stream):
+        yield name, line
+
+
+def split_demuxed_buffer(stream):
+    """Split a stream attached with `demux=True`, which yields (stdout, stderr)
+    tuples, into (stream, line) tuples. Chunks of an attachment without
+    `demux` are read as stdout.
+    """
+    buffers = {STDOUT: '', STDERR: ''}
+    for chunk in stream:
+        if not isinstance(chunk, tuple):
+            chunk = (chunk, None)
+        for name, data in zip((STDOUT, STDERR), chunk):
+            if not data:
+                continue
+            if not isinstance(data, str):
+                data = data.decode('utf-8', 'replace')
+            buffers[name] += data
+            while True:
+                buffer_split = line_splitter(buffers[name])
+                if buffer_split is None:
+                    break
+                line, buffers[name] = buffer_split
+                yield name, line
+
+    for name, rest in buffers.items():
+        if rest:
+            yield name, rest
+
+
+def merge_generators(generators):
+    """Yield the items of all `generators` as they are produced."""
+    if len(generators) == 1:
+        yield from generators[0]
+        return
 
-    return split_buffer(stream)
+    queue = Queue()
+
+    def pump(generator):
+        try:
+            for item in generator:
+                queue.put(QueueItem.new(item))
+        except Exception as e:
+            queue.put(QueueItem.exception(e))
+        queue.put(QueueItem.stop())
+
+    for generator in generators:
+        Thread(target=pump, args=(generator,), daemon=True).start()
+
+    running = len(generators)
+    while running:
+        item = queue.get()
+        if item.exc:
+            raise item.exc
+        if item.is_stop:
+            running -= 1
+            continue
+        yield item.item
 
 
 def wait_on_exit(container):
@@ -197,15 +398,20 @@ def start_producer_thread(thread_args):
     producer.start()
 
 
-def watch_events(thread_map, event_stream, presenters, thread_args):
+def watch_events(thread_map, event_stream, presenters, thread_args, restarter=None):
     crashed_containers = set()
     for event in event_stream:
         if event['action'] == 'stop':
             thread_map.pop(event['id'], None)
 
+        if event['action'] == 'kill' and restarter is not None:
+            restarter.killed(event['id'])
+
         if event['action'] == 'die':
-            thread_map.pop(event['id'], None)
             crashed_containers.add(event['id'])
+            if restarter is not None:
+                restart_crashed(restarter, event, thread_args[0])
+            thread_map.pop(event['id'], None)
 
         if event['action'] != 'start':
             continue
@@ -232,6 +438,23 @@ def watch_events(thread_map, event_stream, presenters, thread_args):
             next(presenters),
             *thread_args
         )
+        if restarter is not None and restarter.restarting(event['id']):
+            restarter.handled(event['id'])
+
+
+def restart_crashed(restarter, event, queue):
+    container = event.get('container')
+    if container is None:
+        # The container is gone
+        restarter.handled(event['id'])
+        return
+    try:
+        exit_code = int((event.get('attributes') or {}).get('exitCode'))
+    except (TypeError, ValueError):
+        exit_code = container.exit_code
+    line = restarter.restart(container, exit_code)
+    if line:
+        queue.put(QueueItem.new(line))
 
 
 def consume_queue(queue, cascade_stop):
@@ -4,6 +4,7 @@ import json
 import logging
 import pipes
 import re
+import stat
 import subprocess
 import sys
 from distutils.spawn import find_executable
@@ -16,33 +17,59 @@ import docker.utils
 from . import errors
 from . import signals
 from .. import __version__
+from ..capture import write_capture
 from ..config import ConfigurationError
 from ..config import parse_environment
 from ..config import parse_labels
 from ..config import resolve_build_args
+from ..config.environment import env_vars_from_file
 from ..config.environment import Environment
+from ..config.interpolation import InterpolationReport
 from ..config.serialize import serialize_config
+from ..config.serialize import serialize_resolved_project
+from ..config.types import parse_mount_option
+from ..config.types import parse_platform
+from ..config.types import ServicePort
 from ..config.types import VolumeSpec
+from ..const import DEFAULT_RELOAD_SIGNAL
 from ..const import IS_LINUX_PLATFORM
 from ..const import IS_WINDOWS_PLATFORM
+from ..ephemeral import sweep_ephemeral_projects
 from ..errors import StreamParseError
+from ..lock import DEFAULT_LOCK_TIMEOUT
+from ..lock import ProjectLock
 from ..metrics.decorator import metrics
+from ..migrate import migrate_project
 from ..parallel import ParallelStreamWriter
+from ..plan import Plan
 from ..progress_stream import StreamOutputError
 from ..project import get_image_digests
 from ..project import MissingDigests
 from ..project import NoSuchService
 from ..project import OneOffFilter
 from ..project import ProjectError
+from ..publish import load_publishable_config
+from ..publish import publish
+from ..service import allocate_port_ranges
+from ..service import bind_target_kind
 from ..service import BuildAction
 from ..service import BuildError
 from ..service import ConvergenceStrategy
 from ..service import ImageType
 from ..service import NeedsBuildError
 from ..service import OperationFailedError
+from ..stored_config import remove_stored_config
 from ..utils import filter_attached_for_up
+from ..utils import is_local_daemon
+from ..utils import parse_bytes
+from ..wait import parse_target
+from ..warning import BIND_MOUNT_ACCESS
+from ..warning import BIND_MOUNT_TYPE
+from ..warning import Warnings
 from .colors import AnsiMode
+from .command import get_config_details_from_options
 from .command import get_config_from_options
+from .command import get_environment_file_path
 from .command import get_project_dir
 from .command import project_from_options
 from .docopt_command import DocoptDispatcher
@@ -51,7 +78,10 @@ from .docopt_command import NoSuchCommand
 from .errors import UserError
 from .formatter import ConsoleWarningFormatter
 from .formatter import Formatter
+from .log_files import FileLogPresenter
+from .log_files import LogFiles
 from .log_printer import build_log_presenters
+from .log_printer import CrashRestarter
 from .log_printer import LogPrinter
 from .utils import get_version_info
 from .utils import human_readable_file_size
@@ -290,31 +320,40 @@ class TopLevelCommand:
       --env-file PATH             Specify an alternate environment file
 
     Commands:
+      apply              Carry out a plan made by `plan`
       build              Build or rebuild services
+      capture            Capture the state of services for a bug report
       config             Validate and view the Compose file
       create             Create services
       down               Stop and remove resources
+      env                Print the environment of a service's container
       events             Receive real time events from containers
       exec               Execute a command in a running container
       help               Get help on a command
       images             List images
       kill               Kill containers
       logs               View output from containers
+      migrate            Migrate the resources of a project to a new name
       pause              Pause services
+      plan               Show what `up` would do, for `apply`
       port               Print the public port for a port binding
       ps                 List containers
+      publish            Publish the project to a registry
       pull               Pull service images
       push               Push service images
+      reload             Signal services to reload their configuration
       restart            Restart services
       rm                 Remove stopped containers
       run                Run a one-off command
       scale              Set number of containers for a service
       start              Start services
       stop               Stop services
+      sweep              Remove old ephemeral instances of the project
       top                Display the running processes
       unpause            Unpause services
       up                 Create and start containers
       version            Show version information and quit
+      wait-for           Wait until a port of a service is reachable
     """
 
     def __init__(self, project, options=None):
@@ -330,6 +369,41 @@ class TopLevelCommand:
         environment_file = self.toplevel_options.get('--env-file')
         return Environment.from_env_file(self.project_dir, environment_file)
 
+    def project_lock(self):
+        timeout = self.toplevel_environment.get('COMPOSE_LOCK_TIMEOUT')
+        try:
+            timeout = float(timeout) if timeout else DEFAULT_LOCK_TIMEOUT
+        except ValueError:
+            raise UserError('COMPOSE_LOCK_TIMEOUT must be a number of seconds, got "{}"'.format(
+                timeout))
+        return ProjectLock(self.project.name, self.project.client.base_url, timeout=timeout)
+
+    @metrics()
+    def apply(self, options):
+        """
+        Carry out a plan made by `plan`, in the background. Nothing is changed
+        if the project or its containers changed since the plan was made.
+
+        Usage: apply [options] [--] PLAN
+
+        Options:
+            -t, --timeout TIMEOUT   Use this timeout in seconds for container
+                                    shutdown when containers are recreated.
+                                    (default: 10)
+        """
+        path = options['PLAN']
+        try:
+            if path == '-':
+                text = sys.stdin.read()
+            else:
+                with open(path) as f:
+                    text = f.read()
+        except OSError as e:
+            raise UserError('Cannot read plan {}: {}'.format(path, e.strerror))
+        plan = Plan.from_json(text)
+        with self.project_lock():
+            self.project.apply(plan, timeout=timeout_from_opts(options))
+
     @metrics()
     def build(self, options):
         """
@@ -350,6 +424,8 @@ class TopLevelCommand:
             --no-rm                 Do not remove intermediate containers after a successful build.
             --parallel              Build images in parallel.
             --progress string       Set type of progress output (auto, plain, tty).
+            --prune-dangling        Remove the images replaced by this build when no
+                                    container uses them.
             --pull                  Always attempt to pull a newer version of the image.
             -q, --quiet             Don't print anything to STDOUT
         """
@@ -378,8 +454,37 @@ class TopLevelCommand:
             silent=options.get('--quiet', False),
             cli=native_builder,
             progress=options.get('--progress'),
+            prune_dangling=options.get('--prune-dangling', False),
         )
 
+    @metrics()
+    def capture(self, options):
+        """
+        Capture the state of services, such as failing ones, into a gzipped
+        tarball to attach to a bug report: the resolved config of each
+        service, and the inspect output, the last logs and the health check
+        log of each of its containers, running or not, with the daemon info
+        and versions. Nothing is changed. The values of variables whose name
+        looks like that of a secret are masked.
+
+        Usage: capture [options] [--] [SERVICE...]
+
+        Options:
+            -o, --output PATH   Write the capture to PATH
+                                [default: compose-capture.tar.gz]
+            --tail N            Number of lines of logs to capture for each
+                                container [default: 500]
+        """
+        tail = options['--tail']
+        if not tail.isdigit():
+            raise UserError('--tail must be a number (found: "{}")'.format(tail))
+        with open(options['--output'], 'wb') as f:
+            containers = write_capture(
+                self.project, f, service_names=options['SERVICE'], tail=int(tail),
+            )
+        print('Captured {} container(s) to {}'.format(len(containers), options['--output']),
+              file=sys.stderr)
+
     @metrics()
     def config(self, options):
         """
@@ -389,7 +494,13 @@ class TopLevelCommand:
 
         Options:
             --resolve-image-digests  Pin image tags to digests.
+            --resolved               Print the project as `up` acts on it, with the
+                                     names, labels, networks and platforms it
+                                     resolves.
             --no-interpolate         Don't interpolate environment variables.
+            --interpolation          Print the environment variables referenced,
+                                     where, whether they are set, defaulted or
+                                     missing, and their value.
             -q, --quiet              Only validate the configuration, don't print
                                      anything.
             --profiles               Print the profile names, one per line.
@@ -401,6 +512,20 @@ class TopLevelCommand:
         """
 
         additional_options = {'--no-interpolate': options.get('--no-interpolate')}
+        if options['--interpolation']:
+            report = InterpolationReport()
+            try:
+                get_config_from_options('.', self.toplevel_options, report=report)
+            finally:
+                print(Formatter.table(
+                    ['Variable', 'Referenced in', 'State', 'Value'],
+                    [
+                        [r.name, r.path, r.state, r.error or r.masked_value]
+                        for r in report.references
+                    ],
+                ))
+            return
+
         compose_config = get_config_from_options('.', self.toplevel_options, additional_options)
         image_digests = None
 
@@ -412,6 +537,19 @@ class TopLevelCommand:
         if options['--quiet']:
             return
 
+        if options['--resolved']:
+            if image_digests is None:
+                # Resolving the project only needs the daemon to look up digests
+                self.project = project_from_options(
+                    '.', self.toplevel_options, additional_options, negotiate_api_version=False,
+                )
+            print(serialize_resolved_project(
+                self.project.resolved_config(image_digests=image_digests),
+                compose_config.version,
+                not options['--no-interpolate'],
+            ))
+            return
+
         if options['--profiles']:
             profiles = set()
             for service in compose_config.services:
@@ -463,6 +601,7 @@ class TopLevelCommand:
             'Use the up command with the --no-start flag instead.'
         )
 
+        print_generated_suffix(self.project, self.toplevel_environment)
         self.project.create(
             service_names=service_names,
             strategy=convergence_strategy_from_opts(options),
@@ -483,7 +622,10 @@ class TopLevelCommand:
 
         Networks and volumes defined as `external` are never removed.
 
-        Usage: down [options]
+        Given services, only their containers are removed, along with the
+        networks, volumes and images they use that other services don't.
+
+        Usage: down [options] [--] [SERVICE...]
 
         Options:
             --rmi type              Remove images. Type must be one of:
@@ -497,6 +639,8 @@ class TopLevelCommand:
                                     Compose file
             -t, --timeout TIMEOUT   Specify a shutdown timeout in seconds.
                                     (default: 10)
+            -f, --force             Don't warn about running services that
+                                    depend on the services removed.
         """
         ignore_orphans = self.toplevel_environment.get_boolean('COMPOSE_IGNORE_ORPHANS')
 
@@ -505,12 +649,44 @@ class TopLevelCommand:
 
         image_type = image_type_from_opt('--rmi', options['--rmi'])
         timeout = timeout_from_opts(options)
-        self.project.down(
-            image_type,
-            options['--volumes'],
-            options['--remove-orphans'],
-            timeout=timeout,
-            ignore_orphans=ignore_orphans)
+        # SIGTERM aborts like Ctrl-C, releasing the lock. Running `down` again
+        # finishes the job, even once every container is gone.
+        signals.set_signal_handler_to_shutdown()
+        with self.project_lock():
+            self.project.down(
+                image_type,
+                options['--volumes'],
+                options['--remove-orphans'],
+                timeout=timeout,
+                ignore_orphans=ignore_orphans,
+                service_names=options['SERVICE'],
+                force=options['--force'])
+            if not options['SERVICE']:
+                remove_stored_config(self.project.name, self.project.client.base_url)
+
+    @metrics()
+    def env(self, options):
+        """
+        Print the environment a container of a service runs with, after
+        env_file merging and interpolation. The values of variables whose
+        name looks like that of a secret are masked.
+
+        Usage: env [options] [--] SERVICE
+
+        Options:
+            --index=index     index of the container if there are multiple
+                              instances of a service [default: 1]
+            --show-secrets    Print the values of secrets too.
+        """
+        index = int(options.get('--index'))
+        try:
+            environment = self.project.container_environment(
+                options['SERVICE'], number=index, show_secrets=options['--show-secrets'],
+            )
+        except ValueError as e:
+            raise UserError(str(e))
+        for name, value in sorted(environment.items()):
+            print(name if value is None else '{}={}'.format(name, value))
 
     def events(self, options):
         """
@@ -519,7 +695,10 @@ class TopLevelCommand:
         Usage: events [options] [--] [SERVICE...]
 
         Options:
-            --json      Output events as a stream of json objects
+            --json          Output events as a stream of json objects
+            --synthesize    Also output service events: a service becoming
+                            unhealthy, recovering, or flapping (restarting
+                            repeatedly)
         """
 
         def format_event(event):
@@ -529,11 +708,12 @@ class TopLevelCommand:
                 **event)
 
         def json_format_event(event):
-            event['time'] = event['time'].isoformat()
+            # The event is still read by the synthesizer once formatted
+            event = dict(event, time=event['time'].isoformat())
             event.pop('container')
             return json.dumps(event)
 
-        for event in self.project.events():
+        for event in self.project.events(synthesize=options['--synthesize']):
             formatter = json_format_event if options['--json'] else format_event
             print(formatter(event))
             sys.stdout.flush()
@@ -543,6 +723,8 @@ class TopLevelCommand:
         """
         Execute a command in a running container
 
+        SERVICE may also be the ID, name or ID prefix of one of its containers.
+
         Usage: exec [options] [-e KEY=VAL...] [--] SERVICE COMMAND [ARGS...]
 
         Options:
@@ -559,7 +741,6 @@ class TopLevelCommand:
         """
         use_cli = not self.toplevel_environment.get_boolean('COMPOSE_INTERACTIVE_NO_CLI')
         index = int(options.get('--index'))
-        service = self.project.get_service(options['SERVICE'])
         detach = options.get('--detach')
 
         if options['--env'] and docker.utils.version_lt(self.project.client.api_version, '1.25'):
@@ -570,10 +751,13 @@ class TopLevelCommand:
             raise UserError("Setting workdir for exec is not supported in API < 1.35 (%s)"
                             % self.project.client.api_version)
 
-        try:
-            container = service.get_container(number=index)
-        except ValueError as e:
-            raise UserError(str(e))
+        if options['SERVICE'] in self.project.service_names:
+            try:
+                container = self.project.get_service(options['SERVICE']).get_container(number=index)
+            except ValueError as e:
+                raise UserError(str(e))
+        else:
+            container = self.project.find_container(options['SERVICE'])
         command = [options['COMMAND']] + options['ARGS']
         tty = not options["-T"]
 
@@ -658,6 +842,7 @@ class TopLevelCommand:
             'Repository',
             'Tag',
             'Image Id',
+            'Platform',
             'Size'
         ]
         rows = []
@@ -674,12 +859,16 @@ class TopLevelCommand:
             )
 
             image_id = image_config['Id'].split(':')[1][:12]
+            platform = '/'.join(filter(None, [
+                image_config.get('Os'), image_config.get('Architecture'), image_config.get('Variant')
+            ]))
             size = human_readable_file_size(image_config['Size'])
             rows.append([
                 container.name,
                 repo_tags[0],
                 repo_tags[1],
                 image_id,
+                platform,
                 size
             ])
         print(Formatter.table(headers, rows))
@@ -699,11 +888,33 @@ class TopLevelCommand:
 
         self.project.kill(service_names=options['SERVICE'], signal=signal)
 
+    @metrics()
+    def migrate(self, options):
+        """
+        Migrate the resources of the project OLD_PROJECT, which must be
+        stopped, to this project, such as after renaming its directory. Its
+        containers are removed, for `up` to create them again. Its networks
+        are created again, and its volumes copied, under the name of this
+        project. Run it again to resume a migration that was interrupted.
+
+        Usage: migrate [options] OLD_PROJECT
+
+        Options:
+            --image IMAGE   Image of the containers that copy the volumes
+                            [default: busybox:latest]
+        """
+        with self.project_lock():
+            migrate_project(self.project, options['OLD_PROJECT'], image=options['--image'])
+        print('Migrated project {} to {}'.format(options['OLD_PROJECT'], self.project.name),
+              file=sys.stderr)
+
     @metrics()
     def logs(self, options):
         """
         View output from containers.
 
+        SERVICE may also be the ID, name or ID prefix of one of its containers.
+
         Usage: logs [options] [--] [SERVICE...]
 
         Options:
@@ -712,9 +923,21 @@ class TopLevelCommand:
             -t, --timestamps        Show timestamps.
             --tail="all"            Number of lines to show from the end of the logs
                                     for each container.
+            --stream=STREAM         Only show the lines written to STREAM, stdout
+                                    or stderr.
             --no-log-prefix         Don't print prefix in logs.
+            --output-dir DIR        Also write the logs of each service to
+                                    DIR/<service>.log, without colors.
+            --per-replica           Write a file per container,
+                                    DIR/<service>-<number>.log, rather than per
+                                    service.
+            --max-file-size SIZE    Rotate the files once they reach SIZE,
+                                    such as 10m.
+            --no-console            Only write the logs to the files of
+                                    --output-dir.
         """
         containers = self.project.containers(service_names=options['SERVICE'], stopped=True)
+        log_files = log_files_from_opts(options)
 
         tail = options['--tail']
         if tail is not None:
@@ -722,19 +945,36 @@ class TopLevelCommand:
                 tail = int(tail)
             elif tail != 'all':
                 raise UserError("tail flag must be all or a number")
+        stream = options.get('--stream')
+        if stream not in (None, 'stdout', 'stderr'):
+            raise UserError("stream flag must be stdout or stderr")
         log_args = {
             'follow': options['--follow'],
             'tail': tail,
             'timestamps': options['--timestamps']
         }
+        if stream:
+            log_args.update(stdout=stream == 'stdout', stderr=stream == 'stderr')
         print("Attaching to", list_containers(containers))
-        log_printer_from_project(
+        service_names = sorted(
+            {c.service for c in containers} |
+            {name for name in options['SERVICE'] if name in self.project.service_names}
+        )
+        log_printer = log_printer_from_project(
             self.project,
             containers,
             options['--no-color'],
             log_args,
-            event_stream=self.project.events(service_names=options['SERVICE']),
-            keep_prefix=not options['--no-log-prefix']).run()
+            event_stream=self.project.events(service_names=service_names),
+            keep_prefix=not options['--no-log-prefix'],
+            log_files=log_files,
+            console=not options['--no-console'])
+        try:
+            log_printer.run()
+        finally:
+            if log_files is not None:
+                for path in log_files.close():
+                    print('Wrote', path, file=sys.stderr)
 
     @metrics()
     def pause(self, options):
@@ -746,6 +986,33 @@ class TopLevelCommand:
         containers = self.project.pause(service_names=options['SERVICE'])
         exit_if(not containers, 'No containers to pause', 1)
 
+    @metrics()
+    def plan(self, options):
+        """
+        Print, as JSON, what `up` would do, without changing anything. The
+        plan can be reviewed, then carried out with `apply`.
+
+        Usage: plan [options] [--] [SERVICE...]
+
+        Options:
+            --no-deps           Don't plan for linked services.
+            --force-recreate    Plan to recreate containers even if their
+                                configuration and image haven't changed.
+            --no-recreate       Don't plan to recreate existing containers.
+            -o, --output PATH   Write the plan to PATH rather than to
+                                standard output.
+        """
+        plan = self.project.plan(
+            service_names=options['SERVICE'],
+            start_deps=not options['--no-deps'],
+            strategy=convergence_strategy_from_opts(options),
+        )
+        if options['--output']:
+            with open(options['--output'], 'w') as f:
+                f.write(plan.to_json() + '\n')
+        else:
+            print(plan.to_json())
+
     @metrics()
     def port(self, options):
         """
@@ -778,13 +1045,28 @@ class TopLevelCommand:
         Options:
             -q, --quiet          Only display IDs
             --services           Display services
-            --filter KEY=VAL     Filter services by a property. KEY is either:
+            --filter KEY=VAL     Filter services, or their containers, by a property. KEY is either:
                                  1. `source` with values `image`, or `build`;
                                  2. `status` with values `running`, `stopped`, `paused`, or `restarted`.
+                                    Containers can also be filtered by status `created`, `exited`
+                                    or `dead`.
             -a, --all            Show all stopped containers (including those created by the run command)
+            --replicas           Display the number of running and desired replicas of each service
+            --sort KEY           Sort containers by `name`, `status` or `replicas` (service and
+                                 container number). [default: name]
         """
         if options['--quiet'] and options['--services']:
             raise UserError('--quiet and --services cannot be combined')
+        if options.get('--replicas') and (options['--quiet'] or options['--services']):
+            raise UserError('--replicas cannot be combined with --quiet or --services')
+
+        if options.get('--replicas'):
+            rows = [
+                [status.name, '{}/{}'.format(status.running, status.desired), status.state]
+                for status in self.project.replica_status(options['SERVICE'])
+            ]
+            print(Formatter.table(['Service', 'Replicas', 'State'], rows))
+            return
 
         if options['--services']:
             filt = build_filter(options.get('--filter'))
@@ -794,15 +1076,10 @@ class TopLevelCommand:
             print('\n'.join(service.name for service in services))
             return
 
-        if options['--all']:
-            containers = sorted(self.project.containers(service_names=options['SERVICE'],
-                                                        one_off=OneOffFilter.include, stopped=True),
-                                key=attrgetter('name'))
-        else:
-            containers = sorted(
-                self.project.containers(service_names=options['SERVICE'], stopped=True) +
-                self.project.containers(service_names=options['SERVICE'], one_off=OneOffFilter.only),
-                key=attrgetter('name'))
+        containers = ps_containers(
+            self.project, options['SERVICE'], build_filter(options.get('--filter')),
+            options.get('--sort') or 'name', options['--all'],
+        )
 
         if options['--quiet']:
             for container in containers:
@@ -819,14 +1096,62 @@ class TopLevelCommand:
                 command = container.human_readable_command
                 if len(command) > 30:
                     command = '%s ...' % command[:26]
+                state = container.human_readable_state
+                if container.external_service:
+                    state += ' (external)'
                 rows.append([
                     container.name,
                     command,
-                    container.human_readable_state,
+                    state,
                     container.human_readable_ports,
                 ])
             print(Formatter.table(headers, rows))
 
+    @metrics()
+    def publish(self, options):
+        """
+        Publish the project to a registry, as an OCI artifact holding its
+        Compose file. The file is published with its variables uninterpolated,
+        and services taking values from env files or from the environment
+        are refused, unless --with-env is set.
+
+        Usage: publish [options] REPOSITORY
+
+        Options:
+            --resolve-image-digests  Pin image tags to digests.
+            --with-env               Publish the file interpolated, with env
+                                     files inlined, along with the environment
+                                     file of the project. Their values, such
+                                     as passwords, end up in the registry.
+        """
+        with_env = options['--with-env']
+        compose_config = load_publishable_config(
+            get_config_details_from_options('.', self.toplevel_options), with_env
+        )
+        env_files = []
+        if with_env:
+            log.warning(
+                'Publishing with --with-env: the values of the environment, '
+                'including any secret they hold, are published to {}.'.format(
+                    options['REPOSITORY'])
+            )
+            env_file = get_environment_file_path('.', self.toplevel_options)
+            if env_file:
+                env_files.append(env_file)
+
+        with errors.handle_connection_errors(self.project.client):
+            image_digests = None
+            if options['--resolve-image-digests']:
+                image_digests = image_digests_for_project(self.project)
+            print(publish(
+                self.project.client,
+                compose_config,
+                options['REPOSITORY'],
+                env_files=env_files,
+                image_digests=image_digests,
+                interpolated=with_env,
+            ))
+
     @metrics()
     def pull(self, options):
         """
@@ -840,9 +1165,17 @@ class TopLevelCommand:
             --no-parallel           Disable parallel pulling.
             -q, --quiet             Pull without printing progress information
             --include-deps          Also pull services declared as dependencies
+            --warm-cache            Pull every image needed to run `up --offline`
+                                    later, including the `cache_from` images of
+                                    the services that are built.
         """
         if options.get('--parallel'):
             log.warning('--parallel option is deprecated and will be removed in future versions.')
+        if options.get('--warm-cache'):
+            self.project.warm_cache(
+                service_names=options['SERVICE'], silent=options.get('--quiet'),
+            )
+            return
         self.project.pull(
             service_names=options['SERVICE'],
             ignore_pull_failures=options.get('--ignore-pull-failures'),
@@ -860,7 +1193,15 @@ class TopLevelCommand:
 
         Options:
             --ignore-push-failures  Push what it can and ignores images with push failures.
+            --dry-run               Only check the credentials for the registries the
+                                    images would be pushed to.
         """
+        if options.get('--dry-run'):
+            services = self.project.get_services(options['SERVICE'])
+            for registry, found in self.project.check_credentials(services, push=True):
+                print('{}: {}'.format(registry, 'credentials found' if found else 'no credentials'))
+            return
+
         self.project.push(
             service_names=options['SERVICE'],
             ignore_push_failures=options.get('--ignore-push-failures')
@@ -876,6 +1217,8 @@ class TopLevelCommand:
 
         Any data which is not in a volume will be lost.
 
+        SERVICE may also be the ID, name or ID prefix of one of its containers.
+
         Usage: rm [options] [--] [SERVICE...]
 
         Options:
@@ -925,8 +1268,8 @@ class TopLevelCommand:
         `docker-compose run --no-deps SERVICE COMMAND [ARGS...]`.
 
         Usage:
-            run [options] [-v VOLUME...] [-p PORT...] [-e KEY=VAL...] [-l KEY=VALUE...] [--]
-                SERVICE [COMMAND] [ARGS...]
+            run [options] [-v VOLUME...] [--mount MOUNT...] [-p PORT...] [-e KEY=VAL...]
+                [-l KEY=VALUE...] [--env-file PATH...] [--] SERVICE [COMMAND] [ARGS...]
 
         Options:
             -d, --detach          Detached mode: Run container in the background, print
@@ -934,16 +1277,31 @@ class TopLevelCommand:
             --name NAME           Assign a name to the container
             --entrypoint CMD      Override the entrypoint of the image.
             -e KEY=VAL            Set an environment variable (can be used multiple times)
+            --env-file PATH       Read environment variables from a file, after the
+                                  service's own env_file and environment. Variables
+                                  set with -e take precedence (can be used multiple times)
             -l, --label KEY=VAL   Add or override a label (can be used multiple times)
             -u, --user=""         Run as specified username or uid
             --no-deps             Don't start linked services.
             --rm                  Remove container after run. Ignored in detached mode.
-            -p, --publish=[]      Publish a container's port(s) to the host
+            --remove-image        With --rm, also remove the image of the container if no
+                                  other container uses it.
+            -p, --publish=[]      Publish a container's port(s) to the host. With a
+                                  range of host ports, as in 8000-8999:80, the first
+                                  one that no container publishes is used
+            -P, --publish-all     Publish all the ports the image and the service
+                                  expose to random host ports
+            --platform PLATFORM   Run the container on PLATFORM (os[/arch[/variant]]),
+                                  pulling the image for it if needed
             --service-ports       Run command with the service's ports enabled and mapped
                                   to the host.
             --use-aliases         Use the service's network aliases in the network(s) the
                                   container connects to.
             -v, --volume=[]       Bind mount a volume (default [])
+            --mount MOUNT         Attach a filesystem mount, as
+                                  `type=bind|volume|tmpfs,target=PATH[,source=SRC][,...]`
+                                  with the fields of `docker run --mount`. Replaces a
+                                  volume with the same target (can be used multiple times)
             -T                    Disable pseudo-tty allocation. By default `docker-compose run`
                                   allocates a TTY.
             -w, --workdir=""      Working directory inside the container
@@ -951,6 +1309,9 @@ class TopLevelCommand:
         service = self.project.get_service(options['SERVICE'])
         detach = options.get('--detach')
 
+        if options.get('--remove-image') and not options['--rm']:
+            raise UserError('--remove-image requires --rm')
+
         if options['--publish'] and options['--service-ports']:
             raise UserError(
                 'Service port mapping and manual port mapping '
@@ -966,7 +1327,16 @@ class TopLevelCommand:
 
         options['stdin_open'] = service.options.get('stdin_open', True)
 
+        if options.get('--platform'):
+            parse_platform(options['--platform'])
+            service.options['platform'] = options['--platform']
+
         container_options = build_one_off_container_options(options, detach, command)
+        ports = container_options.get('ports', service.options.get('ports'))
+        if ports:
+            container_options['ports'] = allocate_port_ranges(
+                self.project.client, [port for spec in ports for port in ServicePort.parse(spec)],
+            )
         run_one_off_container(
             container_options, self.project, service, options,
             self.toplevel_options, self.toplevel_environment
@@ -1008,7 +1378,8 @@ class TopLevelCommand:
 
         Usage: start [SERVICE...]
         """
-        containers = self.project.start(service_names=options['SERVICE'])
+        with self.project_lock():
+            containers = self.project.start(service_names=options['SERVICE'])
         exit_if(not containers, 'No containers to start', 1)
 
     @metrics()
@@ -1018,14 +1389,74 @@ class TopLevelCommand:
 
         They can be started again with `docker-compose start`.
 
+        SERVICE may also be the ID, name or ID prefix of one of its containers.
+
         Usage: stop [options] [--] [SERVICE...]
 
         Options:
           -t, --timeout TIMEOUT      Specify a shutdown timeout in seconds.
                                      (default: 10)
+          -f, --force                Don't warn about running services that
+                                     depend on the services stopped.
         """
         timeout = timeout_from_opts(options)
-        self.project.stop(service_names=options['SERVICE'], timeout=timeout)
+        with self.project_lock():
+            self.project.stop(
+                service_names=options['SERVICE'], force=options['--force'], timeout=timeout,
+            )
+
+    @metrics()
+    def reload(self, options):
+        """
+        Send a signal to the running containers of services, for them to
+        reload their configuration without being restarted, such as after
+        changing a bind-mounted configuration file.
+
+        Usage: reload [options] [--] [SERVICE...]
+
+        Options:
+            -s SIGNAL           SIGNAL to send to the containers.
+                                Default signal is SIGHUP.
+            --settle SECONDS    Wait this many seconds after sending the
+                                signal, then fail if a container stopped.
+        """
+        signal = options.get('-s') or DEFAULT_RELOAD_SIGNAL
+        try:
+            settle = float(options.get('--settle') or 0)
+        except ValueError:
+            settle = -1
+        if settle < 0:
+            raise UserError('--settle must be a number of seconds')
+        containers = self.project.reload(
+            service_names=options['SERVICE'], signal=signal, settle=settle,
+        )
+        exit_if(not containers, 'No containers to reload', 1)
+
+    @metrics()
+    def sweep(self, options):
+        """
+        Remove the containers, networks and volumes of the ephemeral
+        instances of the project, started with COMPOSE_EPHEMERAL_SUFFIX,
+        that are older than the TTL, such as those a crashed test run left.
+
+        Usage: sweep [options]
+
+        Options:
+            --ttl SECONDS   Only remove the instances created more than this
+                            many seconds ago. [default: 3600]
+        """
+        try:
+            ttl = float(options.get('--ttl') or 3600)
+        except ValueError:
+            raise UserError('--ttl must be a number of seconds')
+        swept = sweep_ephemeral_projects(
+            self.project.client,
+            self.project.ephemeral_base or self.project.name,
+            ttl,
+            tenant=self.project.tenant,
+        )
+        for name in swept:
+            print(name)
 
     @metrics()
     def restart(self, options):
@@ -1039,7 +1470,8 @@ class TopLevelCommand:
                                      (default: 10)
         """
         timeout = timeout_from_opts(options)
-        containers = self.project.restart(service_names=options['SERVICE'], timeout=timeout)
+        with self.project_lock():
+            containers = self.project.restart(service_names=options['SERVICE'], timeout=timeout)
         exit_if(not containers, 'No containers to restart', 1)
 
     @metrics()
@@ -1108,7 +1540,15 @@ class TopLevelCommand:
                                        --abort-on-container-exit.
             --no-color                 Produce monochrome output.
             --quiet-pull               Pull without printing progress information
+            --pull                     Pull images before starting containers, even
+                                       if they are present.
+            --offline                  Never pull images. Fail if an image is
+                                       missing and can't be built.
             --no-deps                  Don't start linked services.
+            --create-bind-dirs         Create the missing source directories of bind
+                                       mounts, and the parent directories of missing
+                                       files, as the current user. Files are never
+                                       created. Ignored for a remote daemon.
             --force-recreate           Recreate containers even if their configuration
                                        and image haven't changed.
             --always-recreate-deps     Recreate dependent containers.
@@ -1118,8 +1558,19 @@ class TopLevelCommand:
             --no-build                 Don't build an image, even if it's missing.
             --no-start                 Don't start the services after creating them.
             --build                    Build images before starting containers.
+            --prune-dangling           Remove the images replaced by a rebuild once
+                                       no container uses them.
+            --strict-platform          Refuse to start services whose image is for
+                                       another platform than the Docker daemon's,
+                                       unless they set `platform`.
             --abort-on-container-exit  Stops all containers if any container was
                                        stopped. Incompatible with -d.
+            --restart-crashed RETRIES  Restart the attached containers that exit with
+                                       an error, at most RETRIES times each within
+                                       --restart-window, unless they have a restart
+                                       policy. Incompatible with -d and
+                                       --abort-on-container-exit.
+            --restart-window SECONDS   The window of --restart-crashed. [default: 60]
             --attach-dependencies      Attach to dependent containers.
             -t, --timeout TIMEOUT      Use this timeout in seconds for container
                                        shutdown when attached or when containers are
@@ -1150,19 +1601,48 @@ class TopLevelCommand:
             raise UserError(
                 "-d cannot be combined with --abort-on-container-exit or --attach-dependencies.")
 
+        restarter = restarter_from_opts(options)
+        if restarter and (detached or cascade_stop):
+            raise UserError(
+                "--restart-crashed cannot be combined with -d or --abort-on-container-exit.")
+
         ignore_orphans = self.toplevel_environment.get_boolean('COMPOSE_IGNORE_ORPHANS')
 
         if ignore_orphans and remove_orphans:
             raise UserError("COMPOSE_IGNORE_ORPHANS and --remove-orphans cannot be combined.")
 
-        opts = ['--detach', '--abort-on-container-exit', '--exit-code-from', '--attach-dependencies']
+        opts = [
+            '--detach', '--abort-on-container-exit', '--exit-code-from', '--attach-dependencies',
+            '--restart-crashed',
+        ]
         for excluded in [x for x in opts if options.get(x) and no_start]:
             raise UserError('--no-start and {} cannot be combined.'.format(excluded))
 
+        if options.get('--offline') and options.get('--pull'):
+            raise UserError('--offline and --pull cannot be combined.')
+
         native_builder = self.toplevel_environment.get_boolean('COMPOSE_DOCKER_CLI_BUILD', True)
+        print_generated_suffix(self.project, self.toplevel_environment)
 
         with up_shutdown_context(self.project, service_names, timeout, detached):
             warn_for_swarm_mode(self.project.client)
+            warn_for_missing_init_binary(
+                self.project.client,
+                self.project.get_services(service_names, include_deps=start_deps))
+            if options.get('--create-bind-dirs'):
+                if not is_local_daemon(self.project.client):
+                    log.warning(
+                        'Ignoring --create-bind-dirs: the Docker daemon runs on another machine'
+                    )
+                for service in self.project.get_services(service_names, include_deps=start_deps):
+                    service.create_bind_mount_directories()
+            warn_for_misconfigured_bind_mounts(
+                self.project.get_services(service_names, include_deps=start_deps),
+                self.project.warnings)
+            warn_for_inaccessible_bind_mounts(
+                self.project.client,
+                self.project.get_services(service_names, include_deps=start_deps),
+                self.project.warnings)
 
             def up(rebuild):
                 return self.project.up(
@@ -1182,21 +1662,27 @@ class TopLevelCommand:
                     silent=options.get('--quiet-pull'),
                     cli=native_builder,
                     attach_dependencies=attach_dependencies,
+                    prune_dangling=options.get('--prune-dangling', False),
+                    strict_platform=options.get('--strict-platform', False),
+                    pull=options.get('--pull', False),
+                    offline=options.get('--offline', False),
                 )
 
-            try:
-                to_attach = up(False)
-            except docker.errors.ImageNotFound as e:
-                log.error(
-                    "The image for the service you're trying to recreate has been removed. "
-                    "If you continue, volume data could be lost. Consider backing up your data "
-                    "before continuing.\n"
-                )
-                res = yesno("Continue with the new image? [yN]", False)
-                if res is None or not res:
-                    raise e
-
-                to_attach = up(True)
+            with self.project_lock():
+                try:
+                    to_attach = up(False)
+                except docker.errors.ImageNotFound as e:
+                    log.error(
+                        "The image for the service you're trying to recreate has been removed. "
+                        "If you continue, volume data could be lost. Consider backing up your "
+                        "data before continuing.\n"
+                    )
+                    res = yesno("Continue with the new image? [yN]", False)
+                    if res is None or not res:
+                        raise e
+
+                    to_attach = up(True)
+            log_up_summary(to_attach.summary)
 
             if detached or no_start:
                 return
@@ -1213,7 +1699,8 @@ class TopLevelCommand:
                 {'follow': True},
                 cascade_stop,
                 event_stream=self.project.events(service_names=service_names),
-                keep_prefix=keep_prefix)
+                keep_prefix=keep_prefix,
+                restarter=restarter)
             print("Attaching to", list_containers(log_printer.containers))
             cascade_starter = log_printer.run()
 
@@ -1246,6 +1733,29 @@ class TopLevelCommand:
         else:
             print(get_version_info('full'))
 
+    @metrics("wait-for")
+    def wait_for(self, options):
+        """
+        Wait until a port of the running containers of a service is reachable,
+        retrying with a growing delay. TARGET is `[SCHEME://]PORT[/PATH]`, where
+        SCHEME is `tcp` (the default), `tls`, `http` or `https`. HTTP targets
+        must answer with status 200.
+
+        Usage: wait-for [options] SERVICE TARGET
+
+        Options:
+            -t, --timeout TIMEOUT   Give up after this many seconds. [default: 60]
+        """
+        try:
+            target = parse_target(options['TARGET'])
+        except ValueError as e:
+            raise UserError(str(e))
+        try:
+            timeout = float(options.get('--timeout') or 60)
+        except ValueError:
+            raise UserError('--timeout must be a number of seconds')
+        self.project.wait_for(options['SERVICE'], target, timeout)
+
 
 def compute_service_exit_code(exit_value_from, attached_containers):
     candidates = list(filter(
@@ -1302,6 +1812,40 @@ def timeout_from_opts(options):
     return None if timeout is None else int(timeout)
 
 
+def log_files_from_opts(options):
+    directory = options.get('--output-dir')
+    if not directory:
+        for option in ('--per-replica', '--max-file-size', '--no-console'):
+            if options.get(option):
+                raise UserError('{} requires --output-dir'.format(option))
+        return None
+    max_file_size = None
+    if options.get('--max-file-size'):
+        max_file_size = parse_bytes(options['--max-file-size'])
+        if not max_file_size:
+            raise UserError('--max-file-size must be a size, such as 10m (found: "{}")'.format(
+                options['--max-file-size']
+            ))
+    return LogFiles(directory, max_file_size, per_replica=options.get('--per-replica'))
+
+
+def restarter_from_opts(options):
+    retries = options.get('--restart-crashed')
+    if retries is None:
+        return None
+    try:
+        retries = int(retries)
+        window = float(options.get('--restart-window') or 60)
+    except ValueError:
+        retries = window = 0
+    if retries < 1 or window <= 0:
+        raise UserError(
+            '--restart-crashed must be a positive number of retries, and --restart-window '
+            'a positive number of seconds'
+        )
+    return CrashRestarter(retries, window)
+
+
 def image_digests_for_project(project):
     try:
         return get_image_digests(project)
@@ -1381,10 +1925,12 @@ def build_one_off_container_options(options, detach, command):
         'detach': detach,
     }
 
-    if options['-e']:
-        container_options['environment'] = Environment.from_command_line(
-            parse_environment(options['-e'])
-        )
+    if options.get('--env-file') or options['-e']:
+        environment = {}
+        for env_file in options.get('--env-file') or []:
+            environment.update(env_vars_from_file(env_file))
+        environment.update(parse_environment(options['-e']))
+        container_options['environment'] = Environment.from_command_line(environment)
 
     if options['--label']:
         container_options['labels'] = parse_labels(options['--label'])
@@ -1406,19 +1952,39 @@ def build_one_off_container_options(options, detach, command):
     if options['--publish']:
         container_options['ports'] = options.get('--publish')
 
+    if options.get('--publish-all'):
+        container_options['publish_all_ports'] = True
+
     if options['--name']:
         container_options['name'] = options['--name']
 
     if options['--workdir']:
         container_options['working_dir'] = options['--workdir']
 
-    if options['--volume']:
-        volumes = [VolumeSpec.parse(i) for i in options['--volume']]
+    volumes = parse_run_volumes(options['--volume'], options.get('--mount'))
+    if volumes:
         container_options['volumes'] = volumes
 
     return container_options
 
 
+def parse_run_volumes(volume_options, mount_options):
+    """The volumes of `run -v` and `run --mount`, as VolumeSpecs and
+    MountSpecs. A --mount replaces a -v with the same target.
+    """
+    def parse(flag, parse_option, values):
+        for index, value in enumerate(values or []):
+            try:
+                yield parse_option(value)
+            except ConfigurationError as e:
+                raise UserError('Invalid {} #{} "{}": {}'.format(flag, index + 1, value, e.msg))
+
+    volumes = list(parse('--volume', VolumeSpec.parse, volume_options))
+    mounts = list(parse('--mount', parse_mount_option, mount_options))
+    targets = {mount.target for mount in mounts}
+    return [v for v in volumes if v.internal not in targets] + mounts
+
+
 def run_one_off_container(container_options, project, service, options, toplevel_options,
                           toplevel_environment):
     native_builder = toplevel_environment.get_boolean('COMPOSE_DOCKER_CLI_BUILD')
@@ -1443,11 +2009,18 @@ def run_one_off_container(container_options, project, service, options, toplevel
     if detach:
         service.start_container(container, use_network_aliases)
         print(container.name)
+        for private, bindings in sorted(container.ports.items()):
+            for binding in bindings or []:
+                log.info('Published %s on %s:%s', private, binding['HostIp'], binding['HostPort'])
         return
 
     def remove_container():
-        if options['--rm']:
+        if not options['--rm']:
+            return
+        if not options.get('--remove-image'):
             project.client.remove_container(container.id, force=True, v=True)
+        elif container.remove_with_image(force=True, v=True):
+            log.info('Removed image %s', container.image)
 
     use_cli = not toplevel_environment.get_boolean('COMPOSE_INTERACTIVE_NO_CLI')
 
@@ -1461,6 +2034,12 @@ def run_one_off_container(container_options, project, service, options, toplevel
                     get_docker_start_call(container_options, container.id),
                     toplevel_options, toplevel_environment
                 )
+            elif options['-T']:
+                # Attached before starting, so that no output is missed
+                output = container.attach(stdout=True, stderr=True, stream=True, demux=True)
+                service.start_container(container, use_network_aliases)
+                copy_output(output, sys.stdout.buffer, sys.stderr.buffer)
+                exit_code = container.wait()
             else:
                 operation = RunOperation(
                     project.client,
@@ -1485,6 +2064,21 @@ def run_one_off_container(container_options, project, service, options, toplevel
     sys.exit(exit_code)
 
 
+def copy_output(output, stdout, stderr):
+    """Write the (stdout, stderr) chunks of a container attached with
+    `demux=True` to the binary files `stdout` and `stderr`, as they arrive.
+    Nothing is buffered: a slow reader holds back the container, however
+    much it outputs. Containers with a TTY only have stdout.
+    """
+    for out, err in output:
+        if out:
+            stdout.write(out)
+            stdout.flush()
+        if err:
+            stderr.write(err)
+            stderr.flush()
+
+
 def get_docker_start_call(container_options, container_id):
     docker_call = ["start"]
     if not container_options.get('detach'):
@@ -1503,13 +2097,22 @@ def log_printer_from_project(
         cascade_stop=False,
         event_stream=None,
         keep_prefix=True,
+        restarter=None,
+        log_files=None,
+        console=True,
 ):
+    presenters = build_log_presenters(project.service_names, monochrome, keep_prefix)
+    if log_files is not None:
+        presenters = (
+            FileLogPresenter(presenter, log_files, console) for presenter in presenters
+        )
     return LogPrinter(
         [c for c in containers if c.log_driver not in (None, 'none')],
-        build_log_presenters(project.service_names, monochrome, keep_prefix),
+        presenters,
         event_stream or project.events(),
         cascade_stop=cascade_stop,
-        log_args=log_args)
+        log_args=log_args,
+        restarter=restarter)
 
 
 def filter_attached_containers(containers, service_names, attach_dependencies=False):
@@ -1639,6 +2242,7 @@ def has_container_with_state(containers, state):
         'stopped': lambda c: not c.is_running,
         'paused': lambda c: c.is_paused,
         'restarting': lambda c: c.is_restarting,
+        'restarted': lambda c: c.is_restarting,
     }
     for container in containers:
         if state not in states:
@@ -1669,6 +2273,31 @@ def filter_services(filt, services, project):
     return filter(should_include, services)
 
 
+def ps_containers(project, service_names, filt, sort, all):
+    """The containers `ps` lists. A `source` filter keeps the containers of
+    the services built or not, a `status` filter those in that state.
+    """
+    statuses = None
+    for key, value in filt.items():
+        if key == 'status':
+            statuses = [value]
+        elif key == 'source':
+            matching = [
+                service.name for service in filter_services({key: value}, project.services, project)
+                if not service_names or service.name in service_names
+            ]
+            if not matching:
+                return []
+            service_names = matching
+        else:
+            raise UserError("Invalid filter: %s" % key)
+
+    try:
+        return project.ps(service_names, statuses=statuses, sort=sort, all=all)
+    except ProjectError as e:
+        raise UserError(e.msg)
+
+
 def build_filter(arg):
     filt = {}
     if arg is not None:
@@ -1679,6 +2308,50 @@ def build_filter(arg):
     return filt
 
 
+def log_up_summary(summary):
+    log.info(
+        'Up in {:.1f}s: {} created, {} recreated, {} started, {} unchanged'.format(
+            summary.duration, summary.created, summary.recreated, summary.started,
+            summary.unchanged,
+        )
+    )
+    if summary.images_pulled:
+        log.info('Pulled {} image(s), {} downloaded'.format(
+            summary.images_pulled, human_readable_file_size(summary.pulled_bytes)
+        ))
+    if summary.networks_created or summary.volumes_created:
+        log.info('Created {} network(s) and {} volume(s)'.format(
+            len(summary.networks_created), len(summary.volumes_created)
+        ))
+    if summary.memory:
+        log.info('Memory limits: {} declared, {} on the host'.format(
+            human_readable_file_size(summary.memory),
+            human_readable_file_size(summary.host_memory) if summary.host_memory else 'unknown',
+        ))
+    if summary.cpus:
+        log.info('CPU limits: {:g} declared, {} on the host'.format(
+            summary.cpus, summary.host_cpus or 'unknown'
+        ))
+    if summary.exceeds_host_memory:
+        log.warning(
+            'The containers declare more memory than the host has: they may be '
+            'killed when they use it.'
+        )
+    if summary.exceeds_host_cpus:
+        log.warning(
+            'The containers declare more CPUs than the host has: they will compete '
+            'for them.'
+        )
+
+
+def print_generated_suffix(project, environment):
+    """Print the suffix generated for COMPOSE_EPHEMERAL_SUFFIX=auto, which
+    the other commands need to manage the instance.
+    """
+    if environment.get('COMPOSE_EPHEMERAL_SUFFIX') == 'auto':
+        print(project.ephemeral_suffix)
+
+
 def warn_for_swarm_mode(client):
     info = client.info()
     if info.get('Swarm', {}).get('LocalNodeState') == 'active':
@@ -1693,3 +2366,81 @@ def warn_for_swarm_mode(client):
             "To deploy your application across the swarm, "
             "use `docker stack deploy`.\n"
         )
+
+
+def warn_for_inaccessible_bind_mounts(client, services, warnings=None):
+    warnings = warnings or Warnings()
+    if warnings.is_ignored(BIND_MOUNT_ACCESS):
+        return
+
+    security_options = client.info().get('SecurityOptions') or []
+    userns_remap = any('name=userns' in option for option in security_options)
+
+    for service in services:
+        for path, path_stat in service.inaccessible_bind_mounts(userns_remap):
+            if userns_remap and service.options.get('userns_mode') != 'host':
+                reason = 'the Docker daemon remaps user namespaces'
+                fix = 'set `userns_mode: "host"` on the service, or make the path accessible to all'
+            else:
+                reason = 'its user is {}'.format(service.options.get('user'))
+                fix = 'change the ownership or permissions of the path'
+            warnings.warn(
+                BIND_MOUNT_ACCESS,
+                'Bind mount {path} of service {service} is owned by {uid}:{gid} with mode '
+                '{mode:o}, so its containers may not be able to use it: {reason}.\n'
+                'To fix this, {fix}. Set COMPOSE_IGNORE_BIND_MOUNT_ACCESS=1 to hide this '
+                'warning.\n'.format(
+                    path=path,
+                    service=service.name,
+                    uid=path_stat.st_uid,
+                    gid=path_stat.st_gid,
+                    mode=stat.S_IMODE(path_stat.st_mode),
+                    reason=reason,
+                    fix=fix,
+                )
+            )
+
+
+def warn_for_misconfigured_bind_mounts(services, warnings=None):
+    warnings = warnings or Warnings()
+    problems = {
+        'missing': (
+            'does not exist, so Docker will create a directory there, but {target} looks '
+            'like a {kind}. Create the {kind} first, or fix the path of the mount.'
+        ),
+        'directory': (
+            'is a directory, but {target} looks like a {kind}. It may have been created by '
+            'Docker when the {kind} was missing: if so, remove it and create the {kind}.'
+        ),
+        'not-socket': 'is not a socket, but {target} looks like one.',
+    }
+    for service in services:
+        for source, target, problem in service.misconfigured_bind_mounts():
+            warnings.warn(
+                BIND_MOUNT_TYPE,
+                'Bind mount source {source} of service {service} {problem}\n'.format(
+                    source=source,
+                    service=service.name,
+                    problem=problems[problem].format(
+                        target=target, kind=bind_target_kind(target)
+                    ),
+                )
+            )
+
+
+def warn_for_missing_init_binary(client, services):
+    init_services = [service.name for service in services if service.requests_init]
+    if not init_services:
+        return
+
+    info = client.info()
+    init_commit = (info.get('InitCommit') or {}).get('ID')
+    if info.get('InitBinary') and init_commit not in (None, '', 'N/A'):
+        return
+
+    log.warning(
+        "The following services set `init: true`, but the Docker Engine does not report "
+        "a usable init binary: {}.\n"
+        "Their containers will fail to start unless docker-init is installed on the "
+        "daemon host or `init` is disabled for them.\n".format(', '.join(init_services))
+    )
@@ -1,6 +1,7 @@
 import functools
 import logging
 import pprint
+import time
 from itertools import chain
 
 
@@ -23,14 +24,15 @@ def format_return(result, max_lines):
 
 
 class VerboseProxy:
-    """Proxy all function calls to another class and log method name, arguments
-    and return values for each call.
+    """Proxy all function calls to another class and log method name, arguments,
+    duration and return value or error for each call.
     """
 
-    def __init__(self, obj_name, obj, log_name=None, max_lines=10):
+    def __init__(self, obj_name, obj, log_name=None, max_lines=10, level=logging.INFO):
         self.obj_name = obj_name
         self.obj = obj
         self.max_lines = max_lines
+        self.level = level
         self.log = logging.getLogger(log_name or __name__)
 
     def __getattr__(self, name):
@@ -42,14 +44,24 @@ class VerboseProxy:
         return functools.partial(self.proxy_callable, name)
 
     def proxy_callable(self, call_name, *args, **kwargs):
-        self.log.info("%s %s <- %s",
-                      self.obj_name,
-                      call_name,
-                      format_call(args, kwargs))
-
-        result = getattr(self.obj, call_name)(*args, **kwargs)
-        self.log.info("%s %s -> %s",
-                      self.obj_name,
-                      call_name,
-                      format_return(result, self.max_lines))
+        self.log.log(self.level, "%s %s <- %s",
+                     self.obj_name,
+                     call_name,
+                     format_call(args, kwargs))
+
+        start = time.monotonic()
+        try:
+            result = getattr(self.obj, call_name)(*args, **kwargs)
+        except Exception as e:
+            self.log.log(self.level, "%s %s !! %r (%.3fs)",
+                         self.obj_name,
+                         call_name,
+                         e,
+                         time.monotonic() - start)
+            raise
+        self.log.log(self.level, "%s %s -> %s (%.3fs)",
+                     self.obj_name,
+                     call_name,
+                     format_return(result, self.max_lines),
+                     time.monotonic() - start)
         return result
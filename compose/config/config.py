@@ -1,6 +1,7 @@
 import functools
 import logging
 import os
+import posixpath
 import re
 import string
 import sys
@@ -24,6 +25,7 @@ from ..utils import json_hash
 from ..utils import parse_bytes
 from ..utils import parse_nanoseconds_int
 from ..utils import splitdrive
+from ..utils import unique_everseen
 from ..version import ComposeVersion
 from .environment import env_vars_from_file
 from .environment import Environment
@@ -33,7 +35,10 @@ from .errors import ComposeFileNotFound
 from .errors import ConfigurationError
 from .errors import DuplicateOverrideFileFound
 from .errors import VERSION_EXPLANATION
+from .interpolation import collect_variables
 from .interpolation import interpolate_environment_variables
+from .interpolation import interpolate_top_level_value
+from .interpolation import InterpolationReport
 from .sort_services import get_container_name_from_network_mode
 from .sort_services import get_service_name_from_network_mode
 from .sort_services import sort_service_dicts
@@ -57,6 +62,7 @@ from .validation import validate_ipc_mode
 from .validation import validate_links
 from .validation import validate_network_mode
 from .validation import validate_pid_mode
+from .validation import validate_platform
 from .validation import validate_service_constraints
 from .validation import validate_top_level_object
 from .validation import validate_ulimits
@@ -130,6 +136,7 @@ ALLOWED_KEYS = DOCKER_CONFIG_KEYS + [
     'build',
     'container_name',
     'credential_spec',
+    'develop',
     'dockerfile',
     'init',
     'log_driver',
@@ -138,6 +145,7 @@ ALLOWED_KEYS = DOCKER_CONFIG_KEYS + [
     'network_mode',
     'platform',
     'profiles',
+    'pull_policy',
     'scale',
     'stop_grace_period',
 ]
@@ -162,6 +170,18 @@ DEFAULT_OVERRIDE_FILENAMES = ('docker-compose.override.yml',
                               'compose.override.yml',
                               'compose.override.yaml')
 
+SECURITY_PROFILE_KEY = 'x-security-profile'
+
+# Fields of the project-level security profile, and the type of their value
+SECURITY_PROFILE_FIELDS = {
+    'cap_add': list,
+    'cap_drop': list,
+    'read_only': bool,
+    'security_opt': list,
+    'tmpfs': (str, list),
+    'userns_mode': str,
+}
+
 
 log = logging.getLogger(__name__)
 
@@ -210,7 +230,10 @@ class ConfigFile(namedtuple('_ConfigFile', 'filename config')):
             services = self.config.get('services', None)
             networks = self.config.get('networks', None)
             volumes = self.config.get('volumes', None)
-            if services or networks or volumes:
+            # A V1 file can have a service called "name", but its value
+            # is a mapping
+            project_name = isinstance(self.config.get('name'), str)
+            if services or networks or volumes or project_name:
                 # validate V2/V3 structure
                 for section in ['services', 'networks', 'volumes']:
                     validate_config_section(
@@ -268,8 +291,13 @@ class ConfigFile(namedtuple('_ConfigFile', 'filename config')):
     def get_configs(self):
         return {} if self.version == V1 else self.config.get('configs', {})
 
+    def get_security_profile(self):
+        return {} if self.version == V1 else self.config.get(SECURITY_PROFILE_KEY) or {}
 
-class Config(namedtuple('_Config', 'config_version version services volumes networks secrets configs')):
+
+class Config(namedtuple('_Config', [
+        'config_version', 'version', 'services', 'volumes', 'networks', 'secrets', 'configs',
+        'name'], defaults=[None])):
     """
     :param config_version: configuration file version
     :type  config_version: int
@@ -285,6 +313,8 @@ class Config(namedtuple('_Config', 'config_version version services volumes netw
     :type secrets: :class:`dict`
     :param configs: Dictionary mapping config names to description dictionaries
     :type configs: :class:`dict`
+    :param name: project name set by the top-level `name`, if any
+    :type name: str
     """
 
 
@@ -409,16 +439,21 @@ def check_swarm_only_config(service_dicts):
         )
 
 
-def load(config_details, interpolate=True):
+def load(config_details, interpolate=True, report=None):
     """Load the configuration from a working directory and a list of
     configuration files.  Files are loaded in order, and merged on top
     of each other to create the final configuration.
 
+    The environment variables the files reference are added to `report`,
+    an InterpolationReport, when it is set.
+
     Return a fully interpolated, extended and validated configuration.
     """
 
     # validate against latest version and if fails do it against v1 schema
     validate_config_version(config_details.config_files)
+    if interpolate:
+        check_variables(config_details, report)
 
     processed_files = [
         process_config_file(config_file, config_details.environment, interpolate=interpolate)
@@ -448,7 +483,19 @@ def load(config_details, interpolate=True):
     check_swarm_only_config(service_dicts)
 
     return Config(main_file.config_version, main_file.version,
-                  service_dicts, volumes, networks, secrets, configs)
+                  service_dicts, volumes, networks, secrets, configs,
+                  load_project_name(config_details.config_files))
+
+
+def load_project_name(config_files):
+    """The project name of the top-level `name`, which later files
+    override.
+    """
+    name = None
+    for config_file in config_files:
+        if config_file.version > V1:
+            name = config_file.config.get('name') or name
+    return name
 
 
 def load_mapping(config_files, get_func, entity_type, working_dir=None):
@@ -510,6 +557,8 @@ def validate_external(entity_type, name, config, version):
 
 
 def load_services(config_details, config_file, interpolate=True):
+    security_profile = load_security_profile(config_details)
+
     def build_service(service_name, service_dict, service_names):
         service_config = ServiceConfig.with_abs_paths(
             config_details.working_dir,
@@ -519,7 +568,10 @@ def load_services(config_details, config_file, interpolate=True):
         resolver = ServiceExtendsResolver(
             service_config, config_file, environment=config_details.environment
         )
-        service_dict = process_service(resolver.run())
+        service_config = resolver.run()
+        service_dict = process_service(service_config._replace(
+            config=merge_security_profile(security_profile, service_config.config)
+        ))
 
         service_config = service_config._replace(config=service_dict)
         validate_service(service_config, service_names, config_file)
@@ -536,7 +588,7 @@ def load_services(config_details, config_file, interpolate=True):
         service_names = service_config.keys()
         return sort_service_dicts([
             build_service(name, service_dict, service_names)
-            for name, service_dict in service_config.items()
+            for name, service_dict in sorted(service_config.items())
         ])
 
     def merge_services(base, override):
@@ -546,7 +598,7 @@ def load_services(config_details, config_file, interpolate=True):
                 base.get(name, {}),
                 override.get(name, {}),
                 config_file.version)
-            for name in all_service_names
+            for name in sorted(all_service_names)
         }
 
     service_configs = [
@@ -558,6 +610,36 @@ def load_services(config_details, config_file, interpolate=True):
     return build_services(service_config)
 
 
+def check_variables(config_details, report=None):
+    """Collect the environment variables referenced by the config files in
+    `report`, and raise a ConfigurationError listing all the required ones
+    that are missing. Version 1 files aren't checked.
+    """
+    report = report if report is not None else InterpolationReport()
+    for config_file in config_details.config_files:
+        if config_file.version == V1:
+            continue
+        sections = [
+            ('service', config_file.get_service_dicts()),
+            ('volume', config_file.get_volumes()),
+            ('network', config_file.get_networks()),
+            ('secret', config_file.get_secrets()),
+            ('config', config_file.get_configs()),
+        ]
+        for section, config in sections:
+            collect_variables(
+                config_file.version, config or {}, section, config_details.environment, report
+            )
+        for key in ('name', SECURITY_PROFILE_KEY):
+            if key in config_file.config:
+                collect_variables(
+                    config_file.version, {key: config_file.config[key]}, None,
+                    config_details.environment, report,
+                )
+    report.check()
+    return report
+
+
 def interpolate_config_section(config_file, config, section, environment):
     return interpolate_environment_variables(
         config_file.version,
@@ -579,6 +661,87 @@ def process_config_section(config_file, config, section, environment, interpolat
         return config
 
 
+def load_security_profile(config_details):
+    """Return the project-level security profile, which is applied to every
+    service. Fields set in later files replace those of earlier ones.
+    """
+    profile = {}
+    for config_file in config_details.config_files:
+        file_profile = config_file.get_security_profile()
+        if not isinstance(file_profile, dict):
+            raise ConfigurationError(
+                '{} in "{}" must be a mapping.'.format(SECURITY_PROFILE_KEY, config_file.filename)
+            )
+        for field, value in file_profile.items():
+            if field not in SECURITY_PROFILE_FIELDS:
+                raise ConfigurationError(
+                    'Unsupported field "{}" in {}. Supported fields are: {}.'.format(
+                        field, SECURITY_PROFILE_KEY, ', '.join(sorted(SECURITY_PROFILE_FIELDS))
+                    )
+                )
+            if not isinstance(value, SECURITY_PROFILE_FIELDS[field]):
+                raise ConfigurationError(
+                    '{}.{} has an invalid type.'.format(SECURITY_PROFILE_KEY, field)
+                )
+        profile.update(file_profile)
+
+    if 'security_opt' in profile:
+        profile['security_opt'] = [
+            resolve_seccomp_profile_path(config_details.working_dir, value)
+            for value in profile['security_opt']
+        ]
+    return profile
+
+
+def resolve_seccomp_profile_path(working_dir, value):
+    match = re.match(r'^seccomp([=:])(.+)$', value)
+    if not match or match.group(2) == 'unconfined':
+        return value
+
+    path = expand_path(working_dir, match.group(2))
+    if not os.path.isfile(path):
+        raise ConfigurationError(
+            'seccomp profile "{}" referenced in {} does not exist.'.format(
+                path, SECURITY_PROFILE_KEY
+            )
+        )
+    return 'seccomp{}{}'.format(match.group(1), path)
+
+
+def security_opt_key(value):
+    # Options that can only be set once are keyed by name; others, like
+    # label=..., can be repeated.
+    name = re.split('[=:]', value, 1)[0]
+    return name if name in ('apparmor', 'no-new-privileges', 'seccomp') else value
+
+
+def merge_security_profile(profile, service_dict):
+    """Apply the security profile to a service. Options the service sets
+    itself take precedence over those of the profile.
+    """
+    if not profile:
+        return service_dict
+
+    result = dict(service_dict)
+    for field in ('read_only', 'userns_mode'):
+        if field in profile and field not in result:
+            result[field] = profile[field]
+    for field in ('cap_add', 'cap_drop'):
+        if field in profile:
+            result[field] = merge_unique_items_lists(profile[field], result.get(field, []))
+    if 'security_opt' in profile:
+        result['security_opt'] = list(unique_everseen(
+            chain(result.get('security_opt', []), profile['security_opt']),
+            key=security_opt_key,
+        ))
+    if 'tmpfs' in profile:
+        result['tmpfs'] = list(unique_everseen(
+            chain(to_list(result.get('tmpfs')), to_list(profile['tmpfs'])),
+            key=lambda mount: mount.split(':', 1)[0],
+        ))
+    return result
+
+
 def process_config_file(config_file, environment, service_name=None, interpolate=True):
     services = process_config_section(
         config_file,
@@ -619,6 +782,11 @@ def process_config_file(config_file, environment, service_name=None, interpolate
             environment,
             interpolate,
         )
+        for key in ('name', SECURITY_PROFILE_KEY):
+            if interpolate and key in processed_config:
+                processed_config[key] = interpolate_top_level_value(
+                    config_file.version, key, processed_config[key], environment
+                )
     else:
         processed_config = services
 
@@ -725,7 +893,9 @@ class ServiceExtendsResolver:
 
 def resolve_environment(service_dict, environment=None, interpolate=True):
     """Unpack any environment variables from an env_file, if set.
-    Interpolate environment values if set.
+    Interpolate environment values if set. `environment` overrides
+    `env_file`; a variable without a value takes that of `environment`, the
+    environment of Compose. The build args of the service are never used.
     """
     env = {}
     for env_file in service_dict.get('env_file', []):
@@ -736,6 +906,10 @@ def resolve_environment(service_dict, environment=None, interpolate=True):
 
 
 def resolve_build_args(buildargs, environment):
+    """Resolve the build args without a value from `environment`, the
+    environment of Compose, never from the `environment` or `env_file` of
+    the service.
+    """
     args = parse_build_arguments(buildargs)
     return dict(resolve_env_var(k, v, environment) for k, v in args.items())
 
@@ -793,6 +967,8 @@ def validate_service(service_config, service_names, config_file):
     validate_links(service_config, service_names)
     validate_healthcheck(service_config)
     validate_credential_spec(service_config)
+    validate_platform(service_config)
+    validate_develop_watch(service_config)
 
     if not service_dict.get('image') and has_uppercase(service_name):
         raise ConfigurationError(
@@ -815,6 +991,9 @@ def process_service(service_config):
     if 'build' in service_dict:
         process_build_section(service_dict, working_dir)
 
+    if 'develop' in service_dict:
+        process_develop_section(service_dict, working_dir)
+
     if 'volumes' in service_dict and service_dict.get('volume_driver') is None:
         service_dict['volumes'] = resolve_volume_paths(working_dir, service_dict)
 
@@ -848,6 +1027,11 @@ def process_build_section(service_dict, working_dir):
             service_dict['build']['labels'] = parse_labels(service_dict['build']['labels'])
 
 
+def process_develop_section(service_dict, working_dir):
+    for rule in service_dict['develop'].get('watch', []):
+        rule['path'] = expand_path(working_dir, rule['path'])
+
+
 def process_ports(service_dict):
     if 'ports' not in service_dict:
         return service_dict
@@ -1097,7 +1281,8 @@ def merge_service_dicts(base, override, version):
     md.merge_field('healthcheck', merge_healthchecks, default={})
     md.merge_field('deploy', merge_deploy, default={})
 
-    for field in set(ALLOWED_KEYS) - set(md):
+    extension_keys = {k for k in chain(base, override) if k.startswith('x-')}
+    for field in (set(ALLOWED_KEYS) | extension_keys) - set(md):
         md.merge_scalar(field)
 
     if version == V1:
@@ -1153,6 +1338,7 @@ def merge_build(output, base, override):
     md.merge_scalar('isolation')
     md.merge_mapping('args', parse_build_arguments)
     md.merge_field('cache_from', merge_unique_items_lists, default=[])
+    md.merge_field('cache_to', merge_unique_items_lists, default=[])
     md.merge_mapping('labels', parse_labels)
     md.merge_mapping('extra_hosts', parse_extra_hosts)
     return dict(md)
@@ -1374,6 +1560,51 @@ def is_url(build_path):
     return build_path.startswith(DOCKER_VALID_URL_PREFIXES)
 
 
+def validate_develop_watch(service_config):
+    """Check that rebuild rules have an image to build, and that sync rules
+    target an absolute path the files can reach: either a volume mounted
+    into the container, or a path of an image built by Compose.
+    """
+    service_dict, service_name = service_config.config, service_config.name
+    mount_targets = []
+    for volume in service_dict.get('volumes', []):
+        if isinstance(volume, dict):
+            mount_targets.append(volume.get('target'))
+        else:
+            mount_targets.append(VolumeSpec.parse(volume).internal)
+
+    def check(rule):
+        if rule['action'] == 'rebuild':
+            if 'build' not in service_dict:
+                return 'action "rebuild" requires the service to have a build section'
+            return None
+
+        target = rule.get('target')
+        if not target:
+            return 'action "sync" requires a target'
+        if not target.startswith('/'):
+            return 'target "{}" must be an absolute path'.format(target)
+        target = posixpath.normpath(target)
+        mounted = any(
+            mount and (target + '/').startswith(posixpath.normpath(mount).rstrip('/') + '/')
+            for mount in mount_targets
+        )
+        if not mounted and 'build' not in service_dict:
+            return (
+                'target "{}" is neither inside a volume mounted into the '
+                'container nor in an image built from a build section'.format(target)
+            )
+        return None
+
+    errors = []
+    for index, rule in enumerate(service_dict.get('develop', {}).get('watch', [])):
+        error = check(rule)
+        if error:
+            errors.append("Service '{}' develop.watch[{}]: {}".format(service_name, index, error))
+    if errors:
+        raise ConfigurationError('\n'.join(errors))
+
+
 def validate_paths(service_dict):
     if 'build' in service_dict:
         build = service_dict.get('build', {})
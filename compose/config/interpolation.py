@@ -1,5 +1,7 @@
+import functools
 import logging
 import re
+from collections import namedtuple
 from string import Template
 
 from .errors import ConfigurationError
@@ -13,22 +15,31 @@ log = logging.getLogger(__name__)
 
 class Interpolator:
 
-    def __init__(self, templater, mapping):
+    def __init__(self, templater, mapping, report=None):
         self.templater = templater
         self.mapping = mapping
+        self.report = report
 
-    def interpolate(self, string):
+    def interpolate(self, string, config_path=None):
         try:
-            return self.templater(string).substitute(self.mapping)
+            if self.report is None:
+                return self.templater(string).substitute(self.mapping)
+            return self.templater(string).substitute(
+                self.mapping,
+                record=functools.partial(self.report.add, path=config_path),
+            )
         except ValueError:
             raise InvalidInterpolation(string)
 
 
-def interpolate_environment_variables(version, config, section, environment):
+def get_interpolator(version, environment, report=None):
     if version == V1:
-        interpolator = Interpolator(Template, environment)
-    else:
-        interpolator = Interpolator(TemplateWithDefaults, environment)
+        return Interpolator(Template, environment)
+    return Interpolator(TemplateWithDefaults, environment, report)
+
+
+def interpolate_environment_variables(version, config, section, environment):
+    interpolator = get_interpolator(version, environment)
 
     def process_item(name, config_dict):
         return {
@@ -42,6 +53,35 @@ def interpolate_environment_variables(version, config, section, environment):
     }
 
 
+def collect_variables(version, config, section, environment, report):
+    """Add the variables referenced by a section of a Compose file to
+    `report`, without interpolating it. A missing required variable is
+    reported rather than raised, so that all of them are. Without a
+    `section`, the config holds top-level options.
+    """
+    interpolator = get_interpolator(version, environment, report)
+
+    def collect(obj, config_path):
+        if isinstance(obj, str):
+            try:
+                interpolator.interpolate(obj, config_path)
+            except InvalidInterpolation:
+                # Raised by the interpolation itself, with the option
+                pass
+        elif isinstance(obj, dict):
+            for key, val in obj.items():
+                collect(val, '{}/{}'.format(config_path, key))
+        elif isinstance(obj, list):
+            for val in obj:
+                collect(val, config_path)
+
+    if not isinstance(config, dict):
+        # Reported by the validation
+        return
+    for name, value in config.items():
+        collect(value, '{}/{}'.format(section, name) if section else name)
+
+
 def get_config_path(config_key, section, name):
     return '{}/{}/{}'.format(section, name, config_key)
 
@@ -68,6 +108,22 @@ def interpolate_value(name, config_key, value, section, interpolator):
         )
 
 
+def interpolate_top_level_value(version, key, value, environment):
+    """Interpolate a top-level option of a Compose file, such as `name`."""
+    try:
+        return recursive_interpolate(value, get_interpolator(version, environment), key)
+    except InvalidInterpolation as e:
+        raise ConfigurationError(
+            'Invalid interpolation format for top-level "{}": "{}"'.format(key, e.string)
+        )
+    except UnsetRequiredSubstitution as e:
+        raise ConfigurationError(
+            'Missing mandatory value for top-level "{}" interpolating {}: {}'.format(
+                key, value, e.err
+            )
+        )
+
+
 def recursive_interpolate(obj, interpolator, config_path):
     def append(config_path, key):
         return '{}/{}'.format(config_path, key)
@@ -99,30 +155,51 @@ class TemplateWithDefaults(Template):
     )
 
     @staticmethod
-    def process_braced_group(braced, sep, mapping):
+    def process_braced_group(braced, sep, mapping, record=None):
+        """Substitute a variable with a default or a required value. When
+        `record` is set, it is called with the variable, its state and its
+        value, and a missing required variable is recorded with its error
+        instead of raised.
+        """
+        note = record or (lambda *args: None)
         if ':-' == sep:
             var, _, default = braced.partition(':-')
-            return mapping.get(var) or default
+            if mapping.get(var):
+                note(var, SET, mapping.get(var))
+                return mapping.get(var)
+            note(var, DEFAULTED, default)
+            return default
         elif '-' == sep:
             var, _, default = braced.partition('-')
-            return mapping.get(var, default)
+            if var in mapping:
+                note(var, SET, mapping.get(var))
+                return mapping.get(var)
+            note(var, DEFAULTED, default)
+            return default
 
         elif ':?' == sep:
             var, _, err = braced.partition(':?')
             result = mapping.get(var)
             if not result:
-                err = err or var
-                raise UnsetRequiredSubstitution(err)
+                return TemplateWithDefaults.missing_required(var, err or var, record)
+            note(var, SET, result)
             return result
         elif '?' == sep:
             var, _, err = braced.partition('?')
             if var in mapping:
+                note(var, SET, mapping.get(var))
                 return mapping.get(var)
-            err = err or var
+            return TemplateWithDefaults.missing_required(var, err or var, record)
+
+    @staticmethod
+    def missing_required(var, err, record):
+        if record is None:
             raise UnsetRequiredSubstitution(err)
+        record(var, MISSING, '', err)
+        return ''
 
     # Modified from python2.7/string.py
-    def substitute(self, mapping):
+    def substitute(self, mapping, record=None):
         # Helper function for .sub()
 
         def convert(mo):
@@ -131,9 +208,11 @@ class TemplateWithDefaults(Template):
             if braced is not None:
                 sep = mo.group('sep')
                 if sep:
-                    return self.process_braced_group(braced, sep, mapping)
+                    return self.process_braced_group(braced, sep, mapping, record)
 
             if named is not None:
+                if record is not None:
+                    record(named, SET if named in mapping else MISSING, mapping.get(named, ''))
                 val = mapping[named]
                 if isinstance(val, bytes):
                     val = val.decode('utf-8')
@@ -147,6 +226,67 @@ class TemplateWithDefaults(Template):
         return self.pattern.sub(convert, self.template)
 
 
+SET = 'set'
+DEFAULTED = 'defaulted'
+MISSING = 'missing'
+
+# Names of variables whose value is masked in reports
+SENSITIVE_NAME = re.compile(r'PASS|SECRET|TOKEN|KEY|CREDENTIAL|AUTH|PRIVATE|CERT', re.IGNORECASE)
+
+
+def mask_sensitive(name, value):
+    """Return `value`, or asterisks if `name` looks like that of a secret."""
+    if value and SENSITIVE_NAME.search(name):
+        return '********'
+    return value
+
+
+class VariableReference(namedtuple('_VariableReference', 'name path state value error')):
+    """A reference to an environment variable in a Compose file. `path` is
+    the option it is referenced in, such as services.web.environment.
+    `error` is the error of a missing required variable.
+    """
+
+    @property
+    def masked_value(self):
+        return mask_sensitive(self.name, self.value)
+
+
+class InterpolationReport:
+    """The environment variables referenced by a project."""
+
+    def __init__(self):
+        self.references = []
+
+    def add(self, name, state, value, error=None, path=None):
+        if isinstance(value, bytes):
+            value = value.decode('utf-8')
+        self.references.append(VariableReference(name, display_path(path), state, value, error))
+
+    def check(self):
+        """Raise a ConfigurationError listing every missing required
+        variable.
+        """
+        missing = [r for r in self.references if r.error is not None]
+        if missing:
+            raise ConfigurationError(
+                'Missing mandatory values for environment variables:\n{}'.format(
+                    '\n'.join(
+                        '    {} in {}: {}'.format(r.name, r.path, r.error) for r in missing
+                    )
+                )
+            )
+
+
+def display_path(config_path):
+    if not config_path:
+        return config_path
+    section, _, rest = config_path.partition('/')
+    if rest:
+        section += 's'
+    return '.'.join([section] + rest.split('/')) if rest else section
+
+
 class InvalidInterpolation(Exception):
     def __init__(self, string):
         self.string = string
@@ -277,6 +417,7 @@ class ConversionMap:
         re_path('secret', PATH_JOKER, 'labels', FULL_JOKER): to_str,
         re_path_basic('config', 'external'): to_boolean,
         re_path('config', PATH_JOKER, 'labels', FULL_JOKER): to_str,
+        re_path('x-security-profile', 'read_only'): to_boolean,
     }
 
     def convert(self, path, value):
@@ -1,3 +1,5 @@
+from collections import OrderedDict
+
 import yaml
 
 from compose.config import types
@@ -34,6 +36,7 @@ def serialize_string_escape_dollar(dumper, data):
     return serialize_string(dumper, data)
 
 
+yaml.SafeDumper.add_representer(OrderedDict, yaml.SafeDumper.represent_dict)
 yaml.SafeDumper.add_representer(types.MountSpec, serialize_dict_type)
 yaml.SafeDumper.add_representer(types.VolumeFromSpec, serialize_config_type)
 yaml.SafeDumper.add_representer(types.VolumeSpec, serialize_config_type)
@@ -45,6 +48,8 @@ yaml.SafeDumper.add_representer(types.ServicePort, serialize_dict_type)
 
 def denormalize_config(config, image_digests=None):
     result = {'version': str(config.config_version)}
+    if config.name:
+        result['name'] = config.name
     denormalized_services = [
         denormalize_service_dict(
             service_dict,
@@ -73,6 +78,20 @@ def denormalize_config(config, image_digests=None):
 
 
 def serialize_config(config, image_digests=None, escape_dollar=True):
+    return dump_yaml(denormalize_config(config, image_digests), escape_dollar)
+
+
+def serialize_resolved_project(resolved, version, escape_dollar=True):
+    """Serialize the output of Project.resolved_config()."""
+    resolved = dict(resolved)
+    resolved['services'] = {
+        name: denormalize_service_dict(service_dict, version)
+        for name, service_dict in resolved['services'].items()
+    }
+    return dump_yaml(resolved, escape_dollar)
+
+
+def dump_yaml(data, escape_dollar=True):
     if escape_dollar:
         yaml.SafeDumper.add_representer(str, serialize_string_escape_dollar)
         yaml.SafeDumper.add_representer(str, serialize_string_escape_dollar)
@@ -80,7 +99,7 @@ def serialize_config(config, image_digests=None, escape_dollar=True):
         yaml.SafeDumper.add_representer(str, serialize_string)
         yaml.SafeDumper.add_representer(str, serialize_string)
     return yaml.safe_dump(
-        denormalize_config(config, image_digests),
+        data,
         default_flow_style=False,
         indent=2,
         width=80,
@@ -1,6 +1,7 @@
 """
 Types for objects parsed from the configuration.
 """
+import fnmatch
 import json
 import ntpath
 import os
@@ -10,6 +11,8 @@ from collections import namedtuple
 from docker.utils.ports import build_port_bindings
 
 from ..const import COMPOSEFILE_V1 as V1
+from ..utils import parse_bytes
+from ..utils import parse_seconds_float
 from ..utils import unquote_path
 from .errors import ConfigurationError
 from compose.const import IS_WINDOWS_PLATFORM
@@ -104,6 +107,22 @@ def serialize_restart_spec(restart_spec):
     return ':'.join(parts)
 
 
+PLATFORM_PATTERN = re.compile(r'^[a-z0-9_-]+(/[a-z0-9_-]+(/[a-z0-9_-]+)?)?$')
+
+
+def parse_platform(platform):
+    """Split a platform of the form os[/arch[/variant]] into an (os, arch,
+    variant) tuple, with None for the parts it leaves out.
+    """
+    if not isinstance(platform, str) or not PLATFORM_PATTERN.match(platform.lower()):
+        raise ConfigurationError(
+            'Invalid platform "{}": should be os[/arch[/variant]], such as '
+            'linux/arm64 or linux/arm/v7'.format(platform)
+        )
+    parts = platform.lower().split('/')
+    return tuple(parts + [None] * (3 - len(parts)))
+
+
 def parse_extra_hosts(extra_hosts_config):
     if not extra_hosts_config:
         return {}
@@ -155,7 +174,8 @@ class MountSpec:
             'propagation': 'propagation'
         },
         'tmpfs': {
-            'size': 'tmpfs_size'
+            'size': 'tmpfs_size',
+            'mode': 'tmpfs_mode',
         }
     }
     _fields = ['type', 'source', 'target', 'read_only', 'consistency']
@@ -184,6 +204,8 @@ class MountSpec:
 
     def as_volume_spec(self):
         mode = 'ro' if self.read_only else 'rw'
+        if self.consistency:
+            mode += ',' + self.consistency
         return VolumeSpec(external=self.source, internal=self.target, mode=mode)
 
     def legacy_repr(self):
@@ -211,8 +233,80 @@ class MountSpec:
         return self.source
 
 
+MOUNT_TYPES = ('bind', 'volume', 'tmpfs')
+
+
+def parse_mount_option(value):
+    """Parse a mount in the syntax of `docker run --mount`, such as
+    `type=tmpfs,target=/cache,tmpfs-size=64m` or
+    `type=volume,source=data,target=/data,readonly,volume-driver=local`,
+    into a MountSpec.
+    """
+    mount = {}
+    options = {}
+    for field in value.split(','):
+        key, sep, val = field.partition('=')
+        key = key.strip().lower()
+        if key in ('readonly', 'ro'):
+            if sep and val.lower() not in ('1', 'true', '0', 'false'):
+                raise ConfigurationError('invalid value for {}: {}'.format(key, val))
+            mount['read_only'] = not sep or val.lower() in ('1', 'true')
+        elif key == 'volume-nocopy':
+            options['nocopy'] = not sep or val.lower() in ('1', 'true')
+        elif not sep or not val:
+            raise ConfigurationError('invalid field "{}": expected key=value'.format(field))
+        elif key == 'type':
+            mount['type'] = val
+        elif key in ('source', 'src'):
+            mount['source'] = val
+        elif key in ('target', 'destination', 'dst'):
+            mount['target'] = val
+        elif key == 'consistency':
+            mount['consistency'] = val
+        elif key == 'bind-propagation':
+            options['propagation'] = val
+        elif key == 'tmpfs-size':
+            options['size'] = parse_bytes(val)
+            if options['size'] is None:
+                raise ConfigurationError('invalid tmpfs-size: {}'.format(val))
+        elif key == 'tmpfs-mode':
+            try:
+                options['mode'] = int(val, 8)
+            except ValueError:
+                raise ConfigurationError('invalid tmpfs-mode: {}'.format(val))
+        elif key == 'volume-driver':
+            options['driver'] = val
+        elif key == 'volume-opt':
+            opt, sep, opt_val = val.partition('=')
+            if not sep:
+                raise ConfigurationError('invalid volume-opt "{}": expected key=value'.format(val))
+            options.setdefault('driver_opts', {})[opt] = opt_val
+        else:
+            raise ConfigurationError('unknown field "{}"'.format(key))
+
+    mount.setdefault('type', 'volume')
+    if mount['type'] not in MOUNT_TYPES:
+        raise ConfigurationError('invalid type "{}": expected one of {}'.format(
+            mount['type'], ', '.join(MOUNT_TYPES)
+        ))
+    if not mount.get('target'):
+        raise ConfigurationError('target is required')
+    if mount['type'] == 'bind' and not mount.get('source'):
+        raise ConfigurationError('bind mounts require a source')
+    for key in options:
+        prefix = {'propagation': 'bind', 'size': 'tmpfs', 'mode': 'tmpfs'}.get(key, 'volume')
+        if prefix != mount['type']:
+            raise ConfigurationError('{} options are not valid for {} mounts'.format(
+                prefix, mount['type']
+            ))
+    if options:
+        mount[mount['type']] = options
+    return MountSpec.parse(mount)
+
+
 class VolumeSpec(namedtuple('_VolumeSpec', 'external internal mode')):
     win32 = False
+    consistency_modes = ('consistent', 'cached', 'delegated')
 
     @classmethod
     def _parse_unix(cls, volume_config):
@@ -279,15 +373,37 @@ class VolumeSpec(namedtuple('_VolumeSpec', 'external internal mode')):
         parts to be returned as a valid VolumeSpec.
         """
         if IS_WINDOWS_PLATFORM or win_host:
-            return cls._parse_win32(volume_config, normalize)
+            result = cls._parse_win32(volume_config, normalize)
         else:
-            return cls._parse_unix(volume_config)
+            result = cls._parse_unix(volume_config)
+
+        flags = result.mode_flags
+        if ('ro' in flags and 'rw' in flags) or len(
+                [f for f in flags if f in cls.consistency_modes]) > 1:
+            raise ConfigurationError(
+                "Volume %s has conflicting modes: %s" % (volume_config, result.mode))
+        return result
 
     def repr(self):
         external = self.external + ':' if self.external else ''
         mode = ':' + self.mode if self.external else ''
         return '{ext}{v.internal}{mode}'.format(mode=mode, ext=external, v=self)
 
+    @property
+    def mode_flags(self):
+        return (self.mode or '').split(',')
+
+    @property
+    def read_only(self):
+        return 'ro' in self.mode_flags
+
+    @property
+    def consistency(self):
+        for flag in self.mode_flags:
+            if flag in self.consistency_modes:
+                return flag
+        return None
+
     @property
     def is_named_volume(self):
         res = self.external and not self.external.startswith(('.', '/', '~'))
@@ -351,6 +467,127 @@ class ServiceConfig(ServiceConfigBase):
     pass
 
 
+class ServiceHook(namedtuple('_ServiceHook', 'command user privileged working_dir timeout')):
+    @classmethod
+    def parse(cls, spec):
+        if isinstance(spec, (str, list)):
+            spec = {'command': spec}
+        if not isinstance(spec, dict) or not spec.get('command'):
+            raise ConfigurationError(
+                'Invalid hook {!r}: hooks must define a command'.format(spec)
+            )
+        timeout = spec.get('timeout')
+        if isinstance(timeout, str):
+            timeout = parse_seconds_float(timeout)
+            if timeout is None:
+                raise ConfigurationError(
+                    'Invalid hook timeout: {}'.format(spec.get('timeout'))
+                )
+        return cls(
+            spec['command'],
+            spec.get('user'),
+            spec.get('privileged', False),
+            spec.get('working_dir'),
+            timeout,
+        )
+
+    def repr(self):
+        return {
+            k: v for k, v in zip(self._fields, self) if v is not None
+        }
+
+
+READINESS_PROBE_TYPES = ('tcp', 'http', 'exec')
+
+
+class ReadinessProbe(namedtuple(
+        '_ReadinessProbe', 'type port path status command interval timeout retries')):
+    """A readiness check run from the client, declared with `x-readiness`."""
+
+    @classmethod
+    def parse(cls, spec):
+        if not isinstance(spec, dict) or spec.get('type') not in READINESS_PROBE_TYPES:
+            raise ConfigurationError(
+                'Invalid readiness probe {!r}: type must be one of {}'.format(
+                    spec, ', '.join(READINESS_PROBE_TYPES))
+            )
+        probe_type = spec['type']
+        if probe_type == 'exec' and not spec.get('command'):
+            raise ConfigurationError('Invalid readiness probe: exec probes must define a command')
+        if probe_type != 'exec' and not isinstance(spec.get('port'), int):
+            raise ConfigurationError(
+                'Invalid readiness probe: {} probes must define a port number'.format(probe_type)
+            )
+
+        def duration(key, default):
+            value = spec.get(key, default)
+            if isinstance(value, str):
+                value = parse_seconds_float(value)
+            if not isinstance(value, (int, float)) or value < 0:
+                raise ConfigurationError(
+                    'Invalid readiness probe {}: {}'.format(key, spec.get(key))
+                )
+            return value
+
+        return cls(
+            probe_type,
+            spec.get('port'),
+            spec.get('path', '/'),
+            spec.get('status', 200),
+            spec.get('command'),
+            duration('interval', 1),
+            duration('timeout', 1),
+            spec.get('retries', 60),
+        )
+
+
+class ExternalContainer(namedtuple('_ExternalContainer', 'name optional')):
+    """A container managed outside of Compose that a service adopts,
+    declared with `x-external-container`: the name of the container, or a
+    mapping with its `name` and whether it is `optional`.
+    """
+
+    @classmethod
+    def parse(cls, spec):
+        if isinstance(spec, str) and spec:
+            return cls(spec, False)
+        if isinstance(spec, dict) and isinstance(spec.get('name'), str) and spec['name']:
+            return cls(spec['name'], bool(spec.get('optional', False)))
+        raise ConfigurationError(
+            'Invalid external container {!r}: it must be the name of a container, '
+            'or a mapping with its name'.format(spec)
+        )
+
+
+class WatchRule(namedtuple('_WatchRule', 'action path target ignore')):
+    """A rule of a service's `develop.watch` section."""
+
+    @classmethod
+    def parse(cls, spec):
+        return cls(
+            spec['action'],
+            spec['path'],
+            spec.get('target'),
+            tuple(spec.get('ignore') or ()),
+        )
+
+    def matches(self, path):
+        """Whether a change to `path` falls under the rule: it is inside the
+        rule's path and matches none of its ignore patterns, which are
+        relative to that path. `.dockerignore` plays no part here.
+        """
+        relative = os.path.relpath(path, self.path)
+        if relative == os.pardir or relative.startswith(os.pardir + os.sep):
+            return False
+        parts = relative.split(os.sep)
+        for pattern in self.ignore:
+            pattern = pattern.rstrip('/')
+            for i in range(1, len(parts) + 1):
+                if fnmatch.fnmatch('/'.join(parts[:i]), pattern):
+                    return False
+        return True
+
+
 class ServicePort(namedtuple('_ServicePort', 'target published protocol mode external_ip')):
     def __new__(cls, target, published, *args, **kwargs):
         try:
@@ -15,6 +15,7 @@ from ..const import NANOCPUS_SCALE
 from .errors import ConfigurationError
 from .errors import VERSION_EXPLANATION
 from .sort_services import get_service_name_from_network_mode
+from .types import parse_platform
 
 
 log = logging.getLogger(__name__)
@@ -263,6 +264,17 @@ def validate_credential_spec(service_config):
         )
 
 
+def validate_platform(service_config):
+    platform = service_config.config.get('platform')
+    if platform is None:
+        return
+
+    try:
+        parse_platform(platform)
+    except ConfigurationError as e:
+        raise ConfigurationError("Service '{}': {}".format(service_config.name, e.msg))
+
+
 def get_unsupported_config_msg(path, error_key):
     msg = "Unsupported config option for {}: '{}'".format(path_string(path), error_key)
     if error_key in DOCKER_CONFIG_HINTS:
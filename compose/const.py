@@ -3,6 +3,13 @@ import sys
 from .version import ComposeVersion
 
 DEFAULT_TIMEOUT = 10
+# The signal `reload` sends, on which most servers reload their configuration
+DEFAULT_RELOAD_SIGNAL = 'SIGHUP'
+# Joins the parts of the names of containers, networks, volumes and images,
+# such as <project>_<service>_<number>. Names with either of NAME_SEPARATORS
+# belong to the project.
+DEFAULT_SEPARATOR = '_'
+NAME_SEPARATORS = ('_', '-')
 HTTP_TIMEOUT = 60
 IS_WINDOWS_PLATFORM = (sys.platform == "win32")
 IS_LINUX_PLATFORM = (sys.platform == "linux")
@@ -11,13 +18,24 @@ LABEL_ONE_OFF = 'com.docker.compose.oneoff'
 LABEL_PROJECT = 'com.docker.compose.project'
 LABEL_WORKING_DIR = 'com.docker.compose.project.working_dir'
 LABEL_CONFIG_FILES = 'com.docker.compose.project.config_files'
+LABEL_CONFIG_DATA = 'com.docker.compose.project.config_data'
 LABEL_ENVIRONMENT_FILE = 'com.docker.compose.project.environment_file'
 LABEL_SERVICE = 'com.docker.compose.service'
+LABEL_TENANT = 'com.docker.compose.tenant'
 LABEL_NETWORK = 'com.docker.compose.network'
 LABEL_VERSION = 'com.docker.compose.version'
 LABEL_SLUG = 'com.docker.compose.slug'
 LABEL_VOLUME = 'com.docker.compose.volume'
 LABEL_CONFIG_HASH = 'com.docker.compose.config-hash'
+LABEL_PROJECT_CONFIG_HASH = 'com.docker.compose.project.config-hash'
+LABEL_DEPENDS_ON = 'com.docker.compose.depends_on'
+LABEL_HEALTHCHECK_OVERRIDE = 'com.docker.compose.healthcheck-override'
+LABEL_MIGRATED_FROM = 'com.docker.compose.migrated-from'
+LABEL_EPHEMERAL = 'com.docker.compose.ephemeral'
+# The project and service an image was built for. Containers inherit the
+# labels of their image, so these differ from those of the containers.
+LABEL_IMAGE_PROJECT = 'com.docker.compose.image.project'
+LABEL_IMAGE_SERVICE = 'com.docker.compose.image.service'
 NANOCPUS_SCALE = 1000000000
 PARALLEL_LIMIT = 64
 
@@ -1,17 +1,48 @@
+import datetime
+from collections import deque
+from collections import namedtuple
 from functools import reduce
 
+from docker.errors import APIError
 from docker.errors import ImageNotFound
+from docker.utils.socket import demux_adaptor
+from docker.utils.socket import frames_iter
 
+from .const import DEFAULT_SEPARATOR
+from .const import LABEL_CONFIG_HASH
 from .const import LABEL_CONTAINER_NUMBER
 from .const import LABEL_ONE_OFF
 from .const import LABEL_PROJECT
 from .const import LABEL_SERVICE
 from .const import LABEL_SLUG
 from .const import LABEL_VERSION
+from .const import NAME_SEPARATORS
+from .stats import NO_STATS
+from .utils import microseconds_from_time_nano
 from .utils import truncate_id
 from .version import ComposeVersion
 
 
+# Why the daemon may refuse to remove an unforced image that no container
+# uses: it is tagged in several repositories, or a container was just
+# created from it
+KEPT_IMAGE_ERRORS = ('referenced in multiple repositories', 'is being used by')
+
+# The events of the lifecycle of a container that ContainerEvents reports
+# by default
+LIFECYCLE_ACTIONS = ('create', 'start', 'die', 'oom', 'health_status')
+
+
+class ContainerSummary(namedtuple('ContainerSummary', [
+        'id', 'name', 'state', 'health', 'exit_code', 'image', 'image_digest',
+        'ports', 'mounts', 'networks', 'config_hash', 'number'])):
+    """The state of a service container, as needed to verify a rollout."""
+
+    def to_dict(self):
+        """A JSON-serializable dict, with its keys in field order."""
+        return dict(self._asdict())
+
+
 class Container:
     """
     Represents a Docker container, constructed from the output of
@@ -22,6 +53,10 @@ class Container:
         self.dictionary = dictionary
         self.has_been_inspected = has_been_inspected
         self.log_stream = None
+        self.stats = NO_STATS
+        # The service that adopts the container, when it is managed outside
+        # of Compose (see Service.external_containers)
+        self.external_service = None
 
     @classmethod
     def from_ps(cls, client, dictionary, **kwargs):
@@ -60,6 +95,16 @@ class Container:
     def image_config(self):
         return self.client.inspect_image(self.image)
 
+    @property
+    def platform(self):
+        """The os/arch[/variant] the container runs on, as its image reports it."""
+        image = self.image_config
+        return '/'.join(filter(None, [
+            image.get('Os') or self.get('Platform'),
+            image.get('Architecture'),
+            image.get('Variant'),
+        ]))
+
     @property
     def short_id(self):
         return self.id[:12]
@@ -74,14 +119,42 @@ class Container:
 
     @property
     def service(self):
-        return self.labels.get(LABEL_SERVICE)
+        return self.labels.get(LABEL_SERVICE) or self.external_service
 
     @property
-    def name_without_project(self):
-        if self.name.startswith('{}_{}'.format(self.project, self.service)):
-            return '{}_{}'.format(self.service, self.number if self.number is not None else self.slug)
-        else:
+    def canonical_name(self):
+        """The name Compose gives the container, `<project>_<service>_<number>`
+        (or `_run_<slug>` for one-off containers), computed from its labels.
+        Falls back to the container name when the labels are missing.
+        """
+        return self._canonical_name(DEFAULT_SEPARATOR)
+
+    def _canonical_name(self, separator):
+        if not self.project or not self.service:
             return self.name
+        if self.one_off:
+            if not self.slug:
+                return self.name
+            suffix = 'run{}{}'.format(separator, self.slug)
+        else:
+            suffix = self.labels.get(LABEL_CONTAINER_NUMBER)
+            if not suffix:
+                return self.name
+        return separator.join([self.project.lstrip('-_'), self.service, suffix])
+
+    @property
+    def name_without_project(self):
+        # Containers being recreated are temporarily renamed to
+        # <short id>_<name>. Either separator may have been used.
+        for separator in NAME_SEPARATORS:
+            prefix = separator.join([str(self.project), str(self.service)])
+            if (self.name.startswith(prefix) or
+                    self.name == '{}_{}'.format(self.short_id, self._canonical_name(separator))):
+                return '{}{}{}'.format(
+                    self.service, separator,
+                    self.number if self.number is not None else self.slug,
+                )
+        return self.name
 
     @property
     def number(self):
@@ -198,8 +271,46 @@ class Container:
             status_string += ' (%s)' % container_status
         return status_string
 
+    def summary(self, image_digest=None):
+        """Return a ContainerSummary of the inspected container."""
+        self.inspect_if_not_inspected()
+        return ContainerSummary(
+            id=self.id,
+            name=self.name,
+            state=self.get('State.Status'),
+            health=self.get('State.Health.Status'),
+            exit_code=self.exit_code,
+            image=self.get('Config.Image'),
+            image_digest=image_digest,
+            ports=sorted((
+                {
+                    'target': int(private.split('/')[0]),
+                    'protocol': private.split('/')[1],
+                    'host_ip': binding['HostIp'],
+                    'published': int(binding['HostPort']),
+                }
+                for private, bindings in self.ports.items()
+                for binding in bindings or []
+            ), key=lambda port: (port['target'], port['protocol'], port['published'])),
+            mounts=[
+                {
+                    'type': mount.get('Type'),
+                    'source': mount.get('Name') or mount.get('Source'),
+                    'destination': mount['Destination'],
+                    'read_only': not mount.get('RW', True),
+                }
+                for mount in self.get('Mounts') or []
+            ],
+            networks={
+                name: network.get('IPAddress') or None
+                for name, network in (self.get('NetworkSettings.Networks') or {}).items()
+            },
+            config_hash=self.labels.get(LABEL_CONFIG_HASH),
+            number=self.number,
+        )
+
     def attach_log_stream(self):
-        self.log_stream = self.attach(stdout=True, stderr=True, stream=True)
+        self.log_stream = self.attach(stdout=True, stderr=True, stream=True, demux=True)
 
     def get(self, key):
         """Return a value from the container or None if the value is not set.
@@ -245,6 +356,26 @@ class Container:
     def remove(self, **options):
         return self.client.remove_container(self.id, **options)
 
+    def remove_with_image(self, **options):
+        """Remove the container, then its image unless another container
+        uses it. The image is never removed by force, so one that is tagged in
+        several repositories is kept. Returns whether the image was removed.
+        """
+        self.inspect_if_not_inspected()
+        image_id = self.image
+        self.remove(**options)
+        if self.client.containers(all=True, quiet=True, filters={'ancestor': image_id}):
+            return False
+        try:
+            self.client.remove_image(image_id)
+        except ImageNotFound:
+            return False
+        except APIError as e:
+            if any(reason in str(e) for reason in KEPT_IMAGE_ERRORS):
+                return False
+            raise
+        return True
+
     def create_exec(self, command, **options):
         return self.client.exec_create(self.id, command, **options)
 
@@ -270,6 +401,29 @@ class Container:
     def logs(self, *args, **kwargs):
         return self.client.logs(self.id, *args, **kwargs)
 
+    def demuxed_logs(self, follow=False, tail='all'):
+        """Stream the logs of the container as (stdout, stderr) tuples, like
+        an attachment with `demux`. docker-py drops the stream of each frame
+        of the logs API, so the logs are replayed through an attachment,
+        which keeps both streams in order; the output of a TTY is all stdout.
+        An attachment can't tail the logs itself: the last `tail` frames are
+        kept of logs that aren't followed.
+        """
+        socket = self.client.attach_socket(self.id, params={
+            'logs': 1,
+            'stdout': 1,
+            'stderr': 1,
+            'stream': int(bool(follow)),
+        })
+        if follow:
+            # As docker-py does for streamed attachments, so that following
+            # the logs doesn't time out
+            socket.settimeout(None)
+        frames = read_demuxed_frames(socket, self.get('Config.Tty'))
+        if isinstance(tail, int) and tail >= 0 and not follow:
+            return iter(deque(frames, maxlen=tail))
+        return frames
+
     def inspect(self):
         self.dictionary = self.client.inspect_container(self.id)
         self.has_been_inspected = True
@@ -290,6 +444,12 @@ class Container:
         if not self.image_exists():
             self.dictionary['Image'] = img_id
 
+    def events(self, actions=LIFECYCLE_ACTIONS):
+        """The lifecycle events of the container, as they happen (see
+        ContainerEvents).
+        """
+        return ContainerEvents(self.client, container_ids=[self.id], actions=actions)
+
     def attach(self, *args, **kwargs):
         return self.client.attach(self.id, *args, **kwargs)
 
@@ -312,11 +472,81 @@ class Container:
 
 
 def get_container_name(container):
-    if not container.get('Name') and not container.get('Names'):
-        return None
     # inspect
-    if 'Name' in container:
+    if container.get('Name'):
         return container['Name']
-    # ps
-    shortest_name = min(container['Names'], key=lambda n: len(n.split('/')))
-    return shortest_name.split('/')[-1]
+    # ps: names are /<name>, plus /<linking container>/<alias> for each link,
+    # possibly prefixed with /<node> on Swarm classic
+    names = [n for n in container.get('Names') or [] if n.strip('/')]
+    if not names:
+        return None
+    shortest_name = min(names, key=lambda n: len(n.strip('/').split('/')))
+    return shortest_name.rstrip('/').split('/')[-1]
+
+
+class ContainerEvents:
+    """The events of containers, as they happen, filtered by the daemon on
+    the containers' IDs or labels and the event actions. Iterating yields a
+    dict for each event:
+
+        {'time': datetime, 'action': 'die', 'id': '...', 'name': 'app_web_1',
+         'exit_code': 137, 'health': None, 'attributes': {...}}
+
+    `exit_code` is set for `die` events, and `health` for `health_status`
+    events, whose action is reported as `health_status`. Stop by breaking
+    out of the loop, or by calling close(), from any thread, which ends the
+    iteration.
+    """
+
+    def __init__(self, client, container_ids=None, labels=None, actions=LIFECYCLE_ACTIONS):
+        filters = {'type': 'container', 'event': list(actions)}
+        if container_ids:
+            filters['container'] = list(container_ids)
+        if labels:
+            filters['label'] = list(labels)
+        self.stream = client.events(filters=filters, decode=True)
+
+    def __iter__(self):
+        try:
+            for event in self.stream:
+                if event.get('Type', 'container') == 'container':
+                    yield container_event(event)
+        finally:
+            self.close()
+
+    def close(self):
+        close = getattr(self.stream, 'close', None)
+        if close is not None:
+            close()
+
+
+def container_event(event):
+    attributes = event['Actor']['Attributes']
+    time = datetime.datetime.fromtimestamp(event['time'])
+    if 'timeNano' in event:
+        time = time.replace(microsecond=microseconds_from_time_nano(event['timeNano']))
+    action, _, health = (event.get('Action') or event['status']).partition(':')
+    exit_code = attributes.get('exitCode')
+    return {
+        'time': time,
+        'action': action,
+        'id': event['Actor']['ID'],
+        'name': attributes.get('name'),
+        'exit_code': int(exit_code) if exit_code is not None else None,
+        'health': health.strip() or None,
+        'attributes': {
+            k: v for k, v in attributes.items()
+            if not k.startswith('com.docker.compose.') and k not in ('exitCode', 'name')
+        },
+    }
+
+
+def read_demuxed_frames(socket, tty):
+    """Read the frames of an attachment socket as (stdout, stderr) tuples,
+    and close it when it ends.
+    """
+    try:
+        for stream_id, data in frames_iter(socket, tty):
+            yield demux_adaptor(stream_id, data)
+    finally:
+        socket.close()
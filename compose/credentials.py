@@ -0,0 +1,101 @@
+"""
+Resolution of the registry credentials used to push and pull images.
+
+Compose resolves them for every registry involved before transferring
+anything, so that a failing credential helper (a locked keychain, a
+missing docker-credential-* binary) is reported right away, along with
+the registry and the helper at fault.
+
+The credentials come from the Docker CLI configuration: DOCKER_CONFIG, or
+~/.docker/config.json. load_auth_configs replaces it with an explicit file,
+or credentials given in memory, or both.
+"""
+import json
+
+from docker import auth
+from docker.errors import DockerException
+
+from .errors import CredentialsError
+from .service import ImageReference
+
+
+class ExplicitAuthConfig(auth.AuthConfig):
+    """Credentials that never fall back to the default Docker CLI
+    configuration. The `overrides`, credentials by registry, take precedence
+    over those of the configuration, including its credential helpers.
+    """
+
+    def __init__(self, dct, overrides=None, credstore_env=None):
+        super().__init__(dct, credstore_env)
+        self.overrides = {
+            auth.resolve_index_name(registry): credentials
+            for registry, credentials in (overrides or {}).items()
+        }
+
+    @property
+    def is_empty(self):
+        # docker-py reloads the default configuration when this is empty
+        return False
+
+    def resolve_authconfig(self, registry=None):
+        registry = auth.resolve_index_name(registry) if registry else auth.INDEX_NAME
+        if registry in self.overrides:
+            return self.overrides[registry]
+        return super().resolve_authconfig(registry)
+
+
+def load_auth_configs(auth_file=None, auths=None, credstore_env=None):
+    """The registry credentials to use instead of the default Docker CLI
+    configuration, by order of precedence:
+
+    1. `auths`, credentials (`username` and `password`, or `IdentityToken`)
+       by registry;
+    2. the Docker CLI configuration file at `auth_file`, with the credential
+       helpers it sets.
+
+    The default configuration is not read, even for registries neither has
+    credentials for. Raises OSError or ValueError when `auth_file` can't be
+    read.
+    """
+    config_dict = {}
+    if auth_file:
+        with open(auth_file) as f:
+            config_dict = json.load(f)
+
+    auth_configs = auth.AuthConfig({}, credstore_env)
+    if config_dict:
+        auth_configs = auth.load_config(config_dict=config_dict, credstore_env=credstore_env)
+    return ExplicitAuthConfig(dict(auth_configs), auths, credstore_env)
+
+
+def image_registry(image):
+    registry, _ = auth.resolve_repository_name(ImageReference.parse(image).repository)
+    return registry
+
+
+def is_credential_store_error(error):
+    return str(error).startswith('Credentials store error')
+
+
+def resolve_credentials(client, registry):
+    """The credentials for `registry`, or None when there are none. Raises
+    CredentialsError when the credential helper fails.
+    """
+    try:
+        return client._auth_configs.resolve_authconfig(registry)
+    except DockerException as e:
+        helper = client._auth_configs.get_credential_store(registry)
+        if not helper or not is_credential_store_error(e):
+            raise
+        raise CredentialsError(registry, helper, e.__context__ or e)
+
+
+def check_credentials(client, images):
+    """Resolve the credentials of the registries `images` are in. Returns
+    each registry, in order, with whether there are credentials for it.
+    """
+    registries = sorted({image_registry(image) for image in images})
+    return [
+        (registry, resolve_credentials(client, registry) is not None)
+        for registry in registries
+    ]
@@ -0,0 +1,167 @@
+"""
+Ephemeral instances of a project, for test suites that run several isolated
+copies of the same project at once on one daemon:
+
+    project = ephemeral_project('app', config_data, client)
+    project.up(detached=True)
+    ...
+    sweep_ephemeral_projects(client, 'app', ttl=3600)
+
+An instance is the project named `<name>-<suffix>`, so that its containers,
+networks and volumes are named and labelled apart from those of the other
+instances, and each is managed as a project of its own. The names set with
+`container_name` and the custom names of networks and volumes get the suffix
+too. Published ports are always given a free host port by the daemon, as two
+instances can't publish the same one; `port` tells which.
+
+Every resource of an instance is labelled with LABEL_EPHEMERAL, set to the
+name of the project, for the instances left behind, such as by a crashed
+test run, to be swept once older than a TTL.
+"""
+import datetime
+import logging
+import re
+import uuid
+
+from .config.errors import ConfigurationError
+from .const import LABEL_EPHEMERAL
+from .const import LABEL_PROJECT
+from .const import LABEL_TENANT
+from .project import Project
+from .service import ImageType
+
+log = logging.getLogger(__name__)
+
+VALID_SUFFIX = re.compile(r'^[a-z0-9][a-z0-9_-]*$')
+TIMESTAMP = re.compile(r'^(\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d)(?:\.\d+)?(Z|[+-]\d\d:\d\d)?$')
+
+
+def generate_suffix():
+    return uuid.uuid4().hex[:8]
+
+
+def ephemeral_name(name, suffix):
+    if not VALID_SUFFIX.match(suffix):
+        raise ConfigurationError(
+            'Invalid ephemeral suffix "{}": it must only contain lowercase letters, digits, '
+            '"-" and "_", and start with a letter or a digit'.format(suffix)
+        )
+    return '{}-{}'.format(name, suffix)
+
+
+def ephemeral_service(service_dict, suffix):
+    service_dict = dict(service_dict)
+    if service_dict.get('ports'):
+        service_dict['ports'] = [port._replace(published=None) for port in service_dict['ports']]
+    if service_dict.get('container_name'):
+        service_dict['container_name'] = ephemeral_name(service_dict['container_name'], suffix)
+    return service_dict
+
+
+def ephemeral_resources(resources, name, suffix):
+    """The networks or volumes of the config, labelled with LABEL_EPHEMERAL
+    and their custom names suffixed. External and shared ones are left as
+    they are, as they aren't the instance's own.
+    """
+    result = {}
+    for resource_name, data in (resources or {}).items():
+        data = dict(data or {})
+        if not data.get('external') and not data.get('x-shared'):
+            data['labels'] = dict(data.get('labels') or {}, **{LABEL_EPHEMERAL: name})
+            if data.get('name'):
+                data['name'] = ephemeral_name(data['name'], suffix)
+        result[resource_name] = data
+    return result
+
+
+def ephemeral_config(config_data, name, suffix):
+    """`config_data` for the instance of the project `name` with `suffix`."""
+    networks = dict(config_data.networks or {})
+    # The default network is created even when it isn't declared
+    networks.setdefault('default', {})
+    return config_data._replace(
+        services=[ephemeral_service(service, suffix) for service in config_data.services],
+        networks=ephemeral_resources(networks, name, suffix),
+        volumes=ephemeral_resources(config_data.volumes, name, suffix),
+    )
+
+
+def ephemeral_project(name, config_data, client, suffix=None, extra_labels=None, **kwargs):
+    """A new instance of the project `name`, with `suffix`, or a generated
+    one. The other arguments are those of Project.from_config.
+    """
+    suffix = suffix or generate_suffix()
+    project = Project.from_config(
+        ephemeral_name(name, suffix),
+        ephemeral_config(config_data, name, suffix),
+        client,
+        extra_labels=list(extra_labels or []) + ['{}={}'.format(LABEL_EPHEMERAL, name)],
+        **kwargs
+    )
+    project.ephemeral_base = name
+    project.ephemeral_suffix = suffix
+    return project
+
+
+def created_time(value):
+    """The creation time the daemon reports for a resource, as a timestamp
+    for containers and in RFC 3339 for networks and volumes, as an aware
+    datetime. None if it can't be parsed.
+    """
+    if isinstance(value, (int, float)):
+        return datetime.datetime.fromtimestamp(value, datetime.timezone.utc)
+    match = TIMESTAMP.match(value or '')
+    if not match:
+        return None
+    created = datetime.datetime.strptime(match.group(1), '%Y-%m-%dT%H:%M:%S')
+    offset = match.group(2)
+    if offset and offset != 'Z':
+        sign = -1 if offset[0] == '-' else 1
+        hours, minutes = offset[1:].split(':')
+        created -= sign * datetime.timedelta(hours=int(hours), minutes=int(minutes))
+    return created.replace(tzinfo=datetime.timezone.utc)
+
+
+def find_ephemeral_projects(client, name, tenant=None):
+    """The instances of the project `name`, by name, with the time the
+    oldest of their containers, networks and volumes was created, None if
+    it isn't known.
+    """
+    labels = ['{}={}'.format(LABEL_EPHEMERAL, name)]
+    if tenant:
+        labels.append('{}={}'.format(LABEL_TENANT, tenant))
+    filters = {'label': labels}
+    resources = (
+        [(data, data.get('Created')) for data in client.containers(all=True, filters=filters)] +
+        [(data, data.get('Created')) for data in client.networks(filters=filters)] +
+        [
+            (data, data.get('CreatedAt'))
+            for data in client.volumes(filters=filters).get('Volumes') or []
+        ]
+    )
+    projects = {}
+    for data, created in resources:
+        project = (data.get('Labels') or {}).get(LABEL_PROJECT)
+        if not project:
+            continue
+        created = created_time(created)
+        oldest = projects.get(project)
+        projects[project] = created if oldest is None else min(oldest, created or oldest)
+    return projects
+
+
+def sweep_ephemeral_projects(client, name, ttl, tenant=None, now=None):
+    """Remove the containers, networks and volumes of the instances of the
+    project `name` created more than `ttl` seconds ago, or at an unknown
+    time. Returns the names of the instances removed.
+    """
+    now = now or datetime.datetime.now(datetime.timezone.utc)
+    swept = []
+    for project_name, created in sorted(find_ephemeral_projects(client, name, tenant).items()):
+        if created is not None and (now - created).total_seconds() < ttl:
+            continue
+        log.info('Removing ephemeral project {}'.format(project_name))
+        project = Project.from_containers(project_name, client, tenant)
+        project.down(ImageType.none, include_volumes=True, ignore_orphans=True)
+        swept.append(project_name)
+    return swept
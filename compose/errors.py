@@ -3,6 +3,165 @@ class OperationFailedError(Exception):
         self.msg = reason
 
 
+class ImageNotFoundError(OperationFailedError):
+    def __init__(self, image, reason):
+        super().__init__(reason)
+        self.image = image
+
+
+class PortInUseError(OperationFailedError):
+    def __init__(self, port, reason):
+        super().__init__(reason)
+        self.port = port
+
+
+class ImagePlatformMismatchError(OperationFailedError):
+    pass
+
+
+class PlatformNotSupportedError(OperationFailedError):
+    pass
+
+
+class CredentialsError(OperationFailedError):
+    def __init__(self, registry, helper, reason):
+        super().__init__(
+            'Could not get the credentials for {registry} from docker-credential-{helper}: '
+            '{reason}\nCheck that docker-credential-{helper} is installed and in the PATH, '
+            'and that the keychain it uses is unlocked.'.format(
+                registry=registry, helper=helper, reason=reason,
+            )
+        )
+        self.registry = registry
+        self.helper = helper
+
+
+class OfflineImagesMissingError(OperationFailedError):
+    def __init__(self, images):
+        super().__init__(
+            'The following images are missing and can\'t be pulled in offline mode:\n{}'.format(
+                '\n'.join('    {}'.format(image) for image in images)
+            )
+        )
+        self.images = images
+
+
+class RegistryError(OperationFailedError):
+    def __init__(self, reference, reason):
+        super().__init__('Registry error for {}: {}'.format(reference, reason))
+        self.reference = reference
+
+
+class UnsupportedFeatureError(OperationFailedError):
+    def __init__(self, api_version, requirements):
+        super().__init__(
+            'The Docker daemon, with API {}, can\'t run this project:\n{}'.format(
+                api_version,
+                '\n'.join(
+                    '    service {} requires daemon API >= {} for {}'.format(
+                        service, feature.api_version, feature.description
+                    )
+                    for service, feature in requirements
+                )
+            )
+        )
+        self.api_version = api_version
+        self.requirements = requirements
+
+
+class ImageRejectedError(OperationFailedError):
+    def __init__(self, service, image, error):
+        super().__init__('Image {} of service {} was rejected: {}'.format(image, service, error))
+        self.service = service
+        self.image = image
+        self.error = error
+
+
+class WaitTimeoutError(OperationFailedError):
+    def __init__(self, timeout, error):
+        super().__init__('Timed out after {}s: {}'.format(timeout, error))
+        self.timeout = timeout
+        self.error = error
+
+
+class PullCancelledError(OperationFailedError):
+    def __init__(self, image):
+        super().__init__('Pull of {} was cancelled'.format(image))
+        self.image = image
+
+
+class InvalidPlanError(OperationFailedError):
+    def __init__(self, reason):
+        super().__init__('Invalid plan: {}'.format(reason))
+        self.reason = reason
+
+
+class PlanDriftError(OperationFailedError):
+    def __init__(self, project, differences):
+        super().__init__(
+            'Project {} changed since the plan was made, plan again:\n{}'.format(
+                project, '\n'.join('    {}'.format(d) for d in differences)
+            )
+        )
+        self.project = project
+        self.differences = differences
+
+
+class ProjectLockedError(OperationFailedError):
+    def __init__(self, project, timeout):
+        super().__init__(
+            'Another compose operation is in progress for project "{}" '
+            '(gave up waiting after {}s). Set COMPOSE_LOCK_TIMEOUT to wait '
+            'longer.'.format(project, timeout)
+        )
+
+
+class NetworkDriverError(OperationFailedError):
+    def __init__(self, network, driver, reason):
+        super().__init__(
+            'Network {} with driver {} can\'t be created: {}'.format(network, driver, reason)
+        )
+        self.network = network
+        self.driver = driver
+
+
+class MigrationError(OperationFailedError):
+    def __init__(self, old_name, new_name, reason):
+        super().__init__(
+            'Cannot migrate project {} to {}: {}'.format(old_name, new_name, reason)
+        )
+        self.old_name = old_name
+        self.new_name = new_name
+
+
+class ExternalContainerError(OperationFailedError):
+    def __init__(self, service, container, reason):
+        super().__init__(
+            'External container {} of service {} {}'.format(container, service, reason)
+        )
+        self.service = service
+        self.container = container
+
+
+class ReloadError(OperationFailedError):
+    def __init__(self, signal, exited, restarted=()):
+        super().__init__(
+            'Containers stopped after {} was sent to reload them:\n{}'.format(
+                signal,
+                '\n'.join(
+                    ['    {} {}'.format(
+                        name,
+                        'was removed' if code is None else 'exited with code {}'.format(code),
+                    ) for name, code in exited] +
+                    ['    {} was restarted'.format(name) for name in restarted]
+                ),
+            )
+        )
+        self.signal = signal
+        self.exited = exited
+        self.restarted = list(restarted)
+
+
 class StreamParseError(RuntimeError):
     def __init__(self, reason):
         self.msg = reason
@@ -20,6 +179,13 @@ class HealthCheckFailed(HealthCheckException):
         )
 
 
+class ReadinessCheckFailed(HealthCheckFailed):
+    def __init__(self, container_name, error):
+        HealthCheckException.__init__(
+            self, 'Container "{}" is not ready: {}'.format(container_name, error)
+        )
+
+
 class NoHealthCheckConfigured(HealthCheckException):
     def __init__(self, service_name):
         super().__init__(
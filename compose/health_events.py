@@ -0,0 +1,125 @@
+"""
+Service events synthesized from the container events of a project, for
+the transitions the daemon only reports container by container.
+
+A service becomes `unhealthy` when one of its containers fails its
+healthcheck, and has `recovered` once all of those are healthy again. It
+is `flapping` when its containers restarted `restarts` times within
+`window`; a container restarts when it starts again after dying.
+"""
+import datetime
+from collections import deque
+
+FLAP_RESTARTS = 3
+FLAP_WINDOW = datetime.timedelta(seconds=60)
+
+UNHEALTHY = 'unhealthy'
+RECOVERED = 'recovered'
+FLAPPING = 'flapping'
+
+
+def service_event(event, action, **attributes):
+    return {
+        'time': event['time'],
+        'type': 'service',
+        'action': action,
+        'id': event['service'],
+        'service': event['service'],
+        'attributes': {k: str(v) for k, v in attributes.items()},
+        'container': event['container'],
+    }
+
+
+class ServiceHealth:
+    """What the container events tell of one service."""
+
+    def __init__(self):
+        self.unhealthy = set()
+        self.died = set()
+        self.restarts = deque()
+        self.flapping = False
+
+
+class EventSynthesizer:
+    """Turns the container events of a project into service events, keeping
+    the state of each service in memory.
+    """
+
+    def __init__(self, restarts=FLAP_RESTARTS, window=FLAP_WINDOW):
+        self.restarts = restarts
+        self.window = window
+        self.services = {}
+
+    def process(self, event):
+        """The service events that container `event` gives rise to."""
+        if event['type'] != 'container' or not event['service']:
+            return []
+
+        health = self.services.setdefault(event['service'], ServiceHealth())
+        container_id = event['id']
+        action = event['action']
+
+        if action.startswith('health_status:'):
+            status = action.partition(':')[2].strip()
+            if status == 'unhealthy':
+                return self._unhealthy(event, health)
+            if status == 'healthy':
+                return self._healthy(event, health)
+        elif action == 'die':
+            health.died.add(container_id)
+        elif action == 'start' and container_id in health.died:
+            health.died.discard(container_id)
+            return self._restarted(event, health)
+        elif action == 'destroy':
+            health.died.discard(container_id)
+            health.unhealthy.discard(container_id)
+        return []
+
+    def _unhealthy(self, event, health):
+        was_healthy = not health.unhealthy
+        health.unhealthy.add(event['id'])
+        if not was_healthy:
+            return []
+        return [service_event(event, UNHEALTHY, container=container_name(event))]
+
+    def _healthy(self, event, health):
+        if event['id'] not in health.unhealthy:
+            return []
+        health.unhealthy.discard(event['id'])
+        if health.unhealthy:
+            return []
+        return [service_event(event, RECOVERED, container=container_name(event))]
+
+    def _restarted(self, event, health):
+        now = event['time']
+        health.restarts.append(now)
+        while health.restarts and now - health.restarts[0] > self.window:
+            health.restarts.popleft()
+
+        if len(health.restarts) < self.restarts:
+            health.flapping = False
+            return []
+        if health.flapping:
+            return []
+        health.flapping = True
+        return [service_event(
+            event, FLAPPING,
+            restarts=len(health.restarts),
+            window='{}s'.format(int(self.window.total_seconds())),
+        )]
+
+
+def container_name(event):
+    if event['container'] is not None:
+        return event['container'].name
+    return event['attributes'].get('name', event['id'])
+
+
+def synthesize_events(events, synthesizer=None):
+    """Yield each of `events`, followed by the service events it gives
+    rise to.
+    """
+    synthesizer = synthesizer or EventSynthesizer()
+    for event in events:
+        yield event
+        yield from synthesizer.process(event)
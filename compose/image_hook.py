@@ -0,0 +1,66 @@
+"""
+A hook for programs embedding Compose to inspect each image before any
+container is created from it, such as to scan it for vulnerabilities or
+record its bill of materials:
+
+    def scan(service, image_ref, image_id):
+        report = scanner.scan(image_id)
+        if report.critical:
+            raise Exception('{} critical vulnerabilities'.format(len(report.critical)))
+
+    project.up(image_hook=scan)
+
+Project.up, build and pull call it for each service whose image is
+present locally, once it is pulled or built. On `up`, a service whose
+hook raises isn't started, nor are the services that depend on it.
+
+Each call is reported to the project's `notify` as an image
+LifecycleEvent, `checking` then `checked` or `rejected`, with its
+duration in seconds.
+"""
+import logging
+import time
+
+from . import parallel
+from .errors import ImageRejectedError
+from .lifecycle import LifecycleEvent
+from .service import NoSuchImageError
+
+log = logging.getLogger(__name__)
+
+# Hooks running at once
+IMAGE_HOOK_LIMIT = 4
+
+
+def run_image_hook(hook, services, notify=None, limit=IMAGE_HOOK_LIMIT):
+    """Call `hook` for the local image of each of `services`. Returns the
+    error of each service whose image was rejected, or couldn't be
+    inspected, by service name.
+    """
+    notify = notify or (lambda event: None)
+
+    def check(service):
+        try:
+            image_id = service.image()['Id']
+        except NoSuchImageError:
+            return
+
+        image = service.image_name
+        notify(LifecycleEvent('image', image, image_id, 'checking', None))
+        started = time.monotonic()
+        try:
+            hook(service.name, image, image_id)
+        except Exception as e:
+            duration = time.monotonic() - started
+            notify(LifecycleEvent('image', image, image_id, 'rejected', None, duration))
+            raise ImageRejectedError(service.name, image, e)
+
+        duration = time.monotonic() - started
+        log.debug('Image hook for %s took %.3fs', service.name, duration)
+        notify(LifecycleEvent('image', image, image_id, 'checked', None, duration))
+
+    return {
+        result.id.name: result.error
+        for result in parallel.parallel_batch(services, check, limit)
+        if not result.ok
+    }
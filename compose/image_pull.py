@@ -0,0 +1,61 @@
+"""
+Pulling images, with the progress of each layer:
+
+    def show(layer):
+        print(layer.id, layer.status, layer.current, layer.total)
+
+    digest = pull_image(client, 'postgres', tag='16', progress=show)
+
+Credentials are resolved by the client, from the Docker configuration of
+the registry of the image. Setting the `cancel` threading.Event stops a
+pull in progress with a PullCancelledError. The daemon keeps the layers
+already downloaded, so pulling the image again resumes from them.
+"""
+from collections import namedtuple
+
+from .errors import PullCancelledError
+from .progress_stream import get_digest_from_pull
+from .progress_stream import StreamOutputError
+from .utils import json_stream
+
+
+class LayerProgress(namedtuple('_LayerProgress', 'id current total status')):
+    """The progress of a layer of a pull. `current` and `total` are in
+    bytes, and None until the daemon reports them.
+    """
+
+    @classmethod
+    def from_event(cls, event):
+        detail = event.get('progressDetail') or {}
+        return cls(event['id'], detail.get('current'), detail.get('total'), event.get('status'))
+
+
+def pull_events(client, repository, tag=None, platform=None, progress=None, cancel=None):
+    """Pull an image and yield each event the daemon reports, decoded.
+    `progress` is called with a LayerProgress for the events about a layer.
+    An error reported by the daemon raises StreamOutputError.
+    """
+    output = client.pull(repository, tag=tag, stream=True, platform=platform)
+    try:
+        for event in json_stream(output):
+            if cancel is not None and cancel.is_set():
+                raise PullCancelledError(
+                    '{}:{}'.format(repository, tag) if tag else repository
+                )
+            if 'errorDetail' in event:
+                raise StreamOutputError(event['errorDetail']['message'])
+            if progress is not None and 'id' in event and 'progressDetail' in event:
+                progress(LayerProgress.from_event(event))
+            yield event
+    finally:
+        # Stop reading the pull rather than draining it
+        close = getattr(output, 'close', None)
+        if close is not None:
+            close()
+
+
+def pull_image(client, repository, tag=None, platform=None, progress=None, cancel=None):
+    """Pull an image, like pull_events, and return its digest."""
+    return get_digest_from_pull(
+        list(pull_events(client, repository, tag, platform, progress, cancel))
+    )
@@ -0,0 +1,159 @@
+"""
+Structured notifications of the changes Compose makes to containers,
+networks, volumes and images, for programs embedding Compose.
+
+    def notify(event):
+        print(event.kind, event.name, event.action, event.progress)
+
+    project = Project.from_config('app', config_data, client, notify=notify)
+    project.up()
+
+`notify` is called synchronously, once the Engine has carried out the
+change, from whichever thread made the API call.
+"""
+import functools
+import json
+import threading
+from collections import namedtuple
+
+from . import utils
+
+# `kind` is one of container, network, volume or image, or service for the
+# steps of a plan (see Project.apply). `progress` is the completed fraction
+# of an image pull or push, when known. `duration` is that of an image hook,
+# in seconds (see compose.image_hook).
+LifecycleEvent = namedtuple(
+    'LifecycleEvent', 'kind name id action progress duration', defaults=[None],
+)
+
+# API calls that change a resource: (kind, action)
+ACTIONS = {
+    'create_container': ('container', 'created'),
+    'start': ('container', 'started'),
+    'stop': ('container', 'stopped'),
+    'kill': ('container', 'killed'),
+    'restart': ('container', 'restarted'),
+    'pause': ('container', 'paused'),
+    'unpause': ('container', 'unpaused'),
+    'rename': ('container', 'renamed'),
+    'remove_container': ('container', 'removed'),
+    'create_network': ('network', 'created'),
+    'remove_network': ('network', 'removed'),
+    'create_volume': ('volume', 'created'),
+    'remove_volume': ('volume', 'removed'),
+    'remove_image': ('image', 'removed'),
+}
+
+# Image transfers: (status of the progress events, action while in
+# progress, action once done). A transfer that fails, or whose output isn't
+# read to the end, ends with a 'failed' action instead.
+TRANSFERS = {
+    'pull': ('Downloading', 'pulling', 'pulled'),
+    'push': ('Pushing', 'pushing', 'pushed'),
+}
+
+
+def _ref(value):
+    if isinstance(value, dict):
+        return value.get('Id')
+    return value
+
+
+class NotifyingClient:
+    """Proxy to a `docker.APIClient` that calls `notify` with a
+    LifecycleEvent after each API call that changes a resource.
+    """
+
+    def __init__(self, client, notify):
+        self.client = client
+        self.notify = notify
+        self._container_names = {}
+        self._lock = threading.Lock()
+
+    def __getattr__(self, name):
+        attr = getattr(self.client, name)
+        if name in TRANSFERS:
+            return functools.partial(self._transfer, name, attr)
+        if name in ('containers', 'inspect_container'):
+            return functools.partial(self._remember_container_names, attr)
+        if name in ACTIONS:
+            return functools.partial(self._notify_after, name, attr)
+        return attr
+
+    def _container_name(self, ref):
+        with self._lock:
+            for container_id, name in self._container_names.items():
+                if container_id.startswith(ref) or name == ref:
+                    return container_id, name
+        return ref, None
+
+    def _remember(self, container_id, name):
+        if container_id and name:
+            with self._lock:
+                self._container_names[container_id] = name.lstrip('/')
+
+    def _remember_container_names(self, method, *args, **kwargs):
+        result = method(*args, **kwargs)
+        for container in result if isinstance(result, list) else [result]:
+            if not isinstance(container, dict):
+                continue
+            names = container.get('Names') or [container.get('Name')]
+            self._remember(container.get('Id'), names[0])
+        return result
+
+    def _notify_after(self, call_name, method, *args, **kwargs):
+        result = method(*args, **kwargs)
+        kind, action = ACTIONS[call_name]
+        ref = _ref(args[0] if args else kwargs.get('container') or kwargs.get('name'))
+
+        if call_name == 'create_container':
+            resource_id, name = result['Id'], kwargs.get('name')
+            self._remember(resource_id, name)
+        elif call_name == 'rename':
+            resource_id, _ = self._container_name(ref)
+            name = args[1] if len(args) > 1 else kwargs.get('name')
+            self._remember(resource_id, name)
+        elif kind == 'container':
+            resource_id, name = self._container_name(ref)
+        elif call_name == 'create_network':
+            resource_id, name = (result or {}).get('Id'), kwargs.get('name', ref)
+        else:
+            resource_id, name = None, ref
+
+        self.notify(LifecycleEvent(kind, name, resource_id, action, None))
+        return result
+
+    def _transfer(self, call_name, method, repository, tag=None, stream=False, **kwargs):
+        name = '{}:{}'.format(repository, tag or 'latest')
+        output = method(repository, tag=tag, stream=stream, **kwargs)
+        if not stream:
+            self.notify(LifecycleEvent('image', name, None, TRANSFERS[call_name][2], 1.0))
+            return output
+        return self._transfer_progress(call_name, name, output)
+
+    def _transfer_progress(self, call_name, name, output):
+        status, action, done_action = TRANSFERS[call_name]
+        # Keyed by layer ID, as a layer is reported several times, notably
+        # when images share it, and must only count once
+        layers = {}
+        error = finished = False
+        try:
+            for event in utils.json_stream(output):
+                detail = event.get('progressDetail') or {}
+                if event.get('status') == status and detail.get('total'):
+                    layers[event.get('id')] = (detail.get('current', 0), detail['total'])
+                    current, total = (sum(values) for values in zip(*layers.values()))
+                    self.notify(LifecycleEvent('image', name, None, action, current / total))
+                error = error or 'error' in event
+                # A push ends with the digest of the image, where readers
+                # such as get_digest_from_push stop reading
+                if not error and not finished and (event.get('aux') or {}).get('Digest'):
+                    finished = True
+                    self.notify(LifecycleEvent('image', name, None, done_action, 1.0))
+                yield json.dumps(event).encode('utf-8')
+            if not error and not finished:
+                finished = True
+                self.notify(LifecycleEvent('image', name, None, done_action, 1.0))
+        finally:
+            if not finished:
+                self.notify(LifecycleEvent('image', name, None, 'failed', None))
@@ -0,0 +1,97 @@
+import hashlib
+import logging
+import os
+import time
+
+from .const import IS_WINDOWS_PLATFORM
+from .errors import ProjectLockedError
+
+if IS_WINDOWS_PLATFORM:
+    import msvcrt
+else:
+    import fcntl
+
+log = logging.getLogger(__name__)
+
+DEFAULT_LOCK_TIMEOUT = 60
+
+
+def default_lock_dir():
+    return os.path.join(os.path.expanduser('~'), '.docker', 'compose', 'locks')
+
+
+class ProjectLock:
+    """Advisory lock serializing the operations that converge or tear down a
+    project (up, down, start, stop, restart).
+
+    The lock is a file keyed by the project name and the daemon host, held
+    through an OS-level lock on its file descriptor: it is released when the
+    context exits, including on errors and Ctrl-C, and by the OS if the
+    process dies.
+    """
+
+    poll_interval = 0.1
+
+    def __init__(self, project, host, timeout=DEFAULT_LOCK_TIMEOUT, lock_dir=None):
+        self.project = project
+        self.timeout = timeout
+        host_digest = hashlib.sha256((host or '').encode('utf-8')).hexdigest()[:12]
+        self.path = os.path.join(
+            lock_dir or default_lock_dir(),
+            '{}-{}.lock'.format(project, host_digest)
+        )
+        self._file = None
+
+    def acquire(self):
+        os.makedirs(os.path.dirname(self.path), exist_ok=True)
+        lock_file = open(self.path, 'a+')
+        deadline = time.monotonic() + self.timeout
+        waiting = False
+        while True:
+            try:
+                _lock(lock_file)
+                break
+            except OSError:
+                if time.monotonic() >= deadline:
+                    lock_file.close()
+                    raise ProjectLockedError(self.project, self.timeout)
+                if not waiting:
+                    log.info(
+                        'Waiting for another compose operation on project "{}" '
+                        'to finish...'.format(self.project)
+                    )
+                    waiting = True
+                time.sleep(self.poll_interval)
+        self._file = lock_file
+
+    def release(self):
+        if self._file is None:
+            return
+        try:
+            _unlock(self._file)
+        finally:
+            self._file.close()
+            self._file = None
+
+    def __enter__(self):
+        self.acquire()
+        return self
+
+    def __exit__(self, *exc_info):
+        self.release()
+
+
+def _lock(lock_file):
+    if IS_WINDOWS_PLATFORM:
+        lock_file.seek(0)
+        msvcrt.locking(lock_file.fileno(), msvcrt.LK_NBLCK, 1)
+    else:
+        fcntl.flock(lock_file.fileno(), fcntl.LOCK_EX | fcntl.LOCK_NB)
+
+
+def _unlock(lock_file):
+    if IS_WINDOWS_PLATFORM:
+        lock_file.seek(0)
+        msvcrt.locking(lock_file.fileno(), msvcrt.LK_UNLCK, 1)
+    else:
+        fcntl.flock(lock_file.fileno(), fcntl.LOCK_UN)
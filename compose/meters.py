@@ -0,0 +1,131 @@
+"""
+Metrics of the operations of a project, for long-running programs embedding
+Compose, such as to export them to Prometheus. Pass an implementation of
+Metrics to Project.from_config:
+
+    class PrometheusMetrics(Metrics):
+        def increment(self, name, value=1, labels=None):
+            counters[name].labels(**labels).inc(value)
+
+        def observe(self, name, value, labels=None):
+            histograms[name].labels(**labels).observe(value)
+
+Every metric has an `operation` label, one of up, down, build, pull and
+push. Errors also have a `category`, the class of the error, such as
+ProjectError or APIError. Containers created or started outside of an
+operation, such as by `run`, have an empty `operation`.
+"""
+import functools
+import json
+import time
+
+from . import utils
+
+# Counters
+OPERATIONS = 'compose_operations_total'
+OPERATION_ERRORS = 'compose_operation_errors_total'
+CONTAINERS_CREATED = 'compose_containers_created_total'
+CONTAINERS_STARTED = 'compose_containers_started_total'
+PULL_BYTES = 'compose_pull_bytes_total'
+
+# Histograms, in seconds
+OPERATION_DURATION = 'compose_operation_duration_seconds'
+
+# API calls counted: counter
+CONTAINER_CALLS = {
+    'create_container': CONTAINERS_CREATED,
+    'start': CONTAINERS_STARTED,
+}
+
+
+class Metrics:
+    """Receives the metrics of a project. This implementation discards
+    them.
+    """
+
+    def increment(self, name, value=1, labels=None):
+        """Add `value` to the counter `name`."""
+
+    def observe(self, name, value, labels=None):
+        """Record `value` in the histogram `name`."""
+
+
+class MeteringClient:
+    """Proxy to a `docker.APIClient` that counts the containers created and
+    started, and the bytes of the layers pulled, for the operation in
+    progress.
+    """
+
+    def __init__(self, client, metrics):
+        self.client = client
+        self.metrics = metrics
+        self.operation = ''
+
+    def __getattr__(self, name):
+        attr = getattr(self.client, name)
+        if name in CONTAINER_CALLS:
+            return functools.partial(self._count, CONTAINER_CALLS[name], attr)
+        if name == 'pull':
+            return functools.partial(self._pull, attr)
+        return attr
+
+    def _labels(self):
+        return {'operation': self.operation}
+
+    def _count(self, counter, method, *args, **kwargs):
+        result = method(*args, **kwargs)
+        self.metrics.increment(counter, labels=self._labels())
+        return result
+
+    def _pull(self, method, *args, **kwargs):
+        output = method(*args, **kwargs)
+        if not kwargs.get('stream'):
+            return output
+        return self._pull_progress(output)
+
+    def _pull_progress(self, output):
+        # Keyed by layer ID, as a layer is reported several times
+        layers = {}
+        try:
+            for event in utils.json_stream(output):
+                detail = event.get('progressDetail') or {}
+                if event.get('status') == 'Downloading' and detail.get('total'):
+                    layers[event.get('id')] = detail['total']
+                yield json.dumps(event).encode('utf-8')
+        finally:
+            if layers:
+                self.metrics.increment(PULL_BYTES, sum(layers.values()), labels=self._labels())
+
+
+def metered(operation):
+    """Count the calls of the decorated Project method, their duration and
+    errors, and label the containers it creates and starts with
+    `operation`.
+    """
+    def decorator(fn):
+        @functools.wraps(fn)
+        def wrapper(project, *args, **kwargs):
+            metrics = project.metrics
+            if metrics is None:
+                return fn(project, *args, **kwargs)
+
+            labels = {'operation': operation}
+            client = project.client if isinstance(project.client, MeteringClient) else None
+            previous = client.operation if client else None
+            if client:
+                client.operation = operation
+            metrics.increment(OPERATIONS, labels=labels)
+            started = time.monotonic()
+            try:
+                return fn(project, *args, **kwargs)
+            except Exception as e:
+                metrics.increment(
+                    OPERATION_ERRORS, labels=dict(labels, category=type(e).__name__)
+                )
+                raise
+            finally:
+                metrics.observe(OPERATION_DURATION, time.monotonic() - started, labels)
+                if client:
+                    client.operation = previous
+        return wrapper
+    return decorator
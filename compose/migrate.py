@@ -0,0 +1,166 @@
+"""
+Migrating a project to a new name, such as after renaming its directory or
+setting its top-level `name`, which otherwise leaves all its resources
+behind, as they are named and labelled after the project:
+
+    project = Project.from_config('new', config_data, client)
+    migrate_project(project, 'old')
+
+The labels of containers, networks and volumes can't be changed. The
+containers of the old project are removed, for `up` to create them again
+under the new name. Its networks are removed and created again under the
+new name. Each of its volumes is created under the new name, its data
+copied from the old one by a helper container, and the old one removed
+only once copied.
+
+The old project must be stopped. Each step is skipped once done, so an
+interrupted migration is resumed by running it again: a volume whose copy
+was interrupted is copied again from the start, as the old one is still
+there.
+"""
+import logging
+
+from docker.errors import ImageNotFound
+from docker.errors import NotFound
+
+from .cli.utils import binarystr_to_unicode
+from .const import LABEL_MIGRATED_FROM
+from .const import LABEL_PROJECT
+from .const import LABEL_TENANT
+from .const import LABEL_VOLUME
+from .container import Container
+from .errors import MigrationError
+from .image_pull import pull_image
+from .progress_stream import StreamOutputError
+from .service import ImageReference
+
+log = logging.getLogger(__name__)
+
+MIGRATE_IMAGE = 'busybox:latest'
+# Empty the new volume, for an interrupted copy to start over, then copy the
+# old one into it, keeping ownership, permissions and times
+COPY_COMMAND = 'find /to -mindepth 1 -delete && cp -a /from/. /to/'
+
+
+def project_labels(name, tenant=None):
+    labels = ['{}={}'.format(LABEL_PROJECT, name)]
+    if tenant:
+        labels.append('{}={}'.format(LABEL_TENANT, tenant))
+    return labels
+
+
+def ensure_helper_image(client, image):
+    """Pull `image` unless it is there. An error reported by the daemon
+    raises StreamOutputError.
+    """
+    try:
+        client.inspect_image(image)
+    except ImageNotFound:
+        log.info('Pulling {}...'.format(image))
+        reference = ImageReference.parse(image)
+        pull_image(client, reference.repository, tag=reference.pull_tag)
+
+
+def copy_volume(client, source, target, image=MIGRATE_IMAGE):
+    """Replace the content of the volume `target` with that of `source`,
+    with a helper container running `image`. Returns the exit status of the
+    copy, and its output if it failed.
+    """
+    container = client.create_container(
+        image,
+        ['sh', '-c', COPY_COMMAND],
+        host_config=client.create_host_config(
+            binds=['{}:/from:ro'.format(source), '{}:/to'.format(target)],
+        ),
+    )
+    try:
+        client.start(container)
+        status = client.wait(container).get('StatusCode')
+        if status:
+            output = binarystr_to_unicode(client.logs(container, stdout=True, stderr=True))
+            return status, output.strip()
+        return 0, None
+    finally:
+        client.remove_container(container, force=True)
+
+
+def migrate_volume(project, old_project, data, image):
+    client = project.client
+    source = data['Name']
+    volume = project.volumes.volumes.get((data.get('Labels') or {}).get(LABEL_VOLUME))
+    if volume is None or volume.external:
+        log.warning(
+            'Volume {} is not a volume of project {}, leaving it as it is.'.format(
+                source, project.name)
+        )
+        return
+    if volume.full_name == source:
+        log.info('Volume {} has a custom name, leaving it as it is.'.format(source))
+        return
+
+    try:
+        existing = client.inspect_volume(volume.full_name)
+    except NotFound:
+        log.info('Creating volume {}'.format(volume.full_name))
+        volume.create(extra_labels={LABEL_MIGRATED_FROM: source})
+    else:
+        if (existing.get('Labels') or {}).get(LABEL_MIGRATED_FROM) != source:
+            raise MigrationError(
+                old_project, project.name,
+                'volume {} already exists. Remove it, if its data can be lost, for '
+                'the data of {} to be copied into it.'.format(volume.full_name, source)
+            )
+
+    log.info('Copying volume {} to {}'.format(source, volume.full_name))
+    status, output = copy_volume(client, source, volume.full_name, image)
+    if status:
+        raise MigrationError(
+            old_project, project.name,
+            'copying volume {} to {} failed with status {}: {}'.format(
+                source, volume.full_name, status, output)
+        )
+    log.info('Removing volume {}'.format(source))
+    client.remove_volume(source)
+
+
+def migrate_project(project, old_name, image=MIGRATE_IMAGE):
+    """Migrate the resources of the project `old_name` to `project`. Raises
+    MigrationError, before changing anything, if a container of the old
+    project is running. `image` is that of the helper containers that copy
+    the volumes.
+    """
+    client = project.client
+    if old_name == project.name:
+        raise MigrationError(old_name, project.name, 'the names are the same.')
+    labels = project_labels(old_name, project.tenant)
+
+    containers = [
+        Container.from_ps(client, c)
+        for c in client.containers(all=True, filters={'label': labels})
+    ]
+    running = sorted(c.name for c in containers if c.is_running)
+    if running:
+        raise MigrationError(
+            old_name, project.name,
+            'stop it first, these containers are running: {}'.format(', '.join(running))
+        )
+
+    for container in containers:
+        log.info('Removing container {}'.format(container.name))
+        container.remove()
+
+    volumes = client.volumes(filters={'label': labels}).get('Volumes') or []
+    if volumes:
+        try:
+            ensure_helper_image(client, image)
+        except StreamOutputError as e:
+            raise MigrationError(
+                old_name, project.name, 'pulling the helper image {} failed: {}'.format(image, e)
+            )
+    for data in volumes:
+        migrate_volume(project, old_name, data, image)
+
+    for data in client.networks(filters={'label': labels}):
+        log.info('Removing network {}'.format(data['Name']))
+        client.remove_network(data['Id'])
+    project.networks.initialize(warnings=project.warnings)
@@ -3,6 +3,7 @@ import re
 from collections import OrderedDict
 from operator import itemgetter
 
+from docker.errors import APIError
 from docker.errors import NotFound
 from docker.types import IPAMConfig
 from docker.types import IPAMPool
@@ -10,10 +11,17 @@ from docker.utils import version_gte
 from docker.utils import version_lt
 
 from . import __version__
+from .cli.utils import binarystr_to_unicode
 from .config import ConfigurationError
+from .const import DEFAULT_SEPARATOR
 from .const import LABEL_NETWORK
 from .const import LABEL_PROJECT
+from .const import LABEL_TENANT
 from .const import LABEL_VERSION
+from .errors import NetworkDriverError
+from .tracing import traced
+from .warning import LABEL_ADOPTION
+from .warning import Warnings
 
 
 log = logging.getLogger(__name__)
@@ -24,11 +32,42 @@ OPTS_EXCEPTIONS = [
     'com.docker.network.windowsshim.networkname'
 ]
 
+# The drivers that come with the daemon, which it lists in its info when it
+# supports them. Plugins are left for the daemon to find.
+BUILTIN_DRIVERS = ('bridge', 'host', 'ipvlan', 'macvlan', 'null', 'overlay')
+# The drivers that attach containers to an interface of the host
+PARENT_DRIVERS = ('ipvlan', 'macvlan')
+
+# Common failures to create a network, with what to do about them
+DRIVER_ERRORS = [
+    (
+        re.compile(r'parent interface was not found on the host: (\S+)'),
+        'the parent interface {0} does not exist on the host. Set the "parent" '
+        'driver option to one of its interfaces, as listed by `ip link`.',
+    ),
+    (
+        re.compile(r'is already using parent interface (\S+)'),
+        'another network already uses the parent interface {0}. Use a VLAN '
+        'sub-interface of it as parent, such as {0}.10, or remove the other network.',
+    ),
+    (
+        re.compile(r'plugin "?[^"\s]*"? ?not found|could not find plugin'),
+        'the driver is not available on this daemon. Install its plugin, or use '
+        'another driver.',
+    ),
+    (
+        re.compile(r'[Pp]ool overlaps with other one'),
+        'its subnet overlaps with that of another network. Set another subnet in '
+        'its ipam config, or remove the other network.',
+    ),
+]
+
 
 class Network:
     def __init__(self, client, project, name, driver=None, driver_opts=None,
                  ipam=None, external=False, internal=False, enable_ipv6=False,
-                 labels=None, custom_name=False):
+                 labels=None, custom_name=False, tenant=None, shared=False,
+                 separator=DEFAULT_SEPARATOR):
         self.client = client
         self.project = project
         self.name = name
@@ -40,9 +79,23 @@ class Network:
         self.enable_ipv6 = enable_ipv6
         self.labels = labels
         self.custom_name = custom_name
+        self.tenant = tenant
+        # Shared networks are used by several projects: created if missing,
+        # never labeled as any project's, and never removed
+        self.shared = shared
+        self.separator = separator
         self.legacy = None
-
-    def ensure(self):
+        # The name of the network when it was created with another separator
+        self.existing_name = None
+
+    @traced('network.ensure', lambda network, *args, **kwargs: {
+        'compose.project': network.project,
+        'network.name': network.full_name,
+    })
+    def ensure(self, warnings=None):
+        """Create the network if it is missing. Returns whether it was
+        created.
+        """
         if self.external:
             if self.driver == 'overlay':
                 # Swarm nodes do not register overlay networks that were
@@ -66,19 +119,65 @@ class Network:
                 )
             return
 
+        if self.shared:
+            return self._ensure_shared()
+
         self._set_legacy_flag()
         try:
             data = self.inspect(legacy=self.legacy)
+            if not self.owns(data):
+                raise ConfigurationError(
+                    'Network "{}" already exists and belongs to another tenant.'.format(
+                        self.true_name
+                    )
+                )
+            labels = data.get('Labels') or {}
+            if labels.get(LABEL_PROJECT) != self.project:
+                (warnings or Warnings()).warn(
+                    LABEL_ADOPTION,
+                    'Network "{}" already exists but was not created by Compose for project '
+                    '"{}". It is used as it is; declare it as external if that is '
+                    'intended.'.format(self.true_name, self.project)
+                )
             check_remote_network_config(data, self)
         except NotFound:
             driver_name = 'the default driver'
             if self.driver:
                 driver_name = 'driver "{}"'.format(self.driver)
 
+            options = ''
+            if self.driver_opts:
+                options = ' and options {}'.format(', '.join(
+                    '{}={}'.format(k, v) for k, v in sorted(self.driver_opts.items())
+                ))
+
             log.info(
-                'Creating network "{}" with {}'.format(self.full_name, driver_name)
+                'Creating network "{}" with {}{}'.format(self.full_name, driver_name, options)
             )
+            self._create()
+            return True
+        return False
 
+    def _ensure_shared(self):
+        try:
+            data = self.inspect()
+        except NotFound:
+            log.info('Creating shared network "{}"'.format(self.full_name))
+            try:
+                self._create()
+                return True
+            except APIError as e:
+                # Another project may have created it in the meantime
+                try:
+                    data = self.inspect()
+                except NotFound:
+                    raise e
+        check_remote_network_config(data, self)
+        return False
+
+    def _create(self):
+        self._check_driver()
+        try:
             self.client.create_network(
                 name=self.full_name,
                 driver=self.driver,
@@ -90,19 +189,82 @@ class Network:
                 attachable=version_gte(self.client._version, '1.24') or None,
                 check_duplicate=True,
             )
+        except APIError as e:
+            explanation = binarystr_to_unicode(e.explanation) or str(e)
+            for pattern, reason in DRIVER_ERRORS:
+                match = pattern.search(explanation)
+                if match:
+                    raise NetworkDriverError(
+                        self.full_name, self.driver or 'bridge', reason.format(*match.groups())
+                    )
+            raise
+
+    def _check_driver(self):
+        """Check what can be known about the driver of the network before
+        creating it, for errors that say what to do.
+        """
+        if self.driver not in BUILTIN_DRIVERS:
+            return
+        info = self.client.info()
+        drivers = (info.get('Plugins') or {}).get('Network')
+        if drivers is not None and self.driver not in drivers:
+            raise NetworkDriverError(
+                self.full_name, self.driver,
+                'the daemon doesn\'t support it, it supports {}.'.format(', '.join(drivers))
+            )
+        if self.driver not in PARENT_DRIVERS:
+            return
+        if not (self.driver_opts or {}).get('parent'):
+            log.warning(
+                'Network {} with driver {} has no "parent" driver option: its containers '
+                'are only reachable from each other, not from the network of the '
+                'host.'.format(self.full_name, self.driver)
+            )
+        if info.get('OperatingSystem') == 'Docker Desktop':
+            log.warning(
+                'Network {} with driver {} is created in the VM of Docker Desktop: its '
+                'containers are not reachable from the network of the host. Publish '
+                'ports instead.'.format(self.full_name, self.driver)
+            )
+
+    def differs(self):
+        """Whether the network is missing, or would have to be recreated for
+        its configuration, on the daemon. Nothing is changed.
+        """
+        if self.external or self.shared:
+            return False
+        self._set_legacy_flag()
+        try:
+            check_remote_network_config(self.inspect(legacy=self.legacy), self)
+        except (NotFound, NetworkConfigChangedError):
+            return True
+        return False
 
     def remove(self):
         if self.external:
             log.info("Network %s is external, skipping", self.true_name)
             return
 
+        if self.shared:
+            log.info("Network %s is shared with other projects, skipping", self.true_name)
+            return
+
+        if self.tenant and not self.owns(self.client.inspect_network(self.true_name)):
+            log.info("Network %s belongs to another tenant, skipping", self.true_name)
+            return
+
         log.info("Removing network {}".format(self.true_name))
         self.client.remove_network(self.true_name)
 
     def inspect(self, legacy=False):
         if legacy:
             return self.client.inspect_network(self.legacy_full_name)
-        return self.client.inspect_network(self.full_name)
+        return self.client.inspect_network(self.existing_name or self.full_name)
+
+    def owns(self, data):
+        if not self.tenant:
+            return True
+        return (data.get('Labels') or {}).get(LABEL_TENANT) == self.tenant
 
     @property
     def legacy_full_name(self):
@@ -116,25 +278,44 @@ class Network:
     def full_name(self):
         if self.custom_name:
             return self.name
-        return '{}_{}'.format(self.project, self.name)
+        return '{}{}{}'.format(self.project, self.separator, self.name)
 
     @property
     def true_name(self):
         self._set_legacy_flag()
         if self.legacy:
             return self.legacy_full_name
-        return self.full_name
+        return self.existing_name or self.full_name
+
+    def resolved_config(self):
+        """The network as `up` creates it, without looking it up."""
+        config = {
+            'name': self.full_name,
+            'driver': self.driver,
+            'driver_opts': self.driver_opts,
+            'ipam': dict(self.ipam) if self.ipam else None,
+            'external': self.external,
+            'internal': self.internal,
+            'enable_ipv6': self.enable_ipv6,
+            'labels': None if self.external else self._labels,
+            'x-shared': self.shared,
+        }
+        return {k: v for k, v in config.items() if v}
 
     @property
     def _labels(self):
         if version_lt(self.client._version, '1.23'):
             return None
+        if self.shared:
+            return self.labels
         labels = self.labels.copy() if self.labels else {}
         labels.update({
             LABEL_PROJECT: self.project,
             LABEL_NETWORK: self.name,
             LABEL_VERSION: __version__,
         })
+        if self.tenant:
+            labels[LABEL_TENANT] = self.tenant
         return labels
 
     def _set_legacy_flag(self):
@@ -145,6 +326,37 @@ class Network:
             self.legacy = data is not None
         except NotFound:
             self.legacy = False
+            self.existing_name = self._find_existing_name()
+
+    def _find_existing_name(self):
+        # A network of the project is found by its labels, whichever
+        # separator its name was made with
+        if self.custom_name or self.external:
+            return None
+        try:
+            self.client.inspect_network(self.full_name)
+            return None
+        except NotFound:
+            pass
+        labels = [
+            '{}={}'.format(LABEL_PROJECT, self.project),
+            '{}={}'.format(LABEL_NETWORK, self.name),
+        ]
+        if self.tenant:
+            labels.append('{}={}'.format(LABEL_TENANT, self.tenant))
+        for data in self.client.networks(filters={'label': labels}):
+            return data['Name']
+        return None
+
+
+def ensure_shared_network(client, name, **options):
+    """Create the network `name` unless it exists, for several projects to
+    share: it isn't labeled as any project's, so none removes it on `down`.
+    `options` are those of Network. Returns the Network.
+    """
+    network = Network(client, None, name, custom_name=True, shared=True, **options)
+    network.ensure()
+    return network
 
 
 def create_ipam_config_from_dict(ipam_dict):
@@ -235,35 +447,53 @@ def check_remote_network_config(remote, local):
             )
 
 
-def build_networks(name, config_data, client):
+def network_driver_opts(data, default_driver_opts):
+    # Networks of other projects, and networks that declare their own
+    # options, aren't subject to this project's defaults
+    if data.get('external') or data.get('x-shared') or data.get('driver_opts'):
+        return data.get('driver_opts')
+    return dict(default_driver_opts) if default_driver_opts else None
+
+
+def build_networks(name, config_data, client, tenant=None, default_driver_opts=None,
+                   separator=DEFAULT_SEPARATOR):
     network_config = config_data.networks or {}
     networks = {
         network_name: Network(
             client=client, project=name,
             name=data.get('name', network_name),
             driver=data.get('driver'),
-            driver_opts=data.get('driver_opts'),
+            driver_opts=network_driver_opts(data, default_driver_opts),
             ipam=data.get('ipam'),
             external=bool(data.get('external', False)),
             internal=data.get('internal'),
             enable_ipv6=data.get('enable_ipv6'),
             labels=data.get('labels'),
-            custom_name=data.get('name') is not None,
+            # Shared networks aren't prefixed with the project name
+            custom_name=data.get('name') is not None or bool(data.get('x-shared')),
+            tenant=tenant,
+            shared=bool(data.get('x-shared')),
+            separator=separator,
         )
         for network_name, data in network_config.items()
     }
 
     if 'default' not in networks:
-        networks['default'] = Network(client, name, 'default')
+        networks['default'] = Network(
+            client, name, 'default', driver_opts=default_driver_opts or None, tenant=tenant,
+            separator=separator,
+        )
 
     return networks
 
 
 class ProjectNetworks:
 
-    def __init__(self, networks, use_networking):
+    def __init__(self, networks, use_networking, declared=None):
         self.networks = networks or {}
         self.use_networking = use_networking
+        # Every network of the Compose file, including those no service uses
+        self.declared = declared if declared is not None else self.networks
 
     @classmethod
     def from_services(cls, services, networks, use_networking):
@@ -276,24 +506,37 @@ class ProjectNetworks:
         if unused:
             log.warning(
                 "Some networks were defined but are not used by any service: "
-                "{}".format(", ".join(unused)))
-        return cls(service_networks, use_networking)
-
-    def remove(self):
+                "{}".format(", ".join(sorted(unused))))
+        return cls(service_networks, use_networking, declared=networks)
+
+    def select(self, names=None):
+        """The networks, or only those with one of `names`, which are the
+        names the services refer to them by.
+        """
+        return [
+            network for _, network in sorted(self.networks.items())
+            if names is None or set(names) & {
+                network.full_name, network.legacy_full_name, network.existing_name,
+            }
+        ]
+
+    def remove(self, names=None):
         if not self.use_networking:
             return
-        for network in self.networks.values():
+        for network in self.select(names):
             try:
                 network.remove()
             except NotFound:
                 log.warning("Network %s not found.", network.true_name)
 
-    def initialize(self):
+    def initialize(self, names=None, warnings=None):
+        """Create the networks that are missing. Returns the names of those
+        created.
+        """
         if not self.use_networking:
-            return
+            return []
 
-        for network in self.networks.values():
-            network.ensure()
+        return [network.name for network in self.select(names) if network.ensure(warnings)]
 
 
 def get_network_defs_for_service(service_dict):
@@ -1,15 +1,19 @@
 import _thread as thread
+import itertools
 import logging
 import operator
 import sys
+from collections import namedtuple
 from queue import Empty
 from queue import Queue
+from threading import local
 from threading import Lock
 from threading import Semaphore
 from threading import Thread
 
 from docker.errors import APIError
 from docker.errors import ImageNotFound
+from docker.errors import NotFound
 
 from compose.cli.colors import AnsiMode
 from compose.cli.colors import green
@@ -20,12 +24,37 @@ from compose.errors import CompletedUnsuccessfully
 from compose.errors import HealthCheckFailed
 from compose.errors import NoHealthCheckConfigured
 from compose.errors import OperationFailedError
+from compose.tracing import propagate_context
 
 
 log = logging.getLogger(__name__)
 
 STOP = object()
 
+# The operation the progress of the current thread belongs to: the
+# parallel_execute() call it runs for, so that concurrent operations, such as
+# `up` of several projects in one process, each update their own lines
+_progress = local()
+_operation_ids = itertools.count(1)
+
+
+def current_operation():
+    return getattr(_progress, 'operation', None)
+
+
+def in_operation(operation, fn):
+    """Bind `fn` to `operation`, for it to report its progress there when
+    run in another thread.
+    """
+    def wrapper(*args, **kwargs):
+        previous = current_operation()
+        _progress.operation = operation
+        try:
+            return fn(*args, **kwargs)
+        finally:
+            _progress.operation = previous
+    return wrapper
+
 
 class GlobalLimit:
     """Simple class to hold a global semaphore limiter for a project. This class
@@ -41,7 +70,8 @@ class GlobalLimit:
         cls.global_limiter = Semaphore(value)
 
 
-def parallel_execute_watch(events, writer, errors, results, msg, get_name, fail_check):
+def parallel_execute_watch(events, writer, errors, results, msg, get_name, fail_check,
+                           done_status=None):
     """ Watch events from a parallel execution, update status and fill errors and results.
         Returns exception to re-raise.
     """
@@ -51,7 +81,8 @@ def parallel_execute_watch(events, writer, errors, results, msg, get_name, fail_
             if fail_check is not None and fail_check(obj):
                 writer.write(msg, get_name(obj), 'failed', red)
             else:
-                writer.write(msg, get_name(obj), 'done', green)
+                status = done_status(result) if done_status else 'done'
+                writer.write(msg, get_name(obj), status, green)
             results.append(result)
         elif isinstance(exception, ImageNotFound):
             # This is to bubble up ImageNotFound exceptions to the client so we
@@ -74,7 +105,8 @@ def parallel_execute_watch(events, writer, errors, results, msg, get_name, fail_
     return error_to_reraise
 
 
-def parallel_execute(objects, func, get_name, msg, get_deps=None, limit=None, fail_check=None):
+def parallel_execute(objects, func, get_name, msg, get_deps=None, limit=None, fail_check=None,
+                     done_status=None):
     """Runs func on objects in parallel while ensuring that func is
     ran on object only after it is ran on all its dependencies.
 
@@ -82,25 +114,28 @@ def parallel_execute(objects, func, get_name, msg, get_deps=None, limit=None, fa
     get_name called on object must return its name.
     fail_check is an additional failure check for cases that should display as a failure
         in the CLI logs, but don't raise an exception (such as attempting to start 0 containers)
+    done_status called on the result of func returns the status shown once it is done,
+        instead of "done"
     """
     objects = list(objects)
     stream = sys.stderr
 
     writer = ParallelStreamWriter.get_or_assign_instance(ParallelStreamWriter(stream))
 
-    for obj in objects:
-        writer.add_object(msg, get_name(obj))
-    for obj in objects:
-        writer.write_initial(msg, get_name(obj))
-
-    events = parallel_execute_iter(objects, func, get_deps, limit)
+    def watch():
+        writer.add_objects(msg, [get_name(obj) for obj in objects])
+        events = parallel_execute_iter(objects, func, get_deps, limit)
+        return parallel_execute_watch(
+            events, writer, errors, results, msg, get_name, fail_check, done_status
+        )
 
     errors = {}
     results = []
-    error_to_reraise = parallel_execute_watch(
-        events, writer, errors, results, msg, get_name, fail_check
-    )
+    error_to_reraise = in_operation(next(_operation_ids), watch)()
 
+    # Report errors in the order of the objects rather than of their completion
+    names = [get_name(obj) for obj in objects]
+    errors = {name: errors[name] for name in names if name in errors}
     for obj_name, error in errors.items():
         stream.write("\nERROR: for {}  {}\n".format(obj_name, error))
 
@@ -110,6 +145,27 @@ def parallel_execute(objects, func, get_name, msg, get_deps=None, limit=None, fa
     return results, errors
 
 
+class OperationResult(namedtuple('_OperationResult', 'id ok error value')):
+    """The outcome of an operation on one item of a batch: the item, whether
+    the operation succeeded, the exception it raised otherwise, and the value
+    it returned.
+    """
+
+
+def parallel_batch(items, func, limit=None):
+    """Run func on each of items concurrently, at most `limit` at a time,
+    without writing progress. A failure doesn't stop the other items.
+    Returns an OperationResult for each item, in the order of `items`.
+    """
+    items = list(items)
+    unique_items = list(dict.fromkeys(items))
+    outcomes = {
+        obj: OperationResult(obj, exception is None, exception, result)
+        for obj, result, exception in parallel_execute_iter(unique_items, func, None, limit)
+    }
+    return [outcomes[item] for item in items]
+
+
 def _no_deps(x):
     return []
 
@@ -133,7 +189,11 @@ class State:
         return len(self.finished) + len(self.failed) >= len(self.objects)
 
     def pending(self):
-        return set(self.objects) - self.started - self.finished - self.failed
+        """Objects not yet processed, in the order they were given."""
+        return [
+            obj for obj in self.objects
+            if obj not in self.started and obj not in self.finished and obj not in self.failed
+        ]
 
 
 class NoLimit:
@@ -233,7 +293,10 @@ def feed_queue(objects, func, get_deps, results, state, limiter):
                 ) for dep, ready_check in deps
             ):
                 log.debug('Starting producer thread for {}'.format(obj))
-                t = Thread(target=producer, args=(obj, func, results, limiter))
+                t = Thread(
+                    target=propagate_context(in_operation(current_operation(), producer)),
+                    args=(obj, func, results, limiter)
+                )
                 t.daemon = True
                 t.start()
                 state.started.add(obj)
@@ -262,7 +325,9 @@ class ParallelStreamWriter:
     """Write out messages for operations happening in parallel.
 
     Each operation has its own line, and ANSI code characters are used
-    to jump to the correct line, and write over the line.
+    to jump to the correct line, and write over the line. The lines of each
+    call of parallel_execute() are kept together, and told apart from those
+    of concurrent calls by current_operation().
     """
 
     default_ansi_mode = AnsiMode.AUTO
@@ -297,20 +362,22 @@ class ParallelStreamWriter:
         self.lines = []
         self.width = 0
 
-    def add_object(self, msg, obj_index):
+    def add_objects(self, msg, obj_indexes):
+        """Add a line for each of `obj_indexes`, and write them, at once so
+        that the lines of concurrent operations don't interleave.
+        """
         if msg is None:
             return
-        self.lines.append(msg + obj_index)
-        self.width = max(self.width, len(msg + ' ' + obj_index))
-
-    def write_initial(self, msg, obj_index):
-        if msg is None:
-            return
-        return self._write_noansi(msg, obj_index, '')
+        operation = current_operation()
+        with self.write_lock:
+            for obj_index in obj_indexes:
+                self.lines.append((operation, msg, obj_index))
+                self.width = max(self.width, len(msg + ' ' + obj_index))
+            for obj_index in obj_indexes:
+                self._write_noansi(msg, obj_index, '')
 
     def _write_ansi(self, msg, obj_index, status):
-        self.write_lock.acquire()
-        position = self.lines.index(msg + obj_index)
+        position = self.lines.index((current_operation(), msg, obj_index))
         diff = len(self.lines) - position
         # move up
         self.stream.write("%c[%dA" % (27, diff))
@@ -321,7 +388,6 @@ class ParallelStreamWriter:
         # move back down
         self.stream.write("%c[%dB" % (27, diff))
         self.stream.flush()
-        self.write_lock.release()
 
     def _write_noansi(self, msg, obj_index, status):
         self.stream.write(
@@ -334,24 +400,44 @@ class ParallelStreamWriter:
     def write(self, msg, obj_index, status, color_func):
         if msg is None:
             return
-        if self.use_ansi_codes:
-            self._write_ansi(msg, obj_index, color_func(status))
-        else:
-            self._write_noansi(msg, obj_index, status)
+        with self.write_lock:
+            if self.use_ansi_codes:
+                self._write_ansi(msg, obj_index, color_func(status))
+            else:
+                self._write_noansi(msg, obj_index, status)
 
 
-def parallel_operation(containers, operation, options, message):
+def parallel_operation(containers, operation, options, message, get_deps=None):
     parallel_execute(
         containers,
         operator.methodcaller(operation, **options),
         operator.attrgetter('name'),
         message,
+        get_deps,
     )
 
 
-def parallel_remove(containers, options):
+def ignore_missing(operation):
+    """Wrap an operation on a container so that it succeeds if the container
+    is gone, as when an interrupted or concurrent `down` removed it.
+    """
+    def run(container):
+        try:
+            return operation(container)
+        except NotFound:
+            log.debug('%s was already removed', container.name)
+    return run
+
+
+def parallel_remove(containers, options, get_deps=None):
     stopped_containers = [c for c in containers if not c.is_running]
-    parallel_operation(stopped_containers, 'remove', options, 'Removing')
+    parallel_execute(
+        stopped_containers,
+        ignore_missing(operator.methodcaller('remove', **options)),
+        operator.attrgetter('name'),
+        'Removing',
+        get_deps,
+    )
 
 
 def parallel_pause(containers, options):
@@ -0,0 +1,83 @@
+"""
+Two-phase deploys, for change-review pipelines: plan what `up` would do,
+review the plan, then apply exactly that plan.
+
+    plan = project.plan()
+    with open('plan.json', 'w') as f:
+        f.write(plan.to_json())
+
+    # Once the plan is approved
+    with open('plan.json') as f:
+        project.apply(Plan.from_json(f.read()))
+
+A plan records the state it was made from: the config hash of the project
+and of each service, and the config hash of each container. Applying it
+fails with a PlanDriftError if any of them changed since, rather than doing
+something that wasn't reviewed.
+"""
+import json
+from collections import namedtuple
+
+from .errors import InvalidPlanError
+from .utils import json_hash
+
+PLAN_VERSION = 1
+
+
+class PlanStep(namedtuple('_PlanStep', 'service action config_hash containers')):
+    """What `up` does for a service: the action of its convergence plan
+    (create, recreate, start or noop), the config hash of the service, and
+    the IDs of the containers the action applies to.
+    """
+
+    @property
+    def changes(self):
+        return self.action != 'noop'
+
+
+class Plan(namedtuple('_Plan', 'project config_hash steps state')):
+    """The steps `up` would take for a project, in dependency order, and
+    `state`, the config hash of each container of the project by ID.
+    """
+
+    @property
+    def digest(self):
+        """A hash of the content of the plan."""
+        return json_hash(self._content())
+
+    @property
+    def changes(self):
+        return any(step.changes for step in self.steps)
+
+    def _content(self):
+        return {
+            'version': PLAN_VERSION,
+            'project': self.project,
+            'config_hash': self.config_hash,
+            'steps': [step._asdict() for step in self.steps],
+            'state': self.state,
+        }
+
+    def to_json(self):
+        return json.dumps(dict(self._content(), digest=self.digest), indent=2, sort_keys=True)
+
+    @classmethod
+    def from_json(cls, text):
+        """Load a plan written by to_json(). Raises InvalidPlanError if it
+        can't be read, or was edited since.
+        """
+        try:
+            data = json.loads(text)
+            if data.get('version') != PLAN_VERSION:
+                raise InvalidPlanError('unsupported version {}'.format(data.get('version')))
+            plan = cls(
+                data['project'],
+                data['config_hash'],
+                [PlanStep(**step) for step in data['steps']],
+                data['state'],
+            )
+        except (ValueError, TypeError, KeyError, AttributeError) as e:
+            raise InvalidPlanError(e)
+        if data.get('digest') != plan.digest:
+            raise InvalidPlanError('its digest does not match its content')
+        return plan
@@ -0,0 +1,154 @@
+"""
+Live progress of Compose operations, as newline-delimited JSON, for GUIs
+and other programs driving Compose.
+
+A ProgressServer receives the LifecycleEvents of a project (pass its
+`notify` to Project.from_config) and gives each a sequence number. It
+serves them over a unix socket, and to in-process consumers through
+`subscribe()`:
+
+    {"seq": 7, "kind": "image", "name": "redis:latest", "id": null,
+     "action": "pulling", "progress": 0.42, "duration": null}
+
+A subscriber first receives a snapshot, the last event of each resource
+that hasn't been removed, then every event that follows. The terminal
+output is not affected.
+"""
+import json
+import logging
+import os
+import queue
+import socket
+import stat
+import threading
+
+log = logging.getLogger(__name__)
+
+# Sent to subscribers once the server is closed
+END = None
+
+# How long closing the server waits for each connection to send the last
+# events
+CLOSE_TIMEOUT = 5
+
+
+def event_record(seq, event):
+    record = {'seq': seq}
+    record.update(event._asdict())
+    return record
+
+
+class ProgressServer:
+
+    def __init__(self, path=None):
+        self.path = path
+        self._seq = 0
+        self._snapshot = {}
+        self._subscribers = []
+        self._lock = threading.Lock()
+        self._socket = None
+        self._threads = []
+        self._closed = False
+
+    def notify(self, event):
+        """Publish a LifecycleEvent to every subscriber."""
+        with self._lock:
+            self._seq += 1
+            record = event_record(self._seq, event)
+            key = (event.kind, event.id or event.name)
+            if event.action == 'removed':
+                self._snapshot.pop(key, None)
+            else:
+                self._snapshot[key] = record
+            for subscriber in self._subscribers:
+                subscriber.put(record)
+
+    def subscribe(self):
+        """A queue receiving the snapshot, then each event as it is
+        published, as dicts, and END once the server is closed.
+        """
+        subscriber = queue.Queue()
+        with self._lock:
+            for record in sorted(self._snapshot.values(), key=lambda r: r['seq']):
+                subscriber.put(record)
+            if self._closed:
+                subscriber.put(END)
+            else:
+                self._subscribers.append(subscriber)
+        return subscriber
+
+    def unsubscribe(self, subscriber):
+        with self._lock:
+            if subscriber in self._subscribers:
+                self._subscribers.remove(subscriber)
+
+    def start(self):
+        """Listen on the unix socket at `path`, replacing a stale one. Any
+        other file at `path` is left alone, and OSError is raised.
+        """
+        try:
+            mode = os.lstat(self.path).st_mode
+        except FileNotFoundError:
+            pass
+        else:
+            if not stat.S_ISSOCK(mode):
+                raise OSError('{} exists and is not a socket'.format(self.path))
+            os.unlink(self.path)
+        self._socket = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+        self._socket.bind(self.path)
+        self._socket.listen()
+        self._start_thread(self._accept)
+
+    def close(self):
+        """End the subscriptions, and wait for the connections to send the
+        events they haven't yet.
+        """
+        with self._lock:
+            self._closed = True
+            subscribers, self._subscribers = self._subscribers, []
+        for subscriber in subscribers:
+            subscriber.put(END)
+        if self._socket is not None:
+            try:
+                # Closing alone doesn't wake up a thread blocked accepting
+                self._socket.shutdown(socket.SHUT_RDWR)
+            except OSError:
+                pass
+            self._socket.close()
+            self._socket = None
+            if os.path.exists(self.path):
+                os.unlink(self.path)
+        # The connections accepted meanwhile are joined in turn
+        while True:
+            with self._lock:
+                threads, self._threads = self._threads, []
+            if not threads:
+                break
+            for thread in threads:
+                thread.join(CLOSE_TIMEOUT)
+
+    def _start_thread(self, target, *args):
+        thread = threading.Thread(target=target, args=args, daemon=True)
+        with self._lock:
+            self._threads.append(thread)
+        thread.start()
+
+    def _accept(self):
+        listener = self._socket
+        while True:
+            try:
+                connection, _ = listener.accept()
+            except OSError:
+                return
+            self._start_thread(self._serve, connection)
+
+    def _serve(self, connection):
+        subscriber = self.subscribe()
+        try:
+            with connection:
+                for record in iter(subscriber.get, END):
+                    connection.sendall(json.dumps(record).encode('utf-8') + b'\n')
+        except OSError as e:
+            log.debug('Progress subscriber went away: %s', e)
+        finally:
+            self.unsubscribe(subscriber)
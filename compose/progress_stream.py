@@ -14,12 +14,16 @@ def write_to_stream(s, stream):
 
 
 def stream_output(output, stream):
+    return stream_events(utils.json_stream(output), stream)
+
+
+def stream_events(events, stream):
+    """Like stream_output, for events already decoded."""
     is_terminal = hasattr(stream, 'isatty') and stream.isatty()
-    stream = stream
     lines = {}
     diff = 0
 
-    for event in utils.json_stream(output):
+    for event in events:
         yield event
         is_progress_event = 'progress' in event or 'progressDetail' in event
 
@@ -105,6 +109,16 @@ def get_digest_from_pull(events):
     return digest
 
 
+def get_download_size(events):
+    """The number of bytes downloaded for the layers of a pull."""
+    sizes = {}
+    for event in events:
+        total = (event.get('progressDetail') or {}).get('total')
+        if event.get('status') == 'Downloading' and total:
+            sizes[event.get('id')] = total
+    return sum(sizes.values())
+
+
 def get_digest_from_push(events):
     for event in events:
         digest = event.get('aux', {}).get('Digest')
@@ -3,6 +3,9 @@ import enum
 import logging
 import operator
 import re
+import time
+from collections import Counter
+from collections import namedtuple
 from functools import reduce
 from os import path
 
@@ -12,26 +15,71 @@ from docker.errors import NotFound
 from docker.utils import version_lt
 
 from . import parallel
+from .api_features import unsupported_features
 from .cli.errors import UserError
+from .cli.utils import human_readable_file_size
+from .cli.verbose_proxy import VerboseProxy
 from .config import ConfigurationError
+from .config.config import process_healthcheck
+from .config.config import ServiceConfig
 from .config.config import V1
+from .config.errors import DependencyError
+from .config.interpolation import mask_sensitive
 from .config.sort_services import get_container_name_from_network_mode
 from .config.sort_services import get_service_name_from_network_mode
+from .config.types import ExternalContainer
+from .config.types import ReadinessProbe
+from .config.types import ServiceHook
+from .config.types import WatchRule
+from .config.validation import validate_healthcheck
+from .const import DEFAULT_RELOAD_SIGNAL
+from .const import DEFAULT_SEPARATOR
+from .const import LABEL_CONFIG_HASH
+from .const import LABEL_DEPENDS_ON
+from .const import LABEL_NETWORK
 from .const import LABEL_ONE_OFF
 from .const import LABEL_PROJECT
+from .const import LABEL_PROJECT_CONFIG_HASH
 from .const import LABEL_SERVICE
+from .const import LABEL_TENANT
+from .const import LABEL_VOLUME
+from .const import NAME_SEPARATORS
 from .container import Container
+from .credentials import check_credentials
+from .errors import ImageNotFoundError
+from .errors import OfflineImagesMissingError
+from .errors import OperationFailedError
+from .errors import PlanDriftError
+from .errors import ReloadError
+from .errors import UnsupportedFeatureError
+from .health_events import synthesize_events
+from .image_hook import run_image_hook
+from .image_pull import pull_image
+from .lifecycle import LifecycleEvent
+from .lifecycle import NotifyingClient
+from .meters import metered
+from .meters import MeteringClient
 from .network import build_networks
 from .network import get_networks
+from .network import Network
 from .network import ProjectNetworks
+from .plan import Plan
+from .plan import PlanStep
+from .progress_stream import get_download_size
 from .progress_stream import read_status
+from .progress_stream import StreamOutputError
+from .readiness import probe_address
+from .retry import RetryingClient
 from .service import BuildAction
 from .service import ContainerIpcMode
 from .service import ContainerNetworkMode
 from .service import ContainerPidMode
+from .service import ConvergencePlan
 from .service import ConvergenceStrategy
+from .service import ImageReference
 from .service import IpcMode
 from .service import NetworkMode
+from .service import normalize_architecture
 from .service import NoSuchImageError
 from .service import parse_repository_tag
 from .service import PidMode
@@ -39,10 +87,28 @@ from .service import Service
 from .service import ServiceIpcMode
 from .service import ServiceNetworkMode
 from .service import ServicePidMode
+from .stats import fetch_container_stats
+from .stats import STATS_LIMIT
+from .summary import UpRecorder
+from .summary import UpResult
+from .tracing import project_attributes
+from .tracing import service_attributes
+from .tracing import span
+from .tracing import traced
 from .utils import filter_attached_for_up
+from .utils import json_hash
 from .utils import microseconds_from_time_nano
+from .utils import parse_seconds_float
 from .utils import truncate_string
+from .utils import unique_everseen
 from .volume import ProjectVolumes
+from .volume import Volume
+from .wait import check_target
+from .wait import DIAL_TIMEOUT
+from .wait import ProbeError
+from .wait import wait_for
+from .warning import ORPHANS
+from .warning import Warnings
 
 log = logging.getLogger(__name__)
 
@@ -65,12 +131,53 @@ class OneOffFilter(enum.Enum):
             raise ValueError("Invalid value for one_off: {}".format(repr(value)))
 
 
+ServiceStatus = namedtuple('ServiceStatus', 'name running desired state')
+
+# The statuses Project.ps filters containers by: those of the Engine,
+# `stopped` for any container that isn't running, and `restarted`, as the
+# help of `ps` has it, for `restarting`
+CONTAINER_STATUSES = (
+    'created', 'running', 'paused', 'restarting', 'removing', 'exited', 'dead', 'stopped',
+    'restarted',
+)
+
+# The orders Project.ps sorts containers in. Names are unique, which makes
+# each order deterministic.
+PS_SORT_KEYS = {
+    'name': lambda c: c.name,
+    'status': lambda c: (c.get('State.Status') or '', c.name),
+    'replicas': lambda c: (c.service or '', c.number or 0, c.name),
+}
+
+
+class DriftReport(namedtuple('_DriftReport', [
+        'config_hash', 'recorded_hash', 'added', 'removed', 'changed', 'networks', 'volumes'])):
+    """How the project differs from what runs: the hash of the project and
+    the one recorded by the last `up`, the names of the services without
+    containers, of those whose containers are left from services no longer
+    in the project, and of those whose containers are out of date, and the
+    names of the networks and volumes missing or to be recreated.
+
+    Only the containers `up` creates record the hash of the project, as
+    networks and volumes are never updated once created. Containers from
+    before the hash was recorded have none, and are only told by their
+    services.
+    """
+
+    @property
+    def drifted(self):
+        return bool(
+            (self.recorded_hash is not None and self.config_hash != self.recorded_hash) or
+            self.added or self.removed or self.changed or self.networks or self.volumes
+        )
+
+
 class Project:
     """
     A collection of services.
     """
     def __init__(self, name, services, client, networks=None, volumes=None, config_version=None,
-                 enabled_profiles=None):
+                 enabled_profiles=None, tenant=None, warnings=None, notify=None, metrics=None):
         self.name = name
         self.services = services
         self.client = client
@@ -78,31 +185,91 @@ class Project:
         self.networks = networks or ProjectNetworks({}, False)
         self.config_version = config_version
         self.enabled_profiles = enabled_profiles or []
+        self.tenant = tenant
+        self.warnings = warnings or Warnings()
+        self.notify = notify
+        self.metrics = metrics
+        # The name of the project this is an ephemeral instance of, and the
+        # suffix of the instance (see compose.ephemeral)
+        self.ephemeral_base = None
+        self.ephemeral_suffix = None
 
     def labels(self, one_off=OneOffFilter.exclude, legacy=False):
         name = self.name
         if legacy:
             name = re.sub(r'[_-]', '', name)
         labels = ['{}={}'.format(LABEL_PROJECT, name)]
+        if self.tenant:
+            labels.append('{}={}'.format(LABEL_TENANT, self.tenant))
 
         OneOffFilter.update_labels(one_off, labels)
         return labels
 
     @classmethod
     def from_config(cls, name, config_data, client, default_platform=None, extra_labels=None,
-                    enabled_profiles=None):
+                    enabled_profiles=None, api_logger=None, tenant=None,
+                    network_driver_opts=None, notify=None, retry_policy=None, warnings=None,
+                    metrics=None, default_bind_ip=None, separator=DEFAULT_SEPARATOR):
         """
         Construct a Project from a config.Config object.
+
+        When `api_logger` is set, every Docker API call made for the project
+        is logged to it at debug level, with its arguments, duration and
+        result or error.
+
+        When `tenant` is set, every container, network, volume and image
+        created for the project is labelled with it, and only resources with
+        the same label are listed or removed. This keeps identically named
+        projects of different tenants on a shared daemon apart.
+
+        `network_driver_opts` are default driver options (such as the MTU)
+        for the networks created for the project that set no options of
+        their own.
+
+        `notify` is called with a LifecycleEvent for each container, network,
+        volume and image the project creates, changes or removes (see
+        compose.lifecycle).
+
+        `retry_policy` is a RetryPolicy setting the timeout of each API call
+        and how calls failing on a flaky connection are retried (see
+        compose.retry).
+
+        `warnings` is where the project reports the warnings that can be
+        silenced (see compose.warning).
+
+        `metrics` is a Metrics receiving counts and durations of the
+        operations of the project (see compose.meters).
+
+        Published ports that don't set a host IP are bound to
+        `default_bind_ip`, such as 127.0.0.1, rather than to every interface.
+
+        `separator` joins the parts of the names of the containers, networks,
+        volumes and images of the project, such as `-` for DNS-friendly names.
+        Resources are found by their labels, so those named with another
+        separator, before it changed, are still managed.
         """
+        if retry_policy is not None:
+            client = RetryingClient(client, retry_policy)
+        if notify is not None:
+            client = NotifyingClient(client, notify)
+        if api_logger is not None:
+            client = VerboseProxy('docker', client, log_name=api_logger.name, level=logging.DEBUG)
+        if metrics is not None:
+            client = MeteringClient(client, metrics)
         extra_labels = extra_labels or []
         use_networking = (config_data.version and config_data.version != V1)
-        networks = build_networks(name, config_data, client)
+        networks = build_networks(
+            name, config_data, client, tenant, network_driver_opts, separator,
+        )
         project_networks = ProjectNetworks.from_services(
             config_data.services,
             networks,
             use_networking)
-        volumes = ProjectVolumes.from_config(name, config_data, client)
-        project = cls(name, [], client, project_networks, volumes, config_data.version, enabled_profiles)
+        volumes = ProjectVolumes.from_config(name, config_data, client, tenant, separator)
+        project = cls(
+            name, [], client, project_networks, volumes, config_data.version, enabled_profiles,
+            tenant, warnings, notify, metrics,
+        )
 
         for service_dict in config_data.services:
             service_dict = dict(service_dict)
@@ -131,6 +298,21 @@ class Project:
                 service_dict.pop('secrets', None) or [],
                 config_data.secrets)
 
+            hooks = get_hooks(service_dict['name'], service_dict.pop('x-hooks', None) or {})
+            readiness = get_readiness_probe(
+                service_dict['name'], service_dict.pop('x-readiness', None)
+            )
+            external_container = get_external_container(
+                service_dict['name'], service_dict.pop('x-external-container', None)
+            )
+            drain_seconds = get_drain_seconds(
+                service_dict['name'], service_dict.pop('x-drain-seconds', None)
+            )
+            watch = [
+                WatchRule.parse(rule)
+                for rule in (service_dict.pop('develop', None) or {}).get('watch', [])
+            ]
+
             service_dict['scale'] = project.get_service_scale(service_dict)
             service_dict['device_requests'] = project.get_device_requests(service_dict)
             service_dict = translate_credential_spec_to_security_opt(service_dict)
@@ -158,16 +340,114 @@ class Project:
                     ipc_mode=ipc_mode,
                     platform=service_dict.pop('platform', None),
                     default_platform=default_platform,
+                    default_bind_ip=default_bind_ip,
                     extra_labels=extra_labels,
+                    hooks=hooks,
+                    tenant=tenant,
+                    separator=separator,
+                    readiness=readiness,
+                    watch=watch,
+                    external_container=external_container,
+                    drain_seconds=drain_seconds,
                     **service_dict)
             )
 
         return project
 
+    @classmethod
+    def from_containers(cls, name, client, tenant=None):
+        """
+        Construct a Project from the labels of its containers, networks and
+        volumes, for when its Compose file is gone. Only the services that
+        have containers are known, with the dependencies recorded when their
+        containers were created, which is enough to stop and remove them.
+
+        The labels are merged across all the containers listed, none of which
+        is inspected, so that containers removed meanwhile, such as by an
+        interrupted `down`, don't matter.
+        """
+        project = cls(name, [], client, tenant=tenant)
+        dependencies = {}
+        images = {}
+        filters = {'label': project.labels(one_off=OneOffFilter.include)}
+        for data in client.containers(all=True, filters=filters):
+            labels = data.get('Labels') or {}
+            service_name = labels.get(LABEL_SERVICE)
+            if not service_name:
+                continue
+            if data.get('Image'):
+                images.setdefault(service_name, data['Image'])
+            dependencies.setdefault(service_name, set()).update(
+                filter(None, labels.get(LABEL_DEPENDS_ON, '').split(','))
+            )
+
+        for service_name in sorted(dependencies):
+            project.services.append(Service(
+                service_name,
+                client=client,
+                project=name,
+                tenant=tenant,
+                image=images.get(service_name),
+                depends_on={
+                    dep: {'condition': 'service_started'}
+                    for dep in dependencies[service_name] if dep in dependencies
+                },
+            ))
+
+        networks = {}
+        for data in client.networks(filters=filters):
+            net_name = data['Labels'][LABEL_NETWORK]
+            separator = generated_name_separator(data['Name'], name, net_name)
+            networks[net_name] = Network(
+                client, name, net_name if separator else data['Name'],
+                custom_name=not separator, tenant=tenant,
+                separator=separator or DEFAULT_SEPARATOR,
+            )
+        project.networks = ProjectNetworks(networks, bool(networks))
+
+        volumes = {}
+        for data in client.volumes(filters=filters).get('Volumes') or []:
+            vol_name = data['Labels'][LABEL_VOLUME]
+            separator = generated_name_separator(data['Name'], name.lstrip('-_'), vol_name)
+            volumes[vol_name] = Volume(
+                client, name, vol_name if separator else data['Name'],
+                custom_name=not separator, tenant=tenant,
+                separator=separator or DEFAULT_SEPARATOR,
+            )
+        project.volumes = ProjectVolumes(volumes)
+        return project
+
     @property
     def service_names(self):
         return [service.name for service in self.services]
 
+    def resolved_config(self, service_names=None, image_digests=None):
+        """
+        The project as `up` acts on it, after profile filtering, default
+        network creation, name prefixing, label injection and platform
+        resolution, read from the same services, networks and volumes that
+        `up` uses. Only `image_digests` (see get_image_digests) needs the
+        daemon, and it is up to the caller to look them up.
+        """
+        services = {}
+        for service in self.get_services(service_names):
+            services[service.name] = service.resolved_config()
+            if image_digests:
+                services[service.name]['image'] = image_digests[service.name]
+
+        return {
+            'name': self.name,
+            'services': services,
+            'networks': {
+                name: network.resolved_config()
+                for name, network in self.networks.networks.items()
+            },
+            'volumes': {
+                name: volume.resolved_config()
+                for name, volume in self.volumes.volumes.items()
+            },
+        }
+
     def get_service(self, name):
         """
         Retrieve a service by name. Raises NoSuchService
@@ -177,7 +457,7 @@ class Project:
             if service.name == name:
                 return service
 
-        raise NoSuchService(name)
+        raise NoSuchService(name, self.service_names)
 
     def validate_service_names(self, service_names):
         """
@@ -187,7 +467,7 @@ class Project:
         valid_names = self.service_names
         for name in service_names:
             if name not in valid_names:
-                raise NoSuchService(name)
+                raise NoSuchService(name, valid_names)
 
     def get_services(self, service_names=None, include_deps=False, auto_enable_profiles=True):
         """
@@ -407,8 +687,14 @@ class Project:
 
         return containers
 
-    def stop(self, service_names=None, one_off=OneOffFilter.exclude, **options):
+    def stop(self, service_names=None, one_off=OneOffFilter.exclude, force=False, **options):
+        """Stop the containers of the given services, the services that
+        depend on others first. Unless `force` is set, warns about the running
+        services left that depend on one of them.
+        """
         containers = self.containers(service_names, one_off=one_off)
+        if service_names and not force:
+            self.warn_running_dependents({c.service for c in containers})
 
         def get_deps(container):
             # actually returning inversed dependencies
@@ -418,7 +704,7 @@ class Project:
 
         parallel.parallel_execute(
             containers,
-            self.build_container_operation_with_timeout_func('stop', options),
+            parallel.ignore_missing(self.build_container_operation_with_timeout_func('stop', options)),
             operator.attrgetter('name'),
             'Stopping',
             get_deps,
@@ -437,32 +723,138 @@ class Project:
     def kill(self, service_names=None, **options):
         parallel.parallel_kill(self.containers(service_names), options)
 
+    def reload(self, service_names=None, signal=DEFAULT_RELOAD_SIGNAL, settle=None):
+        """Send `signal` to the running containers of the services, for them
+        to reload their configuration without being restarted. With `settle`,
+        wait that many seconds, then raise ReloadError if any of them exited,
+        or was restarted by its restart policy meanwhile. Returns the
+        containers signalled.
+        """
+        service_names = [s.name for s in self.get_services(service_names)]
+        containers = self.containers(service_names)
+        starts = {c.id: container_start(c) for c in containers} if settle else {}
+        _, errors = parallel.parallel_execute(
+            containers,
+            operator.methodcaller('kill', signal=signal),
+            operator.attrgetter('name'),
+            'Reloading',
+        )
+        if errors:
+            raise ProjectError('Could not reload {}:\n{}'.format(
+                ', '.join(sorted(errors)),
+                '\n'.join(
+                    '    {}: {}'.format(name, e.decode('utf-8') if isinstance(e, bytes) else e)
+                    for name, e in sorted(errors.items())
+                ),
+            ))
+
+        if settle and containers:
+            time.sleep(settle)
+            exited = []
+            restarted = []
+            for container in containers:
+                try:
+                    container.inspect()
+                except NotFound:
+                    exited.append((container.name, None))
+                    continue
+                if not container.is_running:
+                    exited.append((container.name, container.exit_code))
+                elif container_start(container) != starts[container.id]:
+                    restarted.append(container.name)
+            if exited or restarted:
+                raise ReloadError(signal, exited, restarted)
+        return containers
+
     def remove_stopped(self, service_names=None, one_off=OneOffFilter.exclude, **options):
-        parallel.parallel_remove(self.containers(
-            service_names, stopped=True, one_off=one_off
-        ), options)
+        containers = self.containers(service_names, stopped=True, one_off=one_off)
+
+        def get_deps(container):
+            # containers are removed after the ones sharing their namespaces
+            return {(other, None) for other in containers
+                    if container.service in
+                    self.get_service(other.service).get_namespace_dependency_names()}
+
+        parallel.parallel_remove(containers, options, get_deps)
+
+    def stop_containers(self, identifiers, timeout=None, limit=None):
+        """Stop the containers of the project that `identifiers` designate
+        (see find_container()), at most `limit` at a time. Returns an
+        OperationResult per identifier, in the same order; a container that
+        can't be found or stopped doesn't prevent stopping the others.
+        """
+        stop = self.build_container_operation_with_timeout_func('stop', {'timeout': timeout})
+        containers = self._project_containers(stopped=True)
+
+        def stop_container(identifier):
+            stop(self._resolve_container(containers, identifier))
+
+        return parallel.parallel_batch(identifiers, stop_container, limit)
+
+    def remove_containers(self, identifiers, force=False, limit=None, remove_image=False):
+        """Remove the containers of the project that `identifiers` designate,
+        like stop_containers(). Running containers are only removed with
+        `force`. With `remove_image`, the image of each container is removed
+        too once no other container uses it, and the `value` of its
+        OperationResult tells whether it was.
+        """
+        containers = self._project_containers(stopped=True)
 
+        def remove_container(identifier):
+            container = self._resolve_container(containers, identifier)
+            if remove_image:
+                return container.remove_with_image(force=force)
+            container.remove(force=force)
+            return False
+
+        return parallel.parallel_batch(identifiers, remove_container, limit)
+
+    @traced('compose.down', project_attributes)
+    @metered('down')
     def down(
             self,
             remove_image_type,
             include_volumes,
             remove_orphans=False,
             timeout=None,
-            ignore_orphans=False):
-        self.stop(one_off=OneOffFilter.include, timeout=timeout)
+            ignore_orphans=False,
+            service_names=None,
+            force=False):
+        """Remove the containers, networks and, with `include_volumes`, the
+        volumes of the project. Given `service_names`, only those of the
+        services are removed, keeping the networks and volumes that other
+        services use.
+        """
+        self.stop(service_names, one_off=OneOffFilter.include, force=force, timeout=timeout)
         if not ignore_orphans:
             self.find_orphan_containers(remove_orphans)
-        self.remove_stopped(v=include_volumes, one_off=OneOffFilter.include)
+        self.remove_stopped(service_names, v=include_volumes, one_off=OneOffFilter.include)
 
-        self.networks.remove()
+        if not service_names:
+            self.networks.remove()
+            if include_volumes:
+                self.volumes.remove()
+            self.remove_images(remove_image_type)
+            return
+
+        services = self.get_services(service_names)
+        networks, volumes = self.resources_used_by(services)
+        remaining_networks, remaining_volumes = self.resources_used_by(
+            [service for service in self.services if service not in services]
+        )
+        for name in sorted(networks & remaining_networks):
+            log.info("Network %s is still used by other services, not removing it", name)
+        self.networks.remove(networks - remaining_networks)
 
         if include_volumes:
-            self.volumes.remove()
+            for name in sorted(volumes & remaining_volumes):
+                log.info("Volume %s is still used by other services, not removing it", name)
+            self.volumes.remove(volumes - remaining_volumes)
 
-        self.remove_images(remove_image_type)
+        self.remove_images(remove_image_type, services)
 
-    def remove_images(self, remove_image_type):
-        for service in self.services:
+    def remove_images(self, remove_image_type, services=None):
+        for service in self.services if services is None else services:
             service.remove_image(remove_image_type)
 
     def restart(self, service_names=None, **options):
@@ -478,9 +870,14 @@ class Project:
         )
         return containers
 
+    @traced('compose.build', project_attributes)
+    @metered('build')
     def build(self, service_names=None, no_cache=False, pull=False, force_rm=False, memory=None,
               build_args=None, gzip=False, parallel_build=False, rm=True, silent=False, cli=False,
-              progress=None):
+              progress=None, prune_dangling=False, image_hook=None):
+        """Build the images of the services. `image_hook` is called for each
+        image built (see compose.image_hook).
+        """
 
         services = []
         for service in self.get_services(service_names):
@@ -497,15 +894,25 @@ class Project:
                 log.warning("Flag '--compress' is ignored when building with "
                             "COMPOSE_DOCKER_CLI_BUILD=1")
 
+        build_deps = self.get_build_dependencies(services, build_args)
+        services = sort_for_build(services, build_deps)
+        previous_images = self.built_images(services) if prune_dangling else {}
+
         def build_service(service):
             service.build(no_cache, pull, force_rm, memory, build_args, gzip, rm, silent, cli, progress)
 
+        def get_deps(service):
+            return {
+                (other, None) for other in services if other.name in build_deps[service.name]
+            }
+
         if parallel_build:
             _, errors = parallel.parallel_execute(
                 services,
                 build_service,
                 operator.attrgetter('name'),
                 'Building',
+                get_deps,
                 limit=5,
             )
             if len(errors):
@@ -518,6 +925,62 @@ class Project:
             for service in services:
                 build_service(service)
 
+        self.remove_dangling_images(previous_images)
+        self.check_images(services, image_hook)
+
+    def get_build_dependencies(self, services, build_args=None):
+        """The names of the services each of `services` must be built after:
+        those listed in its `x-build-depends-on`, and those whose image its
+        Dockerfile uses. Raises DependencyError on a cycle.
+        """
+        built = {
+            normalize_image_name(service.image_name): service.name
+            for service in self.services if service.can_be_built()
+        }
+        dependencies = {}
+        for service in self.services:
+            if not service.can_be_built():
+                continue
+            names = set(service.options.get('x-build-depends-on') or [])
+            for name in sorted(names - set(self.service_names)):
+                raise ConfigurationError(
+                    'Service "{}" has x-build-depends-on "{}", which is not a service'.format(
+                        service.name, name
+                    )
+                )
+            names.update(
+                built[image] for image in map(
+                    normalize_image_name, service.build_base_images(build_args)
+                ) if image in built
+            )
+            names.discard(service.name)
+            dependencies[service.name] = names
+
+        check_build_cycles(dependencies)
+        return {service.name: dependencies.get(service.name, set()) for service in services}
+
+    def built_images(self, services):
+        """Return the current image ID of each service that can be built."""
+        return {
+            service.name: service.image_id()
+            for service in services if service.can_be_built()
+        }
+
+    def remove_dangling_images(self, previous_images):
+        """Remove the images in `previous_images` that were replaced by a
+        rebuild and are no longer used. Returns the bytes reclaimed.
+        """
+        reclaimed = 0
+        for name, image_id in sorted(previous_images.items()):
+            service = self.get_service(name)
+            if image_id and image_id != service.image_id():
+                reclaimed += service.remove_dangling_image(image_id)
+        if reclaimed:
+            log.info('Reclaimed {} from dangling images'.format(
+                human_readable_file_size(reclaimed)
+            ))
+        return reclaimed
+
     def create(
         self,
         service_names=None,
@@ -577,7 +1040,14 @@ class Project:
                 continue
             yield build_container_event(event, container)
 
-    def events(self, service_names=None):
+    def events(self, service_names=None, synthesize=False):
+        """The events of the containers of the given services. With
+        `synthesize`, each one is followed by the service events it gives
+        rise to (see compose.health_events).
+        """
+        if synthesize:
+            return synthesize_events(self.events(service_names))
+
         if version_lt(self.client.api_version, '1.22'):
             # New, better event API was introduced in 1.22.
             return self._legacy_event_processor(service_names)
@@ -627,6 +1097,8 @@ class Project:
 
         return yield_loop(set(service_names) if service_names else self.service_names)
 
+    @traced('compose.up', project_attributes)
+    @metered('up')
     def up(self,
            service_names=None,
            start_deps=True,
@@ -647,22 +1119,64 @@ class Project:
            one_off=False,
            attach_dependencies=False,
            override_options=None,
+           env_files=None,
+           prune_dangling=False,
+           strict_platform=False,
+           pull=False,
+           offline=False,
+           image_hook=None,
+           convergence_plans=None,
            ):
-
-        self.initialize()
+        """Create and start the containers of the given services. `offline`
+        guarantees that no image is pulled: images that are missing and can't
+        be built are reported before anything is created. `image_hook` is
+        called for the image of each service before its containers are
+        created, and a service whose image it rejects isn't started, nor are
+        its dependents (see compose.image_hook). `convergence_plans`, by
+        service name, are carried out instead of those `up` would compute
+        (see apply()). Returns an UpResult: the containers, with an UpSummary
+        of what was done (see compose.summary).
+        """
+        recorder = UpRecorder()
+        services = self.get_services_without_duplicate(
+            service_names,
+            include_deps=start_deps)
+        if not start_deps:
+            self.warn_missing_dependencies(services)
+        self.check_api_features(services)
+        self.check_external_containers(services)
+        # The containers adopted with x-external-container have no image to get
+        image_services = [service for service in services if not service.external_container]
+        if offline:
+            self.check_offline_images(image_services, do_build)
+
+        recorder.networks, recorder.volumes = self.initialize(services if service_names else None)
         if not ignore_orphans:
             self.find_orphan_containers(remove_orphans)
 
         if scale_override is None:
             scale_override = {}
 
-        services = self.get_services_without_duplicate(
-            service_names,
-            include_deps=start_deps)
+        for service_name, service_env_files in (env_files or {}).items():
+            self.get_service(service_name).apply_env_files(service_env_files)
 
-        for svc in services:
-            svc.ensure_image_exists(do_build=do_build, silent=silent, cli=cli)
-        plans = self._get_convergence_plans(
+        config_hash = self.config_hash()
+        for service in self.services:
+            service.project_config_hash = config_hash
+
+        previous_images = self.built_images(image_services) if prune_dangling else {}
+        for svc in sort_for_build(image_services, self.get_build_dependencies(image_services)):
+            svc.ensure_image_exists(
+                do_build=do_build,
+                silent=silent,
+                cli=cli,
+                pull=pull or svc.options.get('pull_policy') == 'always',
+                offline=offline,
+                progress=recorder.pull_progress(svc.image_name),
+            )
+        self.check_image_platforms(image_services, strict=strict_platform)
+        rejected = run_image_hook(image_hook, image_services, self.notify) if image_hook else {}
+        plans = convergence_plans or self._get_convergence_plans(
             services,
             strategy,
             always_recreate_deps=always_recreate_deps,
@@ -676,7 +1190,10 @@ class Project:
             lambda service: service.name)
 
         def do(service):
-            return service.execute_convergence_plan(
+            if service.name in rejected:
+                raise rejected[service.name]
+            recorder.planned(service, plans[service.name])
+            containers = service.execute_convergence_plan(
                 plans[service.name],
                 timeout=timeout,
                 detached=detached or (service not in services_to_attach),
@@ -687,6 +1204,12 @@ class Project:
                 renew_anonymous_volumes=renew_anonymous_volumes,
                 override_options=override_options,
             )
+            recorder.converged(service, plans[service.name], containers or [])
+            if convergence_plans and self.notify:
+                self.notify(LifecycleEvent(
+                    'service', service.name, None, plans[service.name].action, None,
+                ))
+            return containers
 
         def get_deps(service):
             return {
@@ -706,16 +1229,194 @@ class Project:
                 'Encountered errors while bringing up the project.'
             )
 
-        return [
-            container
-            for svc_containers in results
-            if svc_containers is not None
-            for container in svc_containers
+        self.remove_dangling_images(previous_images)
+        return UpResult(
+            [
+                container
+                for svc_containers in results
+                if svc_containers is not None
+                for container in svc_containers
+            ],
+            recorder.summary(self.client.info()),
+        )
+
+    def connect_network(self, service_name, network, aliases=None):
+        """Connect the running containers of a service to `network` without
+        recreating them. A network of the project is created if it is
+        missing; any other must already exist. A container already connected
+        to it is connected again, to update its aliases, with the addresses,
+        links and short ID alias it had. `aliases` are added to the service
+        name and the aliases the service sets for the network.
+        """
+        service = self.get_service(service_name)
+        network_name = self._ensure_network(network)
+        netdefs = service.networks.get(network_name) or {}
+        aliases = list(unique_everseen(
+            [service.name] + sorted(netdefs.get('aliases') or []) + list(aliases or [])
+        ))
+        for container in service.containers():
+            endpoint = (container.get('NetworkSettings.Networks') or {}).get(network_name)
+            if endpoint is not None:
+                self.client.disconnect_container_from_network(container.id, network_name)
+            endpoint = endpoint or {}
+            ipam_config = endpoint.get('IPAMConfig') or {}
+            container_aliases = list(aliases)
+            if container.short_id in (endpoint.get('Aliases') or []):
+                container_aliases.append(container.short_id)
+            log.info('Connecting %s to network %s', container.name, network_name)
+            self.client.connect_container_to_network(
+                container.id, network_name,
+                aliases=container_aliases,
+                ipv4_address=ipam_config.get('IPv4Address'),
+                ipv6_address=ipam_config.get('IPv6Address'),
+                links=endpoint.get('Links'),
+                link_local_ips=ipam_config.get('LinkLocalIPs'),
+            )
+
+    def disconnect_network(self, service_name, network, force=False):
+        """Disconnect the running containers of a service from `network`.
+        Disconnecting a container from its last network is refused unless
+        `force` is set.
+        """
+        service = self.get_service(service_name)
+        declared = self.networks.declared.get(network)
+        network_name = declared.true_name if declared else network
+        containers = [
+            c for c in service.containers()
+            if network_name in (c.get('NetworkSettings.Networks') or {})
         ]
+        if not force:
+            for container in containers:
+                if len(container.get('NetworkSettings.Networks')) == 1:
+                    raise ProjectError(
+                        'Network {} is the last network of {}, use force to disconnect '
+                        'it anyway'.format(network_name, container.name)
+                    )
+        for container in containers:
+            log.info('Disconnecting %s from network %s', container.name, network_name)
+            self.client.disconnect_container_from_network(container.id, network_name, force=force)
+
+    def _ensure_network(self, network):
+        """The name of `network` on the daemon, creating it if it is a
+        network of the project that is missing.
+        """
+        declared = self.networks.declared.get(network)
+        if declared:
+            declared.ensure(self.warnings)
+            return declared.true_name
+        try:
+            return self.client.inspect_network(network)['Name']
+        except NotFound:
+            raise ProjectError('Network {} not found'.format(network))
+
+    def check_images(self, services, image_hook):
+        """Raise ProjectError if `image_hook` rejects the image of one of
+        `services`.
+        """
+        if image_hook is None:
+            return
+        errors = run_image_hook(image_hook, services, self.notify)
+        if errors:
+            raise ProjectError('\n'.join(
+                getattr(error, 'msg', str(error)) for _, error in sorted(errors.items())
+            ))
+
+    def check_offline_images(self, services, do_build=BuildAction.none):
+        """Raise OfflineImagesMissingError if the image of one of `services`
+        is missing and can't be built.
+        """
+        missing = sorted({
+            service.image_name for service in services
+            if not service.has_image() and (
+                not service.can_be_built() or do_build == BuildAction.skip
+            )
+        })
+        if missing:
+            raise OfflineImagesMissingError(missing)
+
+    def warm_cache(self, service_names=None, silent=False):
+        """Pull every image the services use that can't be built, and the
+        `cache_from` images of those that can, in a single parallel pass, so
+        that the project can be brought up offline later.
+        """
+        images = set()
+        for service in self.get_services(service_names):
+            if service.can_be_built():
+                images.update(service.get_cache_images(service.options.get('build', {})))
+            elif 'image' in service.options:
+                images.add(service.image_name)
+
+        def pull(image):
+            reference = ImageReference.parse(image)
+            try:
+                pull_image(self.client, reference.repository, tag=reference.pull_tag)
+            except StreamOutputError as e:
+                raise OperationFailedError(str(e))
+
+        _, errors = parallel.parallel_execute(
+            sorted(images),
+            pull,
+            lambda image: image,
+            'Pulling' if not silent else None,
+        )
+        if errors:
+            raise ProjectError('Could not pull {}'.format(', '.join(sorted(errors))))
+        return sorted(images)
+
+    def initialize(self, services=None):
+        """Create the networks and volumes of the project, or only those that
+        `services` use. Returns the names of the networks and of the volumes
+        created.
+        """
+        if services is None:
+            return (
+                self.networks.initialize(warnings=self.warnings),
+                self.volumes.initialize(warnings=self.warnings),
+            )
+
+        networks, volumes = self.resources_used_by(services)
+        return (
+            self.networks.initialize(networks, warnings=self.warnings),
+            self.volumes.initialize(volumes, warnings=self.warnings),
+        )
+
+    def resources_used_by(self, services):
+        """The names of the networks and of the named volumes `services` use."""
+        networks = {name for service in services for name in service.networks}
+        volumes = {
+            spec.external
+            for service in services
+            for spec in service.options.get('volumes') or []
+            if spec.is_named_volume
+        }
+        return networks, volumes
+
+    def warn_running_dependents(self, service_names):
+        """Warn about the running services that depend on one of
+        `service_names` without being among them.
+        """
+        for service in self.services:
+            if service.name in service_names:
+                continue
+            dependencies = sorted(service_names & set(service.get_dependency_names()))
+            if dependencies and service.containers():
+                log.warning(
+                    'Service "%s" is running and depends on %s',
+                    service.name, ', '.join('"%s"' % name for name in dependencies),
+                )
 
-    def initialize(self):
-        self.networks.initialize()
-        self.volumes.initialize()
+    def warn_missing_dependencies(self, services):
+        """Warn about the dependencies of `services` that are neither among
+        them nor running.
+        """
+        selected = {service.name for service in services}
+        for service in services:
+            for name in sorted(set(service.get_dependency_names()) - selected):
+                if name in self.service_names and not self.get_service(name).containers():
+                    log.warning(
+                        'Service "%s" depends on "%s", which is not running',
+                        service.name, name,
+                    )
 
     def _get_convergence_plans(self, services, strategy, always_recreate_deps=False, one_off=None):
         plans = {}
@@ -738,7 +1439,19 @@ class Project:
                 service_has_links = any(service.get_link_names())
                 container_has_links = any(c.get('HostConfig.Links') for c in service.containers())
                 should_recreate_for_links = service_has_links ^ container_has_links
-                if always_recreate_deps or containers_stopped or should_recreate_for_links:
+                # Shared namespaces are joined by container ID, so they must be
+                # joined again when their owner is replaced
+                should_recreate_for_namespaces = any(
+                    name in updated_dependencies
+                    for name in service.get_namespace_dependency_names()
+                )
+                # Injected ports are those published when the container was created
+                should_recreate_for_ports = service.options.get('x-inject-ports') and any(
+                    name in updated_dependencies
+                    for name in service.options.get('depends_on') or {}
+                )
+                if (always_recreate_deps or containers_stopped or should_recreate_for_links or
+                        should_recreate_for_namespaces or should_recreate_for_ports):
                     plan = service.convergence_plan(ConvergenceStrategy.always, is_one_off)
                 else:
                     plan = service.convergence_plan(strategy, is_one_off)
@@ -749,9 +1462,48 @@ class Project:
 
         return plans
 
+    def check_api_features(self, services):
+        """Raise UnsupportedFeatureError when `services` set options that
+        the API version the client negotiated with the daemon lacks.
+        """
+        api_version = self.client.api_version
+        requirements = [
+            (service.name, feature)
+            for service in services
+            for feature in unsupported_features(service.options, api_version)
+        ]
+        if requirements:
+            raise UnsupportedFeatureError(api_version, requirements)
+
+    def check_external_containers(self, services):
+        """Raise ExternalContainerError, before anything is changed, when
+        a container that one of `services` adopts is missing or stopped,
+        unless it is optional.
+        """
+        for service in services:
+            if service.external_container:
+                service.ensure_external_container()
+
+    def check_image_platforms(self, services, strict=False):
+        """Warn about, or with `strict` refuse, images whose platform differs
+        from the daemon's (see Service.check_image_platform).
+        """
+        version = self.client.version()
+        daemon_platform = (version.get('Os'), normalize_architecture(version.get('Arch')))
+        if not all(daemon_platform):
+            return
+        for service in services:
+            service.check_image_platform(daemon_platform, strict=strict, warnings=self.warnings)
+
+    @traced('compose.pull', project_attributes)
+    @metered('pull')
     def pull(self, service_names=None, ignore_pull_failures=False, parallel_pull=True, silent=False,
-             include_deps=False):
+             include_deps=False, image_hook=None):
+        """Pull the images of the services. `image_hook` is called for each
+        image pulled (see compose.image_hook).
+        """
         services = self.get_services(service_names, include_deps)
+        self.check_credentials(services)
 
         if parallel_pull:
             self.parallel_pull(services, silent=silent)
@@ -761,7 +1513,7 @@ class Project:
             for service in services:
                 try:
                     service.pull(ignore_pull_failures, silent=silent)
-                except (ImageNotFound, NotFound):
+                except ImageNotFoundError:
                     if service.can_be_built():
                         must_build.append(service.name)
                     else:
@@ -772,6 +1524,9 @@ class Project:
                             '    docker-compose build {}'
                             .format(' '.join(must_build)))
 
+        self.check_image_platforms(services)
+        self.check_images(services, image_hook)
+
     def parallel_pull(self, services, ignore_pull_failures=False, silent=False):
         msg = 'Pulling' if not silent else None
         must_build = []
@@ -783,21 +1538,33 @@ class Project:
                 return
 
             try:
-                writer = parallel.ParallelStreamWriter.get_instance()
-                if writer is None:
-                    raise RuntimeError('ParallelStreamWriter has not yet been instantiated')
-                for event in strm:
-                    if 'status' not in event:
-                        continue
-                    status = read_status(event)
-                    writer.write(
-                        msg, service.name, truncate_string(status), lambda s: s
-                    )
-            except (ImageNotFound, NotFound):
+                with span('service.pull', service_attributes(service)):
+                    writer = parallel.ParallelStreamWriter.get_instance()
+                    if writer is None:
+                        raise RuntimeError('ParallelStreamWriter has not yet been instantiated')
+                    events = []
+                    for event in strm:
+                        if 'status' not in event:
+                            continue
+                        events.append(event)
+                        status = read_status(event)
+                        writer.write(
+                            msg, service.name, truncate_string(status), lambda s: s
+                        )
+            except ImageNotFoundError:
                 if service.can_be_built():
                     must_build.append(service.name)
-                else:
-                    raise
+                    return
+                raise
+
+            if any(e['status'].startswith('Status: Image is up to date') for e in events):
+                return 'up to date'
+            size = get_download_size(events)
+            if size:
+                return 'done ({})'.format(human_readable_file_size(size))
+
+        def pull_status(result):
+            return result or 'done'
 
         _, errors = parallel.parallel_execute(
             services,
@@ -805,6 +1572,7 @@ class Project:
             operator.attrgetter('name'),
             msg,
             limit=5,
+            done_status=pull_status,
         )
 
         if len(must_build):
@@ -817,23 +1585,39 @@ class Project:
             ])
             raise ProjectError(combined_errors)
 
+    @traced('compose.push', project_attributes)
+    @metered('push')
     def push(self, service_names=None, ignore_push_failures=False):
+        services = self.get_services(service_names, include_deps=False)
+        self.check_credentials(services, push=True)
+
         unique_images = set()
-        for service in self.get_services(service_names, include_deps=False):
+        for service in services:
             # Considering <image> and <image:latest> as the same
-            repo, tag, sep = parse_repository_tag(service.image_name)
-            service_image_name = sep.join((repo, tag)) if tag else sep.join((repo, 'latest'))
+            service_image_name = ImageReference.parse(service.image_name).familiar()
 
             if service_image_name not in unique_images:
                 service.push(ignore_push_failures)
                 unique_images.add(service_image_name)
 
-    def _labeled_containers(self, stopped=False, one_off=OneOffFilter.exclude):
+    def check_credentials(self, services, push=False):
+        """Resolve the registry credentials for pulling the images of
+        `services`, or pushing them, without transferring anything. Returns
+        each registry with whether there are credentials for it, and raises
+        CredentialsError when a credential helper fails.
+        """
+        return check_credentials(self.client, [
+            service.image_name for service in services
+            if 'image' in service.options and (not push or 'build' in service.options)
+        ])
+
+    def _labeled_containers(self, stopped=False, one_off=OneOffFilter.exclude, service_name=None):
+        service_labels = ['{}={}'.format(LABEL_SERVICE, service_name)] if service_name else []
         ctnrs = list(filter(None, [
             Container.from_ps(self.client, container)
             for container in self.client.containers(
                 all=stopped,
-                filters={'label': self.labels(one_off=one_off)})])
+                filters={'label': self.labels(one_off=one_off) + service_labels})])
         )
         if ctnrs:
             return ctnrs
@@ -842,21 +1626,327 @@ class Project:
             Container.from_ps(self.client, container)
             for container in self.client.containers(
                 all=stopped,
-                filters={'label': self.labels(one_off=one_off, legacy=True)})])
+                filters={'label': self.labels(one_off=one_off, legacy=True) + service_labels})])
         ))
 
-    def containers(self, service_names=None, stopped=False, one_off=OneOffFilter.exclude):
+    def containers(self, service_names=None, stopped=False, one_off=OneOffFilter.exclude,
+                   with_stats=False):
+        """The containers of the given services. A name that is not a service
+        may identify a single container by ID, name or ID prefix, as with
+        find_container(). With `with_stats`, the `stats` of each container
+        are fetched too, which takes a request per container.
+        """
+        # A single service is filtered by the daemon, as label filters only
+        # match containers that have all the labels
+        service_name = None
+        if service_names and len(service_names) == 1 and service_names[0] in self.service_names:
+            service_name = service_names[0]
+        containers = self._project_containers(stopped, one_off, service_name)
         if service_names:
-            self.validate_service_names(service_names)
+            identified = set()
+            for name in service_names:
+                if name not in self.service_names:
+                    identified.add(self._resolve_container(containers, name).id)
+
+            containers = [
+                c for c in containers
+                if c.labels.get(LABEL_SERVICE) in service_names or c.id in identified
+            ]
+
+        if with_stats:
+            self.fetch_stats(containers)
+        return containers
+
+    def ps(self, service_names=None, statuses=None, sort='name', all=False):
+        """The containers `ps` lists: those of the services, stopped or not,
+        and the running one-off containers, or every one-off container with
+        `all`, and those the services adopt with x-external-container. Only
+        containers with one of `statuses` (see CONTAINER_STATUSES) are listed,
+        sorted by `sort`, a key of PS_SORT_KEYS.
+        """
+        if sort not in PS_SORT_KEYS:
+            raise ProjectError('Invalid sort key: {}. Valid keys are: {}'.format(
+                sort, ', '.join(PS_SORT_KEYS)))
+        invalid = set(statuses or []) - set(CONTAINER_STATUSES)
+        if invalid:
+            raise ProjectError('Invalid status: {}. Valid statuses are: {}'.format(
+                ', '.join(sorted(invalid)), ', '.join(CONTAINER_STATUSES)))
+
+        if all:
+            containers = self.containers(service_names, stopped=True, one_off=OneOffFilter.include)
         else:
-            service_names = self.service_names
+            containers = (
+                self.containers(service_names, stopped=True) +
+                self.containers(service_names, one_off=OneOffFilter.only)
+            )
+        containers += [
+            container
+            for service in self.services
+            if not service_names or service.name in service_names
+            for container in service.external_containers(stopped=True)
+        ]
+        if statuses:
+            containers = [c for c in containers if container_has_status(c, statuses)]
+        return sorted(containers, key=PS_SORT_KEYS[sort])
+
+    def set_healthcheck(self, service_name, healthcheck, timeout=None):
+        """Recreate the containers of a service with `healthcheck`, in the
+        form of the Compose file, or without a healthcheck when it's None,
+        to debug a flapping one without editing the file. The next `up`
+        restores the file's healthcheck. Returns the new containers.
+        """
+        service = self.get_service(service_name)
+        if healthcheck is None:
+            healthcheck = {'disable': True}
+        healthcheck = process_healthcheck({'healthcheck': dict(healthcheck)})['healthcheck']
+        validate_healthcheck(ServiceConfig(None, None, service_name, {'healthcheck': healthcheck}))
+        return service.set_healthcheck(healthcheck, timeout)
+
+    def wait_for(self, service_name, target, timeout, **kwargs):
+        """Wait until `target`, a wait.Target, is reachable on every running
+        container of the service, for at most `timeout` seconds, retrying
+        with a backoff (see wait.wait_for). A service without running
+        containers yet is waited for too.
+        """
+        service = self.get_service(service_name)
+
+        def check():
+            containers = service.containers()
+            if not containers:
+                raise ProbeError('service {} has no running container'.format(service_name))
+            for container in containers:
+                host, port = probe_address(container, target.port)
+                check_target(host, target._replace(port=port), DIAL_TIMEOUT)
+
+        wait_for(check, timeout, **kwargs)
+
+    def container_environment(self, service_name, number=1, show_secrets=False):
+        """Return the environment a container of the service runs with, after
+        env_file merging and interpolation. The values of variables that look
+        like secrets are masked, unless `show_secrets`. Raises ValueError if
+        the service has no running container `number`.
+        """
+        container = self.get_service(service_name).get_container(number=number)
+        environment = container.environment
+        if show_secrets:
+            return environment
+        return {name: mask_sensitive(name, value) for name, value in environment.items()}
+
+    def fetch_stats(self, containers):
+        """Set the `stats` of `containers`, fetching them concurrently. Those
+        of containers whose stats can't be fetched in time are left unset.
+        """
+        def fetch(container):
+            container.stats = fetch_container_stats(self.client, container.id)
+
+        parallel.parallel_batch(containers, fetch, STATS_LIMIT)
+
+    def find_container(self, identifier, stopped=False):
+        """The container of the project that `identifier` designates, as the
+        docker CLI resolves it: by exact ID, then exact name, then unique ID
+        prefix. Raises NoSuchService if none matches, and
+        AmbiguousContainerIdentifier if the prefix matches several.
+        """
+        return self._resolve_container(
+            self._project_containers(stopped, OneOffFilter.include), identifier
+        )
+
+    def _project_containers(self, stopped=False, one_off=OneOffFilter.exclude, service_name=None):
+        return [
+            c for c in self._labeled_containers(stopped, one_off, service_name)
+            if c.labels.get(LABEL_SERVICE) in self.service_names
+        ]
+
+    def _resolve_container(self, containers, identifier):
+        container = find_container(containers, identifier)
+        if container is None:
+            raise NoSuchService(identifier)
+        return container
+
+    def known_service_names(self):
+        """The sorted names of the services in the project and of those that
+        have containers, running or not, for shell completion. Containers are
+        listed in a single request and never inspected.
+        """
+        names = set(self.service_names)
+        for container in self.client.containers(
+                all=True, filters={'label': self.labels(one_off=OneOffFilter.include)}):
+            names.add((container.get('Labels') or {}).get(LABEL_SERVICE))
+        names.discard(None)
+        return sorted(names)
+
+    def config_hash(self):
+        """A hash of the whole project, as `up` acts on it (see
+        resolved_config()). It is recorded on the containers `up` creates.
+        """
+        return json_hash(self.resolved_config())
+
+    def drift(self):
+        """Compare the project with its containers, networks and volumes,
+        without changing anything, and return a DriftReport. A service has
+        changed when `up` would recreate its containers for their config
+        hash.
+        """
+        containers = [
+            c for c in self._labeled_containers(stopped=True)
+            if c.labels.get(LABEL_SERVICE)
+        ]
+        by_service = {}
+        for container in containers:
+            by_service.setdefault(container.service, []).append(container)
+
+        services = self.get_services()
+        latest = max(containers, key=lambda c: c.get('Created'), default=None)
+        return DriftReport(
+            config_hash=self.config_hash(),
+            recorded_hash=latest.labels.get(LABEL_PROJECT_CONFIG_HASH) if latest else None,
+            added=[s.name for s in services if s.name not in by_service],
+            removed=sorted(set(by_service) - {s.name for s in services}),
+            changed=[
+                s.name for s in services
+                if any(
+                    c.labels.get(LABEL_CONFIG_HASH) != s.config_hash
+                    for c in by_service.get(s.name, [])
+                )
+            ],
+            networks=[
+                name for name, network in sorted(self.networks.networks.items())
+                if network.differs()
+            ],
+            volumes=[
+                name for name, volume in sorted(self.volumes.volumes.items())
+                if volume.differs()
+            ],
+        )
+
+    def plan(self, service_names=None, start_deps=True, strategy=ConvergenceStrategy.changed,
+             always_recreate_deps=False):
+        """Return the Plan of what `up` would do for the given services,
+        without changing anything (see compose.plan).
+        """
+        services = self.get_services_without_duplicate(service_names, include_deps=start_deps)
+        plans = self._get_convergence_plans(
+            services, strategy, always_recreate_deps=always_recreate_deps,
+        )
+        return Plan(
+            project=self.name,
+            config_hash=self.config_hash(),
+            steps=[
+                PlanStep(
+                    service.name,
+                    plans[service.name].action,
+                    service.config_hash,
+                    [c.id for c in plans[service.name].containers],
+                )
+                for service in services
+            ],
+            state=self._container_state(),
+        )
+
+    @traced('compose.apply', project_attributes)
+    def apply(self, plan, timeout=None, **kwargs):
+        """Carry out exactly `plan`, made by plan(), like `up --detach`.
+        Raises PlanDriftError, without changing anything, if the project,
+        the image of a service or a container changed since the plan was
+        made. `notify` is called with a 'service' LifecycleEvent, whose
+        action is that of the step, once the step of each service is done.
+        """
+        differences = self.plan_differences(plan)
+        if differences:
+            raise PlanDriftError(self.name, differences)
+
+        containers = {c.id: c for c in self._labeled_containers(stopped=True)}
+        return self.up(
+            service_names=[step.service for step in plan.steps],
+            start_deps=False,
+            timeout=timeout,
+            detached=True,
+            convergence_plans={
+                step.service: ConvergencePlan(
+                    step.action, [containers[container_id] for container_id in step.containers],
+                )
+                for step in plan.steps
+            },
+            **kwargs
+        )
 
-        containers = self._labeled_containers(stopped, one_off)
+    def plan_differences(self, plan):
+        """Describe how the project and its containers changed since `plan`
+        was made. Applying a plan is only safe when there is no difference.
+        """
+        differences = []
+        if plan.project != self.name:
+            differences.append('the plan is for project {}'.format(plan.project))
+        if plan.config_hash != self.config_hash():
+            differences.append('the configuration of the project changed')
+        for step in plan.steps:
+            try:
+                service = self.get_service(step.service)
+            except NoSuchService:
+                differences.append('service {} was removed'.format(step.service))
+                continue
+            if service.config_hash != step.config_hash:
+                differences.append(
+                    'the configuration or image of service {} changed'.format(step.service)
+                )
 
-        def matches_service_names(container):
-            return container.labels.get(LABEL_SERVICE) in service_names
+        state = self._container_state()
+        for container_id in sorted(set(plan.state) | set(state)):
+            short_id = container_id[:12]
+            if container_id not in state:
+                differences.append('container {} was removed'.format(short_id))
+            elif container_id not in plan.state:
+                differences.append('container {} was created'.format(short_id))
+            elif state[container_id] != plan.state[container_id]:
+                differences.append('container {} was updated'.format(short_id))
+        return differences
+
+    def _container_state(self):
+        return {
+            c.id: c.labels.get(LABEL_CONFIG_HASH)
+            for c in self._labeled_containers(stopped=True)
+        }
 
-        return [c for c in containers if matches_service_names(c)]
+    def replica_status(self, service_names=None, scale_override=None):
+        """Return a ServiceStatus for each service. The desired count is the
+        service's count in `scale_override`, or else its scale (or
+        deploy.replicas), so that replicas which crashed or were removed still
+        count as missing. Containers numbered beyond the scale, left by
+        `up --scale`, raise it.
+        """
+        scale_override = scale_override or {}
+        status = []
+        for service in self.get_services(service_names):
+            containers = inspect_containers(service.containers(stopped=True))
+            if service.name in scale_override:
+                desired = scale_override[service.name]
+            else:
+                numbers = [c.number for c in containers if c.number is not None]
+                desired = max([service.scale_num] + numbers)
+            status.append(ServiceStatus(
+                service.name,
+                len([c for c in containers if c.is_running]),
+                desired,
+                combined_status(containers),
+            ))
+        return status
+
+    def inspect_service(self, service_name):
+        """Return a ContainerSummary for each container of the service,
+        running or not, sorted by container number.
+        """
+        service = self.get_service(service_name)
+        containers = sorted(
+            inspect_containers(service.containers(stopped=True)),
+            key=lambda c: c.number,
+        )
+        digests = {}
+        summaries = []
+        for container in containers:
+            if container.image not in digests:
+                digests[container.image] = get_container_image_digest(container)
+            summaries.append(container.summary(image_digest=digests[container.image]))
+        return summaries
 
     def find_orphan_containers(self, remove_orphans):
         def _find():
@@ -864,6 +1954,8 @@ class Project:
             for ctnr in containers:
                 service_name = ctnr.labels.get(LABEL_SERVICE)
                 if service_name not in self.service_names:
+                    log.debug('%s is an orphan: service "%s" is not in the project',
+                              ctnr.name, service_name)
                     yield ctnr
         orphans = list(_find())
         if not orphans:
@@ -877,7 +1969,8 @@ class Project:
                     pass
                 ctnr.remove(force=True)
         else:
-            log.warning(
+            self.warnings.warn(
+                ORPHANS,
                 'Found orphan containers ({}) for this project. If '
                 'you removed or renamed this service in your compose '
                 'file, you can run this command with the '
@@ -915,13 +2008,101 @@ class Project:
     def build_container_operation_with_timeout_func(self, operation, options):
         def container_operation_with_timeout(container):
             _options = options.copy()
+            service = self.get_service(container.service)
             if _options.get('timeout') is None:
-                service = self.get_service(container.service)
                 _options['timeout'] = service.stop_timeout(None)
+            service.run_pre_stop_hooks(container)
             return getattr(container, operation)(**_options)
         return container_operation_with_timeout
 
 
+def normalize_image_name(image):
+    return ImageReference.parse(image).familiar()
+
+
+def check_build_cycles(dependencies):
+    """Raise DependencyError if a service must, directly or not, be built
+    after itself.
+    """
+    done = set()
+
+    def visit(name, path):
+        if name in path:
+            cycle = path[path.index(name):] + [name]
+            raise DependencyError(
+                'Circular build dependency between services: {}'.format(' -> '.join(cycle))
+            )
+        if name in done:
+            return
+        for dep in sorted(dependencies.get(name, ())):
+            visit(dep, path + [name])
+        done.add(name)
+
+    for name in sorted(dependencies):
+        visit(name, [])
+
+
+def sort_for_build(services, dependencies):
+    """`services`, each after those it must be built after, keeping their
+    order otherwise.
+    """
+    names = {service.name for service in services}
+    result = []
+
+    def visit(service):
+        if service in result:
+            return
+        for other in services:
+            if other.name in dependencies[service.name] & names:
+                visit(other)
+        result.append(service)
+
+    for service in services:
+        visit(service)
+    return result
+
+
+def get_container_image_digest(container):
+    """The digest of the container's image in the repository it was
+    created from, or None when the image was built or not pulled by digest.
+    """
+    repo, tag, separator = parse_repository_tag(container.get('Config.Image'))
+    if separator == '@':
+        return tag
+    try:
+        repo_digests = container.image_config.get('RepoDigests') or []
+    except ImageNotFound:
+        return None
+    for repo_digest in repo_digests:
+        digest_repo, digest, _ = parse_repository_tag(repo_digest)
+        if digest_repo == repo:
+            return digest
+    return None
+
+
+def generated_name_separator(full_name, project, name):
+    """The separator `full_name` was made of `project` and `name` with, or
+    None if it wasn't generated by Compose.
+    """
+    for separator in NAME_SEPARATORS:
+        if full_name == '{}{}{}'.format(project, separator, name):
+            return separator
+    return None
+
+
+def list_project_names(client, tenant=None):
+    """The sorted names of the projects that have containers, running or
+    not, listed in a single request without inspecting any of them.
+    """
+    labels = [LABEL_PROJECT]
+    if tenant:
+        labels.append('{}={}'.format(LABEL_TENANT, tenant))
+    return sorted({
+        container['Labels'][LABEL_PROJECT]
+        for container in client.containers(all=True, filters={'label': labels})
+    })
+
+
 def translate_credential_spec_to_security_opt(service_dict):
     result = []
 
@@ -1063,6 +2244,111 @@ def get_secrets(service, service_secrets, secret_defs):
     return secrets
 
 
+HOOK_TYPES = ('post_start', 'pre_stop')
+
+
+def get_hooks(service, hooks_config):
+    if not isinstance(hooks_config, dict):
+        raise ConfigurationError(
+            'Service "{}": x-hooks must be a mapping'.format(service))
+
+    hooks = {}
+    for hook_type, specs in hooks_config.items():
+        if hook_type not in HOOK_TYPES:
+            raise ConfigurationError(
+                'Service "{service}" defines an unsupported hook "{hook}". '
+                'Supported hooks are: {supported}'.format(
+                    service=service, hook=hook_type, supported=', '.join(HOOK_TYPES)))
+        if not isinstance(specs, list):
+            specs = [specs]
+        hooks[hook_type] = [ServiceHook.parse(spec) for spec in specs]
+
+    return hooks
+
+
+def get_readiness_probe(service, spec):
+    if spec is None:
+        return None
+    try:
+        return ReadinessProbe.parse(spec)
+    except ConfigurationError as e:
+        raise ConfigurationError('Service "{}": {}'.format(service, e.msg))
+
+
+def get_external_container(service, spec):
+    if spec is None:
+        return None
+    try:
+        return ExternalContainer.parse(spec)
+    except ConfigurationError as e:
+        raise ConfigurationError('Service "{}": {}'.format(service, e.msg))
+
+
+def get_drain_seconds(service, value):
+    """The `x-drain-seconds` of `service`, a number of seconds or a duration
+    such as 10s, in seconds.
+    """
+    if value is None:
+        return 0
+    seconds = value if isinstance(value, (int, float)) else parse_seconds_float(str(value))
+    if isinstance(value, bool) or seconds is None or seconds < 0:
+        raise ConfigurationError(
+            'Service "{}": x-drain-seconds must be a number of seconds or a duration '
+            '(found: "{}")'.format(service, value)
+        )
+    return seconds
+
+
+def inspect_containers(containers):
+    """Inspect containers in parallel, leaving out those removed meanwhile.
+    Any other error inspecting a container is raised.
+    """
+    events = parallel.parallel_execute_iter(containers, Container.inspect, None, None)
+    errors = {}
+    for container, _, exception in events:
+        if exception is not None:
+            errors[container] = exception
+    for container in containers:
+        if container in errors and not isinstance(errors[container], NotFound):
+            raise errors[container]
+    return [c for c in containers if c not in errors]
+
+
+def container_has_status(container, statuses):
+    status = container.get('State.Status')
+    return (
+        status in statuses or
+        ('stopped' in statuses and not container.is_running) or
+        ('restarted' in statuses and status == 'restarting')
+    )
+
+
+def combined_status(containers):
+    """Summarize the state of inspected containers, e.g. "exited(1),
+    running(3)". Running containers whose healthcheck fails are counted
+    separately: "running(3, unhealthy: 1)".
+    """
+    states = Counter(c.get('State.Status') for c in containers)
+    unhealthy = len([
+        c for c in containers
+        if c.is_running and c.get('State.Health.Status') == 'unhealthy'
+    ])
+
+    def describe(state):
+        if state == 'running' and unhealthy:
+            return '{}({}, unhealthy: {})'.format(state, states[state], unhealthy)
+        return '{}({})'.format(state, states[state])
+
+    return ', '.join(describe(state) for state in sorted(states))
+
+
+def container_start(container):
+    """What tells apart the runs of a container: it is restarted when either
+    changes.
+    """
+    return container.get('RestartCount'), container.get('State.StartedAt')
+
+
 def get_image_digests(project):
     digests = {}
     needs_push = set()
@@ -1089,9 +2375,8 @@ def get_image_digest(service):
             "required to generate a proper image digest. Specify an image repo "
             "and tag with the 'image' option.".format(s=service))
 
-    _, _, separator = parse_repository_tag(service.options['image'])
     # Compose file already uses a digest, no lookup required
-    if separator == '@':
+    if ImageReference.parse(service.options['image']).digested:
         return service.options['image']
 
     digest = get_digest(service)
@@ -1148,12 +2433,29 @@ class NeedsPull(Exception):
         self.service_name = service_name
 
 
+def find_container(containers, identifier):
+    """Return the container of `containers` with ID or name `identifier`,
+    or the only one whose ID starts with it, or None.
+    """
+    for key in (operator.attrgetter('id'), operator.attrgetter('name')):
+        for container in containers:
+            if key(container) == identifier:
+                return container
+
+    matches = [c for c in containers if c.id.startswith(identifier)]
+    if len(matches) > 1:
+        raise AmbiguousContainerIdentifier(identifier, matches)
+    return matches[0] if matches else None
+
+
 class NoSuchService(Exception):
-    def __init__(self, name):
+    def __init__(self, name, valid_names=None):
         if isinstance(name, bytes):
             name = name.decode('utf-8')
         self.name = name
         self.msg = "No such service: %s" % self.name
+        if valid_names:
+            self.msg += " (valid services: %s)" % ", ".join(sorted(valid_names))
 
     def __str__(self):
         return self.msg
@@ -1162,3 +2464,12 @@ class NoSuchService(Exception):
 class ProjectError(Exception):
     def __init__(self, msg):
         self.msg = msg
+
+
+class AmbiguousContainerIdentifier(ProjectError):
+    def __init__(self, identifier, containers):
+        self.identifier = identifier
+        self.candidates = sorted(c.name for c in containers)
+        super().__init__('"{}" matches several containers: {}'.format(
+            identifier, ', '.join(self.candidates)
+        ))
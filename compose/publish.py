@@ -0,0 +1,318 @@
+"""
+Distribution of Compose applications through registries, as OCI artifacts.
+
+`publish` pushes the Compose file of a project, and optionally env files,
+as the layers of an OCI artifact. The file is published uninterpolated
+unless the environment is published with it (see load_publishable_config).
+`fetch_project` pulls them into a directory and loads the project from
+there. Artifacts use the media types and annotations of Compose v2.
+
+The registry is reached directly with the credentials the Docker CLI
+stored for it, as the Engine API can only push and pull images.
+"""
+import base64
+import hashlib
+import json
+import os
+import re
+from urllib.parse import quote
+from urllib.parse import urljoin
+
+import requests
+from docker import auth
+
+from . import __version__
+from . import config
+from .config import ConfigurationError
+from .config import parse_environment
+from .config.environment import Environment
+from .config.serialize import serialize_config
+from .credentials import resolve_credentials
+from .errors import RegistryError
+from .project import Project
+from .service import ImageReference
+
+ARTIFACT_TYPE = 'application/vnd.docker.compose.project'
+COMPOSE_FILE_MEDIA_TYPE = 'application/vnd.docker.compose.file+yaml'
+ENV_FILE_MEDIA_TYPE = 'application/vnd.docker.compose.envfile'
+MANIFEST_MEDIA_TYPE = 'application/vnd.oci.image.manifest.v1+json'
+EMPTY_MEDIA_TYPE = 'application/vnd.oci.empty.v1+json'
+EMPTY_BLOB = b'{}'
+
+COMPOSE_FILE_ANNOTATION = 'com.docker.compose.file'
+ENV_FILE_ANNOTATION = 'com.docker.compose.envfile'
+VERSION_ANNOTATION = 'com.docker.compose.version'
+
+COMPOSE_FILE_NAME = 'docker-compose.yml'
+
+# The registries whose API is served on another host than their name
+REGISTRY_HOSTS = {
+    auth.INDEX_NAME: 'registry-1.docker.io',
+}
+
+LOOPBACK_HOSTS = ('localhost', '127.0.0.1', '[::1]')
+
+
+def parse_reference(reference):
+    """The registry, repository and tag or digest of an artifact reference,
+    such as `registry.example.com/team/app:1.0`.
+    """
+    image = ImageReference.parse(reference)
+    registry, repository = auth.resolve_repository_name(image.repository)
+    if registry == auth.INDEX_NAME and '/' not in repository:
+        repository = 'library/' + repository
+    return registry, repository, image.pull_tag
+
+
+def blob_digest(data):
+    return 'sha256:' + hashlib.sha256(data).hexdigest()
+
+
+def descriptor(media_type, data, annotations=None):
+    result = {'mediaType': media_type, 'digest': blob_digest(data), 'size': len(data)}
+    if annotations:
+        result['annotations'] = annotations
+    return result
+
+
+class Registry:
+    """A client of the OCI distribution API of a registry, for a single
+    repository. Authenticates with `credentials`, as resolved from the
+    Docker CLI configuration, using either basic or token authentication,
+    as the registry requests.
+    """
+
+    def __init__(self, reference, registry, repository, credentials=None, session=None):
+        self.reference = reference
+        self.repository = repository
+        self.credentials = credentials or {}
+        self.session = session or requests.Session()
+        host = REGISTRY_HOSTS.get(registry, registry)
+        scheme = 'http' if host.rsplit(':', 1)[0] in LOOPBACK_HOSTS else 'https'
+        self.base_url = '{}://{}/v2/{}/'.format(scheme, host, repository)
+        self._authorization = None
+
+    def request(self, method, path, expected, **kwargs):
+        url = urljoin(self.base_url, path)
+        response = self._send(method, url, **kwargs)
+        if response.status_code == 401 and self._authorize(response):
+            response = self._send(method, url, **kwargs)
+        if response.status_code not in expected:
+            raise RegistryError(
+                self.reference,
+                '{} {} returned {}: {}'.format(method, url, response.status_code, response.text),
+            )
+        return response
+
+    def _send(self, method, url, headers=None, **kwargs):
+        headers = dict(headers or {})
+        if self._authorization:
+            headers['Authorization'] = self._authorization
+        return self.session.request(method, url, headers=headers, **kwargs)
+
+    def _basic_auth(self):
+        username = self.credentials.get('username')
+        password = self.credentials.get('password')
+        if not username:
+            return None
+        return username, password or ''
+
+    def _authorize(self, response):
+        """Get the authorization a 401 `response` asks for. Returns whether
+        the request is worth trying again.
+        """
+        scheme, _, challenge = response.headers.get('WWW-Authenticate', '').partition(' ')
+        basic_auth = self._basic_auth()
+        if scheme.lower() == 'basic' and basic_auth:
+            self._authorization = 'Basic ' + base64.b64encode(
+                '{}:{}'.format(*basic_auth).encode('utf-8')
+            ).decode('ascii')
+            return True
+        if scheme.lower() != 'bearer':
+            return False
+
+        params = dict(re.findall(r'(\w+)="([^"]*)"', challenge))
+        if 'realm' not in params:
+            return False
+        token_response = self.session.request(
+            'GET',
+            params['realm'],
+            params={
+                'service': params.get('service'),
+                'scope': params.get('scope', 'repository:{}:pull,push'.format(self.repository)),
+            },
+            auth=basic_auth,
+        )
+        if token_response.status_code != 200:
+            raise RegistryError(
+                self.reference,
+                'authentication failed with {}: {}'.format(
+                    token_response.status_code, token_response.text
+                ),
+            )
+        body = token_response.json()
+        self._authorization = 'Bearer ' + (body.get('token') or body.get('access_token') or '')
+        return True
+
+    def push_blob(self, data):
+        digest = blob_digest(data)
+        if self.request('HEAD', 'blobs/' + digest, (200, 404)).status_code == 200:
+            return digest
+
+        response = self.request('POST', 'blobs/uploads/', (202,))
+        location = urljoin(self.base_url, response.headers['Location'])
+        separator = '&' if '?' in location else '?'
+        self.request(
+            'PUT',
+            '{}{}digest={}'.format(location, separator, quote(digest)),
+            (201,),
+            data=data,
+            headers={'Content-Type': 'application/octet-stream'},
+        )
+        return digest
+
+    def get_blob(self, digest):
+        data = self.request('GET', 'blobs/' + digest, (200,)).content
+        if blob_digest(data) != digest:
+            raise RegistryError(self.reference, 'blob {} does not match its digest'.format(digest))
+        return data
+
+    def push_manifest(self, tag, manifest):
+        data = json.dumps(manifest, sort_keys=True).encode('utf-8')
+        self.request(
+            'PUT', 'manifests/' + tag, (201,),
+            data=data,
+            headers={'Content-Type': MANIFEST_MEDIA_TYPE},
+        )
+        return blob_digest(data)
+
+    def get_manifest(self, tag):
+        response = self.request(
+            'GET', 'manifests/' + tag, (200,), headers={'Accept': MANIFEST_MEDIA_TYPE},
+        )
+        return response.json()
+
+
+def registry_for(client, reference, session=None):
+    registry, repository, tag = parse_reference(reference)
+    credentials = resolve_credentials(client, registry)
+    return Registry(reference, registry, repository, credentials, session), tag
+
+
+def environment_services(config_details):
+    """The names of the services of `config_details` taking values from env
+    files or from the environment of Compose, which are inlined in their
+    configuration even when it isn't interpolated.
+    """
+    names = set()
+    for config_file in config_details.config_files:
+        for name, service_dict in config_file.get_service_dicts().items():
+            if not isinstance(service_dict, dict):
+                continue
+            environment = parse_environment(service_dict.get('environment'))
+            if service_dict.get('env_file') or None in environment.values():
+                names.add(name)
+    return sorted(names)
+
+
+def load_publishable_config(config_details, with_env=False):
+    """Load the configuration of `config_details` to publish.
+
+    Without `with_env`, variables are left uninterpolated, so that no value
+    of `.env`, of env files or of the shell environment ends up in the
+    artifact, and services taking their environment from those are refused.
+    """
+    if not with_env:
+        services = environment_services(config_details)
+        if services:
+            raise ConfigurationError(
+                'Services {} take values from env files or from the environment, '
+                'which would be published. Publish with --with-env to include '
+                'them.'.format(', '.join(services))
+            )
+    return config.load(config_details, interpolate=with_env)
+
+
+def publish(client, config_data, reference, env_files=None, image_digests=None, session=None,
+            interpolated=False):
+    """Push the Compose file of `config_data` to `reference` as an OCI
+    artifact, along with `env_files`. With `image_digests`, as returned by
+    project.get_image_digests, the images of the services are pinned to
+    their digests. `interpolated` tells whether `config_data` was loaded
+    with its variables interpolated (see load_publishable_config). Returns
+    the digest of the artifact.
+    """
+    registry, tag = registry_for(client, reference, session)
+
+    compose_file = serialize_config(config_data, image_digests, interpolated).encode('utf-8')
+    layers = [
+        descriptor(
+            COMPOSE_FILE_MEDIA_TYPE, compose_file,
+            {COMPOSE_FILE_ANNOTATION: COMPOSE_FILE_NAME, VERSION_ANNOTATION: __version__},
+        )
+    ]
+    blobs = [EMPTY_BLOB, compose_file]
+    for path in env_files or []:
+        with open(path, 'rb') as f:
+            data = f.read()
+        layers.append(descriptor(
+            ENV_FILE_MEDIA_TYPE, data,
+            {ENV_FILE_ANNOTATION: os.path.basename(path), VERSION_ANNOTATION: __version__},
+        ))
+        blobs.append(data)
+
+    for data in blobs:
+        registry.push_blob(data)
+
+    return registry.push_manifest(tag, {
+        'schemaVersion': 2,
+        'mediaType': MANIFEST_MEDIA_TYPE,
+        'artifactType': ARTIFACT_TYPE,
+        'config': descriptor(EMPTY_MEDIA_TYPE, EMPTY_BLOB),
+        'layers': layers,
+        'annotations': {VERSION_ANNOTATION: __version__},
+    })
+
+
+def fetch(client, reference, directory, session=None):
+    """Write the files of the Compose artifact at `reference` to `directory`.
+    Returns the names of its Compose files.
+    """
+    registry, tag = registry_for(client, reference, session)
+    manifest = registry.get_manifest(tag)
+    if manifest.get('artifactType') != ARTIFACT_TYPE:
+        raise RegistryError(reference, 'not a Compose application')
+
+    compose_files = []
+    for layer in manifest.get('layers') or []:
+        annotations = layer.get('annotations') or {}
+        if layer['mediaType'] == COMPOSE_FILE_MEDIA_TYPE:
+            name = annotations.get(COMPOSE_FILE_ANNOTATION, COMPOSE_FILE_NAME)
+            compose_files.append(os.path.basename(name))
+        elif layer['mediaType'] == ENV_FILE_MEDIA_TYPE:
+            name = annotations.get(ENV_FILE_ANNOTATION, '.env')
+        else:
+            continue
+        # Only keep the file name, so that the files stay in `directory`
+        with open(os.path.join(directory, os.path.basename(name)), 'wb') as f:
+            f.write(registry.get_blob(layer['digest']))
+
+    if not compose_files:
+        raise RegistryError(reference, 'the artifact has no Compose file')
+    return compose_files
+
+
+def fetch_project(client, reference, directory, project_name=None, session=None):
+    """Fetch the Compose artifact at `reference` into `directory` and load
+    it as a project, named after its top-level `name` or, without one, its
+    repository by default.
+    """
+    compose_files = fetch(client, reference, directory, session)
+    environment = Environment.from_env_file(directory)
+    config_data = config.load(config.find(directory, compose_files, environment))
+    if project_name is None:
+        project_name = config_data.name
+    if project_name is None:
+        _, repository, _ = parse_reference(reference)
+        project_name = repository.rsplit('/', 1)[-1]
+    return Project.from_config(project_name, config_data, client)
@@ -0,0 +1,124 @@
+"""
+Readiness probes declared with `x-readiness`, for services whose images
+cannot run a Docker healthcheck (no curl or nc in the image).
+
+Probes run from the client: `tcp` dials the container port, `http` sends a
+GET and checks the response status, and `exec` runs a command in the
+container. The port is reached on its published address when it has one,
+and on the container IP otherwise.
+"""
+import logging
+import threading
+import time
+from urllib.parse import urlparse
+
+from .cli.utils import binarystr_to_unicode
+from .errors import ReadinessCheckFailed
+from .wait import dial_tcp
+from .wait import http_get
+from .wait import ProbeError
+
+log = logging.getLogger(__name__)
+
+
+def docker_host(client):
+    """The host on which the daemon of `client` publishes ports: that of a
+    tcp or ssh daemon, and this machine for a unix socket or a named pipe.
+    The URL the client was configured with is preferred, as the client
+    rewrites it (e.g. `http+docker://ssh` for ssh).
+    """
+    url = urlparse(getattr(client, '_original_base_url', None) or client.base_url)
+    if url.scheme in ('tcp', 'ssh', 'http', 'https'):
+        return url.hostname or '127.0.0.1'
+    if url.scheme in ('unix', 'npipe') or url.hostname in ('localhost', 'localnpipe'):
+        return '127.0.0.1'
+    raise ProbeError('cannot tell the host of the Docker daemon at {}'.format(url.geturl()))
+
+
+def probe_address(container, port):
+    published = container.get_local_port(port)
+    if published:
+        host, _, host_port = published.rpartition(':')
+        if host in ('', '0.0.0.0', '::'):
+            host = docker_host(container.client)
+        return host, int(host_port)
+
+    for network in (container.get('NetworkSettings.Networks') or {}).values():
+        if network.get('IPAddress'):
+            return network['IPAddress'], port
+
+    raise ProbeError('port {} is not published and {} has no IP address'.format(
+        port, container.name
+    ))
+
+
+def check_tcp(container, probe):
+    dial_tcp(*probe_address(container, probe.port), timeout=probe.timeout)
+
+
+def check_http(container, probe):
+    host, port = probe_address(container, probe.port)
+    http_get('http://{}:{}{}'.format(host, port, probe.path), probe.timeout, probe.status)
+
+
+def check_exec(container, probe):
+    exec_id = container.create_exec(probe.command)
+    result = {}
+
+    def run():
+        result['output'] = container.start_exec(exec_id)
+
+    thread = threading.Thread(target=run, daemon=True)
+    thread.start()
+    thread.join(probe.timeout)
+    if thread.is_alive():
+        raise ProbeError('{} timed out after {}s'.format(probe.command, probe.timeout))
+
+    exit_code = container.client.exec_inspect(exec_id)['ExitCode']
+    if exit_code != 0:
+        output = binarystr_to_unicode(result.get('output') or b'').strip()
+        raise ProbeError('{} exited with code {}: {}'.format(probe.command, exit_code, output))
+
+
+CHECKS = {
+    'tcp': check_tcp,
+    'http': check_http,
+    'exec': check_exec,
+}
+
+
+class Readiness:
+    """Tracks the probe attempts made on each container of a service."""
+
+    def __init__(self, probe):
+        self.probe = probe
+        self._attempts = {}
+        self._lock = threading.Lock()
+
+    def is_ready(self, container):
+        """Probe `container` unless it was probed less than `interval` ago.
+        Returns True once an attempt succeeds, and raises ReadinessCheckFailed
+        with the last error after `retries` failed attempts.
+        """
+        with self._lock:
+            state = self._attempts.setdefault(container.id, {
+                'failures': 0, 'last': None, 'ready': False,
+            })
+            now = time.monotonic()
+            if state['ready']:
+                return True
+            if state['last'] is not None and now - state['last'] < self.probe.interval:
+                return False
+            state['last'] = now
+
+            try:
+                CHECKS[self.probe.type](container, self.probe)
+            except ProbeError as e:
+                state['failures'] += 1
+                log.debug('Readiness probe for %s failed: %s', container.name, e)
+                if state['failures'] >= self.probe.retries:
+                    raise ReadinessCheckFailed(container.name, e)
+                return False
+
+            state['ready'] = True
+            return True
@@ -0,0 +1,143 @@
+"""
+Timeouts and retries of Docker API calls, for daemons reached over flaky
+links (such as a TCP or SSH tunnelled DOCKER_HOST) where a call sometimes
+hangs or has its connection reset.
+
+Calls that only read state are retried after a timeout or any connection
+error. Creating and starting a container are retried only when the
+connection was reset, and a container created before the reset is reused
+rather than created twice. Other calls are not retried.
+"""
+import functools
+import logging
+import threading
+import time
+from collections import namedtuple
+
+from docker.errors import NotFound
+from requests.exceptions import ConnectionError as RequestsConnectionError
+from requests.exceptions import ReadTimeout
+
+log = logging.getLogger(__name__)
+
+IDEMPOTENT_CALLS = frozenset([
+    'containers',
+    'images',
+    'info',
+    'inspect_container',
+    'inspect_image',
+    'inspect_network',
+    'inspect_volume',
+    'networks',
+    'version',
+    'volumes',
+])
+
+RESET_RETRY_CALLS = frozenset([
+    'create_container',
+    'start',
+])
+
+
+class RetryPolicy(namedtuple('_RetryPolicy', 'timeout retries backoff')):
+    """`timeout` is the number of seconds a call may take, or None to rely
+    on the client's own timeout. A failed call is attempted again up to
+    `retries` times, waiting `backoff` seconds before the first retry and
+    twice as long before each of the next ones.
+    """
+
+    def __new__(cls, timeout=None, retries=3, backoff=0.5):
+        return super().__new__(cls, timeout, retries, backoff)
+
+
+def is_connection_reset(error):
+    """Whether `error`, or an error it wraps, is a reset connection."""
+    seen = set()
+    pending = [error]
+    while pending:
+        e = pending.pop()
+        if id(e) in seen:
+            continue
+        seen.add(id(e))
+        if isinstance(e, ConnectionResetError):
+            return True
+        if isinstance(e, BaseException):
+            pending.extend(arg for arg in e.args if isinstance(arg, BaseException))
+            pending.extend(filter(None, [e.__cause__, e.__context__]))
+    return False
+
+
+def call_with_timeout(timeout, method, *args, **kwargs):
+    """Call `method`, raising ReadTimeout if it doesn't return within
+    `timeout` seconds. The call is then left running in the background.
+    """
+    if timeout is None:
+        return method(*args, **kwargs)
+
+    outcome = {}
+
+    def run():
+        try:
+            outcome['result'] = method(*args, **kwargs)
+        except Exception as e:
+            outcome['error'] = e
+
+    thread = threading.Thread(target=run, daemon=True)
+    thread.start()
+    thread.join(timeout)
+    if thread.is_alive():
+        raise ReadTimeout('{} did not respond within {}s'.format(
+            getattr(method, '__name__', 'API call'), timeout))
+    if 'error' in outcome:
+        raise outcome['error']
+    return outcome['result']
+
+
+class RetryingClient:
+    """Proxy to a `docker.APIClient` that applies a RetryPolicy to each
+    API call.
+    """
+
+    def __init__(self, client, policy):
+        self.client = client
+        self.policy = policy
+
+    def __getattr__(self, name):
+        attr = getattr(self.client, name)
+        if name in IDEMPOTENT_CALLS or name in RESET_RETRY_CALLS:
+            return functools.partial(self._call, name, attr)
+        return attr
+
+    def _should_retry(self, call_name, kwargs, error):
+        if call_name == 'create_container' and not kwargs.get('name'):
+            # Without a name, a container created before the reset can't be found
+            return False
+        if call_name in IDEMPOTENT_CALLS:
+            return isinstance(error, (ReadTimeout, RequestsConnectionError, ConnectionError))
+        return is_connection_reset(error)
+
+    def _call(self, call_name, method, *args, **kwargs):
+        delay = self.policy.backoff
+        for attempt in range(self.policy.retries + 1):
+            try:
+                if attempt and call_name == 'create_container':
+                    created = self._created_container(kwargs.get('name'))
+                    if created:
+                        return created
+                return call_with_timeout(self.policy.timeout, method, *args, **kwargs)
+            except Exception as e:
+                if attempt == self.policy.retries or not self._should_retry(call_name, kwargs, e):
+                    raise
+                log.debug('%s failed (%s), retrying in %ss', call_name, e, delay)
+            time.sleep(delay)
+            delay *= 2
+
+    def _created_container(self, name):
+        """The container a reset create_container call may have created."""
+        if not name:
+            return None
+        try:
+            container = self.client.inspect_container(name)
+        except NotFound:
+            return None
+        return {'Id': container['Id'], 'Warnings': None}
@@ -1,18 +1,27 @@
+import copy
 import enum
 import itertools
+import json
 import logging
 import os
+import posixpath
 import re
+import stat
 import subprocess
 import sys
 import tempfile
+import time
 from collections import namedtuple
 from collections import OrderedDict
 from operator import attrgetter
+from string import Formatter
+from threading import Thread
 
 from docker.errors import APIError
 from docker.errors import ImageNotFound
+from docker.errors import InvalidVersion
 from docker.errors import NotFound
+from docker.types import DriverConfig
 from docker.types import LogConfig
 from docker.types import Mount
 from docker.utils import version_gte
@@ -28,36 +37,63 @@ from .config import DOCKER_CONFIG_KEYS
 from .config import is_url
 from .config import merge_environment
 from .config import merge_labels
+from .config.environment import env_vars_from_file
 from .config.errors import DependencyError
 from .config.types import MountSpec
+from .config.types import parse_platform
 from .config.types import ServicePort
 from .config.types import VolumeSpec
+from .const import DEFAULT_SEPARATOR
 from .const import DEFAULT_TIMEOUT
 from .const import IS_WINDOWS_PLATFORM
 from .const import LABEL_CONFIG_HASH
 from .const import LABEL_CONTAINER_NUMBER
+from .const import LABEL_DEPENDS_ON
+from .const import LABEL_HEALTHCHECK_OVERRIDE
+from .const import LABEL_IMAGE_PROJECT
+from .const import LABEL_IMAGE_SERVICE
 from .const import LABEL_ONE_OFF
 from .const import LABEL_PROJECT
+from .const import LABEL_PROJECT_CONFIG_HASH
 from .const import LABEL_SERVICE
 from .const import LABEL_SLUG
+from .const import LABEL_TENANT
 from .const import LABEL_VERSION
 from .const import NANOCPUS_SCALE
 from .const import WINDOWS_LONGPATH_PREFIX
 from .container import Container
 from .errors import CompletedUnsuccessfully
+from .errors import ExternalContainerError
 from .errors import HealthCheckFailed
+from .errors import ImageNotFoundError
+from .errors import ImagePlatformMismatchError
 from .errors import NoHealthCheckConfigured
+from .errors import OfflineImagesMissingError
 from .errors import OperationFailedError
+from .errors import PlatformNotSupportedError
+from .errors import PortInUseError
+from .image_pull import pull_events
 from .parallel import parallel_execute
+from .progress_stream import stream_events
 from .progress_stream import stream_output
 from .progress_stream import StreamOutputError
+from .readiness import Readiness
+from .stats import ServiceStatsAggregator
+from .tracing import container_attributes
+from .tracing import service_attributes
+from .tracing import span
+from .tracing import traced
 from .utils import generate_random_id
+from .utils import is_local_daemon
 from .utils import json_hash
 from .utils import parse_bytes
 from .utils import parse_seconds_float
 from .utils import truncate_id
 from .utils import unique_everseen
+from .warning import PLATFORM_MISMATCH
+from .warning import Warnings
 from compose.cli.utils import binarystr_to_unicode
+from compose.cli.utils import human_readable_file_size
 
 
 log = logging.getLogger(__name__)
@@ -99,6 +135,7 @@ HOST_CONFIG_KEYS = [
     'pid',
     'pids_limit',
     'privileged',
+    'publish_all_ports',
     'restart',
     'runtime',
     'security_opt',
@@ -114,6 +151,22 @@ CONDITION_STARTED = 'service_started'
 CONDITION_HEALTHY = 'service_healthy'
 CONDITION_COMPLETED_SUCCESSFULLY = 'service_completed_successfully'
 
+MISSING_INIT_BINARY_RE = re.compile(r'exec: "?[^"\s]*init"?: executable file not found')
+PORT_IN_USE_RE = re.compile(
+    r'(?:Bind for|listen \w+) \S*:(\d+)(?: failed)?: '
+    r'(?:port is already allocated|bind: address already in use)'
+)
+# What the daemon answers when inspecting an image whose tag is left but
+# whose layers are gone, such as after a prune
+BROKEN_IMAGE_RE = re.compile(
+    r'layer\b.*\b(?:does not exist|not found|no such file)|unknown layer|failed to get layer',
+    re.IGNORECASE,
+)
+DOCKERFILE_ARG_RE = re.compile(r'^\s*ARG\s+(\w+)(?:=(\S*))?', re.IGNORECASE)
+DOCKERFILE_FROM_RE = re.compile(r'^\s*FROM\s+(?:--platform=\S+\s+)?(\S+)', re.IGNORECASE)
+DOCKERFILE_COPY_FROM_RE = re.compile(r'^\s*COPY\s+.*--from=(\S+)', re.IGNORECASE)
+DOCKERFILE_VARIABLE_RE = re.compile(r'\$(?:\{(\w+)(?::-([^}]*))?\}|(\w+))')
+
 
 class BuildError(Exception):
     def __init__(self, service, reason):
@@ -181,7 +234,15 @@ class Service:
             ipc_mode=None,
             pid_mode=None,
             default_platform=None,
+            default_bind_ip=None,
             extra_labels=None,
+            hooks=None,
+            tenant=None,
+            readiness=None,
+            watch=None,
+            external_container=None,
+            drain_seconds=0,
+            separator=DEFAULT_SEPARATOR,
             **options
     ):
         self.name = name
@@ -197,8 +258,20 @@ class Service:
         self.secrets = secrets or []
         self.scale_num = scale
         self.default_platform = default_platform
+        self.default_bind_ip = default_bind_ip
         self.options = options
         self.extra_labels = extra_labels or []
+        self.hooks = hooks or {}
+        self.tenant = tenant
+        self.readiness = Readiness(readiness) if readiness else None
+        self.watch_rules = watch or []
+        # An ExternalContainer the service adopts instead of creating its own
+        self.external_container = external_container
+        # How long excess containers keep running once scaling down is
+        # decided, for load balancers to notice (`x-drain-seconds`)
+        self.drain_seconds = drain_seconds
+        self.separator = separator
+        self.project_config_hash = None
 
     def __repr__(self):
         return '<Service: {}>'.format(self.name)
@@ -228,6 +301,67 @@ class Service:
             )
         )
 
+    def external_containers(self, stopped=False):
+        """The container the service adopts with `x-external-container`, as
+        a list: empty when there is none, when it doesn't exist or, unless
+        `stopped`, when it isn't running. It is never stopped nor removed by
+        Compose, and isn't part of containers().
+        """
+        if not self.external_container:
+            return []
+        try:
+            container = Container.from_id(self.client, self.external_container.name)
+        except NotFound:
+            return []
+        container.external_service = self.name
+        if not stopped and not container.is_running:
+            return []
+        return [container]
+
+    def ensure_external_container(self):
+        """Check that the container the service adopts is running, and
+        return it as a list. Raises ExternalContainerError if it isn't, unless
+        it is optional.
+        """
+        name = self.external_container.name
+        containers = self.external_containers(stopped=True)
+        if not containers:
+            reason = 'does not exist'
+        elif not containers[0].is_running:
+            reason = 'is not running'
+        else:
+            log.info('Using external container {} for service {}'.format(name, self.name))
+            return containers
+        if not self.external_container.optional:
+            raise ExternalContainerError(self.name, name, reason)
+        log.warning('External container {} of service {} {}, skipping it'.format(
+            name, self.name, reason))
+        return []
+
+    def adopt_external_containers(self):
+        """Connect the running container the service adopts to the networks
+        of the service, with the name of the service among its aliases, for
+        its dependents to reach it by that name. Returns it as a list.
+        """
+        containers = self.external_containers()
+        for container in containers:
+            connected = container.get('NetworkSettings.Networks') or {}
+            for network, netdefs in self.prioritized_networks.items():
+                aliases = set(self._get_aliases(netdefs))
+                if network in connected:
+                    existing = set(connected[network].get('Aliases') or [])
+                    if aliases <= existing:
+                        continue
+                    # Aliases can only be set when connecting
+                    aliases |= existing
+                    self.client.disconnect_container_from_network(container.id, network)
+                log.info('Connecting external container {} to network {}'.format(
+                    container.name, network))
+                self.client.connect_container_to_network(
+                    container.id, network, aliases=sorted(aliases),
+                )
+        return containers
+
     def get_container(self, number=1):
         """Return a :class:`compose.container.Container` for this service. The
         container must be active, and match `number`.
@@ -305,14 +439,13 @@ class Service:
             )
 
         if desired_num < num_running:
-            num_to_stop = num_running - desired_num
-
             sorted_running_containers = sorted(
                 running_containers,
                 key=attrgetter('number'))
 
-            self._downscale(sorted_running_containers[-num_to_stop:], timeout)
+            self._downscale(sorted_running_containers, desired_num, timeout)
 
+    @traced('service.create', service_attributes)
     def create_container(self,
                          one_off=False,
                          previous_container=None,
@@ -339,23 +472,46 @@ class Service:
 
         try:
             return Container.create(self.client, **container_options)
+        except ImageNotFound as ex:
+            raise ImageNotFoundError(
+                self.image_name,
+                "Cannot create container for service %s: %s" %
+                (self.name, binarystr_to_unicode(ex.explanation))
+            )
         except APIError as ex:
+            expl = self._explain_api_error(binarystr_to_unicode(ex.explanation))
             raise OperationFailedError("Cannot create container for service %s: %s" %
-                                       (self.name, binarystr_to_unicode(ex.explanation)))
+                                       (self.name, expl))
+
+    def ensure_image_exists(self, do_build=BuildAction.none, silent=False, cli=False,
+                            pull=False, offline=False, progress=None):
+        """Build or pull the image of the service if it is missing, or when
+        asked to. `offline` never pulls: a missing image that can't be built
+        raises OfflineImagesMissingError. `progress` is as for pull().
+        """
+        if self.external_container:
+            return
 
-    def ensure_image_exists(self, do_build=BuildAction.none, silent=False, cli=False):
         if self.can_be_built() and do_build == BuildAction.force:
             self.build(cli=cli)
             return
 
+        if 'image' in self.options and pull and not offline:
+            self.pull(ignore_pull_failures=self.can_be_built(), silent=silent, progress=progress)
+
         try:
-            self.image()
-            return
+            if self.image_matches_platform(self.image()):
+                return
+            log.info('Image {} of service {} is not for platform {}'.format(
+                self.image_name, self.name, self.platform
+            ))
         except NoSuchImageError:
             pass
 
         if not self.can_be_built():
-            self.pull(silent=silent)
+            if offline:
+                raise OfflineImagesMissingError([self.image_name])
+            self.pull(silent=silent, progress=progress)
             return
 
         if do_build == BuildAction.skip:
@@ -373,15 +529,149 @@ class Service:
         except APIError:
             raise NoSuchImageError("Image '{}' not found".format(self.image_name))
 
+    def has_image(self):
+        """Whether the image of the service is present, for its platform."""
+        try:
+            return self.image_matches_platform(self.image())
+        except NoSuchImageError:
+            return False
+
+    def image_is_up_to_date(self):
+        """Whether the local image is the one the registry has for its tag,
+        compared by manifest digest without downloading anything.
+        """
+        try:
+            image = self.image()
+        except NoSuchImageError:
+            return False
+        if not self.image_matches_platform(image):
+            return False
+        repo_digests = image.get('RepoDigests') or []
+        if ImageReference.parse(self.options['image']).digested:
+            return True
+        try:
+            digest = self.get_image_registry_data()['Descriptor']['digest']
+        except (NoSuchImageError, InvalidVersion):
+            # Daemons before API 1.30 can't look up the registry
+            return False
+        return any(repo_digest.endswith('@' + digest) for repo_digest in repo_digests)
+
+    def image_matches_platform(self, image):
+        """Whether `image` is for the platform the service sets, if any.
+        Parts of the platform the image doesn't report are not compared.
+        """
+        if not self.platform:
+            return True
+        wanted = parse_platform(self.platform)
+        actual = (image.get('Os'), image.get('Architecture'), image.get('Variant'))
+        return all(
+            not want or not have or normalize_architecture(want) == normalize_architecture(have)
+            for want, have in zip(wanted, actual)
+        )
+
     def image(self):
+        """Inspect the image of the service. An image whose layers are gone is
+        treated as missing, for it to be pulled or built again rather than
+        failing to create containers.
+        """
         try:
             return self.client.inspect_image(self.image_name)
         except ImageNotFound:
             raise NoSuchImageError("Image '{}' not found".format(self.image_name))
+        except APIError as e:
+            explanation = binarystr_to_unicode(e.explanation) or str(e)
+            if not BROKEN_IMAGE_RE.search(explanation):
+                raise
+            log.warning('Image {} of service {} is missing layers: {}'.format(
+                self.image_name, self.name, explanation
+            ))
+            raise NoSuchImageError("Image '{}' is missing layers".format(self.image_name))
+
+    def image_id(self):
+        try:
+            return self.image()['Id']
+        except NoSuchImageError:
+            return None
+
+    def remove_dangling_image(self, image_id):
+        """Remove `image_id`, a previous build of this service, if it is left
+        dangling and no container uses it. Images that Compose did not build
+        for this service are never removed. Returns the bytes reclaimed.
+        """
+        try:
+            image = self.client.inspect_image(image_id)
+        except ImageNotFound:
+            return 0
+
+        labels = (image.get('Config') or {}).get('Labels') or {}
+        if (
+                labels.get(LABEL_IMAGE_PROJECT) != self.project or
+                labels.get(LABEL_IMAGE_SERVICE) != self.name
+        ):
+            return 0
+        if any(tag != '<none>:<none>' for tag in image.get('RepoTags') or []):
+            return 0
+        if self.client.containers(all=True, filters={'ancestor': image_id}):
+            log.debug('Image %s of service %s is still in use', image_id, self.name)
+            return 0
+
+        self.client.remove_image(image_id)
+        size = image.get('Size') or 0
+        log.info('Removed dangling image {} of service {} ({})'.format(
+            image_id, self.name, human_readable_file_size(size)
+        ))
+        return size
+
+    def check_image_platform(self, daemon_platform, strict=False, warnings=None):
+        """Warn when the service's image was made for another OS or
+        architecture than the daemon's, as its containers would then fail
+        with exec format errors. With `strict`, raise instead. Services
+        that set a platform are not checked.
+        """
+        if self.platform:
+            return
+        try:
+            image = self.image()
+        except NoSuchImageError:
+            return
+        image_platform = (image.get('Os'), normalize_architecture(image.get('Architecture')))
+        if not all(image_platform) or image_platform == daemon_platform:
+            return
+
+        message = (
+            'Image {image} of service {service} is for {image_platform}, but the '
+            'Docker daemon runs on {daemon_platform}. Its containers may fail with '
+            '"exec format error". Set `platform` on the service to pull an image for '
+            'another platform.'.format(
+                image=self.image_name,
+                service=self.name,
+                image_platform='/'.join(image_platform),
+                daemon_platform='/'.join(daemon_platform),
+            )
+        )
+        if strict:
+            raise ImagePlatformMismatchError(message)
+        (warnings or Warnings()).warn(PLATFORM_MISMATCH, message)
+
+    @property
+    def build_tag(self):
+        """The name the service's image is tagged with when built: the image
+        name, without its digest. A digest alone can't be tagged.
+        """
+        if 'image' not in self.options:
+            return self.image_name
+        reference = ImageReference.parse(self.options['image'])
+        if not reference.tagged and reference.digested:
+            raise BuildError(
+                self,
+                'Image "{}" has no tag to give the built image, only a digest. Add a tag '
+                'to it, such as "{}:latest".'.format(reference, reference.repository)
+            )
+        return str(reference._replace(digest=None))
 
     @property
     def image_name(self):
-        return self.options.get('image', '{project}_{s.name}'.format(
+        return self.options.get('image', '{project}{s.separator}{s.name}'.format(
             s=self, project=self.project.lstrip('_-')
         ))
 
@@ -393,6 +683,15 @@ class Service:
         return platform
 
     def convergence_plan(self, strategy=ConvergenceStrategy.changed, one_off=False):
+        plan = self._convergence_plan(strategy, one_off)
+        log.debug('Convergence plan for %s: %s (strategy: %s)',
+                  self.name, plan.action, strategy.name)
+        return plan
+
+    def _convergence_plan(self, strategy, one_off):
+        if self.external_container and not one_off:
+            return ConvergencePlan('noop', self.external_containers())
+
         containers = self.containers(stopped=True)
 
         if one_off:
@@ -436,6 +735,10 @@ class Service:
                 log.debug('%s has diverged: Legacy project name' % c.name)
                 has_diverged = True
                 continue
+            if LABEL_HEALTHCHECK_OVERRIDE in c.labels:
+                log.info('Restoring the healthcheck of the Compose file for %s' % c.name)
+                has_diverged = True
+                continue
             container_config_hash = c.labels.get(LABEL_CONFIG_HASH, None)
             if container_config_hash != config_hash:
                 log.debug(
@@ -443,6 +746,8 @@ class Service:
                     c.name, container_config_hash, config_hash,
                 )
                 has_diverged = True
+            else:
+                log.debug('%s config hash matches: %s', c.name, config_hash)
 
         return has_diverged
 
@@ -463,7 +768,7 @@ class Service:
 
         def get_name(service_name):
             if one_off:
-                return "_".join([
+                return self.separator.join([
                     service_name.project,
                     service_name.service,
                     "run",
@@ -487,7 +792,7 @@ class Service:
     def _execute_convergence_recreate(self, containers, scale, timeout, detached, start,
                                       renew_anonymous_volumes):
         if scale is not None and len(containers) > scale:
-            self._downscale(containers[scale:], timeout)
+            self._downscale(containers, scale, timeout)
             containers = containers[:scale]
 
         def recreate(container):
@@ -513,7 +818,7 @@ class Service:
 
     def _execute_convergence_start(self, containers, scale, timeout, detached, start):
         if scale is not None and len(containers) > scale:
-            self._downscale(containers[scale:], timeout)
+            self._downscale(containers, scale, timeout)
             containers = containers[:scale]
         if start:
             stopped = [c for c in containers if not c.is_running]
@@ -533,22 +838,49 @@ class Service:
             ))
         return containers
 
-    def _downscale(self, containers, timeout=None):
-        def stop_and_remove(container):
+    def _downscale(self, containers, scale, timeout=None):
+        """Remove the containers beyond the first `scale` of `containers`,
+        which are sorted by number. They are drained for `x-drain-seconds`,
+        for load balancers to notice, then stopped within their stop grace
+        period and removed highest number first, so that the numbering stays
+        contiguous even if stopping or removing one fails: the containers
+        numbered below it are left alone.
+        """
+        excess = sorted(containers[scale:], key=attrgetter('number'), reverse=True)
+        log.info('Scaling %s from %d to %d', self.name, len(containers), scale)
+
+        if self.drain_seconds:
+            parallel_execute(
+                excess, lambda c: time.sleep(self.drain_seconds), attrgetter('name'), 'Draining',
+            )
+
+        def stop(container):
+            self.run_pre_stop_hooks(container)
             container.stop(timeout=self.stop_timeout(timeout))
-            container.remove()
+            return container
+
+        def after_higher(containers):
+            def get_deps(container):
+                index = containers.index(container)
+                return [(containers[index - 1], None)] if index else []
+            return get_deps
+
+        stopped, _ = parallel_execute(
+            excess, stop, attrgetter('name'), 'Stopping', after_higher(excess),
+        )
+        stopped = [c for c in excess if c in stopped]
 
         parallel_execute(
-            containers,
-            stop_and_remove,
-            lambda c: c.name,
-            "Stopping and removing",
+            stopped, lambda c: c.remove(), attrgetter('name'), 'Removing', after_higher(stopped),
         )
 
     def execute_convergence_plan(self, plan, timeout=None, detached=False,
                                  start=True, scale_override=None,
                                  rescale=True, reset_container_image=False,
                                  renew_anonymous_volumes=False, override_options=None):
+        if self.external_container and plan.action != 'one_off':
+            return self.adopt_external_containers()
+
         (action, containers) = plan
         scale = scale_override if scale_override is not None else self.scale_num
         containers = sorted(containers, key=attrgetter('number'))
@@ -599,7 +931,7 @@ class Service:
         raise Exception("Invalid action: {}".format(action))
 
     def recreate_container(self, container, timeout=None, attach_logs=False, start_new_container=True,
-                           renew_anonymous_volumes=False):
+                           renew_anonymous_volumes=False, override_options=None):
         """Recreate a container.
 
         The original container is renamed to a temporary name so that data
@@ -607,20 +939,49 @@ class Service:
         container is removed.
         """
 
+        self.run_pre_stop_hooks(container)
         container.stop(timeout=self.stop_timeout(timeout))
         container.rename_to_tmp_name()
         new_container = self.create_container(
             previous_container=container if not renew_anonymous_volumes else None,
             number=container.number,
             quiet=True,
+            **(override_options or {})
         )
         if attach_logs:
             new_container.attach_log_stream()
         if start_new_container:
             self.start_container(new_container)
-        container.remove()
+        if renew_anonymous_volumes:
+            # The engine only removes anonymous volumes with `v`, named
+            # volumes and bind mounts are left untouched
+            container.remove(v=True)
+        else:
+            container.remove()
         return new_container
 
+    def set_healthcheck(self, healthcheck, timeout=None):
+        """Recreate the containers of the service with `healthcheck`, in the
+        form the engine takes, instead of the Compose file's. Containers
+        that were stopped are left stopped. The next `up` that may recreate
+        them restores the Compose file's healthcheck.
+        """
+        override_options = {
+            'healthcheck': healthcheck,
+            # Override options replace those of the service, labels included
+            'labels': dict(
+                self.options.get('labels') or {},
+                **{LABEL_HEALTHCHECK_OVERRIDE: json.dumps(healthcheck, sort_keys=True)}
+            ),
+        }
+        return [
+            self.recreate_container(
+                container, timeout, start_new_container=container.is_running,
+                override_options=override_options,
+            )
+            for container in sorted(self.containers(stopped=True), key=attrgetter('number'))
+        ]
+
     def stop_timeout(self, timeout):
         if timeout is not None:
             return timeout
@@ -637,6 +998,7 @@ class Service:
                 container.attach_log_stream()
             return self.start_container(container)
 
+    @traced('service.start', container_attributes)
     def start_container(self, container, use_network_aliases=True):
         self.connect_container_to_networks(container, use_network_aliases)
         try:
@@ -645,9 +1007,215 @@ class Service:
             expl = binarystr_to_unicode(ex.explanation)
             if "driver failed programming external connectivity" in expl:
                 log.warn("Host is already in use by another container")
-            raise OperationFailedError("Cannot start service {}: {}".format(self.name, expl))
+            expl = self._explain_api_error(expl)
+            msg = "Cannot start service {}: {}".format(self.name, expl)
+            port_in_use = PORT_IN_USE_RE.search(expl)
+            if port_in_use:
+                raise PortInUseError(int(port_in_use.group(1)), msg)
+            raise OperationFailedError(msg)
+        if container.get('HostConfig.PublishAllPorts') or container.get('HostConfig.PortBindings'):
+            # Host ports that the daemon picks, random ones or from a range,
+            # are only known once the container is started
+            container.inspect()
+        self.run_post_start_hooks(container)
         return container
 
+    def run_post_start_hooks(self, container):
+        for hook in self.hooks.get('post_start', []):
+            exit_code, output = self._run_hook(container, hook, timeout=hook.timeout)
+            if exit_code != 0:
+                raise OperationFailedError(
+                    'post_start hook {} failed for {} (exit code {}): {}'.format(
+                        hook.command, container.name, exit_code, output.strip()
+                    )
+                )
+
+    def run_pre_stop_hooks(self, container):
+        hooks = self.hooks.get('pre_stop', [])
+        # Checking whether the container runs inspects it
+        if not hooks or not container.is_running:
+            return
+        for hook in hooks:
+            timeout = hook.timeout if hook.timeout is not None else DEFAULT_TIMEOUT
+            try:
+                exit_code, output = self._run_hook(container, hook, timeout=timeout)
+            except OperationFailedError as e:
+                log.warning(e.msg)
+                continue
+            if exit_code != 0:
+                log.warning(
+                    'pre_stop hook {} failed for {} (exit code {}): {}'.format(
+                        hook.command, container.name, exit_code, output.strip()
+                    )
+                )
+
+    def _run_hook(self, container, hook, timeout=None):
+        # The daemon can't kill an exec, so the hook runs in a TTY for one
+        # that times out to be interrupted
+        exec_id = container.create_exec(
+            hook.command,
+            user=hook.user or '',
+            privileged=hook.privileged,
+            workdir=hook.working_dir,
+            stdin=True,
+            tty=True,
+        )
+        result = {}
+
+        def run():
+            try:
+                result['socket'] = container.start_exec(exec_id, tty=True, socket=True)
+                result['output'] = read_exec_socket(result['socket'])
+            except Exception as e:
+                result['error'] = e
+
+        thread = Thread(target=run, daemon=True)
+        thread.start()
+        thread.join(timeout)
+        if thread.is_alive():
+            if 'socket' in result:
+                interrupt_exec_socket(result['socket'])
+            raise OperationFailedError(
+                'Hook {} timed out after {}s in {}'.format(
+                    hook.command, timeout, container.name
+                )
+            )
+        if 'error' in result:
+            raise OperationFailedError(
+                'Hook {} could not run in {}: {}'.format(
+                    hook.command, container.name, result['error']
+                )
+            )
+        output = binarystr_to_unicode(result['output']).replace('\r\n', '\n')
+        return self.client.exec_inspect(exec_id)['ExitCode'], output
+
+    def _explain_api_error(self, explanation):
+        if MISSING_INIT_BINARY_RE.search(explanation or ''):
+            return (
+                '{}\nThe "{}" service sets `init`, but the Docker daemon could not find '
+                'its init binary. Install docker-init (tini) on the daemon host, point '
+                'the daemon\'s `init-path` setting at an existing binary, or set '
+                '`init: false` for this service.'.format(explanation, self.name)
+            )
+        return explanation
+
+    def apply_env_files(self, env_files):
+        """Merge extra env files over the service environment, in order. A
+        variable defined in several places takes its last definition.
+        """
+        env = {}
+        for env_file in env_files:
+            env.update(env_vars_from_file(env_file))
+        self.options['environment'] = merge_environment(self.options.get('environment'), env)
+
+    @property
+    def requests_init(self):
+        return self.options.get('init') is True
+
+    def bind_mounts(self):
+        """The host paths bind mounted in the service's containers, with
+        whether they are mounted read-only.
+        """
+        for volume in self.options.get('volumes') or []:
+            if isinstance(volume, MountSpec):
+                if volume.type == 'bind' and volume.source:
+                    yield volume.source, bool(volume.read_only)
+            elif volume.external and not volume.is_named_volume:
+                yield volume.external, volume.read_only
+
+    def inaccessible_bind_mounts(self, userns_remap=False):
+        """The bind mounts, as (path, stat result) pairs, that the container
+        user likely can't use. This is a guess from the ownership and mode of
+        the paths on this host: when the daemon remaps user namespaces, the
+        container users only get the permissions of others, unless the
+        service sets `userns_mode: host`; otherwise a numeric `user` gets
+        those of the owner, group or others of the path.
+        """
+        if IS_WINDOWS_PLATFORM:
+            return []
+        if userns_remap and self.options.get('userns_mode') != 'host':
+            uid = gid = None
+        else:
+            uid, gid = parse_numeric_user(self.options.get('user'))
+            if not uid:
+                return []
+
+        inaccessible = []
+        for path, read_only in self.bind_mounts():
+            try:
+                path_stat = os.stat(os.path.expanduser(path))
+            except OSError:
+                continue
+            if uid is None and path_stat.st_uid >= SUBORDINATE_ID_START:
+                # Probably already owned by a remapped user
+                continue
+            if not stat_allows(path_stat, uid, gid, read_only):
+                inaccessible.append((path, path_stat))
+        return inaccessible
+
+    def misconfigured_bind_mounts(self):
+        """The bind mounts, as (source, target, problem) tuples, whose source
+        is likely not what the container expects:
+
+        - `missing`: the source of a `host:container` mount whose target looks
+          like a file, such as config.yml, or a socket doesn't exist. The
+          daemon would create a directory in its place.
+        - `directory`: the source is a directory, but the target looks like a
+          file or a socket. An earlier missing source may have been created
+          as one by the daemon.
+        - `not-socket`: the target looks like a socket, but the source isn't.
+
+        Sources are only checked when the daemon runs on this machine.
+        """
+        if IS_WINDOWS_PLATFORM or not is_local_daemon(self.client):
+            return []
+
+        problems = []
+        for volume in self.options.get('volumes') or []:
+            if isinstance(volume, MountSpec):
+                if volume.type != 'bind' or not volume.source:
+                    continue
+                source, target, created_by_daemon = volume.source, volume.target, False
+            elif volume.external and not volume.is_named_volume:
+                source, target, created_by_daemon = volume.external, volume.internal, True
+            else:
+                continue
+
+            target_kind = bind_target_kind(target)
+            try:
+                source_mode = os.stat(os.path.expanduser(source)).st_mode
+            except FileNotFoundError:
+                if created_by_daemon and target_kind:
+                    problems.append((source, target, 'missing'))
+                continue
+            except OSError:
+                continue
+
+            if target_kind and stat.S_ISDIR(source_mode):
+                problems.append((source, target, 'directory'))
+            elif target_kind == 'socket' and not stat.S_ISSOCK(source_mode):
+                problems.append((source, target, 'not-socket'))
+        return problems
+
+    def create_bind_mount_directories(self):
+        """Create the missing sources of the `host:container` bind mounts that
+        look like directories, and the missing parent directories of the
+        others, as the current user rather than as root by the daemon. Files
+        are never created, nor directories for a daemon on another machine.
+        """
+        if not is_local_daemon(self.client):
+            return
+        for volume in self.options.get('volumes') or []:
+            if isinstance(volume, MountSpec) or not volume.external or volume.is_named_volume:
+                continue
+            directory = os.path.expanduser(volume.external)
+            if bind_target_kind(volume.internal):
+                directory = os.path.dirname(directory)
+            if os.path.exists(directory):
+                continue
+            log.info('Creating directory %s for service %s', directory, self.name)
+            os.makedirs(directory)
+
     @property
     def prioritized_networks(self):
         return OrderedDict(
@@ -708,8 +1276,13 @@ class Service:
             except NoSuchImageError:
                 return None
 
-        return {
-            'options': self.options,
+        options = self.options
+        if 'image' in options:
+            # Equivalent references, such as `redis` and `redis:latest`, hash alike
+            options = dict(options, image=ImageReference.parse(options['image']).familiar())
+
+        config = {
+            'options': options,
             'image_id': image_id(),
             'links': self.get_link_names(),
             'net': self.network_mode.id,
@@ -721,34 +1294,113 @@ class Service:
                 for v in self.volumes_from if isinstance(v.source, Service)
             ]
         }
+        if self.default_bind_ip and options.get('ports'):
+            # Containers are recreated to move their ports to another IP
+            config['default_bind_ip'] = self.default_bind_ip
+        if options.get('x-inject-ports'):
+            # Containers are recreated when the ports of their dependencies change
+            config['dependency_ports'] = self.dependency_port_environment()
+        return config
+
+    def get_namespace_dependency_names(self):
+        """Names of the services whose network, PID or IPC namespace this
+        service's containers join.
+        """
+        return [
+            mode.service_name
+            for mode in (self.network_mode, self.pid_mode, self.ipc_mode)
+            if mode.service_name
+        ]
 
     def get_dependency_names(self):
-        net_name = self.network_mode.service_name
-        pid_namespace = self.pid_mode.service_name
-        ipc_namespace = self.ipc_mode.service_name
         return (
                 self.get_linked_service_names() +
                 self.get_volumes_from_names() +
-                ([net_name] if net_name else []) +
-                ([pid_namespace] if pid_namespace else []) +
-                ([ipc_namespace] if ipc_namespace else []) +
+                self.get_namespace_dependency_names() +
                 list(self.options.get('depends_on', {}).keys())
         )
 
-    def get_dependency_configs(self):
-        net_name = self.network_mode.service_name
-        pid_namespace = self.pid_mode.service_name
-        ipc_namespace = self.ipc_mode.service_name
+    def dependency_labels(self):
+        # Recorded on the containers so that the dependency graph can be
+        # rebuilt when the Compose file is gone (see Project.from_containers)
+        dependencies = sorted(set(self.get_dependency_names()))
+        if not dependencies:
+            return []
+        return ['{}={}'.format(LABEL_DEPENDS_ON, ','.join(dependencies))]
+
+    def dependency_port_environment(self):
+        """With `x-inject-ports: true`, the host ports published by the
+        services this one depends on, as variables such as
+        `DEPENDENCY_DB_PORT_5432_TCP_PORT`, so that ports assigned by the
+        daemon can be found. The dependencies must have been started.
+        """
+        if not self.options.get('x-inject-ports'):
+            return {}
+
+        environment = {}
+        for dependency in sorted(self.options.get('depends_on') or {}):
+            labels = [
+                label for label in self.labels() if not label.startswith(LABEL_SERVICE + '=')
+            ]
+            labels.append('{}={}'.format(LABEL_SERVICE, dependency))
+            containers = sorted(
+                filter(None, [
+                    Container.from_ps(self.client, container)
+                    for container in self.client.containers(filters={'label': labels})
+                ]),
+                key=attrgetter('number'),
+            )
+            if not containers:
+                continue
+
+            prefix = 'DEPENDENCY_{}'.format(re.sub(r'[^A-Z0-9]', '_', dependency.upper()))
+            for private, bindings in sorted(containers[0].ports.items()):
+                if not bindings:
+                    continue
+                port, _, protocol = private.partition('/')
+                name = '{}_PORT_{}_{}_PORT'.format(prefix, port, protocol.upper())
+                environment[name] = bindings[0]['HostPort']
+        return environment
+
+    def container_labels(self, one_off=False):
+        """The labels Compose sets on the service's containers, besides their
+        number and config hash.
+        """
+        return self.labels(one_off=one_off) + self.extra_labels + self.dependency_labels()
 
+    def resolved_config(self):
+        """The service as `up` acts on it: its options completed with the
+        image name, platform, scale, networks and network mode resolved for
+        the project, and the names and labels of its containers. Containers
+        are created from it.
+        """
+        config = copy.deepcopy(self.options)
+        config['image'] = self.image_name
+        config['scale'] = self.scale_num
+        if self.platform:
+            config['platform'] = self.platform
+        if self.networks:
+            config['networks'] = copy.deepcopy(self.networks)
+        if self.network_mode.service_name:
+            config['network_mode'] = 'service:{}'.format(self.network_mode.service_name)
+        elif self.network_mode.id:
+            config['network_mode'] = self.network_mode.mode
+        config['container_names'] = [
+            self.get_container_name(self.name, number) for number in range(1, self.scale_num + 1)
+        ]
+        config['labels'] = merge_labels(self.options.get('labels'), self.container_labels())
+        return config
+
+    def get_dependency_configs(self):
         configs = {
             name: None for name in self.get_linked_service_names()
         }
         configs.update(
             (name, None) for name in self.get_volumes_from_names()
         )
-        configs.update({net_name: None} if net_name else {})
-        configs.update({pid_namespace: None} if pid_namespace else {})
-        configs.update({ipc_namespace: None} if ipc_namespace else {})
+        configs.update(
+            (name, None) for name in self.get_namespace_dependency_names()
+        )
         configs.update(self.options.get('depends_on', {}))
         for svc, config in self.options.get('depends_on', {}).items():
             if config['condition'] == CONDITION_STARTED:
@@ -838,6 +1490,9 @@ class Service:
                 links[link_name or service.name] = container.name
                 links[container.name] = container.name
                 links[container.name_without_project] = container.name
+            for container in service.external_containers():
+                links[link_name or service.name] = container.name
+                links[container.name] = container.name
 
         if link_to_self:
             for container in self.containers():
@@ -869,17 +1524,34 @@ class Service:
         add_config_hash = (not one_off and not override_options)
         slug = generate_random_id() if one_off else None
 
+        # Containers are created from the service as the project resolves it
+        resolved = self.resolved_config()
         container_options = {
-            k: self.options[k]
-            for k in DOCKER_CONFIG_KEYS if k in self.options}
+            k: resolved[k]
+            for k in DOCKER_CONFIG_KEYS if k in resolved}
         override_volumes = override_options.pop('volumes', [])
         container_options.update(override_options)
 
+        # An unset command or entrypoint is that of the image, an empty one
+        # clears it. As the daemon runs the command of the image when the
+        # entrypoint isn't set, clearing the command takes setting the
+        # entrypoint of the image explicitly
+        command = container_options.get('command')
+        if command is not None and not command and container_options.get('entrypoint') is None:
+            entrypoint = (self.image().get('Config') or {}).get('Entrypoint')
+            if entrypoint:
+                container_options['entrypoint'] = entrypoint
+
         if not container_options.get('name'):
             container_options['name'] = self.get_container_name(self.name, number, slug)
 
         container_options.setdefault('detach', True)
 
+        if 'hostname' in container_options:
+            container_options['hostname'] = expand_hostname(
+                container_options['hostname'], self.project, self.name, number,
+            )
+
         # If a qualified hostname was given, split it into an
         # unqualified hostname and a domainname unless domainname
         # was also given explicitly. This matches behavior
@@ -909,28 +1581,36 @@ class Service:
         container_options['environment'] = merge_environment(
             self._parse_proxy_config(),
             merge_environment(
-                self.options.get('environment'),
+                merge_environment(
+                    dict(
+                        self.dependency_port_environment(),
+                        COMPOSE_REPLICA_INDEX=str(number),
+                    ),
+                    self.options.get('environment')
+                ),
                 override_options.get('environment')
             )
         )
 
         container_options['labels'] = merge_labels(
-            self.options.get('labels'),
+            resolved['labels'],
             override_options.get('labels'))
 
         container_options, override_options = self._build_container_volume_options(
             previous_container, container_options, override_options
         )
 
-        container_options['image'] = self.image_name
+        container_options['image'] = resolved['image']
 
         container_options['labels'] = build_container_labels(
             container_options.get('labels', {}),
-            self.labels(one_off=one_off) + self.extra_labels,
+            self.container_labels(one_off=one_off),
             number,
             self.config_hash if add_config_hash else None,
             slug
         )
+        if add_config_hash and self.project_config_hash:
+            container_options['labels'][LABEL_PROJECT_CONFIG_HASH] = self.project_config_hash
 
         # Delete options which are only used in HostConfig
         for key in HOST_CONFIG_KEYS:
@@ -1013,9 +1693,11 @@ class Service:
 
         return self.client.create_host_config(
             links=self._get_links(link_to_self=one_off),
-            port_bindings=build_port_bindings(
-                formatted_ports(options.get('ports', []))
+            port_bindings=bind_to_host_ip(
+                build_port_bindings(formatted_ports(options.get('ports', []))),
+                self.default_bind_ip,
             ),
+            publish_all_ports=options.get('publish_all_ports'),
             binds=options.get('binds'),
             volumes_from=self._get_volumes_from(),
             privileged=options.get('privileged', False),
@@ -1085,6 +1767,7 @@ class Service:
 
         return [build_spec(secret) for secret in self.secrets]
 
+    @traced('service.build', service_attributes)
     def build(self, no_cache=False, pull=False, force_rm=False, memory=None, build_args_override=None,
               gzip=False, rm=True, silent=False, cli=False, progress=None):
         output_stream = open(os.devnull, 'w')
@@ -1094,16 +1777,13 @@ class Service:
 
         build_opts = self.options.get('build', {})
 
-        build_args = build_opts.get('args', {}).copy()
-        if build_args_override:
-            build_args.update(build_args_override)
-
+        build_args = self.build_args(build_args_override)
         for k, v in self._parse_proxy_config().items():
             build_args.setdefault(k, v)
 
         path = rewrite_build_path(build_opts.get('context'))
         if self.platform and version_lt(self.client.api_version, '1.35'):
-            raise OperationFailedError(
+            raise PlatformNotSupportedError(
                 'Impossible to perform platform-targeted builds for API version < 1.35'
             )
 
@@ -1111,14 +1791,15 @@ class Service:
         return builder.build(
             service=self,
             path=path,
-            tag=self.image_name,
+            tag=self.build_tag,
             rm=rm,
             forcerm=force_rm,
             pull=pull,
             nocache=no_cache,
             dockerfile=build_opts.get('dockerfile', None),
             cache_from=self.get_cache_from(build_opts),
-            labels=build_opts.get('labels', None),
+            cache_to=self.get_cache_to(build_opts),
+            labels=self.build_labels(build_opts),
             buildargs=build_args,
             network_mode=build_opts.get('network', None),
             target=build_opts.get('target', None),
@@ -1132,22 +1813,110 @@ class Service:
             platform=self.platform,
             output_stream=output_stream)
 
+    def build_base_images(self, build_args_override=None):
+        """The images the Dockerfile of the service uses, in FROM and
+        COPY --from instructions, with the build arguments substituted.
+        Empty when the Dockerfile can't be read, e.g. for a remote context.
+        """
+        build_opts = self.options.get('build', {})
+        context = build_opts.get('context')
+        if not context or is_url(context):
+            return []
+        dockerfile = os.path.join(context, build_opts.get('dockerfile') or 'Dockerfile')
+        try:
+            with open(dockerfile) as f:
+                lines = f.read().splitlines()
+        except OSError:
+            return []
+
+        args = self.build_args(build_args_override)
+
+        def substitute(value):
+            return DOCKERFILE_VARIABLE_RE.sub(
+                lambda m: args.get(m.group(1) or m.group(3)) or m.group(2) or '', value
+            )
+
+        images = []
+        for line in lines:
+            arg = DOCKERFILE_ARG_RE.match(line)
+            if arg:
+                if arg.group(2) is not None:
+                    args.setdefault(arg.group(1), substitute(arg.group(2)))
+                continue
+            image = DOCKERFILE_FROM_RE.match(line) or DOCKERFILE_COPY_FROM_RE.match(line)
+            if image:
+                images.append(substitute(image.group(1)))
+        return images
+
+    def build_args(self, build_args_override=None):
+        """The build arguments of the service: its `build.args`, overridden
+        by `build_args_override`. An override without a value takes that of
+        the variable of the same name in the environment of Compose, and is
+        left out when there is none. The environment of the containers of
+        the service, from `environment` and `env_file`, is never used: a
+        variable can be both a build argument and a runtime variable with
+        different values.
+        """
+        args = dict(self.options.get('build', {}).get('args') or {})
+        for key, value in (build_args_override or {}).items():
+            if value is None:
+                value = os.environ.get(key)
+            if value is not None:
+                args[key] = value
+        return args
+
+    def build_labels(self, build_opts):
+        labels = dict(build_opts.get('labels') or {})
+        labels.update({
+            LABEL_IMAGE_PROJECT: self.project,
+            LABEL_IMAGE_SERVICE: self.name,
+        })
+        if self.tenant:
+            labels[LABEL_TENANT] = self.tenant
+        return labels
+
     def get_cache_from(self, build_opts):
+        """The cache sources of the build: images, or buildx cache imports
+        such as `type=registry,ref=<image>`, `type=local,src=<directory>` or
+        `type=gha`. A local cache that doesn't exist yet, as on the first
+        build of a CI machine, is left out with a warning.
+        """
         cache_from = build_opts.get('cache_from', None)
         if cache_from is not None:
             cache_from = [tag for tag in cache_from if tag]
+        for source in list(cache_from or []):
+            attrs = parse_cache_option(source)
+            if attrs.get('type') == 'local' and not os.path.isdir(attrs.get('src', '')):
+                log.warning(
+                    'Service %s: ignoring the build cache %s, which doesn\'t exist',
+                    self.name, attrs.get('src'),
+                )
+                cache_from.remove(source)
         return cache_from
 
+    def get_cache_to(self, build_opts):
+        """The buildx cache exports of the build, such as
+        `type=registry,ref=<image>,mode=max` or `type=local,dest=<directory>`.
+        """
+        return [tag for tag in build_opts.get('cache_to') or [] if tag] or None
+
+    def get_cache_images(self, build_opts):
+        """The images the build uses as cache, to pull beforehand."""
+        return list(filter(None, map(cache_image, self.get_cache_from(build_opts) or [])))
+
     def can_be_built(self):
         return 'build' in self.options
 
     def labels(self, one_off=False, legacy=False):
         proj_name = self.project if not legacy else re.sub(r'[_-]', '', self.project)
-        return [
+        labels = [
             '{}={}'.format(LABEL_PROJECT, proj_name),
             '{}={}'.format(LABEL_SERVICE, self.name),
             '{}={}'.format(LABEL_ONE_OFF, "True" if one_off else "False"),
         ]
+        if self.tenant:
+            labels.append('{}={}'.format(LABEL_TENANT, self.tenant))
+        return labels
 
     @property
     def custom_container_name(self):
@@ -1158,7 +1927,7 @@ class Service:
             return self.custom_container_name
 
         container_name = build_container_name(
-            self.project, service_name, number, slug,
+            self.project, service_name, number, slug, self.separator,
         )
         ext_links_origins = [link.split(':')[0] for link in self.options.get('external_links', [])]
         if container_name in ext_links_origins:
@@ -1215,49 +1984,82 @@ class Service:
 
     def _do_pull(self, repo, pull_kwargs, silent, ignore_pull_failures):
         try:
-            output = self.client.pull(repo, **pull_kwargs)
+            events = pull_events(self.client, repo, **pull_kwargs)
             if silent:
                 with open(os.devnull, 'w') as devnull:
-                    yield from stream_output(output, devnull)
+                    yield from stream_events(events, devnull)
             else:
-                yield from stream_output(output, sys.stdout)
+                yield from stream_events(events, sys.stdout)
         except (StreamOutputError, NotFound) as e:
             if not ignore_pull_failures:
+                if isinstance(e, NotFound):
+                    raise ImageNotFoundError(
+                        self.options['image'], binarystr_to_unicode(e.explanation))
                 raise
             else:
                 log.error(str(e))
 
-    def pull(self, ignore_pull_failures=False, silent=False, stream=False):
+    def pull(self, ignore_pull_failures=False, silent=False, stream=False, progress=None,
+             cancel=None):
+        """Pull the image of the service. `progress` and `cancel` are as for
+        compose.image_pull.pull_image.
+        """
         if 'image' not in self.options:
             return
 
-        repo, tag, separator = parse_repository_tag(self.options['image'])
+        reference = ImageReference.parse(self.options['image'])
+        repo = reference.repository
         kwargs = {
-            'tag': tag or 'latest',
-            'stream': True,
+            'tag': reference.pull_tag,
             'platform': self.platform,
+            'progress': progress,
+            'cancel': cancel,
         }
         if not silent:
-            log.info('Pulling {} ({}{}{})...'.format(self.name, repo, separator, tag))
+            log.info('Pulling {} ({})...'.format(self.name, reference))
 
         if kwargs['platform'] and version_lt(self.client.api_version, '1.35'):
-            raise OperationFailedError(
+            raise PlatformNotSupportedError(
                 'Impossible to perform platform-targeted pulls for API version < 1.35'
             )
 
-        event_stream = self._do_pull(repo, kwargs, silent, ignore_pull_failures)
+        if self.image_is_up_to_date():
+            status = 'Image is up to date for {}'.format(self.options['image'])
+            if not silent and not stream:
+                log.info(status)
+            event_stream = iter([{'status': 'Status: {}'.format(status)}])
+        else:
+            event_stream = self._do_pull(repo, kwargs, silent, ignore_pull_failures)
         if stream:
             return event_stream
-        return progress_stream.get_digest_from_pull(event_stream)
-
+        with span('service.pull', service_attributes(self)):
+            events = list(event_stream)
+        size = progress_stream.get_download_size(events)
+        if size and not silent:
+            log.info('Downloaded {} for service {}'.format(human_readable_file_size(size), self.name))
+        return progress_stream.get_digest_from_pull(events)
+
+    @traced('service.push', service_attributes)
     def push(self, ignore_push_failures=False):
         if 'image' not in self.options or 'build' not in self.options:
             return
 
-        repo, tag, separator = parse_repository_tag(self.options['image'])
-        tag = tag or 'latest'
-        log.info('Pushing {} ({}{}{})...'.format(self.name, repo, separator, tag))
-        output = self.client.push(repo, tag=tag, stream=True)
+        reference = ImageReference.parse(self.options['image'])
+        if not reference.tagged and reference.digested:
+            message = (
+                'Cannot push image "{}" of service {}: a digest can\'t be pushed to. '
+                'Add a tag to it, such as "{}:latest".'.format(
+                    reference, self.name, reference.repository
+                )
+            )
+            if not ignore_push_failures:
+                raise OperationFailedError(message)
+            log.error(message)
+            return None
+
+        tag = reference.tag or 'latest'
+        log.info('Pushing {} ({}:{})...'.format(self.name, reference.repository, tag))
+        output = self.client.push(reference.repository, tag=tag, stream=True)
 
         try:
             return progress_stream.get_digest_from_push(
@@ -1272,13 +2074,17 @@ class Service:
         """ Check that all containers for this service report healthy.
             Returns false if at least one healthcheck is pending.
             If an unhealthy container is detected, raise a HealthCheckFailed
-            exception.
+            exception. Containers without a healthcheck are checked with
+            the service's readiness probe, if it has one.
         """
         result = True
-        for ctnr in self.containers():
+        for ctnr in self.containers() + self.external_containers():
             ctnr.inspect()
             status = ctnr.get('State.Health.Status')
-            if status is None:
+            log.debug('Waiting for %s to be healthy: %s', ctnr.name, status)
+            if status is None and self.readiness:
+                result = self.readiness.is_ready(ctnr) and result
+            elif status is None:
                 raise NoHealthCheckConfigured(self.name)
             elif status == 'starting':
                 result = False
@@ -1293,14 +2099,34 @@ class Service:
             exited with non-zero exit code.
         """
         result = True
-        for ctnr in self.containers(stopped=True):
+        for ctnr in self.containers(stopped=True) + self.external_containers(stopped=True):
             ctnr.inspect()
+            log.debug('Waiting for %s to complete: %s', ctnr.name, ctnr.get('State.Status'))
             if ctnr.get('State.Status') != 'exited':
                 result = False
             elif ctnr.exit_code != 0:
                 raise CompletedUnsuccessfully(ctnr.short_id, ctnr.exit_code)
         return result
 
+    def stats(self, interval=1):
+        """ Yield a StatsSample aggregating the resource usage of all the
+            running containers of this service, once every `interval` seconds.
+            Containers started or removed while streaming are picked up on
+            the next tick.
+        """
+        aggregator = ServiceStatsAggregator()
+        while True:
+            started = time.time()
+            samples = {}
+            for ctnr in self.containers():
+                try:
+                    samples[ctnr.id] = self.client.stats(ctnr.id, stream=False)
+                except NotFound:
+                    # Removed since we listed it
+                    continue
+            yield aggregator.update(samples)
+            time.sleep(max(interval - (time.time() - started), 0))
+
     def _parse_proxy_config(self):
         client = self.client
         if 'proxies' not in client._general_configs:
@@ -1345,6 +2171,66 @@ class Service:
         return False
 
 
+# Subordinate ids, used by userns-remap, start above the range of regular users
+SUBORDINATE_ID_START = 65536
+
+
+def parse_numeric_user(user):
+    """The uid and gid of a `user: uid[:gid]` option, None for names."""
+    name, _, group = str(user or '').partition(':')
+    uid = int(name) if name.isdigit() else None
+    gid = int(group) if group.isdigit() else None
+    return uid, gid
+
+
+def bind_target_kind(target):
+    """Guess whether the path a bind mount is mounted at in a container is a
+    `file` or a `socket`, from its extension. None means it's likely a
+    directory.
+    """
+    if target.endswith('/'):
+        return None
+    name = posixpath.basename(target)
+    if name.endswith('.sock'):
+        return 'socket'
+    # Ignore leading dots, as in .config, version-like extensions and .d
+    # directories
+    extension = posixpath.splitext(name.lstrip('.'))[1][1:]
+    if extension and not extension.isdigit() and extension != 'd':
+        return 'file'
+    return None
+
+
+def stat_allows(path_stat, uid, gid, read_only):
+    """Whether the permissions of a path let `uid`/`gid` read it, and write
+    it unless `read_only`. None stands for a user that is neither the owner
+    nor in the group.
+    """
+    if uid is not None and path_stat.st_uid == uid:
+        shift = 6
+    elif gid is not None and path_stat.st_gid == gid:
+        shift = 3
+    else:
+        shift = 0
+    needed = stat.S_IROTH
+    if not read_only:
+        needed |= stat.S_IWOTH
+    if stat.S_ISDIR(path_stat.st_mode):
+        needed |= stat.S_IXOTH
+    return (path_stat.st_mode >> shift) & needed == needed
+
+
+def normalize_architecture(architecture):
+    """Map the architecture names of the kernel (as reported by some
+    daemons) to those used in image manifests.
+    """
+    return {
+        'x86_64': 'amd64',
+        'aarch64': 'arm64',
+        'armhf': 'arm',
+    }.get(architecture, architecture)
+
+
 def short_id_alias_exists(container, network):
     aliases = container.get(
         'NetworkSettings.Networks.{net}.Aliases'.format(net=network)) or ()
@@ -1489,17 +2375,118 @@ class ServiceNetworkMode:
 # Names
 
 
-def build_container_name(project, service, number, slug=None):
+# The placeholders of `hostname`, expanded for each container, as in
+# `hostname: "{service}-{replica}"` or `"es-{replica:02d}"`: the project
+# name, the service name and the container number
+HOSTNAME_PLACEHOLDERS = ('project', 'service', 'replica')
+
+
+def read_exec_socket(sock):
+    """Read the output of an exec started with a TTY until it ends."""
+    read = getattr(sock, 'read', None) or sock.recv
+    chunks = []
+    while True:
+        chunk = read(4096)
+        if not chunk:
+            return b''.join(chunks)
+        chunks.append(chunk)
+
+
+def interrupt_exec_socket(sock):
+    """Send ^C to the TTY of an exec, which interrupts its process, and
+    close the connection to it.
+    """
+    try:
+        getattr(sock, '_sock', sock).sendall(b'\x03')
+    except OSError as e:
+        log.debug('Could not interrupt exec: %s', e)
+    finally:
+        sock.close()
+
+
+def expand_hostname(template, project, service, number):
+    """Expand the placeholders of the `hostname` of a container of
+    `service`. Raises OperationFailedError on unknown placeholders.
+    """
+    try:
+        fields = [name for _, name, _, _ in Formatter().parse(template) if name is not None]
+        unknown = [name for name in fields if name not in HOSTNAME_PLACEHOLDERS]
+        if not unknown:
+            return template.format(project=project, service=service, replica=number)
+    except (ValueError, IndexError) as e:
+        unknown = [str(e)]
+    raise OperationFailedError(
+        'Service "{}" has an invalid placeholder in hostname "{}": {} (valid placeholders: '
+        '{})'.format(
+            service, template, ', '.join(unknown),
+            ', '.join('{{{}}}'.format(name) for name in HOSTNAME_PLACEHOLDERS),
+        )
+    )
+
+
+def build_container_name(project, service, number, slug=None, separator=DEFAULT_SEPARATOR):
     bits = [project.lstrip('-_'), service]
     if slug:
         bits.extend(['run', truncate_id(slug)])
     else:
         bits.append(str(number))
-    return '_'.join(bits)
+    return separator.join(bits)
 
 
 # Images
 
+class ImageReference(namedtuple('_ImageReference', 'repository tag digest')):
+    """An image reference: a repository with a tag (`repo/app:1.0`), a
+    digest (`repo/app@sha256:...`), both or neither. The tag and digest are
+    None when absent.
+    """
+
+    @classmethod
+    def parse(cls, image):
+        repository, digest = image, None
+        if '@' in image:
+            repository, digest = image.rsplit('@', 1)
+        repository, tag, _ = parse_repository_tag(repository)
+        return cls(repository, tag or None, digest)
+
+    @property
+    def tagged(self):
+        return self.tag is not None
+
+    @property
+    def digested(self):
+        return self.digest is not None
+
+    @property
+    def pull_tag(self):
+        """The tag or digest to pull: a digest takes precedence."""
+        return self.digest or self.tag or 'latest'
+
+    def familiar(self):
+        """The shortest form of the reference, for comparisons: without the
+        default registry, `library/` namespace or `latest` tag, nor the tag
+        when there is a digest, as the digest is what gets used.
+        """
+        repository = self.repository
+        for prefix in ('docker.io/', 'index.docker.io/'):
+            if repository.startswith(prefix):
+                repository = repository[len(prefix):]
+        if repository.startswith('library/') and repository.count('/') == 1:
+            repository = repository[len('library/'):]
+        if self.digested:
+            return '{}@{}'.format(repository, self.digest)
+        if self.tagged and self.tag != 'latest':
+            return '{}:{}'.format(repository, self.tag)
+        return repository
+
+    def __str__(self):
+        return '{}{}{}'.format(
+            self.repository,
+            ':' + self.tag if self.tagged else '',
+            '@' + self.digest if self.digested else '',
+        )
+
+
 def parse_repository_tag(repo_path):
     """Splits image identification into base image path, tag/digest
     and it's separator.
@@ -1548,7 +2535,6 @@ def merge_volume_bindings(volumes, tmpfs, previous_container, mounts):
         old_volumes, old_mounts = get_container_data_volumes(
             previous_container, volumes, tmpfs, mounts
         )
-        warn_on_masked_volume(volumes, old_volumes, previous_container.service)
         volume_bindings.update(
             build_volume_binding(volume) for volume in old_volumes
         )
@@ -1567,6 +2553,7 @@ def get_container_data_volumes(container, volumes_option, tmpfs_option, mounts_o
     """
     volumes = []
     volumes_option = volumes_option or []
+    declared_targets = {v.internal for v in volumes_option if v.external}
 
     container_mounts = {
         mount['Destination']: mount
@@ -1603,6 +2590,11 @@ def get_container_data_volumes(container, volumes_option, tmpfs_option, mounts_o
         if volume.internal in [m.target for m in mounts_option]:
             continue
 
+        # Same for a bind or named volume declared in the short syntax: the
+        # declaration replaces the inherited volume
+        if volume.internal in declared_targets:
+            continue
+
         # Copy existing volume from old container
         volume = volume._replace(external=mount['Name'])
         volumes.append(volume)
@@ -1622,28 +2614,6 @@ def get_container_data_volumes(container, volumes_option, tmpfs_option, mounts_o
     return volumes, updated_mounts
 
 
-def warn_on_masked_volume(volumes_option, container_volumes, service):
-    container_volumes = {
-        volume.internal: volume.external
-        for volume in container_volumes}
-
-    for volume in volumes_option:
-        if (
-                volume.external and
-                volume.internal in container_volumes and
-                container_volumes.get(volume.internal) != volume.external
-        ):
-            log.warning((
-                "Service \"{service}\" is using volume \"{volume}\" from the "
-                "previous container. Host mapping \"{host_path}\" has no effect. "
-                "Remove the existing containers (with `docker-compose rm {service}`) "
-                "to use the host volume mapping."
-            ).format(
-                service=service,
-                volume=volume.internal,
-                host_path=volume.external))
-
-
 def build_volume_binding(volume_spec):
     return volume_spec.internal, volume_spec.repr()
 
@@ -1672,6 +2642,10 @@ def build_mount(mount_spec):
         for option, sdk_name in mount_spec.options_map[mount_spec.type].items():
             if option in mount_spec.options:
                 kwargs[sdk_name] = mount_spec.options[option]
+        if mount_spec.type == 'volume' and mount_spec.options.get('driver'):
+            kwargs['driver_config'] = DriverConfig(
+                mount_spec.options['driver'], mount_spec.options.get('driver_opts')
+            )
 
     return Mount(
         type=mount_spec.type, target=mount_spec.target, source=mount_spec.source,
@@ -1748,6 +2722,54 @@ def formatted_ports(ports):
     return result
 
 
+def allocate_port_ranges(client, ports):
+    """Replace the ranges of host ports of `ports`, ServicePorts such as
+    that of 8000-8999:80, by the first port of the range that no container
+    publishes, so that the port is known before the container starts.
+    Raises OperationFailedError when every port of a range is taken.
+    """
+    if not any(isinstance(port.published, str) for port in ports):
+        return ports
+    taken = {
+        (binding.get('PublicPort'), binding.get('Type') or 'tcp')
+        for container in client.containers()
+        for binding in container.get('Ports') or []
+    }
+    result = []
+    for port in ports:
+        if isinstance(port.published, str):
+            protocol = port.protocol or 'tcp'
+            first, last = (int(bound) for bound in port.published.split('-', 1))
+            published = next(
+                (n for n in range(first, last + 1) if (n, protocol) not in taken), None
+            )
+            if published is None:
+                raise OperationFailedError(
+                    'No free host port in the range {} to publish port {}/{}'.format(
+                        port.published, port.target, protocol
+                    )
+                )
+            taken.add((published, protocol))
+            port = port._replace(published=published)
+        result.append(port)
+    return result
+
+
+def bind_to_host_ip(port_bindings, host_ip):
+    """Bind the ports of `port_bindings`, as built by build_port_bindings,
+    that don't set a host IP to `host_ip`.
+    """
+    if not host_ip:
+        return port_bindings
+    return {
+        port: [
+            binding if isinstance(binding, tuple) else (host_ip, binding)
+            for binding in bindings
+        ]
+        for port, bindings in port_bindings.items()
+    }
+
+
 def build_container_ports(container_ports, options):
     ports = []
     all_ports = container_ports + options.get('expose', [])
@@ -1780,6 +2802,23 @@ def convert_blkio_config(blkio_config):
     return result
 
 
+def parse_cache_option(value):
+    """The attributes of a `cache_from` or `cache_to` entry, either an image
+    or comma-separated attributes such as `type=registry,ref=<image>`.
+    """
+    if '=' not in value.split(',', 1)[0]:
+        return {'type': 'registry', 'ref': value}
+    return dict(attr.split('=', 1) for attr in value.split(',') if '=' in attr)
+
+
+def cache_image(value):
+    """The image of a registry cache entry, None for other backends."""
+    attrs = parse_cache_option(value)
+    if attrs.get('type') != 'registry':
+        return None
+    return attrs.get('ref')
+
+
 def rewrite_build_path(path):
     if IS_WINDOWS_PLATFORM and not is_url(path) and not path.startswith(WINDOWS_LONGPATH_PREFIX):
         path = WINDOWS_LONGPATH_PREFIX + os.path.normpath(path)
@@ -1798,7 +2837,22 @@ class _ClientBuilder:
               decode=False, buildargs=None, gzip=False, shmsize=None,
               labels=None, cache_from=None, target=None, network_mode=None,
               squash=None, extra_hosts=None, platform=None, isolation=None,
-              use_config_proxy=True, output_stream=sys.stdout):
+              use_config_proxy=True, output_stream=sys.stdout, cache_to=None):
+        # The Engine API can only use images as cache, and not export any
+        if cache_to:
+            log.warning(
+                'Service %s: exporting the build cache needs docker buildx, which '
+                'Compose uses with COMPOSE_DOCKER_CLI_BUILD=1. Not exporting it.', service.name
+            )
+        if cache_from:
+            for source in cache_from:
+                if cache_image(source) is None:
+                    log.warning(
+                        'Service %s: ignoring the build cache %s, as only images can be used '
+                        'as cache without COMPOSE_DOCKER_CLI_BUILD=1', service.name, source,
+                    )
+            cache_from = list(filter(None, map(cache_image, cache_from)))
+
         build_output = self.client.build(
             path=path,
             tag=tag,
@@ -1854,14 +2908,15 @@ class _CLIBuilder:
               decode=False, buildargs=None, gzip=False, shmsize=None,
               labels=None, cache_from=None, target=None, network_mode=None,
               squash=None, extra_hosts=None, platform=None, isolation=None,
-              use_config_proxy=True, output_stream=sys.stdout):
+              use_config_proxy=True, output_stream=sys.stdout, cache_to=None):
         """
         Args:
             service (str): Service to be built
             path (str): Path to the directory containing the Dockerfile
             buildargs (dict): A dictionary of build arguments
-            cache_from (:py:class:`list`): A list of images used for build
-                cache resolution
+            cache_from (:py:class:`list`): A list of images, or buildx cache
+                imports, used for build cache resolution
+            cache_to (:py:class:`list`): A list of buildx cache exports
             container_limits (dict): A dictionary of limits applied to each
                 container created by the build process. Valid keys:
                 - memory (int): set memory limit for build
@@ -1914,9 +2969,14 @@ class _CLIBuilder:
             dockerfile = os.path.join(path, dockerfile)
         iidfile = tempfile.mktemp()
 
-        command_builder = _CommandBuilder()
+        # Only buildx exports caches, and imports those that aren't images
+        buildx = bool(cache_to) or any(cache_image(source) is None for source in cache_from or [])
+        command_builder = _CommandBuilder(buildx)
         command_builder.add_params("--build-arg", buildargs)
         command_builder.add_list("--cache-from", cache_from)
+        command_builder.add_list("--cache-to", cache_to)
+        # buildx leaves the image in its build cache otherwise
+        command_builder.add_flag("--load", buildx)
         command_builder.add_arg("--file", dockerfile)
         command_builder.add_flag("--force-rm", forcerm)
         command_builder.add_params("--label", labels)
@@ -1954,8 +3014,8 @@ class _CLIBuilder:
 
 
 class _CommandBuilder:
-    def __init__(self):
-        self._args = ["docker", "build"]
+    def __init__(self, buildx=False):
+        self._args = ["docker", "buildx", "build"] if buildx else ["docker", "build"]
 
     def add_arg(self, name, value):
         if value:
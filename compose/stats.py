@@ -0,0 +1,150 @@
+import logging
+import threading
+import time
+from collections import namedtuple
+
+from docker.errors import APIError
+from requests.exceptions import RequestException
+
+log = logging.getLogger(__name__)
+
+# Seconds to wait for the stats of a single container, and how many
+# containers to fetch the stats of at once, when listing containers
+STATS_TIMEOUT = 2
+STATS_LIMIT = 8
+
+
+StatsSample = namedtuple(
+    'StatsSample',
+    'time replicas cpu_percent memory_usage memory_limit rx_bytes tx_bytes'
+)
+
+
+# The resource usage of a container, as Project.containers(with_stats=True)
+# sets it. `populated` is False, and the other fields zero, when its stats
+# couldn't be fetched in time. `cpu_time` is in nanoseconds.
+ContainerStats = namedtuple(
+    'ContainerStats',
+    'populated cpu_time memory_usage memory_limit pids_current pids_limit'
+)
+
+NO_STATS = ContainerStats(False, 0, 0, 0, 0, 0)
+
+
+def cpu_percent(stats):
+    cpu_stats = stats.get('cpu_stats') or {}
+    precpu_stats = stats.get('precpu_stats') or {}
+
+    cpu_delta = (
+        (cpu_stats.get('cpu_usage') or {}).get('total_usage', 0) -
+        (precpu_stats.get('cpu_usage') or {}).get('total_usage', 0)
+    )
+    system_delta = (
+        cpu_stats.get('system_cpu_usage', 0) -
+        precpu_stats.get('system_cpu_usage', 0)
+    )
+    if cpu_delta <= 0 or system_delta <= 0:
+        return 0.0
+
+    online_cpus = cpu_stats.get('online_cpus') or len(
+        (cpu_stats.get('cpu_usage') or {}).get('percpu_usage') or []
+    ) or 1
+    return cpu_delta / system_delta * online_cpus * 100.0
+
+
+def memory_usage(stats):
+    memory_stats = stats.get('memory_stats') or {}
+    # Page cache is reclaimable, `docker stats` doesn't count it either
+    cache = (memory_stats.get('stats') or {}).get('cache', 0)
+    return max(memory_stats.get('usage', 0) - cache, 0)
+
+
+def memory_limit(stats):
+    return (stats.get('memory_stats') or {}).get('limit', 0)
+
+
+def network_bytes(stats):
+    rx = tx = 0
+    for network in (stats.get('networks') or {}).values():
+        rx += network.get('rx_bytes', 0)
+        tx += network.get('tx_bytes', 0)
+    return rx, tx
+
+
+def container_stats(stats):
+    pids_stats = stats.get('pids_stats') or {}
+    return ContainerStats(
+        populated=True,
+        cpu_time=((stats.get('cpu_stats') or {}).get('cpu_usage') or {}).get('total_usage', 0),
+        memory_usage=memory_usage(stats),
+        memory_limit=memory_limit(stats),
+        pids_current=pids_stats.get('current', 0),
+        pids_limit=pids_stats.get('limit', 0),
+    )
+
+
+def fetch_container_stats(client, container_id, timeout=STATS_TIMEOUT):
+    """The ContainerStats of a container, or NO_STATS when the daemon
+    doesn't return them within `timeout` seconds or fails to.
+    """
+    result = []
+
+    def fetch():
+        try:
+            result.append(client.stats(container_id, stream=False))
+        except (APIError, RequestException) as e:
+            log.debug('Could not fetch the stats of %s: %s', container_id, e)
+
+    # The request can't be cancelled: left behind, it ends on its own
+    thread = threading.Thread(target=fetch, daemon=True)
+    thread.start()
+    thread.join(timeout)
+    if not result:
+        return NO_STATS
+    return container_stats(result[0])
+
+
+class ServiceStatsAggregator:
+    """Fold the raw stats of all the replicas of a service into a single
+    `StatsSample` per tick.
+
+    CPU and memory are gauges and are summed over the replicas present in the
+    tick. Network counters are cumulative: the aggregator keeps the totals
+    across ticks, so replicas disappearing don't make them drop, and a replica
+    whose counters went backwards (the container restarted) only contributes
+    what it transferred since its restart.
+    """
+
+    def __init__(self):
+        self._last_counters = {}
+        self._rx_total = 0
+        self._tx_total = 0
+
+    def update(self, stats_by_container, now=None):
+        cpu = 0.0
+        mem = 0
+        mem_limit = 0
+
+        for container_id, stats in stats_by_container.items():
+            cpu += cpu_percent(stats)
+            mem += memory_usage(stats)
+            mem_limit += memory_limit(stats)
+
+            rx, tx = network_bytes(stats)
+            last_rx, last_tx = self._last_counters.get(container_id, (0, 0))
+            self._rx_total += rx - last_rx if rx >= last_rx else rx
+            self._tx_total += tx - last_tx if tx >= last_tx else tx
+            self._last_counters[container_id] = (rx, tx)
+
+        for container_id in set(self._last_counters) - set(stats_by_container):
+            del self._last_counters[container_id]
+
+        return StatsSample(
+            time=now if now is not None else time.time(),
+            replicas=len(stats_by_container),
+            cpu_percent=cpu,
+            memory_usage=mem,
+            memory_limit=mem_limit,
+            rx_bytes=self._rx_total,
+            tx_bytes=self._tx_total,
+        )
@@ -0,0 +1,80 @@
+"""
+Keep the configuration of projects that were loaded from stdin (`-f -`), so
+that later commands such as `down` can rebuild the full project without the
+Compose file being piped in again.
+
+The interpolated configuration is stored compressed in a label on the
+project's containers or, when it is too large for a label, in a state file
+keyed by project name and daemon host.
+"""
+import base64
+import hashlib
+import os
+import zlib
+
+from .const import LABEL_CONFIG_DATA
+from .const import LABEL_PROJECT
+from .const import LABEL_TENANT
+
+# Largest encoded configuration stored in a container label
+MAX_LABEL_SIZE = 16 * 1024
+
+
+def default_state_dir():
+    return os.path.join(os.path.expanduser('~'), '.docker', 'compose', 'state')
+
+
+def state_file_path(project, host, state_dir=None):
+    host_digest = hashlib.sha256((host or '').encode('utf-8')).hexdigest()[:12]
+    return os.path.join(
+        state_dir or default_state_dir(),
+        '{}-{}.yml'.format(project, host_digest)
+    )
+
+
+def encode_config(config_yaml):
+    return base64.b64encode(zlib.compress(config_yaml.encode('utf-8'))).decode('ascii')
+
+
+def decode_config(data):
+    return zlib.decompress(base64.b64decode(data)).decode('utf-8')
+
+
+def store_config(project, host, config_yaml, state_dir=None):
+    """Store `config_yaml` for `project` and return the labels to set on the
+    project's containers.
+    """
+    encoded = encode_config(config_yaml)
+    path = state_file_path(project, host, state_dir)
+    if len(encoded) <= MAX_LABEL_SIZE:
+        remove_stored_config(project, host, state_dir)
+        return ['{}={}'.format(LABEL_CONFIG_DATA, encoded)]
+
+    os.makedirs(os.path.dirname(path), exist_ok=True)
+    with open(path, 'w') as f:
+        f.write(config_yaml)
+    return []
+
+
+def load_stored_config(client, project, state_dir=None, tenant=None):
+    """Return the configuration stored for `project`, or None."""
+    labels = ['{}={}'.format(LABEL_PROJECT, project)]
+    if tenant:
+        labels.append('{}={}'.format(LABEL_TENANT, tenant))
+    containers = client.containers(all=True, filters={'label': labels})
+    for container in containers:
+        data = (container.get('Labels') or {}).get(LABEL_CONFIG_DATA)
+        if data:
+            return decode_config(data)
+
+    path = state_file_path(project, client.base_url, state_dir)
+    if os.path.isfile(path):
+        with open(path) as f:
+            return f.read()
+    return None
+
+
+def remove_stored_config(project, host, state_dir=None):
+    path = state_file_path(project, host, state_dir)
+    if os.path.isfile(path):
+        os.remove(path)
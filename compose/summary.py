@@ -0,0 +1,129 @@
+"""
+A summary of what `up` did, returned along with the containers:
+
+    containers = project.up()
+    summary = containers.summary
+    print(summary.created, summary.pulled_bytes, summary.duration)
+
+The memory and CPU limits are the sum of those declared for the containers
+brought up, next to those of the host, so that a project that asks for more
+than the host has is noticed.
+"""
+import threading
+import time
+from collections import namedtuple
+
+from .utils import parse_bytes
+
+
+class UpSummary(namedtuple('_UpSummary', [
+        'created', 'recreated', 'started', 'unchanged',
+        'images_pulled', 'pulled_bytes', 'networks_created', 'volumes_created',
+        'duration', 'memory', 'cpus', 'host_memory', 'host_cpus'])):
+    """What `up` did: the number of containers created, recreated, started
+    and left unchanged, of images pulled and of bytes downloaded for them,
+    the names of the networks and volumes created, and the duration in
+    seconds. `memory`, in bytes, and `cpus` are the limits declared for the
+    containers, None when none declares one; `host_memory` and `host_cpus`
+    are those of the host, None when the daemon doesn't report them.
+    """
+
+    @property
+    def exceeds_host_memory(self):
+        return bool(self.memory and self.host_memory and self.memory > self.host_memory)
+
+    @property
+    def exceeds_host_cpus(self):
+        return bool(self.cpus and self.host_cpus and self.cpus > self.host_cpus)
+
+
+class UpResult(list):
+    """The containers of the services `up` brought up, with the UpSummary of
+    what it did.
+    """
+
+    def __init__(self, containers, summary):
+        super().__init__(containers)
+        self.summary = summary
+
+
+def container_limits(service):
+    """The memory limit, in bytes, and the CPU limit of the containers of
+    `service`, each None if it isn't declared.
+    """
+    mem_limit = service.options.get('mem_limit')
+    return (parse_bytes(mem_limit) if mem_limit else None), service.options.get('cpus')
+
+
+class UpRecorder:
+    """Records what `up` does, from the services that converge in parallel,
+    for the UpSummary.
+    """
+
+    def __init__(self):
+        self.started_at = time.monotonic()
+        self.counts = dict.fromkeys(('created', 'recreated', 'started', 'unchanged'), 0)
+        self.images = set()
+        # Keyed by layer ID, as a layer is reported several times
+        self.layers = {}
+        self.networks = []
+        self.volumes = []
+        self.memory = None
+        self.cpus = None
+        # The IDs of the containers that were running before `up`, by service
+        self.running = {}
+        self._lock = threading.Lock()
+
+    def pull_progress(self, image):
+        """A `progress` callback for the pull of `image`."""
+        def progress(layer):
+            with self._lock:
+                self.images.add(image)
+                if layer.status == 'Downloading' and layer.total:
+                    self.layers[layer.id] = layer.total
+        return progress
+
+    def planned(self, service, plan):
+        """Record the state of the containers of `service` before carrying
+        out `plan`, as starting them updates the same Container objects.
+        """
+        # Only a `start` plan starts the containers that are there
+        running = {
+            container.id for container in plan.containers
+            if plan.action != 'start' or container.is_running
+        }
+        with self._lock:
+            self.running[service.name] = running
+
+    def converged(self, service, plan, containers):
+        """Record the `containers` of `service` after carrying out `plan`."""
+        previous = {container.id for container in plan.containers}
+        new = [container for container in containers if container.id not in previous]
+        kept = [container for container in containers if container.id in previous]
+        recreated = min(len(new), len(previous)) if plan.action == 'recreate' else 0
+        running = self.running.get(service.name, previous)
+        started = len([container for container in kept if container.id not in running])
+        memory, cpus = container_limits(service)
+        with self._lock:
+            self.counts['recreated'] += recreated
+            self.counts['created'] += len(new) - recreated
+            self.counts['started'] += started
+            self.counts['unchanged'] += len(kept) - started
+            if memory and containers:
+                self.memory = (self.memory or 0) + memory * len(containers)
+            if cpus and containers:
+                self.cpus = (self.cpus or 0) + cpus * len(containers)
+
+    def summary(self, info):
+        return UpSummary(
+            images_pulled=len(self.images),
+            pulled_bytes=sum(self.layers.values()),
+            networks_created=self.networks,
+            volumes_created=self.volumes,
+            duration=time.monotonic() - self.started_at,
+            memory=self.memory,
+            cpus=self.cpus,
+            host_memory=info.get('MemTotal'),
+            host_cpus=info.get('NCPU'),
+            **self.counts
+        )
@@ -0,0 +1,506 @@
+"""
+In-memory stand-in for `docker.APIClient`, for testing code built on Compose.
+
+`FakeDockerClient` keeps a small model of the daemon state (images,
+containers, networks and volumes) so that the results of one operation are
+visible to the next: after `Project.up()`, `Project.containers()` returns the
+created containers, and `Project.down()` removes them again. Every API call
+is recorded in `calls`, and errors can be injected per method with `fail()`.
+
+    client = FakeDockerClient(images=['busybox'])
+    project = Project.from_config('app', config_data, client)
+    project.up()
+    assert [c.name for c in project.containers()] == ['app_web_1']
+"""
+import copy
+import functools
+import hashlib
+import io
+import itertools
+import json
+import threading
+
+from docker import auth
+from docker.constants import DEFAULT_DOCKER_API_VERSION
+from docker.errors import APIError
+from docker.errors import ImageNotFound
+from docker.errors import NotFound
+from docker.types import HostConfig
+
+
+def recorded(fn):
+    @functools.wraps(fn)
+    def wrapper(self, *args, **kwargs):
+        with self._lock:
+            self.calls.append((fn.__name__, args, kwargs))
+            failure = self._errors.get(fn.__name__)
+            if failure:
+                error, times = failure
+                if times is not None:
+                    failure[1] -= 1
+                    if failure[1] <= 0:
+                        del self._errors[fn.__name__]
+                raise error
+            return fn(self, *args, **kwargs)
+    return wrapper
+
+
+def _fake_id(prefix, seq):
+    return hashlib.sha256('{}-{}'.format(prefix, seq).encode('utf-8')).hexdigest()
+
+
+def _name_of(value):
+    if isinstance(value, dict):
+        return value.get('Id') or value.get('Name')
+    return value
+
+
+class FakeDockerClient:
+    """Implements the subset of the `docker.APIClient` interface used by
+    Compose. Unsupported methods raise AttributeError.
+    """
+
+    def __init__(self, images=None, version=DEFAULT_DOCKER_API_VERSION):
+        self.api_version = self._version = version
+        self.base_url = 'http+docker://fake'
+        self.credstore_env = None
+        self._auth_configs = auth.AuthConfig({})
+        self.timeout = 60
+        self._general_configs = {}
+        # What info() returns, for tests to set the daemon features they need
+        self.daemon_info = {'Swarm': {'LocalNodeState': 'inactive'}}
+        self.calls = []
+        self.images = {}
+        self.registry = {}
+        self.containers_by_id = {}
+        self.networks_by_name = {}
+        self.volumes_by_name = {}
+        self.execs = {}
+        self._errors = {}
+        self._seq = itertools.count(1)
+        self._lock = threading.RLock()
+        for image in images or []:
+            self.add_image(image)
+
+    def fail(self, method, error, times=None):
+        """Make calls to `method` raise `error`: the next `times` calls, or all
+        of them if `times` is None.
+        """
+        self._errors[method] = [error, times]
+
+    def called(self, method):
+        """Return the (args, kwargs) of each recorded call to `method`."""
+        return [(args, kwargs) for name, args, kwargs in self.calls if name == method]
+
+    def add_image(self, name, config=None):
+        """Add an image tagged `name`. An image previously tagged `name` is
+        left dangling, as after a pull or a rebuild.
+        """
+        if ':' not in name.rsplit('/', 1)[-1] and '@' not in name:
+            name += ':latest'
+        previous = self.images.pop(name, None)
+        if previous:
+            previous['RepoTags'] = []
+            self.images[previous['Id']] = previous
+        self.images[name] = {
+            'Id': 'sha256:' + _fake_id('image', '{}-{}'.format(name, next(self._seq))),
+            'RepoTags': [name],
+            'Config': config or {},
+            'ContainerConfig': config or {},
+            'Size': 1000000,
+        }
+        return self.images[name]
+
+    def close(self):
+        pass
+
+    # System
+
+    @recorded
+    def info(self):
+        return copy.deepcopy(self.daemon_info)
+
+    @recorded
+    def version(self, api_version=True):
+        return {'ApiVersion': self.api_version, 'Version': 'fake', 'Os': 'linux', 'Arch': 'x86_64'}
+
+    # Images
+
+    def _find_image(self, name):
+        if name in self.images:
+            return self.images[name]
+        for image in self.images.values():
+            if name + ':latest' in image['RepoTags'] or image['Id'] == name:
+                return image
+            if image['Id'].startswith('sha256:' + name):
+                return image
+        raise ImageNotFound('No such image: {}'.format(name))
+
+    @recorded
+    def inspect_image(self, image):
+        return copy.deepcopy(self._find_image(image))
+
+    def registry_digest(self, name):
+        """The digest the registry has for `name`, which can be changed by
+        setting `registry[name]` to simulate a push.
+        """
+        if ':' not in name.rsplit('/', 1)[-1]:
+            name += ':latest'
+        return self.registry.get(name) or 'sha256:' + _fake_id('manifest', name)
+
+    @recorded
+    def inspect_distribution(self, image):
+        return {'Descriptor': {'digest': self.registry_digest(image)}}
+
+    @recorded
+    def pull(self, repository, tag=None, stream=False, **kwargs):
+        name = '{}:{}'.format(repository, tag or 'latest')
+        image = self.add_image(name)
+        digest = self.registry_digest(name)
+        image['RepoDigests'] = ['{}@{}'.format(repository, digest)]
+        if kwargs.get('platform'):
+            parts = kwargs['platform'].split('/')
+            image.update(zip(['Os', 'Architecture', 'Variant'], parts))
+        events = [
+            {'status': 'Downloading', 'id': 'layer', 'progressDetail': {
+                'current': image['Size'], 'total': image['Size']}},
+            {'status': 'Digest: {}'.format(digest)},
+            {'status': 'Pulled {}'.format(name)},
+        ]
+        output = [json.dumps(event).encode('utf-8') for event in events]
+        return iter(output) if stream else b''.join(output)
+
+    @recorded
+    def build(self, path=None, tag=None, labels=None, **kwargs):
+        image = self.add_image(tag or 'fake', config={'Labels': dict(labels or {})})
+        output = {'stream': 'Successfully built {}\n'.format(image['Id'][7:19])}
+        return iter([json.dumps(output).encode('utf-8')])
+
+    @recorded
+    def remove_image(self, image, force=False, noprune=False):
+        data = self._find_image(image)
+        for key, value in list(self.images.items()):
+            if value is data:
+                del self.images[key]
+
+    # Containers
+
+    def create_host_config(self, *args, **kwargs):
+        kwargs['version'] = self._version
+        return HostConfig(*args, **kwargs)
+
+    def _find_container(self, container):
+        ref = _name_of(container)
+        for data in self.containers_by_id.values():
+            if data['Id'].startswith(ref) or data['Name'] == '/' + ref:
+                return data
+        raise NotFound('No such container: {}'.format(ref))
+
+    def _set_state(self, container, status, exit_code=0):
+        data = self._find_container(container)
+        data['State'].update({
+            'Status': status,
+            'Running': status in ('running', 'paused'),
+            'Paused': status == 'paused',
+            'ExitCode': exit_code,
+        })
+        return data
+
+    @recorded
+    def create_container(self, image, command=None, name=None, labels=None,
+                         environment=None, host_config=None, networking_config=None,
+                         **kwargs):
+        image_data = self._find_image(image)
+        if name and any(c['Name'] == '/' + name for c in self.containers_by_id.values()):
+            raise APIError('Conflict. The container name "/{}" is already in use'.format(name))
+
+        seq = next(self._seq)
+        container_id = _fake_id('container', seq)
+        name = name or 'fake_{}'.format(seq)
+        endpoints = (networking_config or {}).get('EndpointsConfig') or {}
+        self.containers_by_id[container_id] = {
+            'Id': container_id,
+            'Name': '/' + name,
+            'Created': '2021-01-01T00:00:00.{:09d}Z'.format(seq),
+            'Image': image_data['Id'],
+            'Config': {
+                'Image': image,
+                'Cmd': command,
+                'Env': environment,
+                'Labels': labels or {},
+            },
+            'HostConfig': host_config or {},
+            'Mounts': [],
+            'State': {
+                'Status': 'created', 'Running': False, 'Paused': False, 'ExitCode': 0,
+            },
+            'NetworkSettings': {
+                'Ports': {},
+                'Networks': {
+                    network: {
+                        'Aliases': list(endpoint.get('Aliases') or []) + [container_id[:12]],
+                        'IPAMConfig': endpoint.get('IPAMConfig'),
+                        'Links': endpoint.get('Links'),
+                    }
+                    for network, endpoint in endpoints.items()
+                },
+            },
+        }
+        if kwargs.get('healthcheck'):
+            self.containers_by_id[container_id]['Config']['Healthcheck'] = kwargs['healthcheck']
+        if kwargs.get('ports'):
+            self.containers_by_id[container_id]['Config']['ExposedPorts'] = {
+                '/'.join(port) if isinstance(port, tuple) else '{}/tcp'.format(port): {}
+                for port in kwargs['ports']
+            }
+        return {'Id': container_id, 'Warnings': None}
+
+    @recorded
+    def inspect_container(self, container):
+        return copy.deepcopy(self._find_container(container))
+
+    @recorded
+    def containers(self, quiet=False, all=False, filters=None, **kwargs):
+        filters = filters or {}
+        result = []
+        for data in sorted(self.containers_by_id.values(), key=lambda c: c['Created']):
+            if not all and not data['State']['Running']:
+                continue
+            if not _match_labels(data['Config']['Labels'], filters.get('label')):
+                continue
+            status = filters.get('status')
+            if status and data['State']['Status'] not in _as_list(status):
+                continue
+            ancestor = filters.get('ancestor')
+            if ancestor and data['Image'] != self._find_image(ancestor)['Id']:
+                continue
+            result.append({
+                'Id': data['Id'],
+                'Names': [data['Name']],
+                'Image': data['Config']['Image'],
+                'Labels': dict(data['Config']['Labels']),
+                'State': data['State']['Status'],
+                'Created': data['Created'],
+                'Ports': [
+                    {
+                        'IP': binding['HostIp'],
+                        'PrivatePort': int(private.split('/')[0]),
+                        'PublicPort': int(binding['HostPort']),
+                        'Type': private.split('/')[1],
+                    }
+                    for private, bindings in data['NetworkSettings']['Ports'].items()
+                    for binding in bindings
+                ] if data['State']['Running'] else [],
+            })
+        return [{'Id': c['Id']} for c in result] if quiet else result
+
+    @recorded
+    def start(self, container, *args, **kwargs):
+        data = self._set_state(container, 'running')
+        port_bindings = dict(data['HostConfig'].get('PortBindings') or {})
+        if data['HostConfig'].get('PublishAllPorts'):
+            for port in data['Config'].get('ExposedPorts') or {}:
+                if port not in port_bindings and port.split('/')[0] not in port_bindings:
+                    port_bindings[port] = [None]
+        data['NetworkSettings']['Ports'] = self._publish_ports(port_bindings)
+
+    def _publish_ports(self, port_bindings):
+        # Ports published without a host port are given one from the
+        # ephemeral range, as the daemon does
+        ports = {}
+        for private, bindings in port_bindings.items():
+            if '/' not in str(private):
+                private = '{}/tcp'.format(private)
+            ports[private] = []
+            for binding in bindings:
+                host_ip, host_port = binding if isinstance(binding, tuple) else ('', binding)
+                ports[private].append({
+                    'HostIp': host_ip or '0.0.0.0',
+                    'HostPort': str(host_port or 32768 + next(self._seq)),
+                })
+        return ports
+
+    @recorded
+    def stop(self, container, timeout=None):
+        self._set_state(container, 'exited')
+
+    @recorded
+    def kill(self, container, signal=None):
+        # Other signals are taken as handled by the process, such as SIGHUP
+        # to reload its configuration
+        if signal in (None, 'SIGKILL', 'SIGTERM', 'SIGINT'):
+            self._set_state(container, 'exited', exit_code=137)
+        else:
+            self._find_container(container)
+
+    @recorded
+    def restart(self, container, timeout=10):
+        self._set_state(container, 'running')
+
+    @recorded
+    def pause(self, container):
+        self._set_state(container, 'paused')
+
+    @recorded
+    def unpause(self, container):
+        self._set_state(container, 'running')
+
+    @recorded
+    def wait(self, container, timeout=None, condition=None):
+        return {'StatusCode': self._find_container(container)['State']['ExitCode']}
+
+    @recorded
+    def rename(self, container, name):
+        self._find_container(container)['Name'] = '/' + name
+
+    @recorded
+    def remove_container(self, container, v=False, link=False, force=False):
+        data = self._find_container(container)
+        if data['State']['Running'] and not force:
+            raise APIError(
+                'You cannot remove a running container {}. Stop the container '
+                'before attempting removal or force remove'.format(data['Id'])
+            )
+        del self.containers_by_id[data['Id']]
+
+    @recorded
+    def logs(self, container, *args, **kwargs):
+        self._find_container(container)
+        return iter([]) if kwargs.get('stream') else b''
+
+    # Exec
+
+    @recorded
+    def exec_create(self, container, cmd, **kwargs):
+        data = self._find_container(container)
+        exec_id = _fake_id('exec', next(self._seq))
+        self.execs[exec_id] = {'ID': exec_id, 'ContainerID': data['Id'], 'ExitCode': 0}
+        return {'Id': exec_id}
+
+    @recorded
+    def exec_start(self, exec_id, detach=False, stream=False, socket=False, **kwargs):
+        if socket:
+            return io.BytesIO()
+        return iter([]) if stream else b''
+
+    @recorded
+    def exec_inspect(self, exec_id):
+        return self.execs[_name_of(exec_id)]
+
+    # Networks
+
+    def _find_network(self, net_id):
+        for data in self.networks_by_name.values():
+            if net_id in (data['Name'], data['Id']):
+                return data
+        raise NotFound('network {} not found'.format(net_id))
+
+    @recorded
+    def create_network(self, name, driver=None, options=None, ipam=None,
+                       internal=False, labels=None, enable_ipv6=False, **kwargs):
+        if name in self.networks_by_name:
+            raise APIError('network with name {} already exists'.format(name))
+        self.networks_by_name[name] = {
+            'Name': name,
+            'Id': _fake_id('network', name),
+            'Driver': driver or 'bridge',
+            'Options': options or {},
+            'IPAM': ipam or {'Driver': 'default', 'Config': [], 'Options': None},
+            'Internal': internal,
+            'EnableIPv6': enable_ipv6,
+            'Labels': labels or {},
+        }
+        return {'Id': self.networks_by_name[name]['Id']}
+
+    @recorded
+    def inspect_network(self, net_id, verbose=None, scope=None):
+        return copy.deepcopy(self._find_network(net_id))
+
+    @recorded
+    def networks(self, names=None, ids=None, filters=None):
+        labels = (filters or {}).get('label')
+        return [
+            n for n in self.networks_by_name.values()
+            if (not names or n['Name'] in names) and (not ids or n['Id'] in ids)
+            and _match_labels(n['Labels'], labels)
+        ]
+
+    @recorded
+    def remove_network(self, net_id):
+        del self.networks_by_name[self._find_network(net_id)['Name']]
+
+    @recorded
+    def connect_container_to_network(self, container, net_id, aliases=None, ipv4_address=None,
+                                     ipv6_address=None, links=None, link_local_ips=None,
+                                     **kwargs):
+        data = self._find_container(container)
+        network = self._find_network(net_id)
+        aliases = list(aliases or [])
+        ipam_config = {
+            key: value for key, value in (
+                ('IPv4Address', ipv4_address),
+                ('IPv6Address', ipv6_address),
+                ('LinkLocalIPs', link_local_ips),
+            ) if value
+        }
+        data['NetworkSettings']['Networks'][network['Name']] = {
+            # The daemon adds the short ID of the container unless it is set
+            'Aliases': aliases + [a for a in [data['Id'][:12]] if a not in aliases],
+            'IPAMConfig': ipam_config or None,
+            'Links': links,
+        }
+
+    @recorded
+    def disconnect_container_from_network(self, container, net_id, force=False):
+        data = self._find_container(container)
+        data['NetworkSettings']['Networks'].pop(self._find_network(net_id)['Name'], None)
+
+    # Volumes
+
+    def _find_volume(self, name):
+        if name not in self.volumes_by_name:
+            raise NotFound('get {}: no such volume'.format(name))
+        return self.volumes_by_name[name]
+
+    @recorded
+    def create_volume(self, name=None, driver=None, driver_opts=None, labels=None):
+        name = name or _fake_id('volume', next(self._seq))
+        self.volumes_by_name.setdefault(name, {
+            'Name': name,
+            'Driver': driver or 'local',
+            'Options': driver_opts or {},
+            'Labels': labels or {},
+            'Mountpoint': '/var/lib/docker/volumes/{}/_data'.format(name),
+        })
+        return self.volumes_by_name[name]
+
+    @recorded
+    def inspect_volume(self, name):
+        return copy.deepcopy(self._find_volume(name))
+
+    @recorded
+    def volumes(self, filters=None):
+        labels = (filters or {}).get('label')
+        return {
+            'Volumes': [
+                v for v in self.volumes_by_name.values() if _match_labels(v['Labels'], labels)
+            ],
+            'Warnings': None,
+        }
+
+    @recorded
+    def remove_volume(self, name, force=False):
+        self._find_volume(name)
+        del self.volumes_by_name[name]
+
+
+def _as_list(value):
+    return value if isinstance(value, (list, tuple)) else [value]
+
+
+def _match_labels(labels, wanted):
+    for label in _as_list(wanted or []):
+        key, sep, value = label.partition('=')
+        if key not in labels or (sep and labels[key] != value):
+            return False
+    return True
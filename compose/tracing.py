@@ -0,0 +1,94 @@
+"""
+Optional OpenTelemetry instrumentation.
+
+Spans are only created when the `opentelemetry-api` package is installed
+(`pip install docker-compose[tracing]`), and only recorded when the embedding
+application has configured a tracer provider. Otherwise these helpers are
+no-ops.
+"""
+import functools
+
+try:
+    from opentelemetry import context
+    from opentelemetry import trace
+except ImportError:
+    context = trace = None
+
+
+class NoSpan:
+    def __enter__(self):
+        pass
+
+    def __exit__(self, *ex):
+        pass
+
+
+def enabled():
+    """Whether spans are recorded: the API is installed and the embedding
+    application configured a tracer provider.
+    """
+    return trace is not None and not isinstance(
+        trace.get_tracer_provider(), (trace.ProxyTracerProvider, trace.NoOpTracerProvider)
+    )
+
+
+def span(name, attributes=None):
+    if not enabled():
+        return NoSpan()
+    return trace.get_tracer('compose').start_as_current_span(
+        name,
+        attributes={k: v for k, v in (attributes or {}).items() if v is not None},
+    )
+
+
+def traced(name, get_attributes=None):
+    """Run the decorated function in a span. `get_attributes` is called
+    with the function's arguments and returns the span attributes; it isn't
+    called when tracing is disabled.
+    """
+    def decorator(fn):
+        @functools.wraps(fn)
+        def wrapper(*args, **kwargs):
+            if not enabled():
+                return fn(*args, **kwargs)
+            attributes = get_attributes(*args, **kwargs) if get_attributes else None
+            with span(name, attributes):
+                return fn(*args, **kwargs)
+        return wrapper
+    return decorator
+
+
+def propagate_context(fn):
+    """Bind `fn` to the caller's tracing context, so that spans it opens in
+    another thread keep the caller's span as their parent.
+    """
+    if context is None:
+        return fn
+    ctx = context.get_current()
+
+    @functools.wraps(fn)
+    def wrapper(*args, **kwargs):
+        token = context.attach(ctx)
+        try:
+            return fn(*args, **kwargs)
+        finally:
+            context.detach(token)
+    return wrapper
+
+
+def project_attributes(project, *args, **kwargs):
+    return {'compose.project': project.name}
+
+
+def service_attributes(service, *args, **kwargs):
+    return {
+        'compose.project': service.project,
+        'compose.service': service.name,
+        'container.image.name': service.image_name,
+    }
+
+
+def container_attributes(service, container, *args, **kwargs):
+    attributes = service_attributes(service)
+    attributes['container.id'] = container.id
+    return attributes
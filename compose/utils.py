@@ -3,6 +3,7 @@ import json.decoder
 import logging
 import ntpath
 import random
+from urllib.parse import urlparse
 
 from docker.errors import DockerException
 from docker.utils import parse_bytes as sdk_parse_bytes
@@ -15,6 +16,10 @@ from .timeparse import timeparse
 json_decoder = json.JSONDecoder()
 log = logging.getLogger(__name__)
 
+# The hosts of the base URLs of docker-py for a daemon on this machine: its
+# unix socket, its named pipe, and loopback addresses
+LOCAL_DAEMON_HOSTS = ('localhost', 'localnpipe', '127.0.0.1', '::1')
+
 
 def stream_as_text(stream):
     """Given a stream of bytes or text, if any of the items in the stream
@@ -152,6 +157,15 @@ def generate_random_id():
             return val
 
 
+def is_local_daemon(client):
+    """Whether `client` reaches a daemon on this machine, whose bind mount
+    sources are local paths. Without a client, the daemon is assumed local.
+    """
+    if client is None:
+        return True
+    return urlparse(client.base_url).hostname in LOCAL_DAEMON_HOSTS
+
+
 def truncate_id(value):
     if ':' in value:
         value = value[value.index(':') + 1:]
@@ -8,9 +8,13 @@ from docker.utils import version_lt
 from . import __version__
 from .config import ConfigurationError
 from .config.types import VolumeSpec
+from .const import DEFAULT_SEPARATOR
 from .const import LABEL_PROJECT
+from .const import LABEL_TENANT
 from .const import LABEL_VERSION
 from .const import LABEL_VOLUME
+from .warning import LABEL_ADOPTION
+from .warning import Warnings
 
 
 log = logging.getLogger(__name__)
@@ -18,7 +22,8 @@ log = logging.getLogger(__name__)
 
 class Volume:
     def __init__(self, client, project, name, driver=None, driver_opts=None,
-                 external=False, labels=None, custom_name=False):
+                 external=False, labels=None, custom_name=False, tenant=None,
+                 separator=DEFAULT_SEPARATOR):
         self.client = client
         self.project = project
         self.name = name
@@ -27,24 +32,52 @@ class Volume:
         self.external = external
         self.labels = labels
         self.custom_name = custom_name
+        self.tenant = tenant
+        self.separator = separator
         self.legacy = None
+        # The name of the volume when it was created with another separator
+        self.existing_name = None
 
-    def create(self):
+    def create(self, extra_labels=None):
+        labels = self._labels
+        if labels is not None and extra_labels:
+            labels.update(extra_labels)
         return self.client.create_volume(
-            self.full_name, self.driver, self.driver_opts, labels=self._labels
+            self.full_name, self.driver, self.driver_opts, labels=labels
         )
 
     def remove(self):
         if self.external:
             log.info("Volume %s is external, skipping", self.true_name)
             return
+        if self.tenant and not self.owns(self.client.inspect_volume(self.true_name)):
+            log.info("Volume %s belongs to another tenant, skipping", self.true_name)
+            return
         log.info("Removing volume %s", self.true_name)
         return self.client.remove_volume(self.true_name)
 
+    def differs(self):
+        """Whether the volume is missing, or uses another driver or driver
+        options, on the daemon. Nothing is changed.
+        """
+        if self.external:
+            return False
+        self._set_legacy_flag()
+        try:
+            check_remote_volume_config(self.inspect(legacy=self.legacy), self)
+        except (NotFound, VolumeConfigChangedError):
+            return True
+        return False
+
     def inspect(self, legacy=None):
         if legacy:
             return self.client.inspect_volume(self.legacy_full_name)
-        return self.client.inspect_volume(self.full_name)
+        return self.client.inspect_volume(self.existing_name or self.full_name)
+
+    def owns(self, data):
+        if not self.tenant:
+            return True
+        return (data.get('Labels') or {}).get(LABEL_TENANT) == self.tenant
 
     def exists(self):
         self._set_legacy_flag()
@@ -58,7 +91,7 @@ class Volume:
     def full_name(self):
         if self.custom_name:
             return self.name
-        return '{}_{}'.format(self.project.lstrip('-_'), self.name)
+        return '{}{}{}'.format(self.project.lstrip('-_'), self.separator, self.name)
 
     @property
     def legacy_full_name(self):
@@ -73,7 +106,18 @@ class Volume:
         self._set_legacy_flag()
         if self.legacy:
             return self.legacy_full_name
-        return self.full_name
+        return self.existing_name or self.full_name
+
+    def resolved_config(self):
+        """The volume as `up` creates it, without looking it up."""
+        config = {
+            'name': self.full_name,
+            'driver': self.driver,
+            'driver_opts': self.driver_opts,
+            'external': self.external,
+            'labels': None if self.external else self._labels,
+        }
+        return {k: v for k, v in config.items() if v}
 
     @property
     def _labels(self):
@@ -85,6 +129,8 @@ class Volume:
             LABEL_VOLUME: self.name,
             LABEL_VERSION: __version__,
         })
+        if self.tenant:
+            labels[LABEL_TENANT] = self.tenant
         return labels
 
     def _set_legacy_flag(self):
@@ -95,6 +141,27 @@ class Volume:
             self.legacy = data is not None
         except NotFound:
             self.legacy = False
+            self.existing_name = self._find_existing_name()
+
+    def _find_existing_name(self):
+        # A volume of the project is found by its labels, whichever separator
+        # its name was made with
+        if self.custom_name or self.external:
+            return None
+        try:
+            self.client.inspect_volume(self.full_name)
+            return None
+        except NotFound:
+            pass
+        labels = [
+            '{}={}'.format(LABEL_PROJECT, self.project),
+            '{}={}'.format(LABEL_VOLUME, self.name),
+        ]
+        if self.tenant:
+            labels.append('{}={}'.format(LABEL_TENANT, self.tenant))
+        for data in self.client.volumes(filters={'label': labels}).get('Volumes') or []:
+            return data['Name']
+        return None
 
 
 class ProjectVolumes:
@@ -103,7 +170,7 @@ class ProjectVolumes:
         self.volumes = volumes
 
     @classmethod
-    def from_config(cls, name, config_data, client):
+    def from_config(cls, name, config_data, client, tenant=None, separator=DEFAULT_SEPARATOR):
         config_volumes = config_data.volumes or {}
         volumes = {
             vol_name: Volume(
@@ -114,22 +181,39 @@ class ProjectVolumes:
                 driver_opts=data.get('driver_opts'),
                 custom_name=data.get('name') is not None,
                 labels=data.get('labels'),
-                external=bool(data.get('external', False))
+                external=bool(data.get('external', False)),
+                tenant=tenant,
+                separator=separator,
             )
             for vol_name, data in config_volumes.items()
         }
         return cls(volumes)
 
-    def remove(self):
-        for volume in self.volumes.values():
+    def select(self, names=None):
+        """The volumes, or only those with one of `names`, which are the
+        names the services refer to them by.
+        """
+        return [
+            volume for _, volume in sorted(self.volumes.items())
+            if names is None or set(names) & {
+                volume.full_name, volume.legacy_full_name, volume.existing_name,
+            }
+        ]
+
+    def remove(self, names=None):
+        for volume in self.select(names):
             try:
                 volume.remove()
             except NotFound:
                 log.warning("Volume %s not found.", volume.true_name)
 
-    def initialize(self):
+    def initialize(self, names=None, warnings=None):
+        """Create the volumes that are missing. Returns the names of those
+        created.
+        """
+        created = []
         try:
-            for volume in self.volumes.values():
+            for volume in self.select(names):
                 volume_exists = volume.exists()
                 if volume.external:
                     log.debug(
@@ -154,12 +238,28 @@ class ProjectVolumes:
                         )
                     )
                     volume.create()
+                    created.append(volume.name)
                 else:
-                    check_remote_volume_config(volume.inspect(legacy=volume.legacy), volume)
+                    data = volume.inspect(legacy=volume.legacy)
+                    if not volume.owns(data):
+                        raise ConfigurationError(
+                            'Volume "{}" already exists and belongs to another '
+                            'tenant.'.format(volume.true_name)
+                        )
+                    labels = data.get('Labels') or {}
+                    if labels.get(LABEL_PROJECT) != volume.project:
+                        (warnings or Warnings()).warn(
+                            LABEL_ADOPTION,
+                            'Volume "{}" already exists but was not created by Compose for '
+                            'project "{}". It is used as it is; declare it as external if '
+                            'that is intended.'.format(volume.true_name, volume.project)
+                        )
+                    check_remote_volume_config(data, volume)
         except NotFound:
             raise ConfigurationError(
                 'Volume {} specifies nonexistent driver {}'.format(volume.name, volume.driver)
             )
+        return created
 
     def namespace_spec(self, volume_spec):
         if not volume_spec.is_named_volume:
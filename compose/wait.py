@@ -0,0 +1,126 @@
+"""
+Waiting for an address to be reachable: dialling it again, with an
+exponential backoff, until it accepts a connection (`tcp`), completes a TLS
+handshake (`tls`) or answers an HTTP request with the expected status
+(`http`, `https`).
+
+    wait_for(lambda: dial_tcp('db', 5432, timeout=1), timeout=60)
+
+Project.wait_for waits for a port of the containers of a service.
+"""
+import socket
+import ssl
+import time
+import urllib.error
+import urllib.request
+from collections import namedtuple
+
+from .errors import WaitTimeoutError
+
+# Seconds a single attempt may take
+DIAL_TIMEOUT = 2
+
+
+class ProbeError(Exception):
+    pass
+
+
+class Backoff(namedtuple('_Backoff', 'initial factor cap')):
+    """Wait `initial` seconds after the first attempt, `factor` times as
+    long after each of the next ones, and never more than `cap` seconds.
+    """
+
+    def __new__(cls, initial=0.1, factor=2, cap=5):
+        return super().__new__(cls, initial, factor, cap)
+
+    def delays(self):
+        delay = self.initial
+        while True:
+            yield min(delay, self.cap)
+            delay *= self.factor
+
+
+def wait_for(check, timeout, backoff=Backoff(), clock=time.monotonic, sleep=time.sleep):
+    """Call `check` until it doesn't raise ProbeError, for at most `timeout`
+    seconds. Raises WaitTimeoutError with the last error otherwise.
+    """
+    deadline = clock() + timeout
+    delays = backoff.delays()
+    while True:
+        try:
+            return check()
+        except ProbeError as e:
+            remaining = deadline - clock()
+            if remaining <= 0:
+                raise WaitTimeoutError(timeout, e)
+            sleep(min(next(delays), remaining))
+
+
+def dial_tcp(host, port, timeout):
+    try:
+        socket.create_connection((host, port), timeout=timeout).close()
+    except OSError as e:
+        raise ProbeError('dial tcp {}:{}: {}'.format(host, port, e))
+
+
+def dial_tls(host, port, timeout):
+    """Complete a TLS handshake. Certificates aren't verified: services
+    commonly serve self-signed ones, and the point is that they serve.
+    """
+    context = ssl.create_default_context()
+    context.check_hostname = False
+    context.verify_mode = ssl.CERT_NONE
+    try:
+        with socket.create_connection((host, port), timeout=timeout) as sock:
+            context.wrap_socket(sock, server_hostname=host).close()
+    except OSError as e:
+        raise ProbeError('dial tls {}:{}: {}'.format(host, port, e))
+
+
+def http_get(url, timeout, status=200):
+    context = None
+    if url.startswith('https:'):
+        context = ssl.create_default_context()
+        context.check_hostname = False
+        context.verify_mode = ssl.CERT_NONE
+    try:
+        with urllib.request.urlopen(url, timeout=timeout, context=context) as response:
+            response_status = response.status
+    except urllib.error.HTTPError as e:
+        response_status = e.code
+    except (urllib.error.URLError, OSError) as e:
+        raise ProbeError('GET {}: {}'.format(url, getattr(e, 'reason', e)))
+
+    if response_status != status:
+        raise ProbeError('GET {}: status {}, expected {}'.format(url, response_status, status))
+
+
+Target = namedtuple('Target', 'scheme port path')
+
+SCHEMES = ('tcp', 'tls', 'http', 'https')
+
+
+def parse_target(target):
+    """Parse `[SCHEME://]PORT[/PATH]`, where SCHEME is tcp (the default),
+    tls, http or https, such as `5432` or `http://8080/health`.
+    """
+    scheme, sep, rest = target.partition('://')
+    if not sep:
+        scheme, rest = 'tcp', target
+    port, _, path = rest.partition('/')
+    if scheme not in SCHEMES or not port.isdigit():
+        raise ValueError(
+            'Invalid target "{}": expected [SCHEME://]PORT[/PATH], where SCHEME is one of {}'
+            .format(target, ', '.join(SCHEMES))
+        )
+    return Target(scheme, int(port), '/' + path)
+
+
+def check_target(host, target, timeout):
+    """Probe `target` on `host` once."""
+    if target.scheme == 'tcp':
+        dial_tcp(host, target.port, timeout)
+    elif target.scheme == 'tls':
+        dial_tls(host, target.port, timeout)
+    else:
+        http_get('{}://{}:{}{}'.format(target.scheme, host, target.port, target.path), timeout)
@@ -0,0 +1,57 @@
+"""
+The warnings Compose gives about a project, by class, so that the classes
+that are expected can be silenced for an invocation.
+
+COMPOSE_IGNORE_WARNINGS lists the classes to silence, separated by commas.
+COMPOSE_IGNORE_ORPHANS and COMPOSE_IGNORE_BIND_MOUNT_ACCESS silence a
+single class each.
+"""
+import logging
+
+log = logging.getLogger(__name__)
+
+ORPHANS = 'orphans'
+PLATFORM_MISMATCH = 'platform-mismatch'
+LABEL_ADOPTION = 'label-adoption'
+BIND_MOUNT_ACCESS = 'bind-mount-access'
+BIND_MOUNT_TYPE = 'bind-mount-type'
+
+CLASSES = (ORPHANS, PLATFORM_MISMATCH, LABEL_ADOPTION, BIND_MOUNT_ACCESS, BIND_MOUNT_TYPE)
+
+# Boolean variables that silence a single class
+IGNORE_VARIABLES = {
+    'COMPOSE_IGNORE_ORPHANS': ORPHANS,
+    'COMPOSE_IGNORE_BIND_MOUNT_ACCESS': BIND_MOUNT_ACCESS,
+}
+
+
+class Warnings:
+    """Where Compose reports the warnings of the classes above. Those of the
+    `ignored` classes are only logged at debug level.
+    """
+
+    def __init__(self, ignored=()):
+        unknown = set(ignored) - set(CLASSES)
+        if unknown:
+            raise ValueError('Unknown warning classes: {} (valid classes: {})'.format(
+                ', '.join(sorted(unknown)), ', '.join(CLASSES)
+            ))
+        self.ignored = frozenset(ignored)
+
+    @classmethod
+    def from_environment(cls, environment):
+        value = environment.get('COMPOSE_IGNORE_WARNINGS') or ''
+        ignored = [name.strip() for name in value.split(',') if name.strip()]
+        for variable, warning_class in IGNORE_VARIABLES.items():
+            if environment.get_boolean(variable):
+                ignored.append(warning_class)
+        return cls(ignored)
+
+    def is_ignored(self, warning_class):
+        return warning_class in self.ignored
+
+    def warn(self, warning_class, message):
+        if self.is_ignored(warning_class):
+            log.debug('Ignored %s warning: %s', warning_class, message)
+            return
+        log.warning(message)
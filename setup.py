@@ -52,6 +52,7 @@ extras_require = {
     ':python_version < "3.8"': ['cached-property >= 1.2.0, < 2'],
     ':sys_platform == "win32"': ['colorama >= 0.4, < 1'],
     'socks': ['PySocks >= 1.5.6, != 1.5.7, < 2'],
+    'tracing': ['opentelemetry-api >= 1.0, < 2'],
     'tests': tests_require,
 }
 
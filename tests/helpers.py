@@ -1,9 +1,11 @@
 import contextlib
 import os
 
+from compose.config.config import Config
 from compose.config.config import ConfigDetails
 from compose.config.config import ConfigFile
 from compose.config.config import load
+from compose.const import COMPOSE_SPEC
 
 BUSYBOX_IMAGE_NAME = 'busybox'
 BUSYBOX_DEFAULT_TAG = '1.31.0-uclibc'
@@ -21,6 +23,19 @@ def build_config_details(contents, working_dir='working_dir', filename='filename
     )
 
 
+def build_config_data(**kwargs):
+    """A Config as loaded from a Compose file, for Project.from_config()."""
+    return Config(
+        config_version=kwargs.get('config_version', COMPOSE_SPEC),
+        version=kwargs.get('version', COMPOSE_SPEC),
+        services=kwargs.get('services'),
+        volumes=kwargs.get('volumes'),
+        networks=kwargs.get('networks'),
+        secrets=kwargs.get('secrets'),
+        configs=kwargs.get('configs'),
+    )
+
+
 def create_custom_host_file(client, filename, content):
     dirname = os.path.dirname(filename)
     container = client.create_container(
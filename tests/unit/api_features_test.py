@@ -0,0 +1,33 @@
+from compose.api_features import negotiate_api_version
+from compose.api_features import unsupported_features
+from tests import mock
+
+
+def test_unsupported_features():
+    options = {
+        'image': 'busybox',
+        'platform': 'linux/arm64',
+        'init': False,
+        'healthcheck': {'test': ['CMD', 'true'], 'start_period': 10 ** 9},
+    }
+    assert [f.option for f in unsupported_features(options, '1.28')] == [
+        'healthcheck.start_period', 'platform',
+    ]
+    assert [f.option for f in unsupported_features(options, '1.30')] == ['platform']
+    assert unsupported_features(options, '1.41') == []
+
+
+def test_negotiate_older_daemon():
+    client = mock.Mock(_version='1.41')
+    client.version.return_value = {'ApiVersion': '1.38'}
+
+    assert negotiate_api_version(client) == '1.38'
+    assert client._version == '1.38'
+    client.version.assert_called_once_with(api_version=False)
+
+
+def test_negotiate_newer_daemon():
+    client = mock.Mock(_version='1.35')
+    client.version.return_value = {'ApiVersion': '1.43'}
+
+    assert negotiate_api_version(client) == '1.35'
@@ -0,0 +1,109 @@
+import io
+import json
+import tarfile
+
+import yaml
+
+from .. import unittest
+from compose.capture import bounded
+from compose.capture import mask_environment
+from compose.capture import write_capture
+from compose.config.config import Config
+from compose.const import COMPOSE_SPEC as VERSION
+from compose.project import Project
+from compose.testutil import FakeDockerClient
+
+
+class CaptureTest(unittest.TestCase):
+    def setUp(self):
+        self.client = FakeDockerClient(images=['busybox'])
+        self.project = Project.from_config('app', Config(
+            config_version=VERSION,
+            version=VERSION,
+            services=[
+                {
+                    'name': 'web',
+                    'image': 'busybox',
+                    'environment': {'DB_PASSWORD': 'hunter2', 'MODE': 'debug'},
+                },
+                {'name': 'db', 'image': 'busybox'},
+            ],
+            volumes=None,
+            networks=None,
+            secrets=None,
+            configs=None,
+        ), self.client)
+
+    def capture(self, **kwargs):
+        fileobj = io.BytesIO()
+        containers = write_capture(self.project, fileobj, **kwargs)
+        fileobj.seek(0)
+        with tarfile.open(fileobj=fileobj, mode='r:gz') as tar:
+            files = {
+                member.name: tar.extractfile(member).read().decode('utf-8')
+                for member in tar.getmembers()
+            }
+        return containers, files
+
+    def test_capture(self):
+        self.project.up(detached=True)
+        web = self.project.get_service('web').get_container()
+        self.client.containers_by_id[web.id]['State']['Health'] = {
+            'Status': 'unhealthy',
+            'Log': [{'ExitCode': 1, 'Output': 'connection refused'}],
+        }
+        self.client.stop(web.id)
+        logs = []
+
+        def fake_logs(container, **kwargs):
+            logs.append(kwargs)
+            return b'out\n' if kwargs['stdout'] else b'err\n'
+        self.client.logs = fake_logs
+
+        containers, files = self.capture(service_names=['web'], tail=20)
+
+        assert containers == [web]
+        assert sorted(files) == [
+            'info.json',
+            'version.json',
+            'web/app_web_1/health.json',
+            'web/app_web_1/inspect.json',
+            'web/app_web_1/stderr.log',
+            'web/app_web_1/stdout.log',
+            'web/config.yml',
+        ]
+        assert files['web/app_web_1/stdout.log'] == 'out\n'
+        assert files['web/app_web_1/stderr.log'] == 'err\n'
+        assert {log['tail'] for log in logs} == {20}
+        assert json.loads(files['web/app_web_1/health.json'])[0]['Output'] == 'connection refused'
+        assert json.loads(files['version.json'])['docker']['Version'] == 'fake'
+
+        inspect = json.loads(files['web/app_web_1/inspect.json'])
+        assert sorted(inspect['Config']['Env']) == [
+            'COMPOSE_REPLICA_INDEX=1', 'DB_PASSWORD=********', 'MODE=debug',
+        ]
+        config = yaml.safe_load(files['web/config.yml'])
+        assert config['environment'] == {'DB_PASSWORD': '********', 'MODE': 'debug'}
+        assert config['container_names'] == ['app_web_1']
+        assert 'hunter2' not in ''.join(files.values())
+
+    def test_capture_without_containers(self):
+        containers, files = self.capture()
+
+        assert containers == []
+        assert sorted(files) == ['db/config.yml', 'info.json', 'version.json', 'web/config.yml']
+        assert self.client.called('stop') == []
+
+
+def test_mask_environment():
+    assert mask_environment(['API_TOKEN=abc', 'PATH=/bin', 'EMPTY']) == [
+        'API_TOKEN=********', 'PATH=/bin', 'EMPTY',
+    ]
+    assert mask_environment({'SECRET_KEY': 'abc', 'UNSET': None}) == {
+        'SECRET_KEY': '********', 'UNSET': None,
+    }
+
+
+def test_bounded_keeps_the_last_whole_lines():
+    assert bounded(b'first\nsecond\n', max_size=100) == b'first\nsecond\n'
+    assert bounded(b'first\nsecond\nthird\n', max_size=10) == b'third\n'
@@ -1,10 +1,34 @@
+import io
 import os
 
 import pytest
 
+from compose.cli.command import config_files_label
 from compose.cli.command import get_config_path_from_options
+from compose.cli.command import get_default_bind_ip
+from compose.cli.command import get_ephemeral_suffix
+from compose.cli.command import get_name_separator
+from compose.cli.command import get_network_driver_opts
+from compose.cli.command import get_project
+from compose.cli.command import parse_config_files_label
+from compose.cli.errors import UserError
+from compose.config.config import ConfigDetails
+from compose.config.config import ConfigFile
 from compose.config.environment import Environment
+from compose.config.errors import ComposeFileNotFound
 from compose.const import IS_WINDOWS_PLATFORM
+from compose.const import LABEL_CONFIG_DATA
+from compose.const import LABEL_CONFIG_FILES
+from compose.const import LABEL_CONFIG_HASH
+from compose.const import LABEL_DEPENDS_ON
+from compose.const import LABEL_ENVIRONMENT_FILE
+from compose.const import LABEL_PROJECT
+from compose.const import LABEL_SERVICE
+from compose.const import LABEL_WORKING_DIR
+from compose.project import OneOffFilter
+from compose.service import ImageType
+from compose.stored_config import encode_config
+from compose.testutil import FakeDockerClient
 from tests import mock
 
 
@@ -52,3 +76,275 @@ class TestGetConfigPathFromOptions:
         opts = {'--file': paths}
         environment = Environment.from_env_file('.')
         assert get_config_path_from_options(opts, environment) == ['就吃饭/docker-compose.yml']
+
+
+class TestGetNetworkDriverOpts:
+
+    def test_no_options(self):
+        assert get_network_driver_opts(Environment({})) is None
+
+    def test_options_from_env(self):
+        environment = Environment({
+            'COMPOSE_NETWORK_DRIVER_OPTS':
+                'com.docker.network.driver.mtu=1400, com.docker.network.bridge.name=br0',
+        })
+        assert get_network_driver_opts(environment) == {
+            'com.docker.network.driver.mtu': '1400',
+            'com.docker.network.bridge.name': 'br0',
+        }
+
+    def test_invalid_options(self):
+        environment = Environment({'COMPOSE_NETWORK_DRIVER_OPTS': 'mtu'})
+        with pytest.raises(UserError):
+            get_network_driver_opts(environment)
+
+
+class TestGetDefaultBindIp:
+
+    def test_unset(self):
+        assert get_default_bind_ip(Environment({})) is None
+
+    @pytest.mark.parametrize('value,expected', [
+        ('127.0.0.1', '127.0.0.1'),
+        ('::1', '::1'),
+        ('[::1]', '::1'),
+        ('fd00:0::1', 'fd00::1'),
+    ])
+    def test_ip(self, value, expected):
+        assert get_default_bind_ip(Environment({'COMPOSE_DEFAULT_BIND_IP': value})) == expected
+
+    def test_invalid_ip(self):
+        environment = Environment({'COMPOSE_DEFAULT_BIND_IP': 'localhost'})
+        with pytest.raises(UserError) as excinfo:
+            get_default_bind_ip(environment)
+        assert excinfo.value.msg == (
+            'COMPOSE_DEFAULT_BIND_IP must be an IP address (found: "localhost")'
+        )
+
+
+class TestGetNameSeparator:
+
+    def test_default(self):
+        assert get_name_separator(Environment({})) == '_'
+
+    def test_dash(self):
+        assert get_name_separator(Environment({'COMPOSE_NAME_SEPARATOR': '-'})) == '-'
+
+    def test_invalid(self):
+        with pytest.raises(UserError) as excinfo:
+            get_name_separator(Environment({'COMPOSE_NAME_SEPARATOR': '.'}))
+        assert excinfo.value.msg == (
+            'COMPOSE_NAME_SEPARATOR must be one of "_", "-" (found: ".")'
+        )
+
+
+class TestGetEphemeralSuffix:
+
+    def test_unset(self):
+        assert get_ephemeral_suffix(Environment({})) is None
+
+    def test_suffix(self):
+        assert get_ephemeral_suffix(Environment({'COMPOSE_EPHEMERAL_SUFFIX': 'ci-1'})) == 'ci-1'
+
+    def test_auto_generates_a_suffix(self):
+        environment = Environment({'COMPOSE_EPHEMERAL_SUFFIX': 'auto'})
+        with mock.patch('compose.cli.command.generate_suffix', return_value='1a2b3c4d'):
+            assert get_ephemeral_suffix(environment, allow_auto=True) == '1a2b3c4d'
+
+    def test_auto_not_allowed(self):
+        with pytest.raises(UserError) as excinfo:
+            get_ephemeral_suffix(Environment({'COMPOSE_EPHEMERAL_SUFFIX': 'auto'}))
+        assert 'only supported by `up` and `create`' in excinfo.value.msg
+
+
+class TestConfigFilesLabel:
+
+    def label(self, *filenames):
+        return config_files_label(ConfigDetails('.', [ConfigFile(f, {}) for f in filenames], None))
+
+    def test_joined_with_commas(self):
+        label = self.label('/My Projects/app\u00df/compose.yml', '/My Projects/app\u00df/dev.yml')
+        assert label == '/My Projects/app\u00df/compose.yml,/My Projects/app\u00df/dev.yml'
+        assert parse_config_files_label(label) == [
+            '/My Projects/app\u00df/compose.yml', '/My Projects/app\u00df/dev.yml',
+        ]
+
+    def test_json_array_when_a_path_has_a_comma(self):
+        label = self.label('/Acme, Inc/compose.yml', '/Acme, Inc/dev.yml')
+        assert label == '["/Acme, Inc/compose.yml", "/Acme, Inc/dev.yml"]'
+        assert parse_config_files_label(label) == ['/Acme, Inc/compose.yml', '/Acme, Inc/dev.yml']
+
+    def test_relative_paths_are_made_absolute(self):
+        assert self.label('compose.yml') == os.path.join(os.getcwd(), 'compose.yml')
+
+
+class TestGetProject:
+
+    def test_get_project_with_client(self, tmpdir):
+        tmpdir.join('docker-compose.yml').write('services:\n  web:\n    image: busybox\n')
+        client = FakeDockerClient()
+
+        with mock.patch('compose.cli.command.get_client') as get_client:
+            project = get_project(str(tmpdir), client=client)
+
+        assert not get_client.called
+        assert project.client is client
+        assert project.get_service('web').client is client
+
+    def test_get_project_from_stored_config(self, tmpdir):
+        client = FakeDockerClient(images=['busybox'])
+        client.create_container('busybox', name='app_web_1', labels={
+            LABEL_PROJECT: 'app',
+            LABEL_CONFIG_DATA: encode_config('services:\n  web:\n    image: busybox\n'),
+        })
+
+        with pytest.raises(ComposeFileNotFound):
+            get_project(str(tmpdir), project_name='app', client=client)
+
+        project = get_project(str(tmpdir), project_name='app', client=client, use_stored_config=True)
+        assert project.service_names == ['web']
+
+    def test_config_from_stdin_is_only_stored_when_asked(self, tmpdir):
+        client = FakeDockerClient()
+
+        for store_stdin_config in (False, True):
+            with mock.patch('compose.cli.command.store_config', return_value=[]) as store:
+                with mock.patch(
+                        'sys.stdin', io.StringIO('services:\n  web:\n    image: busybox\n')):
+                    get_project(
+                        str(tmpdir), ['-'], project_name='app', client=client,
+                        store_stdin_config=store_stdin_config,
+                    )
+            assert store.called == store_stdin_config
+
+    def test_get_project_from_container_labels(self, tmpdir):
+        client = FakeDockerClient(images=['busybox'])
+        with pytest.raises(ComposeFileNotFound):
+            get_project(str(tmpdir), project_name='app', client=client, use_stored_config=True)
+
+        client.create_container('busybox', name='app_db_1', labels={
+            LABEL_PROJECT: 'app', LABEL_SERVICE: 'db',
+        })
+        client.create_container('busybox', name='app_web_1', labels={
+            LABEL_PROJECT: 'app', LABEL_SERVICE: 'web', LABEL_DEPENDS_ON: 'db',
+        })
+
+        project = get_project(str(tmpdir), project_name='app', client=client, use_stored_config=True)
+        assert project.service_names == ['db', 'web']
+        assert project.get_service('web').get_dependency_names() == ['db']
+
+    def test_get_project_from_recorded_config_files(self, tmpdir):
+        project_dir = tmpdir.mkdir('My Projects, Inc').mkdir('app\u00df')
+        project_dir.join('docker-compose.yml').write('services:\n  web:\n    image: busybox\n')
+        project_dir.join('docker-compose.override.yml').write(
+            'services:\n  web:\n    volumes:\n      - ./data:/data\n'
+        )
+        client = FakeDockerClient(images=['busybox'])
+        get_project(str(project_dir), client=client).up(detached=True)
+
+        web, = client.containers(all=True)
+        assert web['Labels'][LABEL_WORKING_DIR] == str(project_dir)
+        assert parse_config_files_label(web['Labels'][LABEL_CONFIG_FILES]) == [
+            str(project_dir.join('docker-compose.yml')),
+            str(project_dir.join('docker-compose.override.yml')),
+        ]
+
+        project = get_project(
+            str(tmpdir.mkdir('elsewhere')), project_name='app', client=client,
+            use_stored_config=True,
+        )
+        assert project.get_service('web').options['volumes'][0].external == str(
+            project_dir.join('data')
+        )
+        project.down(ImageType.none, include_volumes=False)
+        assert project.containers(stopped=True, one_off=OneOffFilter.include) == []
+
+    def test_get_project_from_recorded_config_files_and_environment_file(self, tmpdir):
+        project_dir = tmpdir.mkdir('app')
+        project_dir.join('docker-compose.yml').write(
+            'services:\n  web:\n    image: busybox\n    environment:\n'
+            '      - MODE=${ENV_FILE_TEST_MODE:-default}\n'
+        )
+        project_dir.join('.env').write('ENV_FILE_TEST_MODE=production\n')
+        elsewhere = tmpdir.mkdir('elsewhere')
+        elsewhere.join('.env').write('ENV_FILE_TEST_MODE=staging\n')
+        client = FakeDockerClient(images=['busybox'])
+        project = get_project(str(project_dir), client=client)
+        project.up(detached=True)
+        config_hash = project.config_hash()
+
+        web, = client.containers(all=True)
+        assert web['Labels'][LABEL_ENVIRONMENT_FILE] == str(project_dir.join('.env'))
+
+        def reconstruct(**kwargs):
+            return get_project(
+                str(elsewhere), project_name='app', client=client, use_stored_config=True,
+                **kwargs
+            )
+
+        project = reconstruct()
+        assert project.get_service('web').options['environment'] == {'MODE': 'production'}
+        assert project.config_hash() == config_hash
+        assert project.get_service('web').config_hash == web['Labels'][LABEL_CONFIG_HASH]
+
+        project = reconstruct(environment_file=str(elsewhere.join('.env')))
+        assert project.get_service('web').options['environment'] == {'MODE': 'staging'}
+
+        project_dir.join('.env').remove()
+        with mock.patch('compose.cli.command.log') as log:
+            project = reconstruct()
+        assert 'no longer exists' in log.warning.call_args[0][0]
+        assert project.get_service('web').options['environment'] == {'MODE': 'default'}
+
+    def test_get_project_auth_file(self, tmpdir):
+        tmpdir.join('docker-compose.yml').write('services:\n  web:\n    image: busybox\n')
+        tmpdir.join('auth.json').write(
+            '{"auths": {"registry.example.com": {"auth": "Y2k6c2VjcmV0"}}}'
+        )
+        environment = Environment({'COMPOSE_AUTH_FILE': str(tmpdir.join('auth.json'))})
+        client = FakeDockerClient()
+
+        get_project(str(tmpdir), environment=environment, client=client)
+        assert client._auth_configs.resolve_authconfig('registry.example.com')['username'] == 'ci'
+
+        get_project(
+            str(tmpdir), environment=environment, client=client,
+            auths={'registry.example.com': {'username': 'bot', 'password': 'x'}},
+        )
+        assert client._auth_configs.resolve_authconfig('registry.example.com')['username'] == 'bot'
+
+    def test_get_project_missing_auth_file(self, tmpdir):
+        tmpdir.join('docker-compose.yml').write('services:\n  web:\n    image: busybox\n')
+        environment = Environment({'COMPOSE_AUTH_FILE': str(tmpdir.join('auth.json'))})
+
+        with pytest.raises(UserError) as excinfo:
+            get_project(str(tmpdir), environment=environment, client=FakeDockerClient())
+        assert 'COMPOSE_AUTH_FILE' in excinfo.value.msg
+
+    def test_get_project_default_bind_ip(self, tmpdir):
+        tmpdir.join('docker-compose.yml').write(
+            'services:\n'
+            '  web:\n'
+            '    image: busybox\n'
+            '    ports: ["8080:80", "0.0.0.0:8443:443"]\n'
+        )
+        environment = Environment({'COMPOSE_DEFAULT_BIND_IP': '127.0.0.1'})
+        client = FakeDockerClient(images=['busybox'])
+
+        project = get_project(str(tmpdir), project_name='app', environment=environment, client=client)
+        project.up(detached=True)
+
+        [container] = project.containers()
+        assert container.human_readable_ports == '0.0.0.0:8443->443/tcp, 127.0.0.1:8080->80/tcp'
+
+    def test_get_project_network_driver_opts(self, tmpdir):
+        tmpdir.join('docker-compose.yml').write('services:\n  web:\n    image: busybox\n')
+        environment = Environment({'COMPOSE_NETWORK_DRIVER_OPTS': 'com.docker.network.driver.mtu=1400'})
+        client = FakeDockerClient(images=['busybox'])
+
+        project = get_project(str(tmpdir), project_name='app', environment=environment, client=client)
+        project.up(detached=True)
+
+        assert client.networks_by_name['app_default']['Options'] == {
+            'com.docker.network.driver.mtu': '1400',
+        }
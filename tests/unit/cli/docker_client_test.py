@@ -9,6 +9,7 @@ from docker.constants import DEFAULT_DOCKER_API_VERSION
 import compose
 from compose.cli import errors
 from compose.cli.docker_client import docker_client
+from compose.cli.docker_client import get_client
 from compose.cli.docker_client import get_tls_version
 from compose.cli.docker_client import tls_config_from_options
 from compose.config.environment import Environment
@@ -64,6 +65,13 @@ class DockerClientTestCase(unittest.TestCase):
         )
         assert client.headers['User-Agent'] == expected
 
+    def test_get_client_without_negotiating(self):
+        with mock.patch('compose.cli.docker_client.negotiate_api_version') as negotiate:
+            client = get_client(os.environ, negotiate=False)
+
+        assert not negotiate.called
+        assert client.api_version == DEFAULT_DOCKER_API_VERSION
+
 
 class TLSConfigTestCase(unittest.TestCase):
     cert_path = 'tests/fixtures/tls/'
@@ -0,0 +1,89 @@
+import os
+
+import pytest
+
+from compose.cli.log_files import FileLogPresenter
+from compose.cli.log_files import log_file_name
+from compose.cli.log_files import LogFiles
+from compose.container import Container
+from tests import mock
+
+
+def container(service, number=1, name=None):
+    container = mock.Mock(spec=Container, service=service, number=number, slug=None)
+    container.name = name or 'app_{}_{}'.format(service, number)
+    return container
+
+
+def read(path):
+    with open(path) as f:
+        return f.read()
+
+
+@pytest.mark.parametrize('name,expected', [
+    ('web', 'web.log'),
+    ('api.v2', 'api.v2.log'),
+    ('team/web', 'team_web.log'),
+    ('../web', '_web.log'),
+    ('', '_.log'),
+])
+def test_log_file_name(name, expected):
+    assert log_file_name(name) == expected
+
+
+def test_one_file_per_service(tmpdir):
+    files = LogFiles(str(tmpdir.join('logs')))
+    files.write(container('web', 1), 'GET /\n')
+    files.write(container('db', 1), '\x1b[32mready\x1b[0m\n')
+    files.write(container('web', 2), 'GET /health\n')
+
+    paths = files.close()
+
+    assert paths == [str(tmpdir.join('logs', 'db.log')), str(tmpdir.join('logs', 'web.log'))]
+    assert read(paths[0]) == 'ready\n'
+    assert read(paths[1]) == 'GET /\nGET /health\n'
+
+
+def test_one_file_per_replica(tmpdir):
+    files = LogFiles(str(tmpdir), per_replica=True)
+    files.write(container('web', 1), 'one\n')
+    files.write(container('web', 2), 'two\n')
+
+    assert [os.path.basename(p) for p in files.close()] == ['web-1.log', 'web-2.log']
+
+
+def test_names_colliding_once_made_safe(tmpdir):
+    files = LogFiles(str(tmpdir))
+    files.write(container(None, name='team/web'), 'a\n')
+    files.write(container(None, name='team_web'), 'b\n')
+
+    assert [os.path.basename(p) for p in files.close()] == ['team_web-2.log', 'team_web.log']
+
+
+def test_rotation(tmpdir):
+    files = LogFiles(str(tmpdir), max_file_size=10)
+    web = container('web')
+    for line in ['first\n', 'second\n', 'third\n']:
+        files.write(web, line)
+
+    [path] = files.close()
+
+    assert read(path) == 'third\n'
+    assert read(path + '.1') == 'second\n'
+    assert read(path + '.2') == 'first\n'
+
+
+def test_file_presenter(tmpdir):
+    files = LogFiles(str(tmpdir))
+    presenter = mock.Mock()
+    web = container('web')
+
+    assert FileLogPresenter(presenter, files).present(web, 'a\n') == (
+        presenter.present.return_value
+    )
+    presenter.present.assert_called_once_with(web, 'a\n', 'stdout')
+    assert FileLogPresenter(presenter, files, console=False).present(web, 'b\n') is None
+    assert presenter.present.call_count == 1
+
+    [path] = files.close()
+    assert read(path) == 'a\nb\n'
@@ -9,6 +9,7 @@ from docker.errors import APIError
 from compose.cli.log_printer import build_log_generator
 from compose.cli.log_printer import build_log_presenters
 from compose.cli.log_printer import consume_queue
+from compose.cli.log_printer import CrashRestarter
 from compose.cli.log_printer import QueueItem
 from compose.cli.log_printer import wait_on_exit
 from compose.cli.log_printer import watch_events
@@ -42,6 +43,16 @@ class TestLogPresenter:
         actual = presenter.present(mock_container, "this line")
         assert '\033[' in actual
 
+    def test_stderr_polychrome(self, mock_container):
+        presenter = next(build_log_presenters(['foo', 'bar'], False, keep_prefix=False))
+        assert presenter.present(mock_container, "oops\n", 'stderr') == '\033[31moops\033[0m\n'
+        assert presenter.present(mock_container, "fine\n", 'stdout') == 'fine\n'
+
+    def test_stderr_monochrome(self, mock_container):
+        presenter = next(build_log_presenters(['foo', 'bar'], True))
+        actual = presenter.present(mock_container, "oops\n", 'stderr')
+        assert actual == "web_1  | oops\n"
+
 
 def test_wait_on_exit():
     exit_status = 3
@@ -78,32 +89,69 @@ class TestBuildLogGenerator:
 
     def test_no_log_stream(self, mock_container):
         mock_container.log_stream = None
-        mock_container.logs.return_value = iter([b"hello\nworld"])
-        log_args = {'follow': True}
+        mock_container.demuxed_logs.return_value = iter([
+            (b"hel", None), (None, b"panic: oops\n"), (b"lo\nworld", None),
+        ])
+        log_args = {'follow': False, 'tail': 10}
+
+        assert list(build_log_generator(mock_container, log_args)) == [
+            ('stderr', 'panic: oops\n'),
+            ('stdout', 'hello\n'),
+            ('stdout', 'world'),
+        ]
+        mock_container.demuxed_logs.assert_called_once_with(follow=False, tail=10)
+        assert not mock_container.logs.called
+
+    def test_no_log_stream_timestamped(self, mock_container):
+        mock_container.log_stream = None
+        mock_container.logs.side_effect = lambda stdout, **kwargs: iter(
+            [b"fine\n"] if stdout else [b"panic: oops\n"]
+        )
+        log_args = {'follow': True, 'tail': 10, 'timestamps': True}
+
+        assert sorted(build_log_generator(mock_container, log_args)) == [
+            ('stderr', 'panic: oops\n'),
+            ('stdout', 'fine\n'),
+        ]
+        assert not mock_container.demuxed_logs.called
+        mock_container.logs.assert_any_call(
+            stdout=True, stderr=False, stream=True, follow=True, tail=10, timestamps=True)
+
+    def test_no_log_stream_one_stream(self, mock_container):
+        mock_container.log_stream = None
+        mock_container.logs.return_value = iter([b"panic: oops\n"])
 
-        generator = build_log_generator(mock_container, log_args)
-        assert next(generator) == "hello\n"
-        assert next(generator) == "world"
+        generator = build_log_generator(mock_container, {'stdout': False, 'tail': 10})
+        assert list(generator) == [('stderr', 'panic: oops\n')]
         mock_container.logs.assert_called_once_with(
-            stdout=True,
-            stderr=True,
-            stream=True,
-            **log_args)
+            stdout=False, stderr=True, stream=True, tail=10)
 
     def test_with_log_stream(self, mock_container):
         mock_container.log_stream = iter([b"hello\nworld"])
         log_args = {'follow': True}
 
         generator = build_log_generator(mock_container, log_args)
-        assert next(generator) == "hello\n"
-        assert next(generator) == "world"
+        assert next(generator) == ('stdout', "hello\n")
+        assert next(generator) == ('stdout', "world")
+
+    def test_with_demuxed_log_stream(self, mock_container):
+        mock_container.log_stream = iter([
+            (b"hel", None), (None, b"panic: "), (b"lo\nworld", None), (None, b"oops\n"),
+        ])
+
+        generator = build_log_generator(mock_container, {})
+        assert list(generator) == [
+            ('stdout', "hello\n"),
+            ('stderr', "panic: oops\n"),
+            ('stdout', "world"),
+        ]
 
     def test_unicode(self, output_stream):
         glyph = '\u2022\n'
         mock_container.log_stream = iter([glyph.encode('utf-8')])
 
         generator = build_log_generator(mock_container, {})
-        assert next(generator) == glyph
+        assert next(generator) == ('stdout', glyph)
 
 
 @pytest.fixture
@@ -158,6 +206,106 @@ class TestWatchEvents:
         assert container_id not in thread_map
 
 
+def crashed_container(restart_policy='no'):
+    container = mock.Mock(spec=Container, id='cid')
+    container.name = 'app_web_1'
+    container.get.return_value = restart_policy
+    return container
+
+
+class TestCrashRestarter:
+
+    def test_restarts_within_budget(self):
+        clock = mock.Mock(return_value=100)
+        restarter = CrashRestarter(2, 60, clock=clock)
+        container = crashed_container()
+
+        assert restarter.restart(container, 1) == 'app_web_1 restarted (attempt 1/2)\n'
+        assert restarter.restarting('cid')
+        assert not restarter.settled()
+        restarter.handled('cid')
+        assert restarter.settled()
+
+        clock.return_value = 130
+        assert restarter.restart(container, 1) == 'app_web_1 restarted (attempt 2/2)\n'
+        restarter.handled('cid')
+        assert restarter.restart(container, 137) == (
+            'app_web_1 exited with code 137, not restarting it: it was restarted 2 times '
+            'within 60s\n'
+        )
+        assert container.start.call_count == 2
+
+        # The first restart is out of the window by now
+        clock.return_value = 161
+        assert restarter.restart(container, 1) == 'app_web_1 restarted (attempt 2/2)\n'
+
+    @pytest.mark.parametrize('exit_code,restart_policy,killed', [
+        (0, 'no', False),
+        (1, 'on-failure', False),
+        (1, 'unless-stopped', False),
+        (143, 'no', True),
+    ])
+    def test_leaves_alone(self, exit_code, restart_policy, killed):
+        restarter = CrashRestarter(5, 60)
+        container = crashed_container(restart_policy)
+        if killed:
+            restarter.killed('cid')
+
+        assert restarter.restart(container, exit_code) is None
+        assert not container.start.called
+        assert not restarter.restarting('cid')
+
+    def test_waits_for_the_death_of_containers_whose_logs_ended(self):
+        clock = mock.Mock(return_value=100)
+        restarter = CrashRestarter(5, 60, clock=clock)
+
+        restarter.logs_ended('cid')
+        assert not restarter.settled()
+        restarter.handled('cid')
+        assert restarter.settled()
+
+        restarter.logs_ended('cid')
+        assert not restarter.settled()
+        clock.return_value = 100 + CrashRestarter.grace + 1
+        assert restarter.settled()
+
+    def test_watch_events_restarts_crashed_container(self, mock_presenters):
+        restarter = CrashRestarter(5, 60)
+        container = crashed_container()
+        queue = Queue()
+        thread_map = {'cid': mock.Mock()}
+        event_stream = [
+            {'action': 'die', 'id': 'cid', 'container': container,
+             'attributes': {'exitCode': '2'}},
+            {'action': 'start', 'id': 'cid', 'container': container},
+        ]
+
+        with mock.patch('compose.cli.log_printer.build_thread', autospec=True) as build_thread:
+            watch_events(thread_map, event_stream, mock_presenters, (queue, {}), restarter)
+
+        assert container.start.called
+        assert queue.get().item == 'app_web_1 restarted (attempt 1/5)\n'
+        assert thread_map == {'cid': build_thread.return_value}
+        assert restarter.settled()
+
+    def test_watch_events_stopped_container(self, mock_presenters):
+        restarter = CrashRestarter(5, 60)
+        container = crashed_container()
+        thread_map = {'cid': mock.Mock()}
+        event_stream = [
+            {'action': 'kill', 'id': 'cid', 'container': container},
+            {'action': 'die', 'id': 'cid', 'container': container,
+             'attributes': {'exitCode': '143'}},
+            {'action': 'stop', 'id': 'cid', 'container': container},
+        ]
+
+        watch_events(thread_map, event_stream, mock_presenters, (Queue(), {}), restarter)
+
+        assert not container.start.called
+        assert not thread_map
+        assert restarter.settled()
+
+
 class TestConsumeQueue:
 
     def test_item_is_an_exception(self):
@@ -1,6 +1,6 @@
 import logging
+import tracemalloc
 
-import docker
 import pytest
 
 from compose import container
@@ -9,11 +9,25 @@ from compose.cli.formatter import ConsoleWarningFormatter
 from compose.cli.main import build_one_off_container_options
 from compose.cli.main import call_docker
 from compose.cli.main import convergence_strategy_from_opts
+from compose.cli.main import copy_output
 from compose.cli.main import filter_attached_containers
 from compose.cli.main import get_docker_start_call
+from compose.cli.main import parse_run_volumes
+from compose.cli.main import print_generated_suffix
+from compose.cli.main import ps_containers
 from compose.cli.main import setup_console_handler
+from compose.cli.main import warn_for_inaccessible_bind_mounts
+from compose.cli.main import warn_for_misconfigured_bind_mounts
+from compose.cli.main import warn_for_missing_init_binary
 from compose.cli.main import warn_for_swarm_mode
+from compose.config.environment import Environment
+from compose.config.types import MountSpec
+from compose.config.types import VolumeSpec
 from compose.service import ConvergenceStrategy
+from compose.service import Service
+from compose.testutil import FakeDockerClient
+from compose.warning import BIND_MOUNT_TYPE
+from compose.warning import Warnings
 from tests import mock
 
 
@@ -69,13 +83,80 @@ class TestCLIMainTestCase:
         assert actual == containers
 
     def test_warning_in_swarm_mode(self):
-        mock_client = mock.create_autospec(docker.APIClient)
-        mock_client.info.return_value = {'Swarm': {'LocalNodeState': 'active'}}
+        client = FakeDockerClient()
+        client.daemon_info = {'Swarm': {'LocalNodeState': 'active'}}
 
         with mock.patch('compose.cli.main.log') as fake_log:
-            warn_for_swarm_mode(mock_client)
+            warn_for_swarm_mode(client)
             assert fake_log.warning.call_count == 1
 
+    def test_warning_for_missing_init_binary(self):
+        client = FakeDockerClient()
+        client.daemon_info = {
+            'InitBinary': 'docker-init',
+            'InitCommit': {'ID': 'N/A', 'Expected': 'fec3683'},
+        }
+        services = [Service('web', init=True), Service('db')]
+
+        with mock.patch('compose.cli.main.log') as fake_log:
+            warn_for_missing_init_binary(client, services)
+            assert fake_log.warning.call_count == 1
+            assert 'web' in fake_log.warning.call_args[0][0]
+            assert 'db' not in fake_log.warning.call_args[0][0]
+
+    def test_no_warning_for_available_init_binary(self):
+        client = FakeDockerClient()
+        client.daemon_info = {
+            'InitBinary': 'docker-init',
+            'InitCommit': {'ID': 'fec3683', 'Expected': 'fec3683'},
+        }
+
+        with mock.patch('compose.cli.main.log') as fake_log:
+            warn_for_missing_init_binary(client, [Service('web', init=True)])
+            assert fake_log.warning.call_count == 0
+
+    def test_no_info_call_without_init(self):
+        client = FakeDockerClient()
+        warn_for_missing_init_binary(client, [Service('web', init=False)])
+        assert not client.called('info')
+
+    def test_warning_for_inaccessible_bind_mounts_under_userns_remap(self, tmpdir):
+        tmpdir.chmod(0o700)
+        client = FakeDockerClient()
+        client.daemon_info = {
+            'SecurityOptions': ['name=seccomp,profile=default', 'name=userns'],
+        }
+        services = [
+            Service('web', volumes=[VolumeSpec.parse('{}:/data'.format(tmpdir))]),
+            Service('db', volumes=[VolumeSpec.parse('{}:/data'.format(tmpdir))],
+                    userns_mode='host'),
+        ]
+
+        with mock.patch('compose.warning.log') as fake_log:
+            warn_for_inaccessible_bind_mounts(client, services)
+            assert fake_log.warning.call_count == 1
+            assert 'service web' in fake_log.warning.call_args[0][0]
+            assert 'userns_mode' in fake_log.warning.call_args[0][0]
+
+    def test_warning_for_misconfigured_bind_mounts(self, tmpdir):
+        services = [
+            Service('web', volumes=[
+                VolumeSpec.parse('{}:/etc/app/app.conf'.format(tmpdir)),
+                VolumeSpec.parse('{}:/data'.format(tmpdir)),
+            ]),
+        ]
+
+        with mock.patch('compose.warning.log') as fake_log:
+            warn_for_misconfigured_bind_mounts(services)
+            assert fake_log.warning.call_count == 1
+            message = fake_log.warning.call_args[0][0]
+            assert 'service web is a directory' in message
+            assert '/etc/app/app.conf looks like a file' in message
+
+        with mock.patch('compose.warning.log') as fake_log:
+            warn_for_misconfigured_bind_mounts(services, Warnings([BIND_MOUNT_TYPE]))
+            assert fake_log.warning.call_count == 0
+
     def test_build_one_off_container_options(self):
         command = 'build myservice'
         detach = False
@@ -111,6 +192,53 @@ class TestCLIMainTestCase:
         container_options = build_one_off_container_options(options, detach, command)
         assert container_options == expected_container_options
 
+    def test_build_one_off_container_options_env_files(self, tmpdir):
+        base = tmpdir.join('base.env')
+        base.write('# comment\nexport A=base\nB="quoted value"\n')
+        test = tmpdir.join('test.env')
+        test.write('A=test\nC=file\n')
+        options = {
+            '-e': ['C=cli'],
+            '--env-file': [str(base), str(test)],
+            '-T': True,
+            '--label': [],
+            '--user': None,
+            '--service-ports': [],
+            '--publish': '',
+            '--name': None,
+            '--workdir': None,
+            '--volume': [],
+            'stdin_open': False,
+        }
+
+        container_options = build_one_off_container_options(options, False, None)
+        assert container_options['environment'] == {
+            'A': 'test',
+            'B': 'quoted value',
+            'C': 'cli',
+        }
+
+    def test_parse_run_volumes_mounts_replace_volumes_with_the_same_target(self):
+        volumes = parse_run_volumes(
+            ['/src:/app', 'data:/data'],
+            ['type=tmpfs,target=/app', 'type=volume,source=cache,target=/cache'],
+        )
+        assert [v.internal for v in volumes if isinstance(v, VolumeSpec)] == ['/data']
+        assert [(m.type, m.target) for m in volumes if isinstance(m, MountSpec)] == [
+            ('tmpfs', '/app'), ('volume', '/cache'),
+        ]
+
+    def test_parse_run_volumes_names_the_invalid_entry(self):
+        with pytest.raises(UserError) as excinfo:
+            parse_run_volumes(['data:/data'], ['type=tmpfs,target=/tmp', 'type=bind,target=/app'])
+        assert excinfo.value.msg == (
+            'Invalid --mount #2 "type=bind,target=/app": bind mounts require a source'
+        )
+
+        with pytest.raises(UserError) as excinfo:
+            parse_run_volumes(['data:/data', 'a:b:c:d'], None)
+        assert excinfo.value.msg.startswith('Invalid --volume #2 "a:b:c:d": ')
+
     def test_get_docker_start_call(self):
         container_id = 'my_container_id'
 
@@ -134,6 +262,75 @@ class TestCLIMainTestCase:
         docker_start_call = get_docker_start_call(mock_container_options, container_id)
         assert expected_docker_start_call == docker_start_call
 
+    def test_ps_containers_filters_by_source_and_status(self):
+        project = mock.Mock(services=[
+            Service('web', image='busybox'),
+            Service('app', build={'context': '.'}),
+            Service('worker', image='busybox'),
+        ])
+
+        ps_containers(project, [], {'source': 'image', 'status': 'exited'}, 'name', False)
+        project.ps.assert_called_once_with(
+            ['web', 'worker'], statuses=['exited'], sort='name', all=False
+        )
+
+        project.ps.reset_mock()
+        assert ps_containers(project, ['app'], {'source': 'image'}, 'name', False) == []
+        project.ps.assert_not_called()
+
+        with pytest.raises(UserError):
+            ps_containers(project, [], {'label': 'a=b'}, 'name', False)
+
+    def test_copy_output_streams_without_buffering(self):
+        chunk_size, chunks = 4096, 4096
+
+        def attachment():
+            # What a hijacked connection yields for 16MB of output, a line
+            # at a time, with the occasional line on stderr
+            for i in range(chunks):
+                err = b'error\n' if i % 1024 == 0 else None
+                yield b'x' * (chunk_size - 1) + b'\n', err
+                # The container is still running: what it output so far
+                # must have been flushed
+                assert (stdout.flushed, stdout.pending) == ((i + 1) * chunk_size, 0)
+                assert stderr.pending == 0
+
+        class CountingWriter:
+            def __init__(self):
+                self.written = 0
+                self.largest_write = 0
+                self.pending = 0
+                self.flushed = 0
+
+            def write(self, data):
+                self.written += len(data)
+                self.largest_write = max(self.largest_write, len(data))
+                self.pending += len(data)
+
+            def flush(self):
+                self.flushed += self.pending
+                self.pending = 0
+
+        stdout, stderr = CountingWriter(), CountingWriter()
+        tracemalloc.start()
+        try:
+            copy_output(attachment(), stdout, stderr)
+            _, peak = tracemalloc.get_traced_memory()
+        finally:
+            tracemalloc.stop()
+
+        assert stdout.written == chunk_size * chunks
+        assert stdout.largest_write == chunk_size
+        assert stderr.written == len(b'error\n') * 4
+        assert peak < 256 * 1024
+
+    def test_print_generated_suffix(self, capsys):
+        project = mock.Mock(ephemeral_suffix='1a2b3c4d')
+        print_generated_suffix(project, Environment({'COMPOSE_EPHEMERAL_SUFFIX': 'auto'}))
+        print_generated_suffix(project, Environment({'COMPOSE_EPHEMERAL_SUFFIX': '1a2b3c4d'}))
+        print_generated_suffix(project, Environment({}))
+        assert capsys.readouterr().out == '1a2b3c4d\n'
+
 
 class TestSetupConsoleHandlerTestCase:
 
@@ -1,4 +1,9 @@
+import logging
+
+import pytest
+
 from compose.cli import verbose_proxy
+from tests import mock
 from tests import unittest
 
 
@@ -26,3 +31,28 @@ class VerboseProxyTestCase(unittest.TestCase):
     def test_format_return_no_result(self):
         actual = verbose_proxy.format_return(None, 2)
         assert actual is None
+
+    def test_proxy_callable_logs_result_and_duration(self):
+        obj = mock.Mock()
+        obj.start.return_value = None
+        proxy = verbose_proxy.VerboseProxy('docker', obj, level=logging.DEBUG)
+
+        with mock.patch.object(proxy, 'log') as mock_log:
+            proxy.start('abc123')
+
+        obj.start.assert_called_once_with('abc123')
+        assert [c[0][0] for c in mock_log.log.call_args_list] == [logging.DEBUG, logging.DEBUG]
+        assert mock_log.log.call_args_list[1][0][1] == "%s %s -> %s (%.3fs)"
+
+    def test_proxy_callable_logs_errors(self):
+        obj = mock.Mock()
+        obj.start.side_effect = ValueError('boom')
+        proxy = verbose_proxy.VerboseProxy('docker', obj)
+
+        with mock.patch.object(proxy, 'log') as mock_log:
+            with pytest.raises(ValueError):
+                proxy.start('abc123')
+
+        level, fmt, name, call_name, error, _ = mock_log.log.call_args[0]
+        assert (level, fmt, name, call_name) == (logging.INFO, "%s %s !! %r (%.3fs)", 'docker', 'start')
+        assert str(error) == 'boom'
@@ -1,3 +1,5 @@
+import datetime
+import json
 import os
 import shutil
 import tempfile
@@ -20,7 +22,9 @@ from compose.config.environment import Environment
 from compose.const import IS_WINDOWS_PLATFORM
 from compose.const import LABEL_SERVICE
 from compose.container import Container
+from compose.health_events import synthesize_events
 from compose.project import Project
+from compose.testutil import FakeDockerClient
 
 
 class CLITestCase(unittest.TestCase):
@@ -76,6 +80,16 @@ class CLITestCase(unittest.TestCase):
         finally:
             shutil.rmtree(base_dir)
 
+    @mock.patch.dict(os.environ)
+    def test_project_name_from_config(self):
+        base_dir = 'tests/fixtures/simple-composefile'
+        os.environ.pop('COMPOSE_PROJECT_NAME', None)
+        assert get_project_name(base_dir, config_name='My-App') == 'my-app'
+        assert get_project_name(base_dir, 'explicit', config_name='my-app') == 'explicit'
+
+        os.environ['COMPOSE_PROJECT_NAME'] = 'namefromenv'
+        assert get_project_name(base_dir, config_name='my-app') == 'namefromenv'
+
     def test_get_project(self):
         base_dir = 'tests/fixtures/longer-filename-composefile'
         env = Environment.from_env_file(base_dir)
@@ -299,3 +313,80 @@ class CLITestCase(unittest.TestCase):
                 '--rm': None,
                 '--name': None,
             })
+
+    def test_events_json_synthesize(self):
+        def container_event(action):
+            return {
+                'time': datetime.datetime(2021, 1, 1, 12, 0, 0),
+                'type': 'container',
+                'action': action,
+                'id': 'abc123',
+                'service': 'web',
+                'attributes': {'name': 'app_web_1'},
+                'container': None,
+            }
+
+        events = [container_event('start'), container_event('health_status: unhealthy')]
+        project = mock.Mock(events=lambda synthesize: synthesize_events(iter(events)))
+        command = TopLevelCommand(project)
+
+        with mock.patch('sys.stdout', new_callable=StringIO) as stdout:
+            command.events({'--json': True, '--synthesize': True, 'SERVICE': []})
+
+        lines = [json.loads(line) for line in stdout.getvalue().splitlines()]
+        assert [(e['type'], e['action']) for e in lines] == [
+            ('container', 'start'),
+            ('container', 'health_status: unhealthy'),
+            ('service', 'unhealthy'),
+        ]
+        assert lines[2]['time'] == '2021-01-01T12:00:00'
+        assert lines[2]['attributes'] == {'container': 'app_web_1'}
+
+    def test_ps_replicas_after_up_with_scale(self):
+        project = Project.from_config(
+            name='composetest',
+            client=FakeDockerClient(images=['busybox']),
+            config_data=build_config({
+                'web': {'image': 'busybox'},
+            }),
+        )
+        command = TopLevelCommand(project)
+        # As `up --scale web=3` does
+        project.up(detached=True, scale_override={'web': 3})
+
+        with mock.patch('sys.stdout', new_callable=StringIO) as stdout:
+            command.ps({
+                'SERVICE': [],
+                '--quiet': False,
+                '--services': False,
+                '--replicas': True,
+            })
+
+        assert stdout.getvalue().splitlines()[-1].split()[:2] == ['web', '3/3']
+
+    def test_ps_filter_status_restarted(self):
+        client = FakeDockerClient(images=['busybox'])
+        project = Project.from_config(
+            name='composetest',
+            client=client,
+            config_data=build_config({
+                'web': {'image': 'busybox'},
+                'db': {'image': 'busybox'},
+            }),
+        )
+        project.up(detached=True)
+        web = project.get_service('web').get_container()
+        client.containers_by_id[web.id]['State'].update({'Status': 'restarting', 'Restarting': True})
+        command = TopLevelCommand(project)
+
+        with mock.patch('sys.stdout', new_callable=StringIO) as stdout:
+            command.ps({
+                'SERVICE': [],
+                '--quiet': True,
+                '--services': False,
+                '--filter': 'status=restarted',
+                '--all': False,
+                '--sort': 'name',
+            })
+
+        assert stdout.getvalue().split() == [web.id]
@@ -2,6 +2,7 @@ import codecs
 import os
 import shutil
 import tempfile
+from collections import OrderedDict
 from operator import itemgetter
 from random import shuffle
 
@@ -21,9 +22,11 @@ from compose.config.config import resolve_environment
 from compose.config.environment import Environment
 from compose.config.errors import ConfigurationError
 from compose.config.errors import VERSION_EXPLANATION
+from compose.config.interpolation import InterpolationReport
 from compose.config.serialize import denormalize_service_dict
 from compose.config.serialize import serialize_config
 from compose.config.serialize import serialize_ns_time_value
+from compose.config.serialize import serialize_resolved_project
 from compose.config.types import VolumeSpec
 from compose.const import COMPOSE_SPEC as VERSION
 from compose.const import COMPOSEFILE_V1 as V1
@@ -177,6 +180,22 @@ class ConfigTest(unittest.TestCase):
             assert cfg.config_version == version
             assert cfg.version == VERSION
 
+    def test_load_project_name(self):
+        cfg = config.load(build_config_details({'services': {'web': {'image': 'busybox'}}}))
+        assert cfg.name is None
+
+        base_file = config.ConfigFile('base.yml', {
+            'name': '${APP:-app}',
+            'services': {'web': {'image': 'busybox'}},
+        })
+        cfg = config.load(config.ConfigDetails('.', [base_file], Environment({'APP': 'shop'})))
+        assert cfg.name == 'shop'
+
+        override_file = config.ConfigFile('override.yml', {'name': 'store'})
+        cfg = config.load(config.ConfigDetails('.', [base_file, override_file], Environment()))
+        assert cfg.name == 'store'
+        assert serialize_config(cfg).startswith('name: store\n')
+
     def test_v1_file_version(self):
         cfg = config.load(build_config_details({'web': {'image': 'busybox'}}))
         assert cfg.version == V1
@@ -877,6 +896,35 @@ class ConfigTest(unittest.TestCase):
         assert services[1]['name'] == 'db'
         assert services[2]['name'] == 'web'
 
+    def test_load_order_does_not_depend_on_file_order(self):
+        def load(base, override):
+            details = config.ConfigDetails('.', [
+                config.ConfigFile('base.yaml', {'version': '3.8', 'services': base}),
+                config.ConfigFile('override.yaml', {'version': '3.8', 'services': override}),
+            ])
+            return [s['name'] for s in config.load(details).services]
+
+        image = {'image': BUSYBOX_IMAGE_WITH_TAG}
+        first = load(
+            {'web': {'image': BUSYBOX_IMAGE_WITH_TAG, 'depends_on': ['db']}, 'db': image},
+            {'cache': image, 'admin': image, 'web': {'environment': ['A=1']}},
+        )
+        second = load(
+            {'db': image, 'web': {'image': BUSYBOX_IMAGE_WITH_TAG, 'depends_on': ['db']}},
+            {'web': {'environment': ['A=1']}, 'admin': image, 'cache': image},
+        )
+
+        assert first == second == ['admin', 'cache', 'db', 'web']
+
+    def test_load_invalid_platform(self):
+        for platform in ['linux/', 'linux/arm/v7/extra', 'linux amd64']:
+            with pytest.raises(ConfigurationError) as exc:
+                config.load(build_config_details({
+                    'version': '3.8',
+                    'services': {'web': {'image': 'busybox', 'platform': platform}},
+                }))
+            assert "Service 'web': Invalid platform \"{}\"".format(platform) in exc.exconly()
+
     def test_load_with_extensions(self):
         config_details = build_config_details({
             'version': '2.3',
@@ -1284,6 +1332,68 @@ class ConfigTest(unittest.TestCase):
         svc_volumes = list(map(lambda v: v.repr(), service_dicts[0]['volumes']))
         assert svc_volumes == ['/c:/b:ro']
 
+    def test_volume_override_bind_with_named_volume(self):
+        base_file = config.ConfigFile(
+            'base.yaml',
+            {
+                'version': '3.7',
+                'services': {
+                    'db': {
+                        'image': 'example/db',
+                        'volumes': ['/srv/data:/var/lib/data'],
+                    }
+                },
+                'volumes': {'data': {}},
+            }
+        )
+        override_file = config.ConfigFile(
+            'override.yaml',
+            {
+                'version': '3.7',
+                'services': {
+                    'db': {
+                        'volumes': [
+                            {'type': 'volume', 'source': 'data', 'target': '/var/lib/data'},
+                        ],
+                    }
+                },
+            }
+        )
+        details = config.ConfigDetails('.', [base_file, override_file])
+        service_dicts = config.load(details).services
+        assert [v.repr() for v in service_dicts[0]['volumes']] == [
+            {'type': 'volume', 'source': 'data', 'target': '/var/lib/data'},
+        ]
+
+    def test_volume_override_named_volume_with_bind(self):
+        base_file = config.ConfigFile(
+            'base.yaml',
+            {
+                'version': '3.7',
+                'services': {
+                    'db': {
+                        'image': 'example/db',
+                        'volumes': ['data:/var/lib/data'],
+                    }
+                },
+                'volumes': {'data': {}},
+            }
+        )
+        override_file = config.ConfigFile(
+            'override.yaml',
+            {
+                'version': '3.7',
+                'services': {
+                    'db': {
+                        'volumes': ['/srv/data:/var/lib/data'],
+                    }
+                },
+            }
+        )
+        details = config.ConfigDetails('.', [base_file, override_file])
+        service_dicts = config.load(details).services
+        assert [v.repr() for v in service_dicts[0]['volumes']] == ['/srv/data:/var/lib/data:rw']
+
     def test_undeclared_volume_v2(self):
         base_file = config.ConfigFile(
             'base.yaml',
@@ -2054,6 +2164,25 @@ web:
             'extends': {'service': 'app'}
         }
 
+    def test_merge_service_dicts_from_files_with_extension_keys(self):
+        base = {
+            'image': 'alpine:edge',
+            'x-hooks': {'post_start': 'echo base'},
+            'x-team': 'core',
+        }
+        override = {
+            'x-hooks': {'pre_stop': 'echo override'},
+        }
+        actual = config.merge_service_dicts_from_files(
+            base,
+            override,
+            DEFAULT_VERSION)
+        assert actual == {
+            'image': 'alpine:edge',
+            'x-hooks': {'pre_stop': 'echo override'},
+            'x-team': 'core',
+        }
+
     def test_merge_service_dicts_from_files_with_extends_in_override(self):
         base = {
             'volumes': ['.:/app'],
@@ -3242,6 +3371,101 @@ web:
         self.assertEqual(str(e.exception), 'Duplicate mount points: [%s]' % (
             ', '.join(['/x:/y:rw', '/z:/y:rw'])))
 
+    def test_security_profile_applies_to_all_services(self):
+        details = build_config_details({
+            'version': '3.8',
+            'x-security-profile': {
+                'cap_drop': ['ALL'],
+                'read_only': True,
+                'security_opt': ['no-new-privileges:true', 'apparmor:docker-default'],
+                'tmpfs': ['/tmp', '/run'],
+            },
+            'services': {
+                'web': {'image': 'busybox'},
+                'db': {
+                    'image': 'busybox',
+                    'cap_add': ['CHOWN'],
+                    'read_only': False,
+                    'security_opt': ['no-new-privileges:false'],
+                    'tmpfs': '/tmp:size=64m',
+                },
+            },
+        })
+
+        db, web = service_sort(config.load(details).services)
+        assert web['cap_drop'] == ['ALL']
+        assert web['read_only'] is True
+        assert [o.value for o in web['security_opt']] == [
+            'no-new-privileges:true', 'apparmor:docker-default'
+        ]
+        assert web['tmpfs'] == ['/tmp', '/run']
+
+        assert db['cap_add'] == ['CHOWN']
+        assert db['cap_drop'] == ['ALL']
+        assert db['read_only'] is False
+        assert [o.value for o in db['security_opt']] == [
+            'no-new-privileges:false', 'apparmor:docker-default'
+        ]
+        assert db['tmpfs'] == ['/tmp:size=64m', '/run']
+
+    @mock.patch.dict(os.environ)
+    def test_security_profile_is_interpolated(self):
+        os.environ['CAP_DROP'] = 'NET_RAW'
+        os.environ['READ_ONLY'] = 'true'
+        details = build_config_details({
+            'version': '3.8',
+            'x-security-profile': {'cap_drop': ['${CAP_DROP}'], 'read_only': '${READ_ONLY}'},
+            'services': {'web': {'image': 'busybox'}},
+        })
+
+        web = config.load(details).services[0]
+        assert web['cap_drop'] == ['NET_RAW']
+        assert web['read_only'] is True
+
+    def test_security_profile_seccomp_path_relative_to_working_dir(self):
+        tmpdir = tempfile.mkdtemp('security_profile')
+        self.addCleanup(shutil.rmtree, tmpdir)
+        with open(os.path.join(tmpdir, 'seccomp.json'), mode='w') as fh:
+            fh.write('{"defaultAction": "SCMP_ACT_ERRNO"}')
+
+        details = build_config_details({
+            'version': '3.8',
+            'x-security-profile': {'security_opt': ['seccomp:seccomp.json']},
+            'services': {'web': {'image': 'busybox'}},
+        }, working_dir=tmpdir)
+
+        security_opt = config.load(details).services[0]['security_opt']
+        assert security_opt == [types.SecurityOpt(
+            'seccomp={"defaultAction": "SCMP_ACT_ERRNO"}',
+            os.path.join(tmpdir, 'seccomp.json'),
+        )]
+
+    def test_security_profile_missing_seccomp_file(self):
+        details = build_config_details({
+            'version': '3.8',
+            'x-security-profile': {'security_opt': ['seccomp:missing.json']},
+            'services': {'web': {'image': 'busybox'}},
+        }, working_dir='/project')
+
+        with pytest.raises(ConfigurationError) as excinfo:
+            config.load(details)
+
+        assert 'seccomp profile "{}" referenced in x-security-profile does not exist'.format(
+            os.path.abspath('/project/missing.json')
+        ) in excinfo.value.msg
+
+    def test_security_profile_unsupported_field(self):
+        details = build_config_details({
+            'version': '3.8',
+            'x-security-profile': {'privileged': False},
+            'services': {'web': {'image': 'busybox'}},
+        })
+
+        with pytest.raises(ConfigurationError) as excinfo:
+            config.load(details)
+
+        assert 'Unsupported field "privileged" in x-security-profile' in excinfo.value.msg
+
 
 class NetworkModeTest(unittest.TestCase):
 
@@ -3757,6 +3981,34 @@ class InterpolationTest(unittest.TestCase):
         assert 'in service "web"' in cm.value.msg
         assert '"${"' in cm.value.msg
 
+    @mock.patch.dict(os.environ)
+    def test_missing_required_variables_are_reported_together(self):
+        os.environ['DB_PASSWORD'] = 'hunter2'
+        report = InterpolationReport()
+        details = build_config_details({
+            'version': '3',
+            'services': {'web': {
+                'image': 'busybox',
+                'environment': {
+                    'DATABASE_URL': '${DATABASE_URL?set it in .env}',
+                    'DB_PASSWORD': '${DB_PASSWORD}',
+                },
+                'ports': ['${HOST_PORT:?}:80'],
+            }},
+        })
+
+        with pytest.raises(config.ConfigurationError) as cm:
+            config.load(details, report=report)
+
+        assert cm.value.msg == (
+            'Missing mandatory values for environment variables:\n'
+            '    DATABASE_URL in services.web.environment.DATABASE_URL: set it in .env\n'
+            '    HOST_PORT in services.web.ports: HOST_PORT'
+        )
+        assert [(r.name, r.state) for r in report.references] == [
+            ('DATABASE_URL', 'missing'), ('DB_PASSWORD', 'set'), ('HOST_PORT', 'missing'),
+        ]
+
     @mock.patch.dict(os.environ)
     def test_interpolation_secrets_section(self):
         os.environ['FOO'] = 'baz.bar'
@@ -4372,6 +4624,26 @@ class EnvTest(unittest.TestCase):
             'env_file': ['tests/fixtures/env/one.env'],
         }) == {'ONE': '2', 'TWO': '1', 'THREE': '3', 'FOO': 'baz'}
 
+    @mock.patch.dict(os.environ)
+    def test_build_args_and_environment_with_the_same_keys(self):
+        os.environ['FOO'] = 'os'
+        service = config.load(build_config_details(
+            {
+                'version': '3',
+                'services': {
+                    'web': {
+                        'build': {'context': '.', 'args': {'FOO': None, 'ONE': 'build'}},
+                        'env_file': 'one.env',
+                        'environment': {'ONE': 'runtime'},
+                    },
+                },
+            },
+            working_dir='tests/fixtures/env',
+        )).services[0]
+
+        assert service['build']['args'] == {'FOO': 'os', 'ONE': 'build'}
+        assert service['environment'] == {'ONE': 'runtime', 'TWO': '1', 'THREE': '3', 'FOO': 'bar'}
+
     def test_resolve_environment_with_multiple_env_files(self):
         service_dict = {
             'env_file': [
@@ -4757,6 +5029,22 @@ class ExtendsTest(unittest.TestCase):
 
         assert set(dicts[0]['volumes']) == set(paths)
 
+    @pytest.mark.xfail(IS_WINDOWS_PLATFORM, reason='paths use slash')
+    def test_extends_resolves_paths_relative_to_the_extended_file(self):
+        fixture = os.path.abspath('tests/fixtures/extends-relative-paths')
+        service = load_from_filename(os.path.join(fixture, 'app/docker-compose.yml'))[0]
+
+        assert service['build'] == {'context': os.path.join(fixture, 'shared/ctx')}
+        assert service['environment'] == {'APP_ENV': 'common'}
+        volumes = {v.internal: v.external for v in service['volumes'] if isinstance(v, VolumeSpec)}
+        assert volumes == {
+            '/cache': os.path.join(fixture, 'shared/cache'),
+            '/data': os.path.join(fixture, 'common/data'),
+            '/code': os.path.join(fixture, 'app/code'),
+        }
+        [mount] = [v for v in service['volumes'] if isinstance(v, types.MountSpec)]
+        assert mount.source == os.path.join(fixture, 'common/config')
+
     def test_parent_build_path_dne(self):
         child = load_from_filename('tests/fixtures/extends/nonexistent-path-child.yml')
 
@@ -5233,6 +5521,70 @@ class HealthcheckTest(unittest.TestCase):
         assert 'the first item must be either NONE, CMD or CMD-SHELL' in excinfo.exconly()
 
 
+class DevelopWatchTest(unittest.TestCase):
+    def load(self, service):
+        return config.load(build_config_details(
+            {'services': {'web': service}, 'volumes': {'data': {}, 'www': {}}},
+            working_dir='/app',
+        ))
+
+    def test_watch_paths_are_resolved(self):
+        service, = self.load({
+            'build': '.',
+            'develop': {'watch': [
+                {'action': 'sync', 'path': './src', 'target': '/app/src', 'ignore': ['*.pyc']},
+                {'action': 'rebuild', 'path': 'requirements.txt'},
+            ]},
+        }).services
+
+        assert service['develop'] == {'watch': [
+            {'action': 'sync', 'path': '/app/src', 'target': '/app/src', 'ignore': ['*.pyc']},
+            {'action': 'rebuild', 'path': '/app/requirements.txt'},
+        ]}
+
+    def test_sync_into_mounted_volume(self):
+        service, = self.load({
+            'image': 'busybox',
+            'volumes': ['data:/srv/data', {'type': 'volume', 'source': 'www', 'target': '/var/www/'}],
+            'develop': {'watch': [
+                {'action': 'sync', 'path': './data', 'target': '/srv/data/seed'},
+                {'action': 'sync', 'path': './www', 'target': '/var/www'},
+            ]},
+        }).services
+        assert len(service['develop']['watch']) == 2
+
+    def test_invalid_rules_are_reported_by_index(self):
+        with pytest.raises(ConfigurationError) as excinfo:
+            self.load({
+                'image': 'busybox',
+                'volumes': ['data:/srv/data'],
+                'develop': {'watch': [
+                    {'action': 'sync', 'path': './data', 'target': '/srv/data'},
+                    {'action': 'rebuild', 'path': './requirements.txt'},
+                    {'action': 'sync', 'path': './src'},
+                    {'action': 'sync', 'path': './src', 'target': 'src'},
+                    {'action': 'sync', 'path': './src', 'target': '/srv/database'},
+                ]},
+            })
+
+        assert excinfo.value.msg.splitlines() == [
+            "Service 'web' develop.watch[1]: action \"rebuild\" requires the service to have"
+            " a build section",
+            "Service 'web' develop.watch[2]: action \"sync\" requires a target",
+            "Service 'web' develop.watch[3]: target \"src\" must be an absolute path",
+            "Service 'web' develop.watch[4]: target \"/srv/database\" is neither inside a"
+            " volume mounted into the container nor in an image built from a build section",
+        ]
+
+    def test_unknown_action(self):
+        with pytest.raises(ConfigurationError) as excinfo:
+            self.load({
+                'image': 'busybox',
+                'develop': {'watch': [{'action': 'restart', 'path': '.'}]},
+            })
+        assert "'restart' is not one of ['rebuild', 'sync']" in excinfo.exconly()
+
+
 class GetDefaultConfigFilesTestCase(unittest.TestCase):
 
     files = [
@@ -5294,6 +5646,43 @@ class SerializeTest(unittest.TestCase):
 
         assert denormalize_service_dict(service_dict, VERSION) == service_dict
 
+    def test_serialize_resolved_project(self):
+        resolved = {
+            'name': 'app',
+            'services': {
+                'web': {
+                    'image': 'busybox',
+                    'healthcheck': {'test': ['CMD', 'true'], 'interval': 1000000000},
+                    'ports': [types.ServicePort(80, None, 'tcp', None, None)],
+                    'container_names': ['app_web_1'],
+                },
+            },
+            'networks': {'default': {'name': 'app_default'}},
+            'volumes': {},
+        }
+
+        assert yaml.safe_load(serialize_resolved_project(resolved, VERSION)) == {
+            'name': 'app',
+            'services': {
+                'web': {
+                    'image': 'busybox',
+                    'healthcheck': {'test': ['CMD', 'true'], 'interval': '1s'},
+                    'ports': [{'target': 80, 'protocol': 'tcp'}],
+                    'container_names': ['app_web_1'],
+                },
+            },
+            'networks': {'default': {'name': 'app_default'}},
+            'volumes': {},
+        }
+
+    def test_serialize_ordered_dict(self):
+        # Resolved service networks are OrderedDicts
+        data = {'networks': OrderedDict([('front', {'aliases': ['web']}), ('back', None)])}
+
+        assert yaml.safe_load(yaml.safe_dump(data)) == {
+            'networks': {'front': {'aliases': ['web']}, 'back': None},
+        }
+
     def test_serialize_time(self):
         data = {
             9: '9ns',
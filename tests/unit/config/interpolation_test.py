@@ -2,7 +2,9 @@ import pytest
 
 from compose.config.environment import Environment
 from compose.config.errors import ConfigurationError
+from compose.config.interpolation import collect_variables
 from compose.config.interpolation import interpolate_environment_variables
+from compose.config.interpolation import InterpolationReport
 from compose.config.interpolation import Interpolator
 from compose.config.interpolation import InvalidInterpolation
 from compose.config.interpolation import TemplateWithDefaults
@@ -457,3 +459,39 @@ def test_interpolate_no_fallthrough():
 
     assert interpol('${TEST:-}') == ''
     assert interpol('${TEST-}') == ''
+
+
+def test_collect_variables():
+    report = InterpolationReport()
+    services = {
+        'web': {
+            'image': 'app:${TAG:-latest}',
+            'command': ['serve', '--db', '${DB_URL}'],
+            'environment': {'API_TOKEN': '${API_TOKEN}', 'DEBUG': '${DEBUG?}'},
+        },
+    }
+    environment = Environment({'DB_URL': 'postgres://db', 'API_TOKEN': 'abcd'})
+
+    collect_variables(VERSION, services, 'service', environment, report)
+
+    assert [(r.path, r.name, r.state, r.masked_value, r.error) for r in report.references] == [
+        ('services.web.image', 'TAG', 'defaulted', 'latest', None),
+        ('services.web.command', 'DB_URL', 'set', 'postgres://db', None),
+        ('services.web.environment.API_TOKEN', 'API_TOKEN', 'set', '********', None),
+        ('services.web.environment.DEBUG', 'DEBUG', 'missing', '', 'DEBUG'),
+    ]
+    with pytest.raises(ConfigurationError) as excinfo:
+        report.check()
+    assert excinfo.value.msg == (
+        'Missing mandatory values for environment variables:\n'
+        '    DEBUG in services.web.environment.DEBUG: DEBUG'
+    )
+
+
+def test_collect_top_level_variables():
+    report = InterpolationReport()
+
+    collect_variables(VERSION, {'name': '${PROJECT-app}'}, None, Environment({}), report)
+
+    assert report.references == [('PROJECT', 'name', 'defaulted', 'app', None)]
+    report.check()
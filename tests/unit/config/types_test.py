@@ -1,10 +1,17 @@
 import pytest
 
 from compose.config.errors import ConfigurationError
+from compose.config.types import ExternalContainer
+from compose.config.types import MountSpec
 from compose.config.types import parse_extra_hosts
+from compose.config.types import parse_mount_option
+from compose.config.types import parse_platform
+from compose.config.types import ReadinessProbe
+from compose.config.types import ServiceHook
 from compose.config.types import ServicePort
 from compose.config.types import VolumeFromSpec
 from compose.config.types import VolumeSpec
+from compose.config.types import WatchRule
 from compose.const import COMPOSE_SPEC as VERSION
 from compose.const import COMPOSEFILE_V1 as V1
 
@@ -39,6 +46,120 @@ def test_parse_extra_hosts_dict():
     }
 
 
+class TestServiceHook:
+
+    def test_parse_string(self):
+        assert ServiceHook.parse('echo hi') == ServiceHook('echo hi', None, False, None, None)
+
+    def test_parse_dict(self):
+        hook = ServiceHook.parse({
+            'command': ['sh', '-c', 'echo hi'],
+            'user': 'root',
+            'privileged': True,
+            'working_dir': '/srv',
+            'timeout': '1m30s',
+        })
+        assert hook == ServiceHook(['sh', '-c', 'echo hi'], 'root', True, '/srv', 90)
+        assert hook.repr() == {
+            'command': ['sh', '-c', 'echo hi'],
+            'user': 'root',
+            'privileged': True,
+            'working_dir': '/srv',
+            'timeout': 90,
+        }
+
+    def test_parse_missing_command(self):
+        with pytest.raises(ConfigurationError):
+            ServiceHook.parse({'user': 'root'})
+
+    def test_parse_invalid_timeout(self):
+        with pytest.raises(ConfigurationError):
+            ServiceHook.parse({'command': 'true', 'timeout': 'soon'})
+
+
+class TestReadinessProbe:
+
+    def test_parse_defaults(self):
+        assert ReadinessProbe.parse({'type': 'tcp', 'port': 5432}) == ReadinessProbe(
+            'tcp', 5432, '/', 200, None, 1, 1, 60
+        )
+
+    def test_parse_http(self):
+        probe = ReadinessProbe.parse({
+            'type': 'http', 'port': 8080, 'path': '/health', 'status': 204,
+            'interval': '500ms', 'timeout': '2s', 'retries': 5,
+        })
+        assert probe == ReadinessProbe('http', 8080, '/health', 204, None, 0.5, 2, 5)
+
+    @pytest.mark.parametrize('spec', [
+        {'port': 5432},
+        {'type': 'udp', 'port': 53},
+        {'type': 'tcp'},
+        {'type': 'exec'},
+        {'type': 'tcp', 'port': 5432, 'interval': 'often'},
+    ])
+    def test_parse_invalid(self, spec):
+        with pytest.raises(ConfigurationError):
+            ReadinessProbe.parse(spec)
+
+
+class TestExternalContainer:
+
+    def test_parse(self):
+        assert ExternalContainer.parse('appliance') == ExternalContainer('appliance', False)
+        assert ExternalContainer.parse({'name': 'appliance', 'optional': True}) == (
+            ExternalContainer('appliance', True)
+        )
+
+    @pytest.mark.parametrize('spec', ['', {}, {'optional': True}, ['appliance']])
+    def test_parse_invalid(self, spec):
+        with pytest.raises(ConfigurationError):
+            ExternalContainer.parse(spec)
+
+
+class TestWatchRule:
+
+    def test_parse(self):
+        rule = WatchRule.parse({'action': 'rebuild', 'path': '/app/package.json'})
+        assert rule == WatchRule('rebuild', '/app/package.json', None, ())
+
+    @pytest.mark.parametrize('path,matches', [
+        ('/app/src/main.py', True),
+        ('/app/src', True),
+        ('/app/src/main.pyc', False),
+        ('/app/src/node_modules/lib/index.js', False),
+        ('/app/src/build', False),
+        ('/app/src/build.py', True),
+        ('/app/srcs/main.py', False),
+        ('/app/README', False),
+    ])
+    def test_matches(self, path, matches):
+        rule = WatchRule.parse({
+            'action': 'sync', 'path': '/app/src', 'target': '/src',
+            'ignore': ['*.pyc', 'node_modules/', 'build'],
+        })
+        assert rule.matches(path) is matches
+
+
+class TestParsePlatform:
+
+    @pytest.mark.parametrize('platform,expected', [
+        ('linux', ('linux', None, None)),
+        ('linux/amd64', ('linux', 'amd64', None)),
+        ('linux/arm/v7', ('linux', 'arm', 'v7')),
+        ('Windows/AMD64', ('windows', 'amd64', None)),
+    ])
+    def test_parse(self, platform, expected):
+        assert parse_platform(platform) == expected
+
+    @pytest.mark.parametrize('platform', [
+        '', '/amd64', 'linux/', 'linux//v7', 'linux/arm/v7/extra', 'linux amd64', 42,
+    ])
+    def test_invalid(self, platform):
+        with pytest.raises(ConfigurationError):
+            parse_platform(platform)
+
+
 class TestServicePort:
     def test_parse_dict(self):
         data = {
@@ -215,6 +336,94 @@ class TestVolumeSpec:
             'rw'
         )
 
+    def test_parse_volume_windows_path_with_spaces_normalized(self):
+        windows_path = 'C:\\Users\\me\\My Projects, Inc\\app\u00df:/code:ro'
+        assert VolumeSpec._parse_win32(windows_path, True) == (
+            '/c/Users/me/My Projects, Inc/app\u00df',
+            '/code',
+            'ro'
+        )
+
+    def test_parse_mount_windows_path_with_spaces_normalized(self):
+        mount = MountSpec.parse({
+            'type': 'bind', 'source': 'C:\\Users\\me\\My Projects\\app\u00df', 'target': '/code',
+        }, normalize=True, win_host=True)
+        assert mount.source == '/c/Users/me/My Projects/app\u00df'
+
+
+class TestVolumeSpecModes:
+
+    def test_short_syntax_modes(self):
+        table = [
+            ('data:/data', False, None),
+            ('data:/data:ro', True, None),
+            ('data:/data:rw', False, None),
+            ('./src:/app:cached', False, 'cached'),
+            ('./src:/app:delegated', False, 'delegated'),
+            ('./src:/app:ro,cached', True, 'cached'),
+            ('./src:/app:rw,delegated', False, 'delegated'),
+            ('./src:/app:z,ro', True, None),
+        ]
+        for volume_config, read_only, consistency in table:
+            spec = VolumeSpec.parse(volume_config)
+            assert (spec.read_only, spec.consistency) == (read_only, consistency), volume_config
+
+    def test_conflicting_modes(self):
+        for volume_config in ['./src:/app:ro,rw', './src:/app:cached,delegated']:
+            with pytest.raises(ConfigurationError):
+                VolumeSpec.parse(volume_config)
+
+    def test_mount_spec_keeps_consistency(self):
+        mount = MountSpec.parse({
+            'type': 'bind', 'source': '/src', 'target': '/app',
+            'read_only': True, 'consistency': 'cached',
+        })
+        spec = mount.as_volume_spec()
+        assert spec.mode == 'ro,cached'
+        assert (spec.read_only, spec.consistency) == (True, 'cached')
+        assert mount.legacy_repr() == '/src:/app:ro,cached'
+
+
+class TestParseMountOption:
+
+    def test_tmpfs(self):
+        mount = parse_mount_option('type=tmpfs,dst=/cache,tmpfs-size=64m,tmpfs-mode=1770')
+        assert mount.repr() == {
+            'type': 'tmpfs', 'target': '/cache', 'tmpfs': {'size': 64 * 1024 * 1024, 'mode': 0o1770},
+        }
+
+    def test_read_only_volume_with_driver_options(self):
+        mount = parse_mount_option(
+            'source=data,target=/data,readonly,volume-driver=local,'
+            'volume-opt=type=nfs,volume-opt=device=:/exports'
+        )
+        assert mount.repr() == {
+            'type': 'volume', 'source': 'data', 'target': '/data', 'read_only': True,
+            'volume': {'driver': 'local', 'driver_opts': {'type': 'nfs', 'device': ':/exports'}},
+        }
+        assert mount.is_named_volume
+
+    def test_bind_propagation(self):
+        mount = parse_mount_option('type=bind,src=/src,target=/app,ro=false,bind-propagation=rshared')
+        assert mount.repr() == {
+            'type': 'bind', 'source': '/src', 'target': '/app', 'bind': {'propagation': 'rshared'},
+        }
+
+    @pytest.mark.parametrize('value', [
+        'target=/data,bogus=1',
+        'type=nfs,target=/data',
+        'type=volume,source=data',
+        'type=bind,target=/app',
+        'type=tmpfs,source=/src,target=/tmp',
+        'type=tmpfs,target=/tmp,tmpfs-size=lots',
+        'type=volume,target=/data,bind-propagation=shared',
+        'target=/data,readonly=maybe',
+        'target=/data,source',
+    ])
+    def test_invalid(self, value):
+        with pytest.raises(ConfigurationError):
+            parse_mount_option(value)
+
 
 class TestVolumesFromSpec:
 
@@ -1,3 +1,7 @@
+import datetime
+import socket
+import struct
+
 import docker
 
 from .. import mock
@@ -6,6 +10,7 @@ from ..helpers import BUSYBOX_IMAGE_WITH_TAG
 from compose.const import LABEL_ONE_OFF
 from compose.const import LABEL_SLUG
 from compose.container import Container
+from compose.container import ContainerEvents
 from compose.container import get_container_name
 
 
@@ -75,6 +80,22 @@ class ContainerTest(unittest.TestCase):
             'BAZ': 'DOGE',
         }
 
+    def test_environment_duplicate_keys_last_wins(self):
+        container = Container(None, {
+            'Id': 'abc',
+            'Config': {
+                'Env': [
+                    'FOO=BAR',
+                    'EMPTY=',
+                    'FOO=BAZ=QUX',
+                ]
+            }
+        }, has_been_inspected=True)
+        assert container.environment == {
+            'FOO': 'BAZ=QUX',
+            'EMPTY': '',
+        }
+
     def test_number(self):
         container = Container(None, self.container_dict, has_been_inspected=True)
         assert container.number == 7
@@ -95,6 +116,28 @@ class ContainerTest(unittest.TestCase):
         container = Container(None, self.container_dict, has_been_inspected=True)
         assert container.name_without_project == "custom_name_of_container"
 
+    def test_name_without_project_renamed_for_recreate(self):
+        self.container_dict['Name'] = "/{}_composetest_web_7".format(self.container_id[:12])
+        container = Container(None, self.container_dict, has_been_inspected=True)
+        assert container.name_without_project == "web_7"
+
+    def test_canonical_name(self):
+        self.container_dict['Name'] = "/custom_name_of_container"
+        container = Container(None, self.container_dict, has_been_inspected=True)
+        assert container.canonical_name == "composetest_web_7"
+
+    def test_canonical_name_one_off(self):
+        self.container_dict['Config']['Labels'][LABEL_SLUG] = (
+            "092cd63296fdc446ad432d3905dd1fcbe12a2ba6b52"
+        )
+        self.container_dict['Config']['Labels'][LABEL_ONE_OFF] = 'True'
+        container = Container(None, self.container_dict, has_been_inspected=True)
+        assert container.canonical_name == "composetest_web_run_092cd63296fd"
+
+    def test_canonical_name_without_labels(self):
+        container = Container(None, {'Id': 'abc', 'Name': '/some_name'}, has_been_inspected=True)
+        assert container.canonical_name == "some_name"
+
     def test_name_without_project_one_off(self):
         self.container_dict['Name'] = "/composetest_web_092cd63296f"
         self.container_dict['Config']['Labels'][LABEL_SLUG] = (
@@ -205,6 +248,60 @@ class ContainerTest(unittest.TestCase):
         expected = "Up (healthy)"
         assert container.human_readable_state == expected
 
+    def test_platform(self):
+        client = mock.create_autospec(docker.APIClient)
+        client.inspect_image.return_value = {'Os': 'linux', 'Architecture': 'arm', 'Variant': 'v7'}
+        container = Container(client, self.container_dict, has_been_inspected=True)
+        assert container.platform == 'linux/arm/v7'
+        client.inspect_image.assert_called_once_with(BUSYBOX_IMAGE_WITH_TAG)
+
+    def test_summary(self):
+        self.container_dict.update({
+            "Name": "/composetest_web_7",
+            "State": {"Status": "running", "ExitCode": 0, "Health": {"Status": "healthy"}},
+            "Mounts": [
+                {"Type": "volume", "Name": "composetest_data", "Source": "/var/lib/x",
+                 "Destination": "/data", "RW": True},
+                {"Type": "bind", "Source": "/etc/app", "Destination": "/etc/app", "RW": False},
+            ],
+        })
+        self.container_dict["Config"]["Image"] = "busybox:1.31"
+        self.container_dict["Config"]["Labels"]["com.docker.compose.config-hash"] = "abc123"
+        self.container_dict["NetworkSettings"] = {
+            "Ports": {
+                "80/tcp": [{"HostIp": "0.0.0.0", "HostPort": "8080"}],
+                "53/udp": [{"HostIp": "127.0.0.1", "HostPort": "5353"}],
+                "443/tcp": None,
+            },
+            "Networks": {"composetest_default": {"IPAddress": "172.18.0.2"}},
+        }
+        container = Container(None, self.container_dict, has_been_inspected=True)
+
+        summary = container.summary(image_digest="sha256:feed")
+        assert summary.to_dict() == {
+            "id": self.container_id,
+            "name": "composetest_web_7",
+            "state": "running",
+            "health": "healthy",
+            "exit_code": 0,
+            "image": "busybox:1.31",
+            "image_digest": "sha256:feed",
+            "ports": [
+                {"target": 53, "protocol": "udp", "host_ip": "127.0.0.1", "published": 5353},
+                {"target": 80, "protocol": "tcp", "host_ip": "0.0.0.0", "published": 8080},
+            ],
+            "mounts": [
+                {"type": "volume", "source": "composetest_data", "destination": "/data",
+                 "read_only": False},
+                {"type": "bind", "source": "/etc/app", "destination": "/etc/app",
+                 "read_only": True},
+            ],
+            "networks": {"composetest_default": "172.18.0.2"},
+            "config_hash": "abc123",
+            "number": 7,
+        }
+        assert list(summary.to_dict()) == list(summary._fields)
+
     def test_get(self):
         container = Container(None, {
             "Status": "Up 8 seconds",
@@ -236,3 +333,108 @@ class GetContainerNameTestCase(unittest.TestCase):
                 '/swarm-host-1/myproject_web_1/db'
             ]
         }) == 'myproject_db_1'
+
+    def test_get_container_name_missing_names(self):
+        assert get_container_name({'Names': []}) is None
+        assert get_container_name({'Names': None}) is None
+        assert get_container_name({'Name': None, 'Names': ['/myproject_db_1']}) == 'myproject_db_1'
+        assert get_container_name({'Names': ['', 'myproject_db_1']}) == 'myproject_db_1'
+
+
+def frame(stream_id, data):
+    return struct.pack('>BxxxL', stream_id, len(data)) + data
+
+
+def attachment(*frames):
+    sock, daemon = socket.socketpair()
+    daemon.sendall(b''.join(frames))
+    daemon.close()
+    return sock
+
+
+def test_demuxed_logs_reads_both_streams_at_once():
+    client = mock.Mock()
+    sock = client.attach_socket.return_value = attachment(
+        frame(2, b'oops\n'), frame(1, b'fine\n'),
+    )
+    container = Container(client, {'Id': 'abc', 'Config': {}}, has_been_inspected=True)
+
+    assert list(container.demuxed_logs(follow=True)) == [
+        (None, b'oops\n'), (b'fine\n', None),
+    ]
+    client.attach_socket.assert_called_once_with('abc', params={
+        'logs': 1, 'stdout': 1, 'stderr': 1, 'stream': 1,
+    })
+    assert sock.fileno() == -1
+
+
+def test_demuxed_logs_tail():
+    client = mock.Mock()
+    client.attach_socket.return_value = attachment(
+        frame(1, b'one\n'), frame(2, b'two\n'), frame(1, b'three\n'),
+    )
+    container = Container(client, {'Id': 'abc', 'Config': {}}, has_been_inspected=True)
+
+    assert list(container.demuxed_logs(tail=2)) == [(None, b'two\n'), (b'three\n', None)]
+    assert client.attach_socket.call_args[1]['params']['stream'] == 0
+
+
+def daemon_event(action, **attributes):
+    attributes = dict({'name': 'app_web_1', 'image': 'busybox'}, **attributes)
+    return {
+        'Type': 'container',
+        'Action': action,
+        'status': action,
+        'id': 'abcde',
+        'Actor': {'ID': 'abcde', 'Attributes': attributes},
+        'time': 1420092061,
+        'timeNano': 1420092061000002000,
+    }
+
+
+class ContainerEventsTest(unittest.TestCase):
+
+    def setUp(self):
+        self.client = mock.Mock()
+        self.client.events.return_value = mock.MagicMock()
+        self.client.events.return_value.__iter__.return_value = iter([
+            daemon_event('start', **{'com.docker.compose.service': 'web'}),
+            daemon_event('health_status: unhealthy'),
+            daemon_event('oom'),
+            daemon_event('die', exitCode='137'),
+        ])
+
+    def test_container_events(self):
+        container = Container(self.client, {'Id': 'abcde'}, has_been_inspected=True)
+
+        events = list(container.events())
+
+        self.client.events.assert_called_once_with(filters={
+            'type': 'container',
+            'event': ['create', 'start', 'die', 'oom', 'health_status'],
+            'container': ['abcde'],
+        }, decode=True)
+        assert [(e['action'], e['health'], e['exit_code']) for e in events] == [
+            ('start', None, None),
+            ('health_status', 'unhealthy', None),
+            ('oom', None, None),
+            ('die', None, 137),
+        ]
+        assert events[0]['time'] == datetime.datetime.fromtimestamp(1420092061).replace(
+            microsecond=2
+        )
+        assert events[0]['name'] == 'app_web_1'
+        assert events[0]['attributes'] == {'image': 'busybox'}
+        self.client.events.return_value.close.assert_called_once_with()
+
+    def test_stop_consuming(self):
+        events = ContainerEvents(self.client, labels=['com.docker.compose.project=app'])
+
+        for event in events:
+            if event['action'] == 'oom':
+                break
+
+        assert self.client.events.call_args[1]['filters']['label'] == [
+            'com.docker.compose.project=app',
+        ]
+        self.client.events.return_value.close.assert_called_once_with()
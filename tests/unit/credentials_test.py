@@ -0,0 +1,133 @@
+import base64
+import json
+from unittest import mock
+
+import pytest
+from docker import auth
+from docker.errors import DockerException
+
+from compose.config.config import Config
+from compose.const import COMPOSE_SPEC as VERSION
+from compose.credentials import check_credentials
+from compose.credentials import image_registry
+from compose.credentials import load_auth_configs
+from compose.credentials import resolve_credentials
+from compose.errors import CredentialsError
+from compose.project import Project
+from compose.testutil import FakeDockerClient
+
+
+def helper_failure(registry):
+    try:
+        raise RuntimeError('docker-credential-osxkeychain exited with status 1')
+    except RuntimeError as e:
+        raise DockerException('Credentials store error: {!r}'.format(e))
+
+
+def client_with_helper(resolve=helper_failure):
+    client = FakeDockerClient(images=['busybox'])
+    client._auth_configs = auth.AuthConfig({'credsStore': 'osxkeychain'})
+    client._auth_configs.resolve_authconfig = mock.Mock(side_effect=resolve)
+    return client
+
+
+def test_image_registry():
+    assert image_registry('busybox') == 'docker.io'
+    assert image_registry('library/busybox:1.33') == 'docker.io'
+    assert image_registry('registry.example.com:5000/team/app:1.0') == 'registry.example.com:5000'
+
+
+def encoded_auth(username, password):
+    return base64.b64encode('{}:{}'.format(username, password).encode('utf-8')).decode('ascii')
+
+
+def test_load_auth_configs_precedence(tmpdir):
+    auth_file = tmpdir.join('config.json')
+    auth_file.write(json.dumps({
+        'auths': {
+            'registry.example.com': {'auth': encoded_auth('file', 'file-secret')},
+            'other.example.com': {'auth': encoded_auth('other', 'other-secret')},
+        },
+        'credHelpers': {'registry.example.com': 'pass'},
+    }))
+
+    auth_configs = load_auth_configs(
+        str(auth_file),
+        auths={'registry.example.com': {'username': 'ci', 'password': 'ci-secret'}},
+    )
+
+    # Credentials given in memory come first, before the helpers of the file
+    assert auth_configs.resolve_authconfig('registry.example.com') == {
+        'username': 'ci', 'password': 'ci-secret',
+    }
+    assert auth_configs.resolve_authconfig('other.example.com')['username'] == 'other'
+    # The default configuration isn't read, even for other registries
+    assert auth_configs.resolve_authconfig('docker.io') is None
+    assert not auth_configs.is_empty
+
+
+def test_load_auth_configs_from_memory_only():
+    auth_configs = load_auth_configs(auths={'docker.io': {'username': 'ci', 'password': 'x'}})
+    client = FakeDockerClient()
+    client._auth_configs = auth_configs
+
+    assert resolve_credentials(client, 'docker.io')['username'] == 'ci'
+    assert resolve_credentials(client, 'registry.example.com') is None
+
+
+def test_load_auth_configs_from_missing_file(tmpdir):
+    with pytest.raises(OSError):
+        load_auth_configs(str(tmpdir.join('missing.json')))
+
+
+def test_resolve_credentials_names_the_registry_and_helper():
+    with pytest.raises(CredentialsError) as exc:
+        resolve_credentials(client_with_helper(), 'registry.example.com')
+
+    assert exc.value.registry == 'registry.example.com'
+    assert exc.value.helper == 'osxkeychain'
+    assert exc.value.msg.startswith(
+        'Could not get the credentials for registry.example.com from '
+        'docker-credential-osxkeychain: docker-credential-osxkeychain exited with status 1\n'
+    )
+
+
+def test_resolve_credentials_passes_other_errors_through():
+    def fail(registry):
+        raise DockerException('Invalid configuration')
+
+    with pytest.raises(DockerException) as exc:
+        resolve_credentials(client_with_helper(fail), 'docker.io')
+    assert not isinstance(exc.value, CredentialsError)
+
+
+def test_check_credentials():
+    client = FakeDockerClient()
+    client._auth_configs = auth.AuthConfig({
+        'auths': {'registry.example.com': {'username': 'ci', 'password': 'secret'}},
+    })
+
+    assert check_credentials(client, [
+        'registry.example.com/app:1.0', 'busybox', 'registry.example.com/worker',
+    ]) == [('docker.io', False), ('registry.example.com', True)]
+
+
+def test_push_fails_before_pushing_anything():
+    client = client_with_helper()
+    config_data = Config(
+        config_version=VERSION,
+        version=VERSION,
+        services=[
+            {'name': 'api', 'image': 'busybox', 'build': {'context': '.'}},
+            {'name': 'web', 'image': 'registry.example.com/web', 'build': {'context': '.'}},
+        ],
+        networks={},
+        volumes={},
+        secrets={},
+        configs={},
+    )
+    project = Project.from_config('app', config_data, client)
+
+    with pytest.raises(CredentialsError):
+        project.push()
+    assert client.called('push') == []
@@ -0,0 +1,97 @@
+import datetime
+
+import pytest
+
+from .. import unittest
+from compose.config.config import Config
+from compose.config.errors import ConfigurationError
+from compose.config.types import ServicePort
+from compose.config.types import VolumeSpec
+from compose.const import COMPOSE_SPEC as VERSION
+from compose.const import LABEL_EPHEMERAL
+from compose.const import LABEL_PROJECT
+from compose.ephemeral import created_time
+from compose.ephemeral import ephemeral_name
+from compose.ephemeral import ephemeral_project
+from compose.ephemeral import find_ephemeral_projects
+from compose.ephemeral import sweep_ephemeral_projects
+from compose.service import ImageType
+from compose.testutil import FakeDockerClient
+
+
+class EphemeralTest(unittest.TestCase):
+    def setUp(self):
+        self.client = FakeDockerClient(images=['busybox'])
+        self.config = Config(
+            config_version=VERSION,
+            version=VERSION,
+            services=[{
+                'name': 'web',
+                'image': 'busybox',
+                'container_name': 'web',
+                'ports': [ServicePort('80', '8080', None, None, None)],
+                'volumes': [VolumeSpec.parse('data:/data')],
+            }],
+            volumes={'data': {}, 'cache': {'name': 'shared-cache'}},
+            networks=None,
+            secrets=None,
+            configs=None,
+        )
+
+    def test_instances_are_apart(self):
+        first = ephemeral_project('app', self.config, self.client, 'one')
+        second = ephemeral_project('app', self.config, self.client, 'two')
+        first.up(detached=True)
+        second.up(detached=True)
+
+        assert (first.name, first.ephemeral_base, first.ephemeral_suffix) == ('app-one', 'app', 'one')
+        assert sorted(c['Name'] for c in self.client.containers_by_id.values()) == [
+            '/web-one', '/web-two',
+        ]
+        for data in self.client.containers_by_id.values():
+            assert data['HostConfig']['PortBindings'] == {'80/tcp': [None]}
+            assert data['Config']['Labels'][LABEL_EPHEMERAL] == 'app'
+        assert sorted(self.client.volumes_by_name) == [
+            'app-one_data', 'app-two_data', 'shared-cache-one', 'shared-cache-two',
+        ]
+        assert sorted(self.client.networks_by_name) == ['app-one_default', 'app-two_default']
+        assert self.client.networks_by_name['app-one_default']['Labels'][LABEL_EPHEMERAL] == 'app'
+        assert self.config.services[0]['container_name'] == 'web'
+
+        assert sorted(find_ephemeral_projects(self.client, 'app')) == ['app-one', 'app-two']
+        first.down(ImageType.none, include_volumes=True)
+        assert list(find_ephemeral_projects(self.client, 'app')) == ['app-two']
+
+    def test_sweep_old_instances(self):
+        old = ephemeral_project('app', self.config, self.client, 'old')
+        new = ephemeral_project('app', self.config, self.client, 'new')
+        old.up(detached=True)
+        new.up(detached=True)
+        now = datetime.datetime.now(datetime.timezone.utc)
+        for container in new.containers():
+            self.client.containers_by_id[container.id]['Created'] = now.strftime(
+                '%Y-%m-%dT%H:%M:%S.000000000Z'
+            )
+
+        assert sweep_ephemeral_projects(self.client, 'app', ttl=3600, now=now) == ['app-old']
+        assert {
+            data['Config']['Labels'][LABEL_PROJECT]
+            for data in self.client.containers_by_id.values()
+        } == {'app-new'}
+        assert sorted(self.client.volumes_by_name) == ['app-new_data', 'shared-cache-new']
+        assert sorted(self.client.networks_by_name) == ['app-new_default']
+
+
+def test_ephemeral_name():
+    assert ephemeral_name('app', 'run-1') == 'app-run-1'
+    with pytest.raises(ConfigurationError):
+        ephemeral_name('app', 'Run 1')
+
+
+def test_created_time():
+    utc = datetime.timezone.utc
+    expected = datetime.datetime(2021, 1, 1, 12, 0, tzinfo=utc)
+    assert created_time(int(expected.timestamp())) == expected
+    assert created_time('2021-01-01T12:00:00.123456789Z') == expected
+    assert created_time('2021-01-01T13:00:00+01:00') == expected
+    assert created_time(None) is None
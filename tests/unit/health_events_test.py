@@ -0,0 +1,138 @@
+import datetime
+
+from compose.health_events import EventSynthesizer
+from compose.health_events import synthesize_events
+
+START = datetime.datetime(2021, 1, 1, 12, 0, 0)
+
+
+def container_event(action, container_id, service='web', seconds=0):
+    return {
+        'time': START + datetime.timedelta(seconds=seconds),
+        'type': 'container',
+        'action': action,
+        'id': container_id,
+        'service': service,
+        'attributes': {'name': 'app_{}_{}'.format(service, container_id)},
+        'container': None,
+    }
+
+
+def synthesized(events, **kwargs):
+    synthesizer = EventSynthesizer(**kwargs)
+    return [
+        (e['service'], e['action'], e['attributes'])
+        for event in events for e in synthesizer.process(event)
+    ]
+
+
+def restart(container_id, seconds, service='worker'):
+    return [
+        container_event('die', container_id, service, seconds),
+        container_event('start', container_id, service, seconds),
+    ]
+
+
+def test_unhealthy_then_recovered():
+    events = [
+        container_event('start', '1'),
+        container_event('health_status: healthy', '1'),
+        container_event('health_status: unhealthy', '1'),
+        container_event('health_status: unhealthy', '1'),
+        container_event('health_status: healthy', '1'),
+        container_event('health_status: healthy', '1'),
+    ]
+    assert synthesized(events) == [
+        ('web', 'unhealthy', {'container': 'app_web_1'}),
+        ('web', 'recovered', {'container': 'app_web_1'}),
+    ]
+
+
+def test_recovered_once_every_container_is_healthy():
+    events = [
+        container_event('health_status: unhealthy', '1'),
+        container_event('health_status: unhealthy', '2'),
+        container_event('health_status: healthy', '1'),
+        container_event('health_status: healthy', '2'),
+    ]
+    assert synthesized(events) == [
+        ('web', 'unhealthy', {'container': 'app_web_1'}),
+        ('web', 'recovered', {'container': 'app_web_2'}),
+    ]
+
+
+def test_services_are_tracked_separately():
+    events = [
+        container_event('health_status: unhealthy', '1', service='web'),
+        container_event('health_status: unhealthy', '2', service='db'),
+        container_event('health_status: healthy', '2', service='db'),
+    ]
+    assert synthesized(events) == [
+        ('web', 'unhealthy', {'container': 'app_web_1'}),
+        ('db', 'unhealthy', {'container': 'app_db_2'}),
+        ('db', 'recovered', {'container': 'app_db_2'}),
+    ]
+
+
+def test_destroyed_container_is_forgotten():
+    events = [
+        container_event('health_status: unhealthy', '1'),
+        container_event('destroy', '1'),
+        container_event('health_status: unhealthy', '2'),
+    ]
+    assert synthesized(events) == [
+        ('web', 'unhealthy', {'container': 'app_web_1'}),
+        ('web', 'unhealthy', {'container': 'app_web_2'}),
+    ]
+
+
+def test_flapping():
+    events = [container_event('start', '1', service='worker')]
+    events += restart('1', 10) + restart('1', 20) + restart('1', 30) + restart('1', 40)
+    assert synthesized(events) == [
+        ('worker', 'flapping', {'restarts': '3', 'window': '60s'}),
+    ]
+
+
+def test_restarts_outside_the_window_are_not_flapping():
+    events = restart('1', 0) + restart('1', 40) + restart('1', 80) + restart('1', 120)
+    assert synthesized(events) == []
+
+
+def test_flapping_again_after_settling():
+    events = (
+        restart('1', 0) + restart('1', 10) + restart('1', 20) +
+        restart('1', 200) +
+        restart('1', 210) + restart('1', 220)
+    )
+    assert synthesized(events) == [
+        ('worker', 'flapping', {'restarts': '3', 'window': '60s'}),
+        ('worker', 'flapping', {'restarts': '3', 'window': '60s'}),
+    ]
+
+
+def test_flapping_threshold_and_window():
+    events = restart('1', 0) + restart('2', 100)
+    assert synthesized(
+        events, restarts=2, window=datetime.timedelta(seconds=120)
+    ) == [
+        ('worker', 'flapping', {'restarts': '2', 'window': '120s'}),
+    ]
+
+
+def test_first_start_is_not_a_restart():
+    events = [container_event('start', str(i), service='worker') for i in range(5)]
+    assert synthesized(events) == []
+
+
+def test_synthesize_events_follows_the_triggering_event():
+    unhealthy = container_event('health_status: unhealthy', '1')
+    events = list(synthesize_events([container_event('start', '1'), unhealthy]))
+
+    assert [(e['type'], e['action']) for e in events] == [
+        ('container', 'start'),
+        ('container', 'health_status: unhealthy'),
+        ('service', 'unhealthy'),
+    ]
+    assert events[2]['id'] == 'web'
+    assert events[2]['time'] == unhealthy['time']
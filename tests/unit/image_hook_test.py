@@ -0,0 +1,66 @@
+import threading
+
+from compose.errors import ImageRejectedError
+from compose.image_hook import run_image_hook
+from compose.service import NoSuchImageError
+from tests import mock
+
+
+def make_service(name, image_id=None):
+    service = mock.Mock(image_name='{}:latest'.format(name))
+    service.name = name
+    if image_id:
+        service.image.return_value = {'Id': image_id}
+    else:
+        service.image.side_effect = NoSuchImageError('missing')
+    return service
+
+
+def test_run_image_hook_reports_each_call():
+    events = []
+    calls = []
+
+    def hook(service, image_ref, image_id):
+        calls.append((service, image_ref, image_id))
+        if service == 'db':
+            raise ValueError('2 critical vulnerabilities')
+
+    errors = run_image_hook(hook, [
+        make_service('web', 'sha256:web'),
+        make_service('db', 'sha256:db'),
+        make_service('cache'),
+    ], events.append)
+
+    assert sorted(calls) == [('db', 'db:latest', 'sha256:db'), ('web', 'web:latest', 'sha256:web')]
+    assert list(errors) == ['db']
+    assert isinstance(errors['db'], ImageRejectedError)
+    assert errors['db'].msg == (
+        'Image db:latest of service db was rejected: 2 critical vulnerabilities'
+    )
+
+    outcomes = {(e.name, e.action): e for e in events}
+    assert set(outcomes) == {
+        ('web:latest', 'checking'), ('web:latest', 'checked'),
+        ('db:latest', 'checking'), ('db:latest', 'rejected'),
+    }
+    assert outcomes['web:latest', 'checking'].duration is None
+    assert outcomes['web:latest', 'checked'].duration >= 0
+    assert outcomes['db:latest', 'rejected'].id == 'sha256:db'
+
+
+def test_run_image_hook_bounds_concurrency():
+    lock = threading.Lock()
+    running = []
+    peak = []
+
+    def hook(service, image_ref, image_id):
+        with lock:
+            running.append(service)
+            peak.append(len(running))
+        threading.Event().wait(0.02)
+        with lock:
+            running.remove(service)
+
+    services = [make_service('svc{}'.format(i), 'sha256:{}'.format(i)) for i in range(6)]
+    assert run_image_hook(hook, services, limit=2) == {}
+    assert max(peak) <= 2
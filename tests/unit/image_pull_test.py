@@ -0,0 +1,103 @@
+import json
+import threading
+
+import pytest
+
+from compose.errors import PullCancelledError
+from compose.image_pull import LayerProgress
+from compose.image_pull import pull_image
+from compose.progress_stream import StreamOutputError
+from tests import mock
+
+# A pull of busybox, as reported by the daemon
+PULL_OUTPUT = [
+    {'status': 'Pulling from library/busybox', 'id': 'latest'},
+    {'status': 'Pulling fs layer', 'progressDetail': {}, 'id': 'a1b2'},
+    {'status': 'Downloading', 'progressDetail': {'current': 512, 'total': 2048},
+     'progress': '[=====>      ]', 'id': 'a1b2'},
+    {'status': 'Downloading', 'progressDetail': {'current': 2048, 'total': 2048},
+     'progress': '[===========>]', 'id': 'a1b2'},
+    {'status': 'Download complete', 'progressDetail': {}, 'id': 'a1b2'},
+    {'status': 'Pull complete', 'progressDetail': {}, 'id': 'a1b2'},
+    {'status': 'Digest: sha256:3fbc6326'},
+    {'status': 'Status: Downloaded newer image for busybox:latest'},
+]
+
+
+class Output:
+    def __init__(self, events):
+        self.lines = [json.dumps(event).encode('utf-8') + b'\r\n' for event in events]
+        self.read = 0
+        self.closed = False
+
+    def __iter__(self):
+        for line in self.lines:
+            self.read += 1
+            yield line
+
+    def close(self):
+        self.closed = True
+
+
+def make_client(events):
+    client = mock.Mock()
+    client.pull.return_value = Output(events)
+    return client
+
+
+def test_pull_image_reports_layer_progress():
+    client = make_client(PULL_OUTPUT)
+    progress = []
+
+    digest = pull_image(
+        client, 'busybox', tag='latest', platform='linux/arm64', progress=progress.append,
+    )
+
+    assert digest == 'sha256:3fbc6326'
+    client.pull.assert_called_once_with(
+        'busybox', tag='latest', stream=True, platform='linux/arm64',
+    )
+    assert progress == [
+        LayerProgress('a1b2', None, None, 'Pulling fs layer'),
+        LayerProgress('a1b2', 512, 2048, 'Downloading'),
+        LayerProgress('a1b2', 2048, 2048, 'Downloading'),
+        LayerProgress('a1b2', None, None, 'Download complete'),
+        LayerProgress('a1b2', None, None, 'Pull complete'),
+    ]
+    assert client.pull.return_value.closed
+
+
+def test_pull_image_cancelled_mid_download():
+    client = make_client(PULL_OUTPUT)
+    cancel = threading.Event()
+    progress = []
+
+    def cancel_after_first_download(layer):
+        progress.append(layer)
+        if layer.status == 'Downloading':
+            cancel.set()
+
+    with pytest.raises(PullCancelledError) as excinfo:
+        pull_image(
+            client, 'busybox', tag='latest', progress=cancel_after_first_download,
+            cancel=cancel,
+        )
+
+    assert excinfo.value.msg == 'Pull of busybox:latest was cancelled'
+    assert [layer.status for layer in progress] == ['Pulling fs layer', 'Downloading']
+    output = client.pull.return_value
+    assert output.closed
+    assert output.read == 4
+
+
+def test_pull_image_error():
+    client = make_client(PULL_OUTPUT[:3] + [{
+        'errorDetail': {'message': 'unexpected EOF'},
+        'error': 'unexpected EOF',
+    }])
+
+    with pytest.raises(StreamOutputError) as excinfo:
+        pull_image(client, 'busybox')
+
+    assert str(excinfo.value) == 'unexpected EOF'
+    assert client.pull.return_value.closed
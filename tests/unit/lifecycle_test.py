@@ -0,0 +1,128 @@
+import json
+
+from ..helpers import build_config_data
+from compose.lifecycle import LifecycleEvent
+from compose.lifecycle import NotifyingClient
+from compose.project import Project
+from compose.service import ImageType
+from compose.service import Service
+from compose.testutil import FakeDockerClient
+
+
+def build_project(client, events):
+    config_data = build_config_data(
+        services=[{'name': 'web', 'image': 'busybox'}],
+        volumes={'data': {}},
+    )
+    return Project.from_config('app', config_data, client, notify=events.append)
+
+
+def test_up_and_down_notify_lifecycle_events():
+    client = FakeDockerClient(images=['busybox'])
+    events = []
+    project = build_project(client, events)
+
+    project.up(detached=True)
+    container_id, = client.containers_by_id
+    assert [(e.kind, e.name, e.action) for e in events] == [
+        ('network', 'app_default', 'created'),
+        ('volume', 'app_data', 'created'),
+        ('container', 'app_web_1', 'created'),
+        ('container', 'app_web_1', 'started'),
+    ]
+    assert events[2].id == container_id
+
+    del events[:]
+    project.down(ImageType.none, include_volumes=True)
+    assert events == [
+        LifecycleEvent('container', 'app_web_1', container_id, 'stopped', None),
+        LifecycleEvent('container', 'app_web_1', container_id, 'removed', None),
+        LifecycleEvent('network', 'app_default', None, 'removed', None),
+        LifecycleEvent('volume', 'app_data', None, 'removed', None),
+    ]
+
+
+def test_pull_notifies_progress():
+    def progress(layer, current):
+        return {
+            'status': 'Downloading', 'id': layer,
+            'progressDetail': {'current': current, 'total': 100},
+        }
+
+    client = FakeDockerClient()
+    client.pull = lambda repository, **kwargs: iter([
+        json.dumps(event).encode('utf-8')
+        for event in [progress('a', 50), progress('b', 0), progress('b', 100),
+                      {'status': 'Status: Downloaded newer image for redis:latest'}]
+    ])
+    events = []
+
+    output = NotifyingClient(client, events.append).pull('redis', stream=True)
+    assert events == []
+    assert len(list(output)) == 4
+
+    assert [(e.name, e.action, e.progress) for e in events] == [
+        ('redis:latest', 'pulling', 0.5),
+        ('redis:latest', 'pulling', 0.25),
+        ('redis:latest', 'pulling', 0.75),
+        ('redis:latest', 'pulled', 1.0),
+    ]
+
+
+def test_push_counts_shared_layers_once_and_ends_as_pushed():
+    # Recorded from a push of an image sharing its base layers with another
+    # image of the project
+    recorded = [
+        {'status': 'The push refers to repository [localhost:5000/web]'},
+        {'status': 'Preparing', 'progressDetail': {}, 'id': 'a1'},
+        {'status': 'Preparing', 'progressDetail': {}, 'id': 'b2'},
+        {'status': 'Waiting', 'progressDetail': {}, 'id': 'b2'},
+        {'status': 'Pushing', 'progressDetail': {'current': 100, 'total': 400}, 'id': 'a1'},
+        {'status': 'Layer already exists', 'progressDetail': {}, 'id': 'b2'},
+        {'status': 'Pushing', 'progressDetail': {'current': 400, 'total': 400}, 'id': 'a1'},
+        {'status': 'Pushing', 'progressDetail': {'current': 400, 'total': 400}, 'id': 'a1'},
+        {'status': 'Pushed', 'progressDetail': {}, 'id': 'a1'},
+        {'status': 'latest: digest: sha256:abcd size: 739'},
+        {'progressDetail': {}, 'aux': {'Tag': 'latest', 'Digest': 'sha256:abcd', 'Size': 739}},
+    ]
+    client = FakeDockerClient()
+    client.push = lambda repository, **kwargs: iter([
+        json.dumps(event).encode('utf-8') for event in recorded
+    ])
+    events = []
+    service = Service(
+        'web',
+        client=NotifyingClient(client, events.append),
+        image='localhost:5000/web',
+        build={'context': '.'},
+    )
+
+    assert service.push() == 'sha256:abcd'
+
+    assert [(e.name, e.action, e.progress) for e in events] == [
+        ('localhost:5000/web:latest', 'pushing', 0.25),
+        ('localhost:5000/web:latest', 'pushing', 1.0),
+        ('localhost:5000/web:latest', 'pushing', 1.0),
+        ('localhost:5000/web:latest', 'pushed', 1.0),
+    ]
+
+
+def test_interrupted_pull_ends_as_failed():
+    client = FakeDockerClient()
+    client.pull = lambda repository, **kwargs: iter([
+        json.dumps(event).encode('utf-8') for event in [
+            {'status': 'Downloading', 'id': 'a', 'progressDetail': {'current': 1, 'total': 2}},
+            {'errorDetail': {'message': 'unexpected EOF'}, 'error': 'unexpected EOF'},
+        ]
+    ])
+    events = []
+
+    output = NotifyingClient(client, events.append).pull('redis', stream=True)
+    next(output)
+    output.close()
+
+    assert [(e.action, e.progress) for e in events] == [('pulling', 0.5), ('failed', None)]
+
+    del events[:]
+    list(NotifyingClient(client, events.append).pull('redis', stream=True))
+    assert events[-1].action == 'failed'
@@ -0,0 +1,41 @@
+import pytest
+
+from .. import mock
+from compose.errors import ProjectLockedError
+from compose.lock import ProjectLock
+
+
+def test_lock_is_exclusive_per_project_and_host(tmpdir):
+    lock_dir = str(tmpdir)
+    with ProjectLock('app', 'unix:///var/run/docker.sock', lock_dir=lock_dir):
+        with pytest.raises(ProjectLockedError) as excinfo:
+            ProjectLock('app', 'unix:///var/run/docker.sock', timeout=0, lock_dir=lock_dir).acquire()
+
+        assert 'Another compose operation is in progress for project "app"' in excinfo.value.msg
+
+        with ProjectLock('other', 'unix:///var/run/docker.sock', timeout=0, lock_dir=lock_dir):
+            pass
+        with ProjectLock('app', 'tcp://remote:2376', timeout=0, lock_dir=lock_dir):
+            pass
+
+
+def test_lock_released_on_error(tmpdir):
+    lock_dir = str(tmpdir)
+    with pytest.raises(RuntimeError):
+        with ProjectLock('app', 'unix:///var/run/docker.sock', lock_dir=lock_dir):
+            raise RuntimeError('boom')
+
+    with ProjectLock('app', 'unix:///var/run/docker.sock', timeout=0, lock_dir=lock_dir):
+        pass
+
+
+def test_lock_waits_for_release(tmpdir):
+    lock_dir = str(tmpdir)
+    holder = ProjectLock('app', None, lock_dir=lock_dir)
+    holder.acquire()
+    waiter = ProjectLock('app', None, timeout=5, lock_dir=lock_dir)
+
+    with mock.patch('compose.lock.time.sleep', side_effect=lambda _: holder.release()):
+        waiter.acquire()
+
+    waiter.release()
@@ -0,0 +1,99 @@
+from collections import Counter
+
+import pytest
+from docker.errors import APIError
+
+from .. import unittest
+from ..helpers import build_config_data
+from compose import meters
+from compose.project import Project
+from compose.project import ProjectError
+from compose.testutil import FakeDockerClient
+
+
+class RecordingMetrics(meters.Metrics):
+    def __init__(self):
+        self.counters = Counter()
+        self.observations = []
+
+    def increment(self, name, value=1, labels=None):
+        self.counters[name, tuple(sorted((labels or {}).items()))] += value
+
+    def observe(self, name, value, labels=None):
+        self.observations.append((name, value, labels))
+
+    def count(self, name, **labels):
+        return self.counters[name, tuple(sorted(labels.items()))]
+
+
+def build_project(client, metrics, services):
+    return Project.from_config('app', build_config_data(services=services), client, metrics=metrics)
+
+
+class MetersTest(unittest.TestCase):
+    def setUp(self):
+        self.client = FakeDockerClient(images=['busybox'])
+        self.metrics = RecordingMetrics()
+        self.project = build_project(self.client, self.metrics, [
+            {'name': 'web', 'image': 'busybox', 'scale': 2},
+            {'name': 'db', 'image': 'postgres'},
+        ])
+
+    def test_up_counts_operations_and_containers(self):
+        self.project.up(detached=True)
+
+        assert self.metrics.count(meters.OPERATIONS, operation='up') == 1
+        assert self.metrics.count(meters.CONTAINERS_CREATED, operation='up') == 3
+        assert self.metrics.count(meters.CONTAINERS_STARTED, operation='up') == 3
+        assert self.metrics.count(
+            meters.PULL_BYTES, operation='up'
+        ) == self.client.inspect_image('postgres')['Size']
+        assert [(name, labels) for name, _, labels in self.metrics.observations] == [
+            (meters.OPERATION_DURATION, {'operation': 'up'}),
+        ]
+        assert not any(name == meters.OPERATION_ERRORS for name, _ in self.metrics.counters)
+
+        self.project.up(detached=True)
+        assert self.metrics.count(meters.OPERATIONS, operation='up') == 2
+        assert self.metrics.count(meters.CONTAINERS_CREATED, operation='up') == 3
+
+        self.project.down(None, include_volumes=False)
+        assert self.metrics.count(meters.OPERATIONS, operation='down') == 1
+        assert self.metrics.count(meters.CONTAINERS_CREATED, operation='down') == 0
+
+    def test_up_counts_errors_by_category(self):
+        self.client.fail('start', APIError(
+            'start failed', explanation='no space left on device'))
+
+        with pytest.raises(ProjectError):
+            self.project.up(detached=True)
+
+        assert self.metrics.count(
+            meters.OPERATION_ERRORS, operation='up', category='ProjectError'
+        ) == 1
+        assert self.metrics.count(meters.CONTAINERS_STARTED, operation='up') == 0
+        assert self.metrics.observations[-1][0] == meters.OPERATION_DURATION
+
+    def test_interrupts_are_not_counted_as_errors(self):
+        self.client.fail('pull', KeyboardInterrupt())
+
+        with pytest.raises(KeyboardInterrupt):
+            self.project.pull(parallel_pull=False, silent=True)
+
+        assert self.metrics.count(meters.OPERATIONS, operation='pull') == 1
+        assert not any(name == meters.OPERATION_ERRORS for name, _ in self.metrics.counters)
+
+    def test_pull_counts_the_bytes_of_each_layer_once(self):
+        self.project.pull(parallel_pull=False, silent=True)
+
+        size = self.client.inspect_image('postgres')['Size']
+        assert self.metrics.count(meters.OPERATIONS, operation='pull') == 1
+        assert self.metrics.count(meters.PULL_BYTES, operation='pull') == 2 * size
+
+    def test_no_metrics(self):
+        project = build_project(self.client, None, [{'name': 'web', 'image': 'busybox'}])
+
+        project.up(detached=True)
+
+        assert not isinstance(project.client, meters.MeteringClient)
+        assert len(self.client.called('start')) == 1
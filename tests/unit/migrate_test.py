@@ -0,0 +1,104 @@
+import json
+
+import pytest
+
+from .. import mock
+from .. import unittest
+from compose.config.config import Config
+from compose.config.types import VolumeSpec
+from compose.const import COMPOSE_SPEC as VERSION
+from compose.const import LABEL_MIGRATED_FROM
+from compose.const import LABEL_PROJECT
+from compose.errors import MigrationError
+from compose.migrate import COPY_COMMAND
+from compose.migrate import migrate_project
+from compose.project import Project
+from compose.testutil import FakeDockerClient
+
+
+class MigrateTest(unittest.TestCase):
+    def setUp(self):
+        self.client = FakeDockerClient(images=['busybox', 'busybox:latest'])
+        self.old = self.project('old')
+        self.old.up(detached=True)
+        self.old.stop()
+        self.new = self.project('new')
+
+    def project(self, name):
+        return Project.from_config(name, Config(
+            config_version=VERSION,
+            version=VERSION,
+            services=[{
+                'name': 'web',
+                'image': 'busybox',
+                'volumes': [VolumeSpec.parse('data:/data')],
+            }],
+            volumes={'data': {}},
+            networks=None,
+            secrets=None,
+            configs=None,
+        ), self.client)
+
+    def test_migrate_project(self):
+        migrate_project(self.new, 'old')
+
+        assert self.client.containers_by_id == {}
+        assert sorted(self.client.volumes_by_name) == ['new_data']
+        assert self.client.volumes_by_name['new_data']['Labels'][LABEL_PROJECT] == 'new'
+        assert self.client.volumes_by_name['new_data']['Labels'][LABEL_MIGRATED_FROM] == 'old_data'
+        assert sorted(self.client.networks_by_name) == ['new_default']
+
+        args, kwargs = self.client.called('create_container')[-1]
+        assert args == ('busybox:latest', ['sh', '-c', COPY_COMMAND])
+        assert sorted(kwargs['host_config']['Binds']) == [
+            'new_data:/to', 'old_data:/from:ro',
+        ]
+
+        self.new.up(detached=True)
+        assert [c.name for c in self.new.containers()] == ['new_web_1']
+
+    def test_migrate_project_refuses_while_running(self):
+        self.old.start()
+        with pytest.raises(MigrationError) as exc:
+            migrate_project(self.new, 'old')
+
+        assert 'old_web_1' in exc.value.msg
+        assert sorted(self.client.volumes_by_name) == ['old_data']
+        assert len(self.client.containers_by_id) == 1
+
+    def test_migrate_project_resumes_an_interrupted_copy(self):
+        self.client.create_volume('new_data', labels={LABEL_MIGRATED_FROM: 'old_data'})
+        migrate_project(self.new, 'old')
+
+        assert sorted(self.client.volumes_by_name) == ['new_data']
+
+    def test_migrate_project_keeps_an_existing_volume(self):
+        self.client.create_volume('new_data', labels={LABEL_PROJECT: 'new'})
+        with pytest.raises(MigrationError) as exc:
+            migrate_project(self.new, 'old')
+
+        assert 'volume new_data already exists' in exc.value.msg
+        assert sorted(self.client.volumes_by_name) == ['new_data', 'old_data']
+
+    def test_migrate_project_keeps_the_volume_when_the_copy_fails(self):
+        with mock.patch.object(self.client, 'wait', return_value={'StatusCode': 1}):
+            with mock.patch.object(self.client, 'logs', return_value=b'cp: no space left\n'):
+                with pytest.raises(MigrationError) as exc:
+                    migrate_project(self.new, 'old')
+
+        assert 'no space left' in exc.value.msg
+        assert 'old_data' in self.client.volumes_by_name
+        assert self.client.containers_by_id == {}
+
+        migrate_project(self.new, 'old')
+        assert sorted(self.client.volumes_by_name) == ['new_data']
+
+    def test_migrate_project_fails_when_the_helper_image_cannot_be_pulled(self):
+        error = {'error': 'manifest unknown', 'errorDetail': {'message': 'manifest unknown'}}
+        output = iter([json.dumps(error).encode('utf-8')])
+        with mock.patch.object(self.client, 'pull', return_value=output):
+            with pytest.raises(MigrationError) as exc:
+                migrate_project(self.new, 'old', image='busybox:missing')
+
+        assert 'pulling the helper image busybox:missing failed: manifest unknown' in exc.value.msg
+        assert sorted(self.client.volumes_by_name) == ['old_data']
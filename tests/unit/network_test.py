@@ -1,10 +1,16 @@
 import pytest
+from docker.errors import APIError
 
 from .. import mock
 from .. import unittest
+from compose.const import LABEL_PROJECT
+from compose.errors import NetworkDriverError
+from compose.network import build_networks
 from compose.network import check_remote_network_config
+from compose.network import ensure_shared_network
 from compose.network import Network
 from compose.network import NetworkConfigChangedError
+from compose.testutil import FakeDockerClient
 
 
 class NetworkTest(unittest.TestCase):
@@ -170,3 +176,142 @@ class NetworkTest(unittest.TestCase):
         remote = {'Labels': None}
         local = Network(None, 'test_project', 'test_network')
         check_remote_network_config(remote, local)
+
+    def test_build_networks_default_driver_opts(self):
+        mtu = 'com.docker.network.driver.mtu'
+        config_data = mock.Mock(networks={
+            'front': {},
+            'back': {'driver_opts': {mtu: '9000', 'com.docker.network.bridge.name': 'back0'}},
+            'bridged': {'driver_opts': {'com.docker.network.bridge.name': 'br0'}},
+            'outside': {'external': True},
+        })
+
+        networks = build_networks('app', config_data, None, default_driver_opts={mtu: '1400'})
+
+        assert networks['default'].driver_opts == {mtu: '1400'}
+        assert networks['front'].driver_opts == {mtu: '1400'}
+        assert networks['back'].driver_opts == {
+            mtu: '9000', 'com.docker.network.bridge.name': 'back0',
+        }
+        assert networks['bridged'].driver_opts == {'com.docker.network.bridge.name': 'br0'}
+        assert networks['outside'].driver_opts is None
+
+    def test_build_networks_without_default_driver_opts(self):
+        networks = build_networks('app', mock.Mock(networks={'front': {}}), None)
+        assert networks['default'].driver_opts is None
+        assert networks['front'].driver_opts is None
+
+    def test_build_networks_shared(self):
+        config_data = mock.Mock(networks={'bus': {'x-shared': True}, 'front': {}})
+        networks = build_networks('app', config_data, None, default_driver_opts={'mtu': '1400'})
+
+        assert networks['bus'].shared
+        assert networks['bus'].full_name == 'bus'
+        assert networks['bus'].driver_opts is None
+        assert not networks['front'].shared
+        assert networks['front'].full_name == 'app_front'
+
+
+class SharedNetworkTest(unittest.TestCase):
+    def setUp(self):
+        self.client = FakeDockerClient()
+
+    def test_ensure_shared_network_creates_it_without_ownership_labels(self):
+        network = ensure_shared_network(self.client, 'bus', labels={'team': 'platform'})
+        assert self.client.inspect_network('bus')['Labels'] == {'team': 'platform'}
+
+        ensure_shared_network(self.client, 'bus', labels={'team': 'platform'})
+        assert len(self.client.called('create_network')) == 1
+
+        network.remove()
+        assert self.client.inspect_network('bus')
+
+    def test_ensure_shared_network_uses_one_created_concurrently(self):
+        create_network = self.client.create_network
+
+        def create_first(name, **kwargs):
+            create_network(name, **kwargs)
+            raise APIError('network with name {} already exists'.format(name))
+
+        with mock.patch.object(self.client, 'create_network', side_effect=create_first):
+            ensure_shared_network(self.client, 'bus')
+        assert self.client.inspect_network('bus')
+
+    def test_ensure_shared_network_raises_when_creation_fails(self):
+        with mock.patch.object(self.client, 'create_network', side_effect=APIError('boom')):
+            with pytest.raises(APIError):
+                ensure_shared_network(self.client, 'bus')
+
+    def test_ensure_shared_network_checks_the_existing_config(self):
+        self.client.create_network('bus', driver='overlay', labels={LABEL_PROJECT: 'other'})
+        with pytest.raises(NetworkConfigChangedError):
+            ensure_shared_network(self.client, 'bus', driver='bridge')
+        ensure_shared_network(self.client, 'bus', driver='overlay')
+
+
+class NetworkDriverTest(unittest.TestCase):
+    def setUp(self):
+        self.client = FakeDockerClient()
+        self.client.daemon_info = {
+            'OperatingSystem': 'Ubuntu 22.04',
+            'Plugins': {'Network': ['bridge', 'host', 'ipvlan', 'macvlan', 'null', 'overlay']},
+        }
+
+    def network(self, driver, **options):
+        return Network(self.client, 'app', 'lan', driver=driver, **options)
+
+    def test_ensure_macvlan_network(self):
+        with mock.patch('compose.network.log', autospec=True) as mock_log:
+            self.network('macvlan', driver_opts={'parent': 'eth0'}).ensure()
+
+        assert not mock_log.warning.called
+        assert self.client.inspect_network('app_lan')['Driver'] == 'macvlan'
+
+    def test_ensure_macvlan_network_without_parent(self):
+        with mock.patch('compose.network.log', autospec=True) as mock_log:
+            self.network('macvlan').ensure()
+
+        assert 'no "parent" driver option' in mock_log.warning.call_args[0][0]
+        assert self.client.inspect_network('app_lan')
+
+    def test_ensure_macvlan_network_on_docker_desktop(self):
+        self.client.daemon_info['OperatingSystem'] = 'Docker Desktop'
+        with mock.patch('compose.network.log', autospec=True) as mock_log:
+            self.network('macvlan', driver_opts={'parent': 'eth0'}).ensure()
+
+        assert 'Docker Desktop' in mock_log.warning.call_args[0][0]
+
+    def test_ensure_network_with_unsupported_driver(self):
+        self.client.daemon_info['Plugins']['Network'] = ['bridge', 'nat']
+        with pytest.raises(NetworkDriverError) as exc:
+            self.network('macvlan', driver_opts={'parent': 'eth0'}).ensure()
+
+        assert 'supports bridge, nat' in exc.value.msg
+        assert not self.client.called('create_network')
+
+    def test_ensure_network_with_plugin_driver(self):
+        self.network('weave').ensure()
+        assert not self.client.called('info')
+
+    def test_ensure_network_with_missing_parent_interface(self):
+        error = APIError(None, None, '-o parent interface was not found on the host: eth9')
+        with mock.patch.object(self.client, 'create_network', side_effect=error):
+            with pytest.raises(NetworkDriverError) as exc:
+                self.network('ipvlan', driver_opts={'parent': 'eth9'}).ensure()
+
+        assert exc.value.network == 'app_lan'
+        assert exc.value.driver == 'ipvlan'
+        assert 'parent interface eth9 does not exist' in exc.value.msg
+
+    def test_ensure_network_with_parent_interface_in_use(self):
+        error = APIError(None, None, 'network dm-1f6b7f7d2b54 is already using parent interface eth0')
+        with mock.patch.object(self.client, 'create_network', side_effect=error):
+            with pytest.raises(NetworkDriverError) as exc:
+                self.network('macvlan', driver_opts={'parent': 'eth0'}).ensure()
+
+        assert 'such as eth0.10' in exc.value.msg
+
+    def test_ensure_network_with_other_error(self):
+        with mock.patch.object(self.client, 'create_network', side_effect=APIError('boom')):
+            with pytest.raises(APIError):
+                self.network('macvlan', driver_opts={'parent': 'eth0'}).ensure()
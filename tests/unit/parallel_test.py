@@ -1,13 +1,18 @@
+import re
+import time
 import unittest
 from threading import Lock
+from threading import Thread
 
 from docker.errors import APIError
 
 from compose.cli.colors import AnsiMode
 from compose.parallel import GlobalLimit
+from compose.parallel import parallel_batch
 from compose.parallel import parallel_execute
 from compose.parallel import parallel_execute_iter
 from compose.parallel import ParallelStreamWriter
+from compose.parallel import State
 from compose.parallel import UpstreamError
 
 
@@ -185,3 +190,97 @@ def test_parallel_execute_noansi(capsys):
 
     _, err = capsys.readouterr()
     assert "\x1b" not in err
+
+
+def render(output):
+    """The lines of a terminal that `output` was written to."""
+    screen, row = [''], 0
+    output = re.sub(r'\x1b\[[0-9;]*m', '', output)
+    for token in re.split(r'(\x1b\[\d+[AB]|\x1b\[2K|\r\n|\r)', output):
+        if token == '\r\n':
+            row += 1
+            screen.extend([''] * (row + 1 - len(screen)))
+        elif re.match(r'\x1b\[\d+A', token):
+            row -= int(token[2:-1])
+        elif re.match(r'\x1b\[\d+B', token):
+            row += int(token[2:-1])
+        elif token == '\x1b[2K':
+            screen[row] = ''
+        elif token and token != '\r':
+            screen[row] = token
+    return [' '.join(line.split()) for line in screen if line]
+
+
+def test_parallel_execute_concurrent_operations(capsys):
+    ParallelStreamWriter.instance = None
+    ParallelStreamWriter.set_default_ansi_mode(AnsiMode.ALWAYS)
+
+    def create(name):
+        time.sleep(0.05 if name == 'web' else 0.01)
+
+    def up():
+        parallel_execute(objects=['db', 'web'], func=create, get_name=str, msg='Creating')
+
+    threads = [Thread(target=up) for _ in range(2)]
+    for thread in threads:
+        thread.start()
+    for thread in threads:
+        thread.join()
+
+    # Each operation updates its own lines, which are kept together
+    assert render(capsys.readouterr().err) == [
+        'Creating db ... done', 'Creating web ... done',
+    ] * 2
+    assert len(ParallelStreamWriter.instance.lines) == 4
+
+
+def test_pending_keeps_object_order():
+    tasks = [object() for _ in range(10)]
+    state = State(tasks)
+    state.started.add(tasks[3])
+    state.finished.add(tasks[0])
+
+    assert state.pending() == tasks[1:3] + tasks[4:]
+
+
+def test_parallel_execute_errors_in_object_order(capsys):
+    names = ['a', 'b', 'c', 'd']
+
+    def fail_in_reverse(name):
+        time.sleep(0.01 * (len(names) - names.index(name)))
+        raise APIError(None, None, 'failed {}'.format(name))
+
+    def run():
+        ParallelStreamWriter.instance = None
+        _, errors = parallel_execute(
+            objects=names,
+            func=fail_in_reverse,
+            get_name=str,
+            msg='Running',
+        )
+        assert list(errors) == names
+        return [line for line in capsys.readouterr().err.splitlines() if line.startswith('ERROR')]
+
+    first = run()
+    assert first == ['ERROR: for {}  failed {}'.format(name, name) for name in names]
+    assert run() == first
+
+
+def test_parallel_batch_reports_each_item_in_order():
+    calls = []
+
+    def stop(name):
+        calls.append(name)
+        time.sleep(0.01 * (3 - len(name)))
+        if name == 'bb':
+            raise APIError(None, None, 'failed')
+        return len(name)
+
+    results = parallel_batch(['a', 'bb', 'ccc', 'a'], stop, limit=2)
+
+    assert [r.id for r in results] == ['a', 'bb', 'ccc', 'a']
+    assert [r.ok for r in results] == [True, False, True, True]
+    assert isinstance(results[1].error, APIError)
+    assert results[0].error is None
+    assert [r.value for r in results] == [1, None, 3, 1]
+    assert sorted(calls) == ['a', 'bb', 'ccc']
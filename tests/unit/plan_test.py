@@ -0,0 +1,52 @@
+import json
+
+import pytest
+
+from compose.errors import InvalidPlanError
+from compose.plan import Plan
+from compose.plan import PlanStep
+
+
+def make_plan():
+    return Plan(
+        project='app',
+        config_hash='f00',
+        steps=[
+            PlanStep('db', 'noop', 'd0', ['1d']),
+            PlanStep('web', 'recreate', 'e0', ['2e']),
+        ],
+        state={'1d': 'd0', '2e': 'e1'},
+    )
+
+
+def test_plan_json_round_trip():
+    plan = make_plan()
+
+    loaded = Plan.from_json(plan.to_json())
+
+    assert loaded == plan
+    assert loaded.digest == plan.digest
+    assert loaded.changes
+    assert json.loads(plan.to_json())['digest'] == plan.digest
+
+
+def test_plan_digest_depends_on_content():
+    plan = make_plan()
+    assert plan._replace(state={'1d': 'd0', '2e': 'e0'}).digest != plan.digest
+    assert not plan._replace(steps=plan.steps[:1]).changes
+
+
+def test_plan_from_json_rejects_edited_plan():
+    data = json.loads(make_plan().to_json())
+    data['steps'][1]['action'] = 'noop'
+
+    with pytest.raises(InvalidPlanError) as excinfo:
+        Plan.from_json(json.dumps(data))
+
+    assert excinfo.value.msg == 'Invalid plan: its digest does not match its content'
+
+
+@pytest.mark.parametrize('text', ['', '[]', '{"version": 1}', '{"version": 2}'])
+def test_plan_from_json_rejects_invalid_plan(text):
+    with pytest.raises(InvalidPlanError):
+        Plan.from_json(text)
@@ -0,0 +1,122 @@
+import json
+import os
+import socket
+import tempfile
+
+import pytest
+
+from compose.lifecycle import LifecycleEvent
+from compose.progress_server import END
+from compose.progress_server import ProgressServer
+
+
+def event(kind, name, action, progress=None, id=None):
+    return LifecycleEvent(kind, name, id or name, action, progress)
+
+
+def drain(subscriber):
+    records = []
+    while not subscriber.empty():
+        records.append(subscriber.get_nowait())
+    return records
+
+
+@pytest.fixture
+def socket_path():
+    # Kept short: unix socket paths are limited to about a hundred bytes
+    directory = tempfile.mkdtemp()
+    yield os.path.join(directory, 'progress.sock')
+    os.rmdir(directory)
+
+
+def test_events_are_numbered_in_order():
+    server = ProgressServer()
+    subscriber = server.subscribe()
+    server.notify(event('image', 'redis:latest', 'pulling', 0.5))
+    server.notify(event('container', 'app_web_1', 'created'))
+
+    assert drain(subscriber) == [
+        {'seq': 1, 'kind': 'image', 'name': 'redis:latest', 'id': 'redis:latest',
+         'action': 'pulling', 'progress': 0.5, 'duration': None},
+        {'seq': 2, 'kind': 'container', 'name': 'app_web_1', 'id': 'app_web_1',
+         'action': 'created', 'progress': None, 'duration': None},
+    ]
+
+
+def test_late_subscriber_gets_a_snapshot():
+    server = ProgressServer()
+    server.notify(event('image', 'redis:latest', 'pulling', 0.2))
+    server.notify(event('network', 'app_default', 'created'))
+    server.notify(event('container', 'app_db_1', 'created'))
+    server.notify(event('image', 'redis:latest', 'pulling', 0.8))
+    server.notify(event('container', 'app_db_1', 'removed'))
+
+    subscriber = server.subscribe()
+    assert [(r['seq'], r['name'], r['progress']) for r in drain(subscriber)] == [
+        (2, 'app_default', None),
+        (4, 'redis:latest', 0.8),
+    ]
+
+    server.notify(event('container', 'app_web_1', 'started'))
+    assert [r['seq'] for r in drain(subscriber)] == [6]
+
+
+def test_close_ends_subscriptions():
+    server = ProgressServer()
+    subscriber = server.subscribe()
+    server.close()
+    assert subscriber.get_nowait() is END
+
+
+def test_serve_on_unix_socket(socket_path):
+    server = ProgressServer(socket_path)
+    server.start()
+    try:
+        server.notify(event('network', 'app_default', 'created'))
+        client = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+        client.settimeout(5)
+        client.connect(socket_path)
+        stream = client.makefile('r')
+
+        assert json.loads(stream.readline())['name'] == 'app_default'
+        server.notify(event('container', 'app_web_1', 'started'))
+        record = json.loads(stream.readline())
+        assert (record['seq'], record['action']) == (2, 'started')
+    finally:
+        server.close()
+
+    assert stream.readline() == ''
+    client.close()
+    assert not os.path.exists(socket_path)
+
+
+def test_start_leaves_other_files_alone(socket_path):
+    with open(socket_path, 'w') as f:
+        f.write('notes')
+
+    with pytest.raises(OSError):
+        ProgressServer(socket_path).start()
+
+    with open(socket_path) as f:
+        assert f.read() == 'notes'
+    os.unlink(socket_path)
+
+
+def test_close_waits_for_the_last_events(socket_path):
+    server = ProgressServer(socket_path)
+    server.start()
+    client = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+    client.settimeout(5)
+    client.connect(socket_path)
+    stream = client.makefile('r')
+    server.notify(event('network', 'app_default', 'created'))
+    assert json.loads(stream.readline())['seq'] == 1
+
+    threads = list(server._threads)
+    for _ in range(100):
+        server.notify(event('container', 'app_web_1', 'started'))
+    server.close()
+
+    assert not any(thread.is_alive() for thread in threads)
+    assert len(stream.read().splitlines()) == 100
+    client.close()
@@ -112,3 +112,16 @@ class ProgressStreamTestCase(unittest.TestCase):
             {"status": "..."},
         ]
         assert progress_stream.get_digest_from_pull(events) == digest
+
+    def test_get_download_size(self):
+        assert progress_stream.get_download_size([]) == 0
+
+        events = [
+            {"status": "Pulling fs layer", "id": "a"},
+            {"status": "Downloading", "id": "a", "progressDetail": {"current": 10, "total": 100}},
+            {"status": "Downloading", "id": "a", "progressDetail": {"current": 100, "total": 100}},
+            {"status": "Downloading", "id": "b", "progressDetail": {"current": 5, "total": 50}},
+            {"status": "Extracting", "id": "b", "progressDetail": {"current": 50, "total": 50}},
+            {"status": "Digest: sha256:abcd"},
+        ]
+        assert progress_stream.get_download_size(events) == 150
@@ -1,47 +1,79 @@
 import datetime
+import json
+import logging
 import os
 import tempfile
 
 import docker
 import pytest
+from docker.errors import APIError
 from docker.errors import NotFound
 
 from .. import mock
 from .. import unittest
+from ..helpers import build_config_data as build_config
 from ..helpers import BUSYBOX_IMAGE_WITH_TAG
+from compose.cli.signals import ShutdownException
 from compose.config import ConfigurationError
-from compose.config.config import Config
+from compose.config.errors import DependencyError
+from compose.config.types import ServiceHook
+from compose.config.types import ServicePort
 from compose.config.types import VolumeFromSpec
-from compose.const import COMPOSE_SPEC as VERSION
+from compose.config.types import VolumeSpec
+from compose.config.types import WatchRule
 from compose.const import COMPOSEFILE_V1 as V1
 from compose.const import DEFAULT_TIMEOUT
+from compose.const import LABEL_CONFIG_HASH
+from compose.const import LABEL_CONTAINER_NUMBER
+from compose.const import LABEL_DEPENDS_ON
+from compose.const import LABEL_HEALTHCHECK_OVERRIDE
+from compose.const import LABEL_IMAGE_PROJECT
+from compose.const import LABEL_IMAGE_SERVICE
+from compose.const import LABEL_ONE_OFF
+from compose.const import LABEL_PROJECT
+from compose.const import LABEL_PROJECT_CONFIG_HASH
 from compose.const import LABEL_SERVICE
+from compose.const import LABEL_TENANT
+from compose.const import LABEL_VERSION
 from compose.container import Container
+from compose.errors import ExternalContainerError
+from compose.errors import ImagePlatformMismatchError
+from compose.errors import OfflineImagesMissingError
 from compose.errors import OperationFailedError
+from compose.errors import PlanDriftError
+from compose.errors import ReloadError
+from compose.errors import UnsupportedFeatureError
+from compose.errors import WaitTimeoutError
+from compose.plan import Plan
+from compose.project import AmbiguousContainerIdentifier
+from compose.project import find_container
+from compose.project import get_drain_seconds
+from compose.project import get_hooks
 from compose.project import get_secrets
+from compose.project import list_project_names
 from compose.project import NoSuchService
+from compose.project import OneOffFilter
 from compose.project import Project
 from compose.project import ProjectError
+from compose.service import BuildAction
+from compose.service import ConvergenceStrategy
 from compose.service import ImageType
 from compose.service import Service
-
-
-def build_config(**kwargs):
-    return Config(
-        config_version=kwargs.get('config_version', VERSION),
-        version=kwargs.get('version', VERSION),
-        services=kwargs.get('services'),
-        volumes=kwargs.get('volumes'),
-        networks=kwargs.get('networks'),
-        secrets=kwargs.get('secrets'),
-        configs=kwargs.get('configs'),
-    )
+from compose.stats import NO_STATS
+from compose.testutil import FakeDockerClient
+from compose.wait import DIAL_TIMEOUT
+from compose.wait import ProbeError
+from compose.wait import Target
+from compose.warning import LABEL_ADOPTION
+from compose.warning import PLATFORM_MISMATCH
+from compose.warning import Warnings
 
 
 class ProjectTest(unittest.TestCase):
     def setUp(self):
         self.mock_client = mock.create_autospec(docker.APIClient)
         self.mock_client._general_configs = {}
+        self.mock_client._auth_configs = docker.auth.AuthConfig({})
         self.mock_client.api_version = docker.constants.DEFAULT_DOCKER_API_VERSION
 
     def test_from_config_v1(self):
@@ -74,6 +106,32 @@ class ProjectTest(unittest.TestCase):
         assert project.get_service('db').options['image'] == BUSYBOX_IMAGE_WITH_TAG
         assert not project.networks.use_networking
 
+    def test_from_config_with_api_logger(self):
+        config = build_config(
+            version=V1,
+            services=[{'name': 'web', 'image': BUSYBOX_IMAGE_WITH_TAG}],
+            networks=None,
+            volumes=None,
+            secrets=None,
+            configs=None,
+        )
+        api_logger = logging.getLogger('embedder.docker')
+        project = Project.from_config(
+            name='composetest',
+            config_data=config,
+            client=self.mock_client,
+            api_logger=api_logger,
+        )
+        self.mock_client.containers.return_value = []
+
+        with mock.patch.object(api_logger, 'log') as mock_log:
+            project.get_service('web').containers()
+
+        assert self.mock_client.containers.called
+        # Service.containers() also looks up legacy names when nothing matches
+        assert mock_log.call_count == 4
+        assert mock_log.call_args[0][:3] == (logging.DEBUG, '%s %s -> %s (%.3fs)', 'docker')
+
     @mock.patch('compose.network.Network.true_name', lambda n: n.full_name)
     def test_from_config_v2(self):
         config = build_config(
@@ -920,3 +978,1979 @@ class ProjectTest(unittest.TestCase):
                                             "\"{secret_file}\", the following file should be created "
                                             "\"{secret_file}\""
                                             .format(service=service, secret_file=not_a_path))
+
+    def test_get_hooks(self):
+        hooks = get_hooks('foo', {
+            'post_start': ['./migrate.sh', {'command': 'warmup', 'user': 'app'}],
+            'pre_stop': 'drain',
+        })
+        assert hooks == {
+            'post_start': [
+                ServiceHook('./migrate.sh', None, False, None, None),
+                ServiceHook('warmup', 'app', False, None, None),
+            ],
+            'pre_stop': [ServiceHook('drain', None, False, None, None)],
+        }
+
+    def test_get_hooks_unsupported_type(self):
+        with pytest.raises(ConfigurationError) as excinfo:
+            get_hooks('foo', {'post_stop': 'true'})
+
+        assert 'unsupported hook "post_stop"' in excinfo.exconly()
+
+    def test_get_drain_seconds(self):
+        assert get_drain_seconds('foo', None) == 0
+        assert get_drain_seconds('foo', 5) == 5
+        assert get_drain_seconds('foo', '1m30s') == 90
+        for value in ('soon', -1, True):
+            with pytest.raises(ConfigurationError):
+                get_drain_seconds('foo', value)
+
+    def test_project_stop_runs_pre_stop_hooks(self):
+        client = FakeDockerClient(images=['busybox'])
+        service = Service('web', client=client, project='test', image='busybox', hooks={
+            'pre_stop': [ServiceHook('drain', None, False, None, None)],
+        })
+        project = Project('test', [service], client)
+        service.start_container(service.create_container())
+        container = project.containers()[0]
+
+        stop = project.build_container_operation_with_timeout_func('stop', {})
+        stop(container)
+
+        assert client.called('exec_create') == [
+            ((container.id, 'drain'), {
+                'user': '', 'privileged': False, 'workdir': None, 'stdin': True, 'tty': True,
+            }),
+        ]
+        assert client.called('stop') == [((container.id,), {'timeout': DEFAULT_TIMEOUT})]
+        assert not container.inspect()['State']['Running']
+
+
+class ProjectFakeClientTest(unittest.TestCase):
+    def setUp(self):
+        self.client = FakeDockerClient(images=['busybox'])
+        self.project = Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[
+                    {'name': 'web', 'image': 'busybox'},
+                    {'name': 'db', 'image': 'busybox'},
+                ],
+                networks=None,
+                volumes=None,
+                secrets=None,
+                configs=None,
+            ),
+        )
+
+    def test_containers_by_name_or_id_prefix(self):
+        self.project.up(detached=True, scale_override={'web': 2})
+        web_1, web_2 = sorted(self.project.get_service('web').containers(), key=lambda c: c.name)
+
+        assert [c.name for c in self.project.containers(['app_web_2'])] == ['app_web_2']
+        assert sorted(c.name for c in self.project.containers([web_1.id[:12], 'db'])) == [
+            'app_db_1', 'app_web_1',
+        ]
+        assert self.project.find_container(web_2.id[:6]).id == web_2.id
+        with pytest.raises(NoSuchService):
+            self.project.containers(['app_web_3'])
+
+        self.project.stop(service_names=['app_web_2'])
+        assert sorted(c.name for c in self.project.containers()) == ['app_db_1', 'app_web_1']
+
+    def test_stop_and_remove_containers_in_batch(self):
+        self.project.up(detached=True, scale_override={'web': 2})
+        web_1 = self.project.find_container('app_web_1')
+
+        results = self.project.stop_containers(['app_db_1', 'app_web_3', web_1.id[:12]])
+        assert [r.id for r in results] == ['app_db_1', 'app_web_3', web_1.id[:12]]
+        assert [r.ok for r in results] == [True, False, True]
+        assert isinstance(results[1].error, NoSuchService)
+        assert sorted(c.name for c in self.project.containers()) == ['app_web_2']
+
+        results = self.project.remove_containers(['app_web_2', 'app_db_1', 'app_web_1'])
+        assert [r.ok for r in results] == [False, True, True]
+        assert [c.name for c in self.project.containers(stopped=True)] == ['app_web_2']
+
+    def test_downscale_drains_then_removes_highest_numbers_first(self):
+        project = Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[{'name': 'web', 'image': 'busybox', 'x-drain-seconds': '2s'}],
+                networks=None,
+                volumes=None,
+                secrets=None,
+                configs=None,
+            ),
+        )
+        project.up(detached=True, scale_override={'web': 5})
+        names = {c.id: c.name for c in project.containers()}
+        del self.client.calls[:]
+
+        with mock.patch('compose.service.time.sleep') as sleep:
+            with mock.patch('compose.service.log') as log:
+                project.up(detached=True, scale_override={'web': 2})
+
+        log.info.assert_any_call('Scaling %s from %d to %d', 'web', 5, 2)
+        assert sleep.call_args_list == [mock.call(2.0)] * 3
+        calls = [
+            (name, names[args[0]]) for name, args, _ in self.client.calls
+            if name in ('stop', 'remove_container')
+        ]
+        assert [name for name, _ in calls] == ['stop'] * 3 + ['remove_container'] * 3
+        assert [container for name, container in calls if name == 'remove_container'] == [
+            'app_web_5', 'app_web_4', 'app_web_3',
+        ]
+        assert sorted(c.name for c in project.containers(stopped=True)) == [
+            'app_web_1', 'app_web_2',
+        ]
+
+    def test_downscale_stops_at_the_first_container_that_fails_to_stop(self):
+        self.project.up(detached=True, scale_override={'web': 4})
+        names = {c.id: c.name for c in self.project.containers()}
+        del self.client.calls[:]
+        stop = self.client.stop
+
+        def flaky_stop(container, *args, **kwargs):
+            if names[container] == 'app_web_3':
+                raise APIError('Conflict', explanation='cannot stop container')
+            return stop(container, *args, **kwargs)
+        self.client.stop = flaky_stop
+
+        self.project.up(['web'], detached=True, scale_override={'web': 1})
+
+        assert [names[args[0]] for args, _ in self.client.called('remove_container')] == [
+            'app_web_4',
+        ]
+        assert sorted(c.name for c in self.project.get_service('web').containers()) == [
+            'app_web_1', 'app_web_2', 'app_web_3',
+        ]
+
+    def test_drain_seconds_keep_the_config_hash(self):
+        def config_hash(**options):
+            return Project.from_config(
+                name='app',
+                client=self.client,
+                config_data=build_config(
+                    services=[dict({'name': 'web', 'image': 'busybox'}, **options)],
+                    networks=None,
+                    volumes=None,
+                    secrets=None,
+                    configs=None,
+                ),
+            ).get_service('web').config_hash
+
+        assert config_hash(**{'x-drain-seconds': '2s'}) == config_hash()
+
+    def test_remove_containers_and_their_unused_images(self):
+        self.project.up(detached=True, scale_override={'web': 2})
+        self.project.stop()
+
+        results = self.project.remove_containers(['app_web_1'], remove_image=True)
+        assert [(r.ok, r.value) for r in results] == [(True, False)]
+        assert 'busybox:latest' in self.client.images
+
+        results = self.project.remove_containers(['app_web_2', 'app_db_1'], remove_image=True)
+        assert [r.ok for r in results] == [True, True]
+        assert sorted(r.value for r in results) == [False, True]
+        assert 'busybox:latest' not in self.client.images
+        assert self.project.containers(stopped=True) == []
+
+    def test_remove_containers_keeps_image_referenced_in_multiple_repositories(self):
+        self.project.up(detached=True, service_names=['db'])
+        self.client.fail('remove_image', APIError(
+            'conflict: unable to delete abcd (must be forced) - '
+            'image is referenced in multiple repositories'
+        ))
+
+        results = self.project.remove_containers(['app_db_1'], force=True, remove_image=True)
+
+        assert [(r.ok, r.value) for r in results] == [(True, False)]
+        assert self.project.containers(stopped=True) == []
+        assert 'busybox:latest' in self.client.images
+
+    def test_drift(self):
+        self.project.up(detached=True)
+        config_hash = self.project.config_hash()
+
+        report = self.project.drift()
+        assert report == (config_hash, config_hash, [], [], [], [], [])
+        assert not report.drifted
+        assert {
+            c.labels[LABEL_PROJECT_CONFIG_HASH] for c in self.project.containers()
+        } == {config_hash}
+
+        changed = Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[
+                    {'name': 'web', 'image': 'busybox', 'command': 'top'},
+                    {'name': 'cache', 'image': 'busybox'},
+                ],
+                networks=None,
+                volumes=None,
+                secrets=None,
+                configs=None,
+            ),
+        )
+        report = changed.drift()
+        assert report.recorded_hash == config_hash
+        assert report.config_hash != config_hash
+        assert (report.added, report.removed, report.changed) == (['cache'], ['db'], ['web'])
+        assert report.drifted
+        assert len(self.client.containers_by_id) == 2
+
+    def test_drift_of_networks_and_volumes(self):
+        def project(network):
+            return Project.from_config(
+                name='app',
+                client=self.client,
+                config_data=build_config(
+                    services=[{
+                        'name': 'web',
+                        'image': 'busybox',
+                        'networks': {'front': None},
+                        'volumes': [VolumeSpec.parse('data:/data')],
+                    }],
+                    networks={'front': network},
+                    volumes={'data': {}},
+                    secrets=None,
+                    configs=None,
+                ),
+            )
+        project({}).up(detached=True)
+        assert not project({}).drift().drifted
+
+        # Only the hash of the project tells a change of labels
+        report = project({'labels': {'tier': 'front'}}).drift()
+        assert report.recorded_hash != report.config_hash
+        assert (report.changed, report.networks, report.volumes) == ([], [], [])
+        assert report.drifted
+
+        report = project({'driver_opts': {'mtu': '1400'}}).drift()
+        assert report.networks == ['front']
+
+        self.client.remove_volume('app_data')
+        assert project({}).drift().volumes == ['data']
+
+    def test_up_then_containers(self):
+        self.project.up(detached=True)
+
+        assert sorted(c.name for c in self.project.containers()) == ['app_db_1', 'app_web_1']
+        assert 'app_default' in self.client.networks_by_name
+
+        self.project.up(detached=True)
+        assert len(self.client.called('create_container')) == 2
+
+    def test_down_removes_containers_and_network(self):
+        self.project.up(detached=True)
+        self.project.down(ImageType.none, include_volumes=False)
+
+        assert self.project.containers(stopped=True) == []
+        assert self.client.containers_by_id == {}
+        assert self.client.networks_by_name == {}
+
+    def test_replica_status_counts_missing_replicas(self):
+        project = Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[{'name': 'web', 'image': 'busybox', 'deploy': {'replicas': 3}}],
+                networks=None,
+                volumes=None,
+                secrets=None,
+                configs=None,
+            ),
+        )
+        project.up(detached=True)
+        assert project.replica_status() == [('web', 3, 3, 'running(3)')]
+
+        web_2, web_3 = sorted(project.containers(), key=lambda c: c.number)[1:]
+        self.client.remove_container(web_2.id, force=True)
+        web_3.stop()
+        assert project.replica_status() == [('web', 1, 3, 'exited(1), running(1)')]
+
+    def test_replica_status_leaves_out_removed_containers(self):
+        self.project.up(detached=True)
+        self.client.fail('inspect_container', NotFound('No such container'))
+
+        assert self.project.replica_status(['web']) == [('web', 0, 1, '')]
+
+    def test_replica_status_raises_inspect_errors(self):
+        self.project.up(detached=True)
+        self.client.fail('inspect_container', APIError('500 Server Error'))
+
+        with pytest.raises(APIError):
+            self.project.replica_status(['web'])
+
+    def test_replica_status_after_scaling_up(self):
+        self.project.up(detached=True, scale_override={'web': 3})
+        web_3 = max(self.project.get_service('web').containers(), key=lambda c: c.number)
+        web_3.stop()
+
+        assert self.project.replica_status(['web']) == [
+            ('web', 2, 3, 'exited(1), running(2)'),
+        ]
+
+    def test_replica_status_counts_unhealthy_containers(self):
+        self.project.up(detached=True, scale_override={'web': 3})
+        web_1, web_2 = sorted(self.project.get_service('web').containers(), key=lambda c: c.number)[:2]
+        self.client.containers_by_id[web_1.id]['State']['Health'] = {'Status': 'unhealthy'}
+        self.client.containers_by_id[web_2.id]['State']['Health'] = {'Status': 'healthy'}
+
+        assert self.project.replica_status(scale_override={'web': 3}) == [
+            ('web', 3, 3, 'running(3, unhealthy: 1)'),
+            ('db', 1, 1, 'running(1)'),
+        ]
+
+    def test_replica_status_ignores_one_off_containers(self):
+        self.project.up(detached=True)
+        web = self.project.get_service('web')
+        for _ in range(2):
+            web.start_container(web.create_container(one_off=True))
+
+        assert self.project.replica_status(['web']) == [('web', 1, 1, 'running(1)')]
+
+    def test_replica_status_with_scale_override(self):
+        self.project.up(detached=True, scale_override={'web': 2})
+
+        assert self.project.replica_status(['web'], {'web': 2}) == [('web', 2, 2, 'running(2)')]
+        assert self.project.replica_status(['web']) == [('web', 2, 2, 'running(2)')]
+
+    def test_from_containers_stops_dependents_first(self):
+        project = Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[
+                    {'name': 'db', 'image': 'busybox'},
+                    {'name': 'web', 'image': 'busybox', 'depends_on': {
+                        'db': {'condition': 'service_started'},
+                    }},
+                ],
+                networks=None,
+                volumes=None,
+                secrets=None,
+                configs=None,
+            ),
+        )
+        project.up(detached=True)
+        names = {c.id: c.name for c in project.containers()}
+        del self.client.calls[:]
+
+        Project.from_containers('app', self.client).down(ImageType.none, include_volumes=False)
+
+        stopped = [names[args[0]] for args, _ in self.client.called('stop')]
+        assert stopped == ['app_web_1', 'app_db_1']
+        assert self.client.containers_by_id == {}
+        assert self.client.networks_by_name == {}
+
+    def test_down_stops_each_dependency_level_after_the_previous_one(self):
+        def depends_on(*names):
+            return {name: {'condition': 'service_started'} for name in names}
+
+        project = Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[
+                    {'name': 'db', 'image': 'busybox'},
+                    {'name': 'web', 'image': 'busybox', 'depends_on': depends_on('db')},
+                    {'name': 'worker', 'image': 'busybox', 'depends_on': depends_on('db')},
+                    {'name': 'proxy', 'image': 'busybox', 'depends_on': depends_on('web')},
+                ],
+                networks=None,
+                volumes=None,
+                secrets=None,
+                configs=None,
+            ),
+        )
+        project.up(detached=True, scale_override={'web': 2})
+        services = {c.id: c.service for c in project.containers()}
+        del self.client.calls[:]
+
+        project.down(ImageType.none, include_volumes=False)
+
+        calls = [
+            (name, services[args[0]]) for name, args, _ in self.client.calls
+            if name in ('stop', 'remove_container')
+        ]
+        stopped = [service for name, service in calls if name == 'stop']
+        assert len(stopped) == 5
+        assert stopped.index('proxy') < stopped.index('web')
+        assert max(i for i, s in enumerate(stopped) if s == 'web') < stopped.index('db')
+        assert stopped.index('worker') < stopped.index('db')
+        assert [name for name, _ in calls] == ['stop'] * 5 + ['remove_container'] * 5
+
+    def namespace_project(self, db_environment=None):
+        return Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[
+                    {'name': 'db', 'image': 'busybox', 'environment': db_environment or {}},
+                    {'name': 'web', 'image': 'busybox', 'ipc': 'service:db', 'pid': 'service:db'},
+                ],
+                networks=None,
+                volumes=None,
+                secrets=None,
+                configs=None,
+            ),
+        )
+
+    def test_up_recreates_namespace_dependents_with_their_owner(self):
+        self.namespace_project().up(detached=True)
+
+        project = self.namespace_project(db_environment={'DEBUG': '1'})
+        project.up(detached=True)
+
+        db, = project.get_service('db').containers()
+        web, = project.get_service('web').containers()
+        assert web.get('HostConfig.IpcMode') == 'container:' + db.id
+        assert web.get('HostConfig.PidMode') == 'container:' + db.id
+
+    def test_down_removes_namespace_dependents_first(self):
+        project = self.namespace_project()
+        project.up(detached=True)
+        services = {c.id: c.service for c in project.containers()}
+        del self.client.calls[:]
+
+        project.down(ImageType.none, include_volumes=False)
+
+        removed = [services[args[0]] for args, _ in self.client.called('remove_container')]
+        assert removed == ['web', 'db']
+
+    def test_up_waits_for_readiness_probe(self):
+        project = Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[
+                    {'name': 'db', 'image': 'busybox',
+                     'x-readiness': {'type': 'exec', 'command': 'pg_isready'}},
+                    {'name': 'web', 'image': 'busybox', 'depends_on': {
+                        'db': {'condition': 'service_healthy'},
+                    }},
+                ],
+                networks=None,
+                volumes=None,
+                secrets=None,
+                configs=None,
+            ),
+        )
+        project.up(detached=True)
+
+        assert [args[1] for args, _ in self.client.called('exec_create')] == ['pg_isready']
+        assert sorted(c.name for c in project.containers()) == ['app_db_1', 'app_web_1']
+
+    def build_project(self):
+        return Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[{'name': 'web', 'build': {'context': '.'}}],
+                networks=None,
+                volumes=None,
+                secrets=None,
+                configs=None,
+            ),
+        )
+
+    def test_up_prunes_images_replaced_by_rebuild(self):
+        project = self.build_project()
+        project.up(detached=True, do_build=BuildAction.force, cli=False)
+        previous = project.get_service('web').image_id()
+        unrelated = self.client.add_image('unrelated')['Id']
+        self.client.add_image('unrelated')
+
+        project.up(detached=True, do_build=BuildAction.force, cli=False, prune_dangling=True)
+
+        image_ids = [image['Id'] for image in self.client.images.values()]
+        assert previous not in image_ids
+        assert unrelated in image_ids
+        container, = project.containers()
+        assert container.image == project.get_service('web').image_id()
+
+    def test_built_image_labels_differ_from_container_labels(self):
+        project = self.build_project()
+        project.build(cli=False)
+
+        labels = project.get_service('web').image()['Config']['Labels']
+        assert (labels[LABEL_IMAGE_PROJECT], labels[LABEL_IMAGE_SERVICE]) == ('app', 'web')
+        # Containers inherit them
+        assert LABEL_PROJECT not in labels
+        assert LABEL_SERVICE not in labels
+
+    def test_build_keeps_replaced_image_in_use(self):
+        project = self.build_project()
+        project.up(detached=True, do_build=BuildAction.force, cli=False)
+        previous = project.get_service('web').image_id()
+
+        project.build(cli=False, prune_dangling=True)
+
+        assert previous in [image['Id'] for image in self.client.images.values()]
+        assert self.client.called('remove_image') == []
+
+    def named_network_project(self, network):
+        return Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[{'name': 'web', 'image': 'busybox', 'networks': {'backend': None}}],
+                networks={'backend': network},
+                volumes=None,
+                secrets=None,
+                configs=None,
+            ),
+        )
+
+    def test_networks_and_volumes_are_created_in_name_order(self):
+        project = Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[{
+                    'name': 'web',
+                    'image': 'busybox',
+                    'networks': {'front': None, 'back': None},
+                    'volumes': [VolumeSpec.parse('logs:/logs'), VolumeSpec.parse('data:/data')],
+                }],
+                networks={'front': {}, 'back': {}},
+                volumes={'logs': {}, 'data': {}},
+                secrets=None,
+                configs=None,
+            ),
+        )
+
+        project.up(detached=True)
+        assert [kwargs['name'] for _, kwargs in self.client.called('create_network')] == [
+            'app_back', 'app_front',
+        ]
+        assert [args[0] for args, _ in self.client.called('create_volume')] == [
+            'app_data', 'app_logs',
+        ]
+
+    def selective_project(self):
+        return Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[
+                    {'name': 'cache', 'image': 'busybox', 'networks': {'back': None}},
+                    {
+                        'name': 'db', 'image': 'busybox', 'network_mode': 'service:cache',
+                        'volumes': [VolumeSpec.parse('data:/data')],
+                    },
+                    {
+                        'name': 'web', 'image': 'busybox', 'networks': {'front': None},
+                        'depends_on': {'db': {'condition': 'service_started'}},
+                    },
+                    {
+                        'name': 'admin', 'image': 'busybox', 'networks': {'admin': None},
+                        'volumes': [VolumeSpec.parse('uploads:/uploads')],
+                    },
+                ],
+                networks={'front': {}, 'back': {}, 'admin': {}},
+                volumes={'data': {}, 'uploads': {}},
+                secrets=None,
+                configs=None,
+            ),
+        )
+
+    def test_up_selected_services_with_their_dependencies(self):
+        project = self.selective_project()
+
+        project.up(['web'], detached=True)
+
+        assert sorted(c.service for c in project.containers()) == ['cache', 'db', 'web']
+        assert sorted(kwargs['name'] for _, kwargs in self.client.called('create_network')) == [
+            'app_back', 'app_front',
+        ]
+        assert [args[0] for args, _ in self.client.called('create_volume')] == ['app_data']
+
+    def test_up_selected_services_without_dependencies(self):
+        project = self.selective_project()
+
+        with mock.patch('compose.project.log') as mock_log:
+            project.up(['web'], start_deps=False, detached=True)
+
+        assert [c.service for c in project.containers()] == ['web']
+        assert [kwargs['name'] for _, kwargs in self.client.called('create_network')] == [
+            'app_front',
+        ]
+        mock_log.warning.assert_called_once_with(
+            'Service "%s" depends on "%s", which is not running', 'web', 'db',
+        )
+
+    def test_up_unknown_service(self):
+        project = self.selective_project()
+
+        with pytest.raises(NoSuchService) as exc:
+            project.up(['wbe'], detached=True)
+
+        assert exc.value.msg == 'No such service: wbe (valid services: admin, cache, db, web)'
+        assert self.client.called('create_network') == []
+
+    def test_stop_selected_service_warns_about_running_dependents(self):
+        project = self.selective_project()
+        project.up(detached=True)
+
+        with mock.patch('compose.project.log') as mock_log:
+            project.stop(['db'])
+        mock_log.warning.assert_called_once_with(
+            'Service "%s" is running and depends on %s', 'web', '"db"',
+        )
+        assert sorted(c.service for c in project.containers()) == ['admin', 'cache', 'web']
+
+        with mock.patch('compose.project.log') as mock_log:
+            project.stop(['cache'], force=True)
+        mock_log.warning.assert_not_called()
+
+    def test_down_selected_services_keeps_shared_resources(self):
+        project = self.selective_project()
+        project.up(detached=True)
+
+        project.down(ImageType.none, include_volumes=True, service_names=['admin'])
+        assert sorted(c.service for c in project.containers(stopped=True)) == [
+            'cache', 'db', 'web',
+        ]
+        assert sorted(self.client.networks_by_name) == ['app_back', 'app_front']
+        assert sorted(self.client.volumes_by_name) == ['app_data']
+
+        project.down(ImageType.none, include_volumes=True, service_names=['web', 'db'], force=True)
+        assert [c.service for c in project.containers(stopped=True)] == ['cache']
+        assert sorted(self.client.networks_by_name) == ['app_back']
+        assert sorted(self.client.volumes_by_name) == []
+
+    def test_projects_with_different_separators_coexist(self):
+        def project(separator, scale):
+            return Project.from_config('app', build_config(
+                services=[{
+                    'name': 'web',
+                    'build': {'context': '.'},
+                    'scale': scale,
+                    'volumes': [VolumeSpec.parse('data:/data')],
+                }],
+                networks=None,
+                volumes={'data': {}},
+                secrets=None,
+                configs=None,
+            ), self.client, separator=separator)
+
+        underscored = project('_', 1)
+        assert underscored.get_service('web').image_name == 'app_web'
+        self.client.add_image('app_web')
+        underscored.up(detached=True)
+
+        dashed = project('-', 2)
+        assert dashed.get_service('web').image_name == 'app-web'
+        self.client.add_image('app-web')
+        dashed.up(detached=True, strategy=ConvergenceStrategy.never)
+
+        assert sorted(c.name for c in dashed.containers()) == ['app-web-2', 'app_web_1']
+        assert sorted(c.name_without_project for c in dashed.containers()) == [
+            'web-2', 'web_1',
+        ]
+        assert sorted(self.client.networks_by_name) == ['app_default']
+        assert sorted(self.client.volumes_by_name) == ['app_data']
+        assert dashed.networks.networks['default'].true_name == 'app_default'
+        assert dashed.volumes.volumes['data'].true_name == 'app_data'
+        assert sorted(c.name for c in underscored.ps()) == ['app-web-2', 'app_web_1']
+
+        dashed.down(ImageType.none, include_volumes=True)
+        assert self.client.containers(all=True) == []
+        assert self.client.networks_by_name == {}
+        assert self.client.volumes_by_name == {}
+
+        dashed = project('-', 1)
+        dashed.up(detached=True)
+        assert [c.name for c in dashed.containers()] == ['app-web-1']
+        assert sorted(self.client.networks_by_name) == ['app-default']
+        assert sorted(self.client.volumes_by_name) == ['app-data']
+
+    def test_ps_filters_and_sorts_containers(self):
+        project = Project.from_config('app', build_config(
+            services=[
+                {'name': 'web', 'image': 'busybox', 'scale': 2},
+                {'name': 'db', 'image': 'busybox'},
+            ],
+            networks=None,
+            volumes=None,
+            secrets=None,
+            configs=None,
+        ), self.client)
+        project.up(detached=True)
+        project.stop(service_names=['db'])
+
+        assert [c.name for c in project.ps()] == ['app_db_1', 'app_web_1', 'app_web_2']
+        assert [c.name for c in project.ps(sort='status')] == [
+            'app_db_1', 'app_web_1', 'app_web_2',
+        ]
+        assert [c.name for c in project.ps(statuses=['running'])] == ['app_web_1', 'app_web_2']
+        assert [c.name for c in project.ps(statuses=['stopped'])] == ['app_db_1']
+
+        project.start(service_names=['db'])
+        project.stop(service_names=['web'])
+        assert [c.name for c in project.ps(sort='status')] == [
+            'app_web_1', 'app_web_2', 'app_db_1',
+        ]
+        assert [c.name for c in project.ps(sort='replicas')] == [
+            'app_db_1', 'app_web_1', 'app_web_2',
+        ]
+
+        with pytest.raises(ProjectError):
+            project.ps(sort='age')
+        with pytest.raises(ProjectError):
+            project.ps(statuses=['up'])
+
+    def test_ps_filters_a_single_service_on_the_daemon(self):
+        project = Project.from_config('app', build_config(
+            services=[{'name': 'web', 'image': 'busybox'}, {'name': 'db', 'image': 'busybox'}],
+            networks=None,
+            volumes=None,
+            secrets=None,
+            configs=None,
+        ), self.client)
+        project.up(detached=True)
+        del self.client.calls[:]
+
+        assert [c.name for c in project.ps(['web'])] == ['app_web_1']
+        _, kwargs = self.client.called('containers')[0]
+        assert 'com.docker.compose.service=web' in kwargs['filters']['label']
+
+    def test_containers_with_stats(self):
+        project = Project.from_config('app', build_config(
+            services=[{'name': 'web', 'image': 'busybox'}, {'name': 'db', 'image': 'busybox'}],
+            networks=None,
+            volumes=None,
+            secrets=None,
+            configs=None,
+        ), self.client)
+        project.up(detached=True)
+        db_id = project.get_service('db').get_container().id
+
+        def stats(container, stream=True):
+            if container == db_id:
+                raise NotFound('gone')
+            return {'cpu_stats': {'cpu_usage': {'total_usage': 42}}, 'pids_stats': {'current': 2}}
+
+        self.client.stats = mock.Mock(side_effect=stats)
+        assert all(c.stats == NO_STATS for c in project.containers())
+        self.client.stats.assert_not_called()
+
+        containers = {c.service: c for c in project.containers(with_stats=True)}
+        assert containers['web'].stats.populated
+        assert (containers['web'].stats.cpu_time, containers['web'].stats.pids_current) == (42, 2)
+        assert containers['db'].stats == NO_STATS
+
+    def test_plan_then_apply(self):
+        def project(image):
+            return Project.from_config('app', build_config(
+                services=[
+                    {'name': 'db', 'image': 'busybox'},
+                    {'name': 'web', 'image': image, 'depends_on': {
+                        'db': {'condition': 'service_started'},
+                    }},
+                ],
+                networks=None,
+                volumes=None,
+                secrets=None,
+                configs=None,
+            ), self.client, notify=events.append)
+
+        events = []
+        first = project('busybox')
+        plan = first.plan()
+        assert [(step.service, step.action) for step in plan.steps] == [
+            ('db', 'create'), ('web', 'create'),
+        ]
+        assert plan.state == {}
+        assert not self.client.called('create_container')
+
+        first.apply(Plan.from_json(plan.to_json()))
+        assert len(self.client.called('create_container')) == 2
+        assert [(e.name, e.action) for e in events if e.kind == 'service'] == [
+            ('db', 'create'), ('web', 'create'),
+        ]
+
+        with pytest.raises(PlanDriftError) as excinfo:
+            first.apply(plan)
+        assert 'was created' in excinfo.value.msg
+        assert len(self.client.called('create_container')) == 2
+
+        second = project('nginx')
+        plan = second.plan()
+        assert [(step.service, step.action) for step in plan.steps] == [
+            ('db', 'noop'), ('web', 'recreate'),
+        ]
+        assert not first.plan().changes
+        with pytest.raises(PlanDriftError) as excinfo:
+            first.apply(plan)
+        assert excinfo.value.differences == [
+            'the configuration of the project changed',
+            'the configuration or image of service web changed',
+        ]
+
+        second.apply(plan)
+        assert len(self.client.called('create_container')) == 3
+        assert not second.plan().changes
+
+    def test_container_environment(self):
+        project = Project.from_config('app', build_config(
+            services=[{
+                'name': 'web',
+                'image': 'busybox',
+                'environment': {
+                    'DATABASE_URL': 'postgres://db/app',
+                    'DB_PASSWORD': 'hunter2',
+                    'API_TOKEN': '',
+                },
+            }],
+            networks=None,
+            volumes=None,
+            secrets=None,
+            configs=None,
+        ), self.client)
+        with pytest.raises(ValueError):
+            project.container_environment('web')
+
+        project.up(detached=True)
+
+        assert project.container_environment('web') == {
+            'DATABASE_URL': 'postgres://db/app',
+            'DB_PASSWORD': '********',
+            'API_TOKEN': '',
+            'COMPOSE_REPLICA_INDEX': '1',
+        }
+        assert project.container_environment('web', show_secrets=True)['DB_PASSWORD'] == 'hunter2'
+        with pytest.raises(ValueError):
+            project.container_environment('web', number=2)
+
+    def test_wait_for_probes_each_container_of_the_service(self):
+        project = Project.from_config('app', build_config(
+            services=[{'name': 'web', 'image': 'busybox', 'scale': 2}],
+            networks=None,
+            volumes=None,
+            secrets=None,
+            configs=None,
+        ), self.client)
+        target = Target('http', 80, '/health')
+        sleep = mock.Mock()
+        with mock.patch('compose.project.check_target', autospec=True) as check_target:
+            with pytest.raises(WaitTimeoutError) as excinfo:
+                project.wait_for('web', target, 0, sleep=sleep)
+            assert 'web has no running container' in excinfo.value.msg
+            check_target.assert_not_called()
+
+            project.up(detached=True)
+            with mock.patch('compose.project.probe_address', autospec=True) as probe_address:
+                probe_address.return_value = ('172.17.0.2', 80)
+                check_target.side_effect = [ProbeError('refused'), None, None, None]
+                project.wait_for('web', target, 60, sleep=sleep)
+
+        assert check_target.call_count == 3
+        check_target.assert_called_with('172.17.0.2', target, DIAL_TIMEOUT)
+        sleep.assert_called_once_with(0.1)
+
+    def test_down_resumes_after_an_interruption(self):
+        project = Project.from_config('app', build_config(
+            services=[
+                {'name': 'db', 'image': 'busybox'},
+                {
+                    'name': 'web', 'image': 'busybox',
+                    'depends_on': {'db': {'condition': 'service_started'}},
+                },
+                {'name': 'worker', 'image': 'busybox', 'scale': 2},
+            ],
+            networks=None,
+            volumes=None,
+            secrets=None,
+            configs=None,
+        ), self.client)
+        project.up(detached=True)
+        remove_container = self.client.remove_container
+        calls = []
+
+        def interrupted(container, **kwargs):
+            # A concurrent `down` removes the container of the first call,
+            # then this one is interrupted
+            calls.append(container)
+            if len(calls) == 1:
+                remove_container(container, **kwargs)
+            raise ShutdownException()
+
+        with mock.patch.object(self.client, 'remove_container', side_effect=interrupted):
+            with pytest.raises(ShutdownException):
+                project.down(ImageType.none, include_volumes=False)
+        assert 0 < len(self.client.containers(all=True)) < 4
+        assert self.client.inspect_network('app_default')
+
+        # The Compose file is gone: the project is rebuilt from what is left
+        Project.from_containers('app', self.client).down(ImageType.none, include_volumes=False)
+        assert self.client.containers(all=True) == []
+        assert self.client.networks(names=['app_default']) == []
+
+    def test_from_containers_without_containers_removes_the_networks_left(self):
+        project = Project.from_config('app', build_config(
+            services=[{'name': 'web', 'image': 'busybox'}],
+            networks=None,
+            volumes=None,
+            secrets=None,
+            configs=None,
+        ), self.client)
+        project.up(detached=True)
+        project.kill()
+        project.remove_stopped(one_off=OneOffFilter.include)
+
+        leftover = Project.from_containers('app', self.client)
+        assert leftover.services == []
+        assert list(leftover.networks.networks) == ['default']
+        leftover.down(ImageType.none, include_volumes=False)
+        assert self.client.networks(names=['app_default']) == []
+
+    def test_down_treats_containers_removed_meanwhile_as_removed(self):
+        project = Project.from_config('app', build_config(
+            services=[{'name': 'web', 'image': 'busybox', 'scale': 2}],
+            networks=None,
+            volumes=None,
+            secrets=None,
+            configs=None,
+        ), self.client)
+        project.up(detached=True)
+        containers = project.containers()
+        stop = self.client.stop
+
+        def stop_and_remove(container, **kwargs):
+            stop(container, **kwargs)
+            self.client.remove_container(container)
+
+        with mock.patch.object(self.client, 'stop', side_effect=stop_and_remove):
+            with mock.patch('compose.parallel.ParallelStreamWriter.write') as write:
+                project.down(ImageType.none, include_volumes=False)
+
+        assert 'error' not in [call[0][2] for call in write.call_args_list]
+        assert self.client.containers(all=True) == []
+        assert len(self.client.called('stop')) == len(containers)
+
+    def test_up_image_hook_blocks_rejected_services_and_their_dependents(self):
+        events = []
+        project = Project.from_config('app', build_config(
+            services=[
+                {'name': 'db', 'image': 'postgres'},
+                {
+                    'name': 'web', 'image': 'busybox',
+                    'depends_on': {'db': {'condition': 'service_started'}},
+                },
+                {'name': 'cache', 'image': 'redis'},
+            ],
+            networks=None,
+            volumes=None,
+            secrets=None,
+            configs=None,
+        ), self.client, notify=events.append)
+        checked = []
+
+        def hook(service, image_ref, image_id):
+            checked.append((service, image_ref, image_id))
+            if image_ref == 'postgres':
+                raise Exception('2 critical vulnerabilities')
+
+        with pytest.raises(ProjectError):
+            project.up(detached=True, image_hook=hook)
+
+        assert sorted(service for service, _, _ in checked) == ['cache', 'db', 'web']
+        assert ('db', 'postgres', self.client.inspect_image('postgres')['Id']) in checked
+        assert [c.service for c in project.containers()] == ['cache']
+        assert ('postgres', 'rejected') in [(e.name, e.action) for e in events]
+
+        with pytest.raises(ProjectError) as excinfo:
+            project.pull(image_hook=hook)
+        assert excinfo.value.msg == (
+            'Image postgres of service db was rejected: 2 critical vulnerabilities'
+        )
+
+    def test_set_healthcheck_until_the_next_up(self):
+        project = Project.from_config('app', build_config(
+            services=[{
+                'name': 'web', 'image': 'busybox', 'scale': 2,
+                'healthcheck': {'test': ['CMD', 'true']},
+                'labels': {'team': 'web'},
+            }],
+            networks=None,
+            volumes=None,
+            secrets=None,
+            configs=None,
+        ), self.client)
+        project.up(detached=True)
+        web = project.get_service('web')
+        web.get_container(2).stop()
+
+        containers = project.set_healthcheck('web', {'test': 'curl -f localhost', 'interval': '2s'})
+        assert [c.number for c in containers] == [1, 2]
+        assert [c.is_running for c in web.containers(stopped=True)] == [True, False]
+        for container in web.containers(stopped=True):
+            assert container.get('Config.Healthcheck') == {
+                'test': 'curl -f localhost', 'interval': 2000000000,
+            }
+            assert LABEL_HEALTHCHECK_OVERRIDE in container.labels
+            assert LABEL_CONFIG_HASH not in container.labels
+            assert container.labels['team'] == 'web'
+
+        project.set_healthcheck('web', None)
+        assert web.get_container(1).get('Config.Healthcheck') == {'test': ['NONE']}
+
+        with mock.patch('compose.service.log') as log:
+            project.up(detached=True)
+        log.info.assert_any_call('Restoring the healthcheck of the Compose file for app_web_1')
+        for container in web.containers(stopped=True):
+            assert container.get('Config.Healthcheck') == {'test': ['CMD', 'true']}
+            assert LABEL_HEALTHCHECK_OVERRIDE not in container.labels
+
+    def test_set_healthcheck_rejects_an_invalid_one(self):
+        project = Project.from_config('app', build_config(
+            services=[{'name': 'web', 'image': 'busybox'}],
+            networks=None,
+            volumes=None,
+            secrets=None,
+            configs=None,
+        ), self.client)
+        with pytest.raises(ConfigurationError):
+            project.set_healthcheck('web', {'test': []})
+
+    def test_projects_share_a_network_that_neither_removes(self):
+        def project(name, service):
+            return Project.from_config(name, build_config(
+                services=[{'name': service, 'image': 'busybox', 'networks': {'bus': None}}],
+                networks={'bus': {'x-shared': True}},
+                volumes=None,
+                secrets=None,
+                configs=None,
+            ), self.client)
+
+        api = project('api', 'web')
+        worker = project('worker', 'job')
+        api.up(detached=True)
+        worker.up(detached=True)
+        assert len(self.client.called('create_network')) == 1
+        assert self.client.inspect_network('bus')['Labels'] == {}
+
+        api.down(ImageType.none, include_volumes=False)
+        assert self.client.inspect_network('bus')
+        assert 'bus' in worker.get_service('job').get_container().get('NetworkSettings.Networks')
+
+        worker.down(ImageType.none, include_volumes=False)
+        assert self.client.inspect_network('bus')
+        assert Project.from_containers('api', self.client).networks.networks == {}
+
+    def test_up_and_down_adopt_containers_of_another_compose_implementation(self):
+        # As Compose v2 creates them: same labels, other names and hashes
+        legacy = self.client.create_container('busybox', name='app-web-1', labels={
+            LABEL_PROJECT: 'app',
+            LABEL_SERVICE: 'web',
+            LABEL_CONTAINER_NUMBER: '1',
+            LABEL_ONE_OFF: 'False',
+            LABEL_CONFIG_HASH: 'computed-differently',
+            LABEL_VERSION: '2.20.0',
+        })['Id']
+        self.client.start(legacy)
+        project = Project.from_config('app', build_config(
+            services=[{'name': 'web', 'image': 'busybox'}],
+            networks=None,
+            volumes=None,
+            secrets=None,
+            configs=None,
+        ), self.client)
+
+        container, = project.up(detached=True)
+        assert container.id != legacy
+        assert container.name == 'app_web_1'
+        assert list(self.client.containers_by_id) == [container.id]
+
+        project.down(ImageType.none, include_volumes=False)
+        assert self.client.containers_by_id == {}
+
+    def test_up_refuses_features_the_daemon_lacks(self):
+        client = FakeDockerClient(images=['busybox'], version='1.30')
+        project = Project.from_config('app', build_config(
+            services=[
+                {'name': 'db', 'image': 'busybox', 'init': True},
+                {'name': 'web', 'image': 'busybox', 'platform': 'linux/amd64'},
+            ],
+            networks=None,
+            volumes=None,
+            secrets=None,
+            configs=None,
+        ), client)
+
+        with pytest.raises(UnsupportedFeatureError) as excinfo:
+            project.up(detached=True)
+        assert excinfo.value.msg.endswith(
+            'service web requires daemon API >= 1.35 for platform selection'
+        )
+        assert client.called('create_network') == []
+
+        project.up(service_names=['db'], detached=True)
+        assert project.get_service('db').get_container().is_running
+
+    def test_up_warns_about_adopted_networks_and_volumes(self):
+        self.client.create_network('app_default')
+        self.client.create_volume('app_data')
+        config_data = build_config(
+            services=[{
+                'name': 'web', 'image': 'busybox',
+                'volumes': [VolumeSpec.parse('data:/data')],
+            }],
+            networks=None,
+            volumes={'data': {}},
+            secrets=None,
+            configs=None,
+        )
+
+        project = Project.from_config('app', config_data, self.client)
+        with mock.patch('compose.warning.log') as mock_log:
+            project.up(detached=True)
+        messages = [call[0][0] for call in mock_log.warning.call_args_list]
+        assert len(messages) == 2
+        assert 'Network "app_default" already exists' in messages[0]
+        assert 'Volume "app_data" already exists' in messages[1]
+
+        project = Project.from_config(
+            'app', config_data, self.client, warnings=Warnings([LABEL_ADOPTION]),
+        )
+        with mock.patch('compose.warning.log') as mock_log:
+            project.up(detached=True)
+        assert not mock_log.warning.called
+
+    def test_connect_and_disconnect_network(self):
+        project = Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[{'name': 'web', 'image': 'busybox'}],
+                networks={'debug': {}},
+                volumes=None,
+                secrets=None,
+                configs=None,
+            ),
+        )
+        project.up(detached=True)
+        self.client.create_network('shared')
+        web, = project.containers()
+
+        def aliases():
+            networks = web.inspect()['NetworkSettings']['Networks']
+            return {name: networks[name]['Aliases'][:-1] for name in networks}
+
+        project.connect_network('web', 'debug', aliases=['web-debug'])
+        project.connect_network('web', 'shared')
+        assert 'app_debug' in self.client.networks_by_name
+        assert aliases() == {
+            'app_default': ['web'], 'app_debug': ['web', 'web-debug'], 'shared': ['web'],
+        }
+
+        project.connect_network('web', 'debug', aliases=['tools'])
+        assert aliases()['app_debug'] == ['web', 'tools']
+        with pytest.raises(ProjectError):
+            project.connect_network('web', 'missing')
+
+        project.disconnect_network('web', 'debug')
+        project.disconnect_network('web', 'shared')
+        with pytest.raises(ProjectError):
+            project.disconnect_network('web', 'default')
+        assert list(aliases()) == ['app_default']
+
+        project.disconnect_network('web', 'default', force=True)
+        assert aliases() == {}
+
+    def test_connect_network_keeps_the_addresses_of_a_connected_container(self):
+        project = Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[{
+                    'name': 'web', 'image': 'busybox',
+                    'networks': {
+                        'front': {'ipv4_address': '172.16.0.10', 'aliases': ['www']},
+                    },
+                }],
+                networks={'front': {}},
+                volumes=None,
+                secrets=None,
+                configs=None,
+            ),
+        )
+        project.up(detached=True)
+        web, = project.containers()
+
+        project.connect_network('web', 'front', aliases=['tools', 'www'])
+
+        endpoint = web.inspect()['NetworkSettings']['Networks']['app_front']
+        assert endpoint['Aliases'] == ['web', 'www', 'tools', web.short_id]
+        assert endpoint['IPAMConfig'] == {'IPv4Address': '172.16.0.10'}
+
+    def test_external_network_with_different_name(self):
+        self.client.create_network('company-shared-net')
+        project = self.named_network_project({'external': True, 'name': 'company-shared-net'})
+
+        project.up(detached=True)
+        web, = project.containers()
+        assert list(web.get('NetworkSettings.Networks')) == ['company-shared-net']
+        assert list(self.client.networks_by_name) == ['company-shared-net']
+
+        project.down(ImageType.none, include_volumes=False)
+        assert list(self.client.networks_by_name) == ['company-shared-net']
+        assert self.client.called('remove_network') == []
+
+    def test_missing_external_network_error_cites_its_name(self):
+        project = self.named_network_project({'external': True, 'name': 'company-shared-net'})
+
+        with pytest.raises(ConfigurationError) as exc:
+            project.up(detached=True)
+        assert 'Network company-shared-net declared as external' in exc.exconly()
+
+    def test_managed_network_with_different_name(self):
+        project = self.named_network_project({'name': 'custom-backend'})
+
+        project.up(detached=True)
+        web, = project.containers()
+        assert list(web.get('NetworkSettings.Networks')) == ['custom-backend']
+        assert list(self.client.networks_by_name) == ['custom-backend']
+
+        project.down(ImageType.none, include_volumes=False)
+        assert self.client.networks_by_name == {}
+
+    def named_volume_project(self, volume):
+        return Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[{
+                    'name': 'web',
+                    'image': 'busybox',
+                    'volumes': [VolumeSpec.parse('db:/var/lib/data')],
+                }],
+                networks=None,
+                volumes={'db': volume},
+                secrets=None,
+                configs=None,
+            ),
+        )
+
+    def check_named_volume(self, volume, volume_name, keep):
+        if volume.get('external'):
+            self.client.create_volume(volume_name)
+        project = self.named_volume_project(volume)
+
+        project.up(detached=True)
+        web, = project.containers()
+        assert web.get('HostConfig.Binds') == ['{}:/var/lib/data:rw'.format(volume_name)]
+        assert list(self.client.volumes_by_name) == [volume_name]
+
+        project.down(ImageType.none, include_volumes=True)
+        assert list(self.client.volumes_by_name) == ([volume_name] if keep else [])
+
+    def test_external_volume_with_name(self):
+        self.check_named_volume(
+            {'external': True, 'name': 'prod-db-data'}, 'prod-db-data', keep=True
+        )
+
+    def test_external_volume_without_name(self):
+        self.check_named_volume({'external': True, 'name': 'db'}, 'db', keep=True)
+
+    def test_managed_volume_with_name(self):
+        self.check_named_volume({'name': 'prod-db-data'}, 'prod-db-data', keep=False)
+
+    def test_managed_volume_without_name(self):
+        self.check_named_volume({}, 'app_db', keep=False)
+
+    def services_project(self, name, *service_names):
+        return Project.from_config(
+            name=name,
+            client=self.client,
+            config_data=build_config(
+                services=[{'name': s, 'image': 'busybox'} for s in service_names],
+                networks=None,
+                volumes=None,
+                secrets=None,
+                configs=None,
+            ),
+        )
+
+    def test_known_service_names_include_stopped_containers(self):
+        old = self.services_project('app', 'worker', 'db')
+        old.up(detached=True)
+        old.stop(service_names=['worker'])
+        self.services_project('other', 'cache').up(detached=True)
+        project = self.services_project('app', 'web', 'db')
+
+        del self.client.calls[:]
+        assert project.known_service_names() == ['db', 'web', 'worker']
+        assert [name for name, _, _ in self.client.calls] == ['containers']
+
+    def test_list_project_names(self):
+        self.services_project('web-app', 'web').up(detached=True)
+        stopped = self.services_project('api', 'api')
+        stopped.up(detached=True)
+        stopped.stop()
+        self.client.create_container('busybox', name='unrelated')
+
+        del self.client.calls[:]
+        assert list_project_names(self.client) == ['api', 'web-app']
+        assert [name for name, _, _ in self.client.calls] == ['containers']
+
+    def test_inspect_service(self):
+        self.client.images['busybox:latest']['RepoDigests'] = [
+            'registry.example.com/busybox@sha256:other',
+            'busybox@sha256:feed',
+        ]
+        project = self.services_project('app', 'web', 'db')
+        project.up(detached=True, scale_override={'web': 3})
+        project.stop(service_names=['web'])
+
+        summaries = project.inspect_service('web')
+        assert [(s.name, s.number, s.state) for s in summaries] == [
+            ('app_web_1', 1, 'exited'),
+            ('app_web_2', 2, 'exited'),
+            ('app_web_3', 3, 'exited'),
+        ]
+        assert {(s.image, s.image_digest) for s in summaries} == {('busybox', 'sha256:feed')}
+        assert summaries[0].config_hash == project.get_service('web').config_hash
+        assert json.loads(json.dumps([s.to_dict() for s in summaries]))[0]['networks'] == {
+            'app_default': None,
+        }
+
+    def test_develop_watch_rules(self):
+        rule = {'action': 'sync', 'path': '/app/src', 'target': '/src', 'ignore': ['*.pyc']}
+        project = Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[{
+                    'name': 'web',
+                    'image': 'busybox',
+                    'develop': {'watch': [rule]},
+                }],
+                networks=None,
+                volumes=None,
+                secrets=None,
+                configs=None,
+            ),
+        )
+
+        web = project.get_service('web')
+        assert web.watch_rules == [WatchRule('sync', '/app/src', '/src', ('*.pyc',))]
+        assert 'develop' not in web.options
+
+    def inject_ports_project(self, inject):
+        return Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[
+                    {
+                        'name': 'web',
+                        'image': 'busybox',
+                        'depends_on': {'db': {'condition': 'service_started'}},
+                        'environment': {'DEPENDENCY_DB_PORT_53_UDP_PORT': 'overridden'},
+                        'x-inject-ports': inject,
+                    },
+                    {
+                        'name': 'db',
+                        'image': 'busybox',
+                        'ports': ServicePort.parse('5432') + ServicePort.parse('8053:53/udp'),
+                    },
+                ],
+                networks=None,
+                volumes=None,
+                secrets=None,
+                configs=None,
+            ),
+        )
+
+    def test_inject_dependency_ports(self):
+        project = self.inject_ports_project(True)
+        project.up(detached=True)
+
+        db = project.get_service('db').get_container()
+        web = project.get_service('web').get_container()
+        published = db.get_local_port(5432).split(':')[1]
+        assert published != '5432'
+        env = web.environment
+        assert env['DEPENDENCY_DB_PORT_5432_TCP_PORT'] == published
+        assert env['DEPENDENCY_DB_PORT_53_UDP_PORT'] == 'overridden'
+
+    def test_injected_ports_follow_a_recreated_dependency(self):
+        project = self.inject_ports_project(True)
+        project.up(detached=True)
+        project.get_service('db').options['environment'] = {'POSTGRES_DB': 'app'}
+        project.up(detached=True)
+
+        db = project.get_service('db').get_container()
+        web = project.get_service('web').get_container()
+        published = db.get_local_port(5432).split(':')[1]
+        assert web.environment['DEPENDENCY_DB_PORT_5432_TCP_PORT'] == published
+
+    def test_injected_ports_follow_a_dependency_recreated_alone(self):
+        project = self.inject_ports_project(True)
+        project.up(detached=True)
+        project.up(['db'], start_deps=False, strategy=ConvergenceStrategy.always, detached=True)
+        project.up(detached=True)
+
+        db = project.get_service('db').get_container()
+        web = project.get_service('web').get_container()
+        published = db.get_local_port(5432).split(':')[1]
+        assert web.environment['DEPENDENCY_DB_PORT_5432_TCP_PORT'] == published
+
+    def test_dependency_ports_are_not_injected_by_default(self):
+        project = self.inject_ports_project(False)
+        project.up(detached=True)
+
+        web = project.get_service('web').get_container()
+        assert 'DEPENDENCY_DB_PORT_5432_TCP_PORT' not in web.environment
+
+    def platform_project(self, **options):
+        self.client.images['busybox:latest'].update({'Os': 'linux', 'Architecture': 'arm64'})
+        return Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[dict(name='web', image='busybox', **options)],
+                networks=None,
+                volumes=None,
+                secrets=None,
+                configs=None,
+            ),
+        )
+
+    def test_up_warns_about_image_platform_mismatch(self):
+        project = self.platform_project()
+
+        with mock.patch('compose.warning.log') as mock_log:
+            project.up(detached=True)
+
+        message = mock_log.warning.call_args[0][0]
+        assert 'Image busybox of service web is for linux/arm64' in message
+        assert 'the Docker daemon runs on linux/amd64' in message
+        assert project.get_service('web').get_container().is_running
+
+    def test_up_ignores_platform_mismatch_warnings(self):
+        project = self.platform_project()
+        project.warnings = Warnings([PLATFORM_MISMATCH])
+
+        with mock.patch('compose.warning.log') as mock_log:
+            project.up(detached=True)
+
+        assert not mock_log.warning.called
+        assert 'platform-mismatch' in mock_log.debug.call_args[0]
+
+    def test_up_with_strict_platform_refuses_mismatched_image(self):
+        project = self.platform_project()
+
+        with pytest.raises(ImagePlatformMismatchError):
+            project.up(detached=True, strict_platform=True)
+        assert self.client.containers_by_id == {}
+
+    def test_explicit_platform_is_not_checked(self):
+        project = self.platform_project(platform='linux/arm64')
+
+        project.up(detached=True, strict_platform=True)
+        assert project.get_service('web').get_container().is_running
+
+    def test_image_for_another_platform_is_pulled(self):
+        project = self.platform_project(platform='linux/amd64')
+
+        project.up(detached=True)
+        (_, kwargs), = self.client.called('pull')
+        assert kwargs['platform'] == 'linux/amd64'
+        image = self.client.images['busybox:latest']
+        assert (image['Os'], image['Architecture']) == ('linux', 'amd64')
+
+        project.up(detached=True)
+        assert len(self.client.called('pull')) == 1
+
+    def pull_project(self, **options):
+        return Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[dict(name='web', image='busybox', **options)],
+                networks=None,
+                volumes=None,
+                secrets=None,
+                configs=None,
+            ),
+        )
+
+    def build_order_project(self, context, base_build_depends_on=None):
+        def write(name, content):
+            with open(os.path.join(context, name), 'w') as f:
+                f.write(content)
+
+        write('base.Dockerfile', 'FROM busybox\n')
+        write('app.Dockerfile', 'ARG BASE=app_base\nFROM ${BASE}\n')
+        write('tools.Dockerfile', 'FROM busybox\n')
+        base = {'name': 'base', 'image': 'app_base', 'build': {
+            'context': context, 'dockerfile': 'base.Dockerfile',
+        }}
+        if base_build_depends_on:
+            base['x-build-depends-on'] = base_build_depends_on
+        return Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[
+                    {
+                        'name': 'tools', 'image': 'app_tools', 'x-build-depends-on': ['app'],
+                        'build': {'context': context, 'dockerfile': 'tools.Dockerfile'},
+                    },
+                    {'name': 'app', 'image': 'app_app', 'build': {
+                        'context': context, 'dockerfile': 'app.Dockerfile',
+                    }},
+                    base,
+                ],
+                networks=None,
+                volumes=None,
+                secrets=None,
+                configs=None,
+            ),
+        )
+
+    def test_build_in_build_dependency_order(self):
+        with tempfile.TemporaryDirectory() as context:
+            project = self.build_order_project(context)
+
+            assert project.get_build_dependencies(project.services) == {
+                'tools': {'app'}, 'app': {'base'}, 'base': set(),
+            }
+            project.build(silent=True)
+            project.build(silent=True, parallel_build=True)
+
+        assert [kwargs['tag'] for _, kwargs in self.client.called('build')] == [
+            'app_base', 'app_app', 'app_tools',
+        ] * 2
+
+    def test_build_dependency_cycle(self):
+        with tempfile.TemporaryDirectory() as context:
+            project = self.build_order_project(context, base_build_depends_on=['tools'])
+
+            with pytest.raises(DependencyError) as exc:
+                project.build(silent=True)
+
+        assert exc.value.msg == (
+            'Circular build dependency between services: app -> base -> tools -> app'
+        )
+        assert self.client.called('build') == []
+
+    def test_up_offline_never_pulls(self):
+        project = self.pull_project(pull_policy='always')
+
+        project.up(detached=True, offline=True)
+
+        assert self.client.called('pull') == []
+        assert [c.name for c in project.containers()] == ['app_web_1']
+
+    def test_up_offline_reports_missing_images_first(self):
+        project = Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[
+                    {'name': 'db', 'image': 'postgres'},
+                    {'name': 'cache', 'image': 'redis'},
+                    {'name': 'web', 'image': 'busybox'},
+                    {'name': 'app', 'image': 'app', 'build': {'context': '.'}},
+                ],
+                networks=None,
+                volumes=None,
+                secrets=None,
+                configs=None,
+            ),
+        )
+
+        with pytest.raises(OfflineImagesMissingError) as exc:
+            project.up(detached=True, offline=True)
+
+        assert exc.value.images == ['postgres', 'redis']
+        assert self.client.called('pull') == []
+        assert self.client.called('create_container') == []
+
+    def test_warm_cache_pulls_images_and_build_caches(self):
+        project = Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[
+                    {'name': 'db', 'image': 'postgres:13'},
+                    {'name': 'worker', 'image': 'postgres:13'},
+                    {
+                        'name': 'app', 'image': 'app',
+                        'build': {'context': '.', 'cache_from': ['app:cache', 'app:base']},
+                    },
+                ],
+                networks=None,
+                volumes=None,
+                secrets=None,
+                configs=None,
+            ),
+        )
+
+        assert project.warm_cache() == ['app:base', 'app:cache', 'postgres:13']
+        assert sorted(
+            '{}:{}'.format(args[0], kwargs['tag']) for args, kwargs in self.client.called('pull')
+        ) == ['app:base', 'app:cache', 'postgres:13']
+
+        project.up(detached=True, offline=True)
+        assert len(self.client.called('pull')) == 3
+
+    def test_pull_skips_up_to_date_image(self):
+        project = self.pull_project()
+        project.pull()
+        image_id = self.client.images['busybox:latest']['Id']
+
+        with mock.patch('compose.parallel.ParallelStreamWriter.write') as write:
+            project.pull()
+
+        assert len(self.client.called('pull')) == 1
+        assert self.client.images['busybox:latest']['Id'] == image_id
+        assert write.call_args[0][1:3] == ('web', 'up to date')
+
+    def test_pull_refreshes_stale_image(self):
+        project = self.pull_project()
+        project.pull()
+        image_id = self.client.images['busybox:latest']['Id']
+        self.client.registry['busybox:latest'] = 'sha256:' + 'f' * 64
+
+        with mock.patch('compose.parallel.ParallelStreamWriter.write') as write:
+            project.pull()
+
+        assert len(self.client.called('pull')) == 2
+        assert self.client.images['busybox:latest']['Id'] != image_id
+        assert write.call_args[0][1:3] == ('web', 'done (1 MB)')
+
+    def test_up_with_pull_refreshes_stale_image(self):
+        project = self.pull_project()
+        project.up(detached=True)
+        assert self.client.called('pull') == []
+
+        self.client.registry['busybox:latest'] = 'sha256:' + 'f' * 64
+        project.up(detached=True, pull=True)
+        assert len(self.client.called('pull')) == 1
+
+        project.up(detached=True, pull=True)
+        assert len(self.client.called('pull')) == 1
+
+    def test_up_summary(self):
+        self.client.daemon_info = {'MemTotal': 10 ** 9, 'NCPU': 4}
+        project = Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[
+                    {'name': 'web', 'image': 'nginx', 'mem_limit': '1g', 'cpus': 1.5},
+                    {'name': 'db', 'image': 'busybox'},
+                ],
+                networks=None,
+                volumes=None,
+                secrets=None,
+                configs=None,
+            ),
+        )
+
+        summary = project.up(detached=True, scale_override={'web': 2}).summary
+        assert (summary.created, summary.recreated, summary.started, summary.unchanged) == (
+            3, 0, 0, 0,
+        )
+        assert summary.images_pulled == 1
+        assert summary.pulled_bytes == self.client.images['nginx:latest']['Size']
+        assert summary.networks_created == ['default']
+        assert summary.volumes_created == []
+        assert summary.memory == 2 * 1024 ** 3
+        assert summary.cpus == 3.0
+        assert summary.exceeds_host_memory
+        assert not summary.exceeds_host_cpus
+
+        project.stop(service_names=['db'])
+        summary = project.up(detached=True, scale_override={'web': 2}).summary
+        assert (summary.created, summary.recreated, summary.started, summary.unchanged) == (
+            0, 0, 1, 2,
+        )
+        assert summary.images_pulled == 0
+        assert summary.networks_created == []
+
+        # Only the stopped container of the plan that starts `web` was started
+        self.client.stop(project.get_service('web').containers()[0].id)
+        summary = project.up(detached=True, scale_override={'web': 2}).summary
+        assert (summary.started, summary.unchanged) == (1, 2)
+
+        containers = project.up(
+            detached=True, strategy=ConvergenceStrategy.always, scale_override={'web': 2},
+        )
+        assert len(containers) == 3
+        assert (
+            containers.summary.created, containers.summary.recreated, containers.summary.unchanged,
+        ) == (0, 3, 0)
+
+    def external_project(self, external_container):
+        return Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[
+                    {'name': 'web', 'image': 'busybox', 'depends_on': {
+                        'db': {'condition': 'service_started'},
+                    }},
+                    {'name': 'db', 'x-external-container': external_container},
+                ],
+                networks=None,
+                volumes=None,
+                secrets=None,
+                configs=None,
+            ),
+        )
+
+    def test_up_adopts_external_container(self):
+        appliance = self.client.create_container('busybox', name='appliance')
+        self.client.start(appliance)
+        project = self.external_project('appliance')
+
+        containers = project.up(detached=True)
+        assert sorted(c.name for c in containers) == ['app_web_1', 'appliance']
+        created = [kwargs.get('name') for _, kwargs in self.client.called('create_container')]
+        assert created == ['appliance', 'app_web_1']
+
+        db = [c for c in project.ps() if c.name == 'appliance']
+        assert len(db) == 1
+        assert db[0].service == 'db'
+        assert db[0].external_service == 'db'
+        # Its dependents reach it by the name of the service
+        networks = self.client.inspect_container('appliance')['NetworkSettings']['Networks']
+        assert 'db' in networks['app_default']['Aliases']
+        project.up(detached=True)
+        assert [
+            args[1] for args, _ in self.client.called('connect_container_to_network')
+            if args[0] == appliance['Id']
+        ] == ['app_default']
+
+        project.down(ImageType.none, include_volumes=False)
+        assert self.client.inspect_container('appliance')['State']['Running']
+        assert [c.name for c in project.ps()] == ['appliance']
+
+    def test_up_fails_without_external_container(self):
+        project = self.external_project('appliance')
+        with pytest.raises(ExternalContainerError) as exc:
+            project.get_service('db').ensure_external_container()
+        assert exc.value.container == 'appliance'
+        assert exc.value.service == 'db'
+
+        with pytest.raises(ExternalContainerError):
+            project.up(detached=True)
+        assert self.client.called('create_network') == []
+        assert self.client.called('create_container') == []
+
+    def test_up_skips_optional_external_container(self):
+        project = self.external_project({'name': 'appliance', 'optional': True})
+        with mock.patch('compose.service.log') as log:
+            containers = project.up(detached=True)
+        assert [c.name for c in containers] == ['app_web_1']
+        assert 'appliance' in log.warning.call_args[0][0]
+
+    def test_reload(self):
+        self.project.up(detached=True, scale_override={'web': 2})
+
+        containers = self.project.reload(service_names=['web'], settle=0.01)
+        assert sorted(c.name for c in containers) == ['app_web_1', 'app_web_2']
+        assert sorted(
+            (args[0], kwargs['signal']) for args, kwargs in self.client.called('kill')
+        ) == sorted((c.id, 'SIGHUP') for c in containers)
+        assert all(c.is_running for c in self.project.containers())
+
+    def test_reload_reports_crashed_containers(self):
+        self.project.up(detached=True)
+        db = self.project.get_service('db').get_container()
+
+        def kill(container, signal=None):
+            self.client._set_state(container, 'exited', exit_code=1)
+        self.client.kill = kill
+
+        with pytest.raises(ReloadError) as exc:
+            self.project.reload(service_names=['db'], signal='SIGUSR1', settle=0.01)
+        assert exc.value.signal == 'SIGUSR1'
+        assert exc.value.exited == [(db.name, 1)]
+
+    def test_reload_reports_restarted_containers(self):
+        self.project.up(detached=True)
+        db = self.project.get_service('db').get_container()
+
+        def kill(container, signal=None):
+            # The container crashed and its restart policy started it again
+            data = self.client._set_state(container, 'running')
+            data['RestartCount'] = 1
+            data['State']['StartedAt'] = '2021-01-01T00:01:00Z'
+        self.client.kill = kill
+
+        with pytest.raises(ReloadError) as exc:
+            self.project.reload(service_names=['db'], settle=0.01)
+        assert exc.value.exited == []
+        assert exc.value.restarted == [db.name]
+        assert '{} was restarted'.format(db.name) in exc.value.msg
+
+    def test_reload_reports_signal_errors(self):
+        self.project.up(detached=True)
+        self.client.fail('kill', APIError('Conflict', explanation='Container is not running'))
+
+        with pytest.raises(ProjectError) as exc:
+            self.project.reload(service_names=['db'])
+        assert exc.value.msg == 'Could not reload app_db_1:\n    app_db_1: Container is not running'
+
+    def test_pull_policy_always_refreshes_stale_image(self):
+        project = self.pull_project(pull_policy='always')
+        self.client.registry['busybox:latest'] = 'sha256:' + 'f' * 64
+
+        project.up(detached=True)
+        assert len(self.client.called('pull')) == 1
+        assert self.client.images['busybox:latest']['RepoDigests'] == [
+            'busybox@sha256:' + 'f' * 64
+        ]
+
+    def test_resolved_config(self):
+        project = Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[
+                    {
+                        'name': 'web',
+                        'image': 'busybox',
+                        'labels': {'team': 'web'},
+                        'depends_on': {'db': {'condition': 'service_started'}},
+                        'volumes': [VolumeSpec.parse('data:/data')],
+                    },
+                    {'name': 'db', 'image': 'busybox', 'platform': 'linux/arm64'},
+                    {'name': 'debug', 'image': 'busybox', 'profiles': ['debug']},
+                ],
+                networks=None,
+                volumes={'data': {}},
+                secrets=None,
+                configs=None,
+            ),
+            tenant='blue',
+        )
+        project.services[0].scale_num = 2
+
+        resolved = project.resolved_config()
+        assert resolved['name'] == 'app'
+        assert list(resolved['services']) == ['web', 'db']
+
+        web = resolved['services']['web']
+        assert web['container_names'] == ['app_web_1', 'app_web_2']
+        assert web['network_mode'] == 'app_default'
+        assert list(web['networks']) == ['app_default']
+        assert web['volumes'] == [VolumeSpec.parse('app_data:/data')]
+        assert web['labels']['team'] == 'web'
+        assert web['labels'][LABEL_SERVICE] == 'web'
+        assert web['labels'][LABEL_TENANT] == 'blue'
+        assert web['labels'][LABEL_DEPENDS_ON] == 'db'
+        assert resolved['services']['db']['platform'] == 'linux/arm64'
+
+        assert resolved['networks']['default']['name'] == 'app_default'
+        assert resolved['networks']['default']['labels'][LABEL_TENANT] == 'blue'
+        assert resolved['volumes']['data']['name'] == 'app_data'
+        assert self.client.called('create_network') == []
+        assert self.client.called('create_volume') == []
+
+    def test_up_creates_containers_from_resolved_config(self):
+        web = self.project.get_service('web')
+        web.options['labels'] = {'team': 'web'}
+        resolved = web.resolved_config()
+
+        with mock.patch.object(web, 'resolved_config', wraps=web.resolved_config) as resolved_config:
+            self.project.up(['web'], detached=True)
+
+        assert resolved_config.called
+        container = web.get_container()
+        assert container.get('Config.Image') == resolved['image']
+        for label, value in resolved['labels'].items():
+            assert container.labels[label] == value
+
+    def tenant_project(self, tenant):
+        return Project.from_config(
+            name='app',
+            client=self.client,
+            config_data=build_config(
+                services=[{'name': 'web', 'image': 'busybox'}],
+                networks=None,
+                volumes={'data': {}},
+                secrets=None,
+                configs=None,
+            ),
+            tenant=tenant,
+        )
+
+    def test_tenant_labels_created_resources(self):
+        self.tenant_project('team-a').up(detached=True)
+
+        container, = self.client.containers_by_id.values()
+        assert container['Config']['Labels'][LABEL_TENANT] == 'team-a'
+        assert self.client.networks_by_name['app_default']['Labels'][LABEL_TENANT] == 'team-a'
+        assert self.client.volumes_by_name['app_data']['Labels'][LABEL_TENANT] == 'team-a'
+
+    def test_no_tenant_label_by_default(self):
+        self.project.up(detached=True)
+
+        for container in self.client.containers_by_id.values():
+            assert LABEL_TENANT not in container['Config']['Labels']
+        assert LABEL_TENANT not in self.client.networks_by_name['app_default']['Labels']
+        assert self.project.labels() == [
+            '{}=app'.format(LABEL_PROJECT),
+            '{}=False'.format(LABEL_ONE_OFF),
+        ]
+
+    def test_tenant_down_leaves_other_tenants_alone(self):
+        team_a = self.tenant_project('team-a')
+        team_b = self.tenant_project('team-b')
+        team_a.up(detached=True)
+
+        assert team_b.containers(stopped=True) == []
+        team_b.down(ImageType.none, include_volumes=True)
+
+        assert [c.name for c in team_a.containers()] == ['app_web_1']
+        assert 'app_default' in self.client.networks_by_name
+        assert 'app_data' in self.client.volumes_by_name
+
+    def test_tenant_up_refuses_other_tenants_network(self):
+        self.tenant_project('team-a').up(detached=True)
+
+        with pytest.raises(ConfigurationError) as exc:
+            self.tenant_project('team-b').up(detached=True)
+        assert 'belongs to another tenant' in exc.exconly()
+
+    def test_up_fails_on_injected_error(self):
+        self.client.fail('start', docker.errors.APIError('boom', explanation='boom'))
+
+        with pytest.raises(ProjectError):
+            self.project.up(detached=True)
+
+        assert self.project.containers() == []
+
+
+def test_find_container():
+    containers = [
+        Container(None, {'Id': 'abc', 'Name': '/app_web_1'}, has_been_inspected=True),
+        Container(None, {'Id': 'abcdef', 'Name': '/app_web_2'}, has_been_inspected=True),
+        Container(None, {'Id': 'fed', 'Name': '/abcd'}, has_been_inspected=True),
+    ]
+
+    assert find_container(containers, 'abc').name == 'app_web_1'
+    assert find_container(containers, 'abcd').id == 'fed'
+    assert find_container(containers, 'abcde').name == 'app_web_2'
+    assert find_container(containers, 'app_web_2').id == 'abcdef'
+    assert find_container(containers, 'web') is None
+
+    with pytest.raises(AmbiguousContainerIdentifier) as exc:
+        find_container(containers, 'ab')
+    assert exc.value.candidates == ['app_web_1', 'app_web_2']
+    assert exc.value.msg == '"ab" matches several containers: app_web_1, app_web_2'
@@ -0,0 +1,215 @@
+import json
+import re
+from urllib.parse import parse_qs
+from urllib.parse import urlparse
+
+import pytest
+from docker import auth
+
+from compose import config
+from compose.config import ConfigurationError
+from compose.config.config import Config
+from compose.config.environment import Environment
+from compose.errors import RegistryError
+from compose.publish import ARTIFACT_TYPE
+from compose.publish import blob_digest
+from compose.publish import fetch_project
+from compose.publish import load_publishable_config
+from compose.publish import parse_reference
+from compose.publish import publish
+from compose.testutil import FakeDockerClient
+
+
+class FakeResponse:
+
+    def __init__(self, status_code, content=b'', headers=None):
+        self.status_code = status_code
+        self.content = content
+        self.headers = headers or {}
+
+    @property
+    def text(self):
+        return self.content.decode('utf-8')
+
+    def json(self):
+        return json.loads(self.content)
+
+
+class FakeRegistrySession:
+    """An in-memory registry, served as a `requests.Session`. With
+    `credentials`, it only accepts requests with a token obtained with them.
+    """
+
+    def __init__(self, credentials=None):
+        self.credentials = credentials
+        self.blobs = {}
+        self.manifests = {}
+        self.uploads = 0
+        self.requests = []
+
+    def request(self, method, url, headers=None, data=None, params=None, auth=None):
+        self.requests.append((method, url))
+        url = urlparse(url)
+        if url.path == '/token':
+            if auth != self.credentials:
+                return FakeResponse(401)
+            return FakeResponse(200, json.dumps({'token': 'abc'}).encode('utf-8'))
+        if self.credentials and (headers or {}).get('Authorization') != 'Bearer abc':
+            return FakeResponse(401, headers={
+                'WWW-Authenticate': 'Bearer realm="https://auth.example.com/token",'
+                                    'service="registry.example.com"',
+            })
+
+        repository, kind, rest = re.match(r'/v2/(.+)/(blobs|manifests)/(.*)', url.path).groups()
+        key = (repository, rest)
+        if kind == 'manifests':
+            if method == 'PUT':
+                self.manifests[key] = data
+                return FakeResponse(201)
+            if key not in self.manifests:
+                return FakeResponse(404)
+            return FakeResponse(200, self.manifests[key])
+
+        if method == 'POST':
+            self.uploads += 1
+            return FakeResponse(202, headers={
+                'Location': '/v2/{}/blobs/uploads/{}?state=x'.format(repository, self.uploads),
+            })
+        if method == 'PUT':
+            digest = parse_qs(url.query)['digest'][0]
+            assert digest == blob_digest(data)
+            self.blobs[(repository, digest)] = data
+            return FakeResponse(201)
+        if key not in self.blobs:
+            return FakeResponse(404)
+        return FakeResponse(200, self.blobs[key])
+
+
+def config_data():
+    return Config(
+        config_version='2.4',
+        version='2.4',
+        services=[{'name': 'web', 'image': 'busybox:latest', 'command': 'top'}],
+        networks={},
+        volumes={},
+        secrets={},
+        configs={},
+    )
+
+
+def config_details(tmpdir, compose_file, env_file='PASSWORD=s3cret\n'):
+    tmpdir.join('docker-compose.yml').write(compose_file)
+    tmpdir.join('.env').write(env_file)
+    return config.find(str(tmpdir), None, Environment.from_env_file(str(tmpdir)))
+
+
+def test_parse_reference():
+    assert parse_reference('app') == ('docker.io', 'library/app', 'latest')
+    assert parse_reference('team/app:1.0') == ('docker.io', 'team/app', '1.0')
+    assert parse_reference('localhost:5000/app@sha256:abc') == (
+        'localhost:5000', 'app', 'sha256:abc'
+    )
+
+
+def test_publish_and_fetch_project(tmpdir):
+    env_file = tmpdir.join('source', '.env').ensure()
+    env_file.write('TAG=1.0\n')
+    session = FakeRegistrySession()
+    client = FakeDockerClient(images=['busybox'])
+
+    digest = publish(
+        client, config_data(), 'localhost:5000/team/app:1.0',
+        env_files=[str(env_file)],
+        image_digests={'web': 'busybox@sha256:1234'},
+        session=session,
+    )
+
+    manifest = session.manifests[('team/app', '1.0')]
+    assert digest == blob_digest(manifest)
+    assert json.loads(manifest)['artifactType'] == ARTIFACT_TYPE
+    assert session.requests[0] == (
+        'HEAD', 'http://localhost:5000/v2/team/app/blobs/' + blob_digest(b'{}')
+    )
+
+    target = tmpdir.mkdir('target')
+    project = fetch_project(client, 'localhost:5000/team/app:1.0', str(target), session=session)
+
+    assert project.name == 'app'
+    assert project.get_service('web').options['image'] == 'busybox@sha256:1234'
+    assert target.join('.env').read() == 'TAG=1.0\n'
+
+
+def test_publish_with_token_authentication():
+    session = FakeRegistrySession(credentials=('me', 'secret'))
+    client = FakeDockerClient()
+    client._auth_configs = auth.AuthConfig({'auths': {
+        'registry.example.com': {'username': 'me', 'password': 'secret'},
+    }})
+
+    publish(client, config_data(), 'registry.example.com/app', session=session)
+    assert ('app', 'latest') in session.manifests
+
+
+def test_publish_without_credentials_fails():
+    session = FakeRegistrySession(credentials=('me', 'secret'))
+
+    with pytest.raises(RegistryError) as excinfo:
+        publish(FakeDockerClient(), config_data(), 'registry.example.com/app', session=session)
+    assert 'registry.example.com/app' in excinfo.value.msg
+
+
+def test_fetch_an_image_fails(tmpdir):
+    session = FakeRegistrySession()
+    session.manifests[('app', 'latest')] = json.dumps({
+        'schemaVersion': 2,
+        'config': {'mediaType': 'application/vnd.oci.image.config.v1+json'},
+        'layers': [],
+    }).encode('utf-8')
+
+    with pytest.raises(RegistryError) as excinfo:
+        fetch_project(FakeDockerClient(), 'localhost:5000/app', str(tmpdir), session=session)
+    assert 'not a Compose application' in excinfo.value.msg
+
+
+def test_publish_leaves_env_values_out(tmpdir):
+    details = config_details(tmpdir, (
+        'version: "2.4"\n'
+        'services:\n'
+        '  web:\n'
+        '    image: busybox\n'
+        '    environment:\n'
+        '      PASSWORD: ${PASSWORD}\n'
+    ))
+    session = FakeRegistrySession()
+
+    publish(
+        FakeDockerClient(), load_publishable_config(details), 'localhost:5000/app',
+        session=session,
+    )
+
+    blobs = list(session.blobs.values())
+    assert not any(b's3cret' in blob for blob in blobs)
+    assert any(b'PASSWORD: ${PASSWORD}' in blob for blob in blobs)
+
+
+def test_publish_refuses_services_with_env_values(tmpdir):
+    tmpdir.join('web.env').write('TOKEN=abc\n')
+    details = config_details(tmpdir, (
+        'version: "2.4"\n'
+        'services:\n'
+        '  web:\n'
+        '    image: busybox\n'
+        '    env_file: web.env\n'
+        '  db:\n'
+        '    image: busybox\n'
+        '    environment:\n'
+        '      - PASSWORD\n'
+    ))
+
+    with pytest.raises(ConfigurationError) as excinfo:
+        load_publishable_config(details)
+    assert 'db, web' in excinfo.value.msg
+
+    config_data = load_publishable_config(details, with_env=True)
+    services = {service['name']: service for service in config_data.services}
+    assert services['db']['environment'] == {'PASSWORD': 's3cret'}
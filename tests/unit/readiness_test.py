@@ -0,0 +1,122 @@
+import socket
+
+import pytest
+
+from compose.config.types import ReadinessProbe
+from compose.errors import ReadinessCheckFailed
+from compose.readiness import probe_address
+from compose.readiness import ProbeError
+from compose.readiness import Readiness
+from tests import mock
+
+
+def make_container(ports=None, networks=None, base_url='http+docker://localhost',
+                   original_base_url=None):
+    client = mock.Mock(base_url=base_url, _original_base_url=original_base_url)
+    container = mock.Mock(id='abc123', client=client)
+    container.name = 'app_db_1'
+    container.get_local_port.side_effect = lambda port: (ports or {}).get(port)
+    container.get.return_value = networks
+    return container
+
+
+@pytest.fixture
+def listener():
+    server = socket.socket()
+    server.bind(('127.0.0.1', 0))
+    server.listen(1)
+    yield server.getsockname()[1]
+    server.close()
+
+
+def free_port():
+    s = socket.socket()
+    s.bind(('127.0.0.1', 0))
+    port = s.getsockname()[1]
+    s.close()
+    return port
+
+
+def test_probe_address_published_port():
+    container = make_container(ports={5432: '0.0.0.0:49153'})
+    assert probe_address(container, 5432) == ('127.0.0.1', 49153)
+
+
+def test_probe_address_remote_daemon():
+    container = make_container(ports={5432: '0.0.0.0:49153'}, base_url='https://10.0.0.5:2376')
+    assert probe_address(container, 5432) == ('10.0.0.5', 49153)
+
+
+def test_probe_address_tcp_daemon():
+    container = make_container(
+        ports={5432: '0.0.0.0:49153'},
+        base_url='http://10.0.0.5:2375',
+        original_base_url='tcp://10.0.0.5:2375',
+    )
+    assert probe_address(container, 5432) == ('10.0.0.5', 49153)
+
+
+def test_probe_address_ssh_daemon():
+    container = make_container(
+        ports={5432: '0.0.0.0:49153'},
+        base_url='http+docker://ssh',
+        original_base_url='ssh://deploy@build.example.com',
+    )
+    assert probe_address(container, 5432) == ('build.example.com', 49153)
+
+
+def test_probe_address_named_pipe():
+    container = make_container(
+        ports={5432: '0.0.0.0:49153'},
+        base_url='http+docker://localnpipe',
+        original_base_url='npipe:////./pipe/docker_engine',
+    )
+    assert probe_address(container, 5432) == ('127.0.0.1', 49153)
+
+
+def test_probe_address_unknown_daemon_host():
+    container = make_container(ports={5432: '0.0.0.0:49153'}, base_url='http+docker://ssh')
+    with pytest.raises(ProbeError):
+        probe_address(container, 5432)
+
+
+def test_probe_address_container_ip():
+    container = make_container(networks={'app_default': {'IPAddress': '172.18.0.2'}})
+    assert probe_address(container, 5432) == ('172.18.0.2', 5432)
+
+
+def test_tcp_probe_ready(listener):
+    readiness = Readiness(ReadinessProbe.parse({'type': 'tcp', 'port': 5432}))
+    container = make_container(ports={5432: '0.0.0.0:{}'.format(listener)})
+    assert readiness.is_ready(container)
+
+
+def test_tcp_probe_reports_last_error():
+    probe = ReadinessProbe.parse({'type': 'tcp', 'port': 5432, 'interval': 0, 'retries': 2})
+    readiness = Readiness(probe)
+    container = make_container(ports={5432: '0.0.0.0:{}'.format(free_port())})
+
+    assert not readiness.is_ready(container)
+    with pytest.raises(ReadinessCheckFailed) as exc:
+        readiness.is_ready(container)
+    assert 'Container "app_db_1" is not ready: dial tcp 127.0.0.1:' in exc.value.msg
+
+
+def test_probe_waits_for_interval():
+    readiness = Readiness(ReadinessProbe.parse({'type': 'tcp', 'port': 5432, 'interval': 60}))
+    check = mock.Mock(side_effect=ProbeError('connection refused'))
+
+    with mock.patch.dict('compose.readiness.CHECKS', {'tcp': check}):
+        assert not readiness.is_ready(make_container())
+        assert not readiness.is_ready(make_container())
+    assert check.call_count == 1
+
+
+def test_exec_probe():
+    readiness = Readiness(ReadinessProbe.parse({'type': 'exec', 'command': 'pg_isready'}))
+    container = make_container()
+    container.start_exec.return_value = b'accepting connections'
+    container.client.exec_inspect.return_value = {'ExitCode': 0}
+
+    assert readiness.is_ready(container)
+    container.create_exec.assert_called_once_with('pg_isready')
@@ -0,0 +1,105 @@
+import time
+
+import pytest
+from docker.errors import APIError
+from requests.exceptions import ConnectionError
+from requests.exceptions import ReadTimeout
+
+from ..helpers import build_config_data
+from compose.project import Project
+from compose.project import ProjectError
+from compose.retry import call_with_timeout
+from compose.retry import is_connection_reset
+from compose.retry import RetryingClient
+from compose.retry import RetryPolicy
+from compose.testutil import FakeDockerClient
+
+POLICY = RetryPolicy(timeout=5, retries=3, backoff=0)
+
+
+def connection_reset():
+    return ConnectionError(
+        'Connection aborted.', ConnectionResetError(104, 'Connection reset by peer')
+    )
+
+
+def build_project(client, policy=POLICY):
+    config_data = build_config_data(services=[{'name': 'web', 'image': 'busybox'}])
+    return Project.from_config('app', config_data, client, retry_policy=policy)
+
+
+class ResetAfterCreateClient(FakeDockerClient):
+    """Creates the container, then loses the connection before replying."""
+
+    resets = 1
+
+    def create_container(self, *args, **kwargs):
+        result = super().create_container(*args, **kwargs)
+        if self.resets:
+            self.resets -= 1
+            raise connection_reset()
+        return result
+
+
+def test_up_succeeds_despite_transient_failures():
+    client = FakeDockerClient(images=['busybox'])
+    client.fail('containers', ConnectionError('connection refused'), times=2)
+    client.fail('inspect_network', ReadTimeout('read timed out'), times=1)
+    client.fail('start', connection_reset(), times=1)
+
+    project = build_project(client)
+    project.up(detached=True)
+
+    web, = project.containers()
+    assert web.is_running
+    assert len(client.called('start')) == 2
+
+
+def test_container_created_before_a_reset_is_reused():
+    client = ResetAfterCreateClient(images=['busybox'])
+
+    project = build_project(client)
+    project.up(detached=True)
+
+    assert [c.name for c in project.containers()] == ['app_web_1']
+    assert len(client.containers_by_id) == 1
+
+
+def test_start_is_not_retried_on_other_errors():
+    client = FakeDockerClient(images=['busybox'])
+    client.fail('start', APIError('500 Server Error', explanation='no space left'), times=1)
+
+    with pytest.raises(ProjectError):
+        build_project(client).up(detached=True)
+    assert len(client.called('start')) == 1
+
+
+def test_create_without_name_is_not_retried():
+    client = ResetAfterCreateClient(images=['busybox'])
+
+    with pytest.raises(ConnectionError):
+        RetryingClient(client, POLICY).create_container('busybox')
+    assert len(client.called('create_container')) == 1
+    assert len(client.containers_by_id) == 1
+
+
+def test_retries_are_limited():
+    client = FakeDockerClient()
+    client.fail('version', ConnectionError('connection refused'))
+
+    with pytest.raises(ConnectionError):
+        RetryingClient(client, POLICY).version()
+    assert len(client.called('version')) == POLICY.retries + 1
+
+
+def test_call_with_timeout():
+    assert call_with_timeout(1, lambda x: x * 2, 21) == 42
+    with pytest.raises(ReadTimeout):
+        call_with_timeout(0.01, time.sleep, 1)
+
+
+def test_is_connection_reset():
+    assert is_connection_reset(connection_reset())
+    assert is_connection_reset(ConnectionResetError())
+    assert not is_connection_reset(ConnectionError('connection refused'))
+    assert not is_connection_reset(ReadTimeout('read timed out'))
@@ -1,19 +1,30 @@
+import io
+import json
+import os
+import shutil
+import tempfile
+import threading
+
 import docker
 import pytest
 from docker.constants import DEFAULT_DOCKER_API_VERSION
 from docker.errors import APIError
 from docker.errors import ImageNotFound
+from docker.errors import InvalidVersion
 from docker.errors import NotFound
 
 from .. import mock
 from .. import unittest
 from compose.config.errors import DependencyError
 from compose.config.types import MountSpec
+from compose.config.types import parse_mount_option
+from compose.config.types import ServiceHook
 from compose.config.types import ServicePort
 from compose.config.types import ServiceSecret
 from compose.config.types import VolumeFromSpec
 from compose.config.types import VolumeSpec
 from compose.const import API_VERSIONS
+from compose.const import IS_WINDOWS_PLATFORM
 from compose.const import LABEL_CONFIG_HASH
 from compose.const import LABEL_ONE_OFF
 from compose.const import LABEL_PROJECT
@@ -21,16 +32,26 @@ from compose.const import LABEL_SERVICE
 from compose.const import SECRETS_PATH
 from compose.const import WINDOWS_LONGPATH_PREFIX
 from compose.container import Container
+from compose.errors import ImageNotFoundError
 from compose.errors import OperationFailedError
+from compose.errors import PlatformNotSupportedError
+from compose.errors import PortInUseError
+from compose.image_pull import LayerProgress
 from compose.parallel import ParallelStreamWriter
 from compose.project import OneOffFilter
+from compose.service import allocate_port_ranges
+from compose.service import bind_target_kind
+from compose.service import bind_to_host_ip
 from compose.service import build_ulimits
 from compose.service import build_volume_binding
 from compose.service import BuildAction
+from compose.service import BuildError
 from compose.service import ContainerNetworkMode
+from compose.service import expand_hostname
 from compose.service import format_environment
 from compose.service import formatted_ports
 from compose.service import get_container_data_volumes
+from compose.service import ImageReference
 from compose.service import ImageType
 from compose.service import merge_volume_bindings
 from compose.service import NeedsBuildError
@@ -40,7 +61,7 @@ from compose.service import parse_repository_tag
 from compose.service import rewrite_build_path
 from compose.service import Service
 from compose.service import ServiceNetworkMode
-from compose.service import warn_on_masked_volume
+from compose.testutil import FakeDockerClient
 
 
 class ServiceTest(unittest.TestCase):
@@ -170,6 +191,27 @@ class ServiceTest(unittest.TestCase):
         assert self.mock_client.create_host_config.call_args[1]['mem_limit'] == 1000000000
         assert self.mock_client.create_host_config.call_args[1]['memswap_limit'] == 2000000000
 
+    def test_one_off_mounts(self):
+        self.mock_client.api_version = '1.30'
+        self.mock_client.create_host_config.return_value = {}
+        service = Service('foo', image='foo', client=self.mock_client)
+        service._get_container_create_options({'volumes': [
+            parse_mount_option('type=tmpfs,target=/cache,tmpfs-size=1k,tmpfs-mode=700'),
+            parse_mount_option('source=data,target=/data,volume-driver=nfs,volume-opt=addr=10.0.0.1'),
+        ]}, 1, one_off=True)
+
+        mounts = self.mock_client.create_host_config.call_args[1]['mounts']
+        assert sorted(mounts, key=lambda m: m['Target']) == [
+            {
+                'Type': 'tmpfs', 'Source': None, 'Target': '/cache', 'ReadOnly': None,
+                'TmpfsOptions': {'SizeBytes': 1024, 'Mode': 0o700},
+            },
+            {
+                'Type': 'volume', 'Source': 'data', 'Target': '/data', 'ReadOnly': None,
+                'VolumeOptions': {'DriverConfig': {'Name': 'nfs', 'Options': {'addr': '10.0.0.1'}}},
+            },
+        ]
+
     def test_self_reference_external_link(self):
         service = Service(
             name='foo',
@@ -269,6 +311,27 @@ class ServiceTest(unittest.TestCase):
         assert opts['hostname'] == 'name', 'hostname'
         assert opts['domainname'] == 'domain.tld', 'domainname'
 
+    def test_hostname_template(self):
+        self.mock_client.inspect_image.return_value = {'Id': 'abcd'}
+        service = Service(
+            'es',
+            project='search',
+            hostname='{service}-{replica}.{project}.local',
+            image='foo',
+            client=self.mock_client)
+        opts = service._get_container_create_options({}, 2)
+        assert opts['hostname'] == 'es-2.search.local'
+        assert 'COMPOSE_REPLICA_INDEX=2' in opts['environment']
+
+    def test_hostname_template_unknown_placeholder(self):
+        service = Service('es', hostname='es-{index}', image='foo', client=self.mock_client)
+        with pytest.raises(OperationFailedError) as excinfo:
+            service._get_container_create_options({}, 1)
+        assert excinfo.value.msg == (
+            'Service "es" has an invalid placeholder in hostname "es-{index}": index '
+            '(valid placeholders: {project}, {service}, {replica})'
+        )
+
     def test_split_domainname_weird(self):
         self.mock_client.api_version = '1.22'
         service = Service(
@@ -331,7 +394,7 @@ class ServiceTest(unittest.TestCase):
 
         assert opts['labels'][LABEL_CONFIG_HASH] == \
             '6da0f3ec0d5adf901de304bdc7e0ee44ec5dd7adb08aebc20fe0dd791d4ee5a8'
-        assert opts['environment'] == ['also=real']
+        assert opts['environment'] == ['COMPOSE_REPLICA_INDEX=1', 'also=real']
 
     def test_get_container_create_options_sets_affinity_with_binds(self):
         service = Service(
@@ -364,7 +427,9 @@ class ServiceTest(unittest.TestCase):
             previous_container=prev_container
         )
 
-        assert opts['environment'] == ['affinity:container==ababab']
+        assert opts['environment'] == [
+            'COMPOSE_REPLICA_INDEX=1', 'affinity:container==ababab',
+        ]
 
     def test_get_container_create_options_no_affinity_without_binds(self):
         service = Service('foo', image='foo', client=self.mock_client)
@@ -379,7 +444,7 @@ class ServiceTest(unittest.TestCase):
             {},
             1,
             previous_container=prev_container)
-        assert opts['environment'] == []
+        assert opts['environment'] == ['COMPOSE_REPLICA_INDEX=1']
 
     def test_get_container_not_found(self):
         self.mock_client.containers.return_value = []
@@ -419,8 +484,21 @@ class ServiceTest(unittest.TestCase):
             stream=True,
             platform=None)
 
+    def test_pull_image_reports_layer_progress(self):
+        self.mock_client.inspect_image.side_effect = ImageNotFound('no such image')
+        self.mock_client.pull.return_value = iter([json.dumps({
+            'status': 'Downloading', 'progressDetail': {'current': 1, 'total': 2}, 'id': 'a1b2',
+        }).encode('utf-8')])
+        service = Service('foo', client=self.mock_client, image='someimage')
+        progress = []
+
+        service.pull(silent=True, progress=progress.append)
+
+        assert progress == [LayerProgress('a1b2', 1, 2, 'Downloading')]
+
     @mock.patch('compose.service.log', autospec=True)
     def test_pull_image_digest(self, mock_log):
+        self.mock_client.inspect_image.side_effect = ImageNotFound('no such image')
         service = Service('foo', client=self.mock_client, image='someimage@sha256:1234')
         service.pull()
         self.mock_client.pull.assert_called_once_with(
@@ -430,6 +508,40 @@ class ServiceTest(unittest.TestCase):
             platform=None)
         mock_log.info.assert_called_once_with('Pulling foo (someimage@sha256:1234)...')
 
+    def test_pull_image_digest_present(self):
+        service = Service('foo', client=self.mock_client, image='someimage@sha256:1234')
+        service.pull()
+        assert not self.mock_client.pull.called
+        assert not self.mock_client.inspect_distribution.called
+
+    def test_pull_image_up_to_date(self):
+        self.mock_client.inspect_image.return_value = {
+            'Id': 'abcd', 'RepoDigests': ['someimage@sha256:1234'],
+        }
+        self.mock_client.inspect_distribution.return_value = {
+            'Descriptor': {'digest': 'sha256:1234'},
+        }
+        service = Service('foo', client=self.mock_client, image='someimage:sometag')
+        service.pull()
+        assert not self.mock_client.pull.called
+
+        self.mock_client.inspect_distribution.return_value = {
+            'Descriptor': {'digest': 'sha256:5678'},
+        }
+        service.pull()
+        assert self.mock_client.pull.called
+
+    def test_pull_image_on_a_daemon_without_distribution_inspection(self):
+        self.mock_client.inspect_image.return_value = {
+            'Id': 'abcd', 'RepoDigests': ['someimage@sha256:1234'],
+        }
+        self.mock_client.inspect_distribution.side_effect = InvalidVersion(
+            'inspect_distribution is not available for version < 1.30'
+        )
+        service = Service('foo', client=self.mock_client, image='someimage:sometag')
+        service.pull()
+        assert self.mock_client.pull.called
+
     @mock.patch('compose.service.log', autospec=True)
     def test_pull_image_with_platform(self, mock_log):
         self.mock_client.api_version = '1.35'
@@ -447,7 +559,7 @@ class ServiceTest(unittest.TestCase):
         service = Service(
             'foo', client=self.mock_client, image='someimage:sometag', platform='linux/arm'
         )
-        with pytest.raises(OperationFailedError):
+        with pytest.raises(PlatformNotSupportedError):
             service.pull()
 
     def test_pull_image_with_default_platform(self):
@@ -478,6 +590,19 @@ class ServiceTest(unittest.TestCase):
         new_container.start.assert_called_once_with()
         mock_container.remove.assert_called_once_with()
 
+    @mock.patch('compose.service.Container', autospec=True)
+    def test_recreate_container_renew_anonymous_volumes(self, _):
+        mock_container = mock.create_autospec(Container)
+        mock_container.full_slug = 'abcdefff1234'
+        service = Service('foo', client=self.mock_client, image='someimage')
+        service.image = lambda: {'Id': 'abc123'}
+
+        with mock.patch.object(service, 'create_container') as create_container:
+            service.recreate_container(mock_container, renew_anonymous_volumes=True)
+
+        assert create_container.call_args[1]['previous_container'] is None
+        mock_container.remove.assert_called_once_with(v=True)
+
     @mock.patch('compose.service.Container', autospec=True)
     def test_recreate_container_with_timeout(self, _):
         mock_container = mock.create_autospec(Container)
@@ -501,6 +626,64 @@ class ServiceTest(unittest.TestCase):
             "url:5000/repo", "sha256:digest", "@"
         )
 
+    def test_image_reference(self):
+        reference = ImageReference.parse('url:5000/repo:tag@sha256:digest')
+        assert reference == ('url:5000/repo', 'tag', 'sha256:digest')
+        assert reference.tagged and reference.digested
+        assert reference.pull_tag == 'sha256:digest'
+        assert str(reference) == 'url:5000/repo:tag@sha256:digest'
+        assert ImageReference.parse('repo@sha256:digest') == ('repo', None, 'sha256:digest')
+        assert ImageReference.parse('repo').pull_tag == 'latest'
+
+    def test_image_reference_familiar(self):
+        for image in ('busybox', 'busybox:latest', 'docker.io/library/busybox:latest'):
+            assert ImageReference.parse(image).familiar() == 'busybox'
+        assert ImageReference.parse('library/busybox:1.33').familiar() == 'busybox:1.33'
+        assert ImageReference.parse('url:5000/library/repo').familiar() == 'url:5000/library/repo'
+        assert ImageReference.parse('repo:tag@sha256:digest').familiar() == 'repo@sha256:digest'
+
+    def test_config_hash_ignores_equivalent_image_references(self):
+        self.mock_client.inspect_image.return_value = {'Id': 'abcd'}
+
+        def config_hash(image):
+            return Service('foo', image=image, client=self.mock_client).config_hash
+
+        assert config_hash('redis') == config_hash('docker.io/library/redis:latest')
+        assert config_hash('redis@sha256:1234') == config_hash('redis:6@sha256:1234')
+        assert config_hash('redis') != config_hash('redis:6')
+
+    def test_build_tag_without_digest(self):
+        service = Service(
+            'foo', client=self.mock_client, build={'context': '.'}, image='repo:1.0@sha256:1234'
+        )
+        assert service.build_tag == 'repo:1.0'
+
+        service = Service(
+            'foo', client=self.mock_client, build={'context': '.'}, image='repo@sha256:1234'
+        )
+        with pytest.raises(BuildError) as excinfo:
+            service.build_tag
+        assert 'repo:latest' in excinfo.value.reason
+
+    def test_push_digest_only_image(self):
+        service = Service(
+            'foo', client=self.mock_client, build={'context': '.'}, image='repo@sha256:1234'
+        )
+        with pytest.raises(OperationFailedError) as excinfo:
+            service.push()
+        assert 'Add a tag' in excinfo.value.msg
+
+        service.push(ignore_push_failures=True)
+        assert not self.mock_client.push.called
+
+    def test_push_tagged_image_with_digest(self):
+        self.mock_client.push.return_value = []
+        service = Service(
+            'foo', client=self.mock_client, build={'context': '.'}, image='repo:1.0@sha256:1234'
+        )
+        service.push()
+        self.mock_client.push.assert_called_once_with('repo', tag='1.0', stream=True)
+
     def test_create_container(self):
         service = Service('foo', client=self.mock_client, build={'context': '.'})
         self.mock_client.inspect_image.side_effect = [
@@ -532,6 +715,56 @@ class ServiceTest(unittest.TestCase):
 
         assert ex.value.msg == "Cannot create container for service foo: Test binary string explanation"
 
+    def test_create_container_image_not_found_error(self):
+        service = Service('foo', client=self.mock_client, image='missing:latest')
+        service.image = lambda: {'Id': 'abc123'}
+
+        self.mock_client.create_container.side_effect = ImageNotFound(
+            None, None, b'No such image: missing:latest'
+        )
+        with pytest.raises(ImageNotFoundError) as ex:
+            service.create_container()
+
+        assert ex.value.image == 'missing:latest'
+        assert ex.value.msg == (
+            'Cannot create container for service foo: No such image: missing:latest'
+        )
+
+    def test_start_port_in_use_error(self):
+        service = Service('foo', client=self.mock_client)
+        container = Container(self.mock_client, {'Id': 'abc123'})
+
+        self.mock_client.start.side_effect = APIError(
+            None, None,
+            b'driver failed programming external connectivity on endpoint foo_1 (abc): '
+            b'Bind for 0.0.0.0:8080 failed: port is already allocated'
+        )
+        with pytest.raises(PortInUseError) as ex:
+            service.start_container(container)
+
+        assert ex.value.port == 8080
+        assert ex.value.msg.startswith('Cannot start service foo: driver failed programming')
+
+        self.mock_client.start.side_effect = APIError(
+            None, None,
+            b'Error starting userland proxy: listen tcp4 0.0.0.0:5432: bind: address already in use'
+        )
+        with pytest.raises(PortInUseError) as ex:
+            service.start_container(container)
+
+        assert ex.value.port == 5432
+
+    def test_pull_image_not_found_error(self):
+        service = Service('foo', client=self.mock_client, image='missing')
+        self.mock_client.pull.side_effect = NotFound(
+            None, None, b'pull access denied for missing, repository does not exist'
+        )
+        with pytest.raises(ImageNotFoundError) as ex:
+            service.pull()
+
+        assert ex.value.image == 'missing'
+        assert ex.value.msg == 'pull access denied for missing, repository does not exist'
+
     def test_start_binary_string_error(self):
         service = Service('foo', client=self.mock_client)
         container = Container(self.mock_client, {'Id': 'abc123'})
@@ -550,6 +783,143 @@ class ServiceTest(unittest.TestCase):
                                "with driver failed programming external connectivity"
         mock_log.warn.assert_called_once_with("Host is already in use by another container")
 
+    def test_start_missing_init_binary_error(self):
+        service = Service('foo', client=self.mock_client, init=True)
+        container = Container(self.mock_client, {'Id': 'abc123'})
+
+        self.mock_client.start.side_effect = APIError(
+            None, None,
+            b'OCI runtime create failed: exec: "docker-init": executable file not found in $PATH'
+        )
+        with pytest.raises(OperationFailedError) as ex:
+            service.start_container(container)
+
+        assert ex.value.msg.startswith("Cannot start service foo: OCI runtime create failed")
+        assert 'set `init: false` for this service' in ex.value.msg
+
+    def test_get_container_host_config_init(self):
+        self.mock_client.create_host_config.return_value = {}
+
+        Service('foo', client=self.mock_client, init=False)._get_container_host_config({})
+        assert self.mock_client.create_host_config.call_args[1]['init'] is False
+
+        Service('foo', client=self.mock_client)._get_container_host_config({})
+        assert self.mock_client.create_host_config.call_args[1]['init'] is None
+
+        Service('foo', client=self.mock_client, init='/usr/bin/tini')._get_container_host_config({})
+        assert self.mock_client.create_host_config.call_args[1]['init'] is True
+        assert self.mock_client.create_host_config.call_args[1]['init_path'] == '/usr/bin/tini'
+
+    def test_apply_env_files(self):
+        with tempfile.NamedTemporaryFile('w', suffix='.env') as env_file:
+            env_file.write('FOO=from_file\nBAZ=2\n')
+            env_file.flush()
+            service = Service('foo', client=self.mock_client, environment={'FOO': 'bar', 'QUX': '1'})
+            service.apply_env_files([env_file.name])
+
+        assert service.options['environment'] == {'FOO': 'from_file', 'QUX': '1', 'BAZ': '2'}
+
+    def test_start_container_runs_post_start_hooks(self):
+        hook = ServiceHook.parse({'command': 'migrate', 'user': 'app'})
+        service = Service('foo', client=self.mock_client, hooks={'post_start': [hook]})
+        container = Container(
+            self.mock_client, {'Id': 'abc123', 'Name': '/foo_1'}, has_been_inspected=True
+        )
+        self.mock_client.exec_create.return_value = {'Id': 'exec1'}
+        self.mock_client.exec_start.return_value = io.BytesIO(b'done')
+        self.mock_client.exec_inspect.return_value = {'ExitCode': 0}
+
+        service.start_container(container)
+
+        self.mock_client.exec_create.assert_called_once_with(
+            'abc123', 'migrate', user='app', privileged=False, workdir=None, stdin=True, tty=True,
+        )
+        self.mock_client.exec_start.assert_called_once_with({'Id': 'exec1'}, tty=True, socket=True)
+
+    def test_start_container_post_start_hook_failure(self):
+        hook = ServiceHook.parse('migrate')
+        service = Service('foo', client=self.mock_client, hooks={'post_start': [hook]})
+        container = Container(
+            self.mock_client, {'Id': 'abc123', 'Name': '/foo_1'}, has_been_inspected=True
+        )
+        self.mock_client.exec_create.return_value = {'Id': 'exec1'}
+        self.mock_client.exec_start.return_value = io.BytesIO(b'no such table\r\n')
+        self.mock_client.exec_inspect.return_value = {'ExitCode': 3}
+
+        with pytest.raises(OperationFailedError) as ex:
+            service.start_container(container)
+
+        assert ex.value.msg == 'post_start hook migrate failed for foo_1 (exit code 3): no such table'
+
+    def test_pre_stop_hook_failure_does_not_raise(self):
+        hook = ServiceHook.parse('drain')
+        service = Service('foo', client=self.mock_client, hooks={'pre_stop': [hook]})
+        container = Container(self.mock_client, {
+            'Id': 'abc123', 'Name': '/foo_1', 'State': {'Running': True},
+        }, has_been_inspected=True)
+        self.mock_client.exec_create.return_value = {'Id': 'exec1'}
+        self.mock_client.exec_start.return_value = io.BytesIO()
+        self.mock_client.exec_inspect.return_value = {'ExitCode': 1}
+
+        with mock.patch('compose.service.log', autospec=True) as mock_log:
+            service.run_pre_stop_hooks(container)
+
+        assert mock_log.warning.call_count == 1
+
+    def test_hook_error_is_reported(self):
+        hook = ServiceHook.parse('migrate')
+        service = Service('foo', client=self.mock_client, hooks={'post_start': [hook]})
+        container = Container(
+            self.mock_client, {'Id': 'abc123', 'Name': '/foo_1'}, has_been_inspected=True
+        )
+        self.mock_client.exec_create.return_value = {'Id': 'exec1'}
+        self.mock_client.exec_start.side_effect = APIError('exec failed')
+
+        with pytest.raises(OperationFailedError) as ex:
+            service.run_post_start_hooks(container)
+
+        assert ex.value.msg.startswith('Hook migrate could not run in foo_1: ')
+        assert not self.mock_client.exec_inspect.called
+
+    def test_hook_timeout_interrupts_exec(self):
+        hook = ServiceHook.parse({'command': 'migrate', 'timeout': '10ms'})
+        service = Service('foo', client=self.mock_client, hooks={'post_start': [hook]})
+        container = Container(
+            self.mock_client, {'Id': 'abc123', 'Name': '/foo_1'}, has_been_inspected=True
+        )
+        finished = threading.Event()
+        sock = mock.Mock(spec=['read', 'sendall', 'close'])
+        sock.read.side_effect = lambda n: finished.wait(5) and b''
+        sock.sendall.side_effect = lambda data: finished.set()
+        self.mock_client.exec_create.return_value = {'Id': 'exec1'}
+        self.mock_client.exec_start.return_value = sock
+
+        with pytest.raises(OperationFailedError) as ex:
+            service.run_post_start_hooks(container)
+
+        assert ex.value.msg == 'Hook migrate timed out after 0.01s in foo_1'
+        sock.sendall.assert_called_once_with(b'\x03')
+        assert sock.close.called
+
+    def test_pre_stop_hooks_skipped_for_stopped_container(self):
+        hook = ServiceHook.parse('drain')
+        service = Service('foo', client=self.mock_client, hooks={'pre_stop': [hook]})
+        container = Container(self.mock_client, {
+            'Id': 'abc123', 'Name': '/foo_1', 'State': {'Running': False},
+        }, has_been_inspected=True)
+
+        service.run_pre_stop_hooks(container)
+
+        assert not self.mock_client.exec_create.called
+
+    def test_no_pre_stop_hooks_does_not_inspect_container(self):
+        service = Service('foo', client=self.mock_client)
+        container = Container(self.mock_client, {'Id': 'abc123', 'Name': '/foo_1'})
+
+        service.run_pre_stop_hooks(container)
+
+        assert not self.mock_client.inspect_container.called
+
     def test_ensure_image_exists_no_build(self):
         service = Service('foo', client=self.mock_client, build={'context': '.'})
         self.mock_client.inspect_image.return_value = {'Id': 'abc123'}
@@ -563,6 +933,31 @@ class ServiceTest(unittest.TestCase):
         with pytest.raises(NeedsBuildError):
             service.ensure_image_exists(do_build=BuildAction.skip)
 
+    def test_ensure_image_exists_pulls_image_missing_layers(self):
+        service = Service('foo', client=self.mock_client, image='foo')
+        self.mock_client.inspect_image.side_effect = [
+            APIError(None, None, 'failed to get layer sha256:1234: layer does not exist'),
+            {'Id': 'abc123'},
+        ]
+        self.mock_client.pull.return_value = iter([])
+
+        with mock.patch('compose.service.log', autospec=True) as mock_log:
+            service.ensure_image_exists()
+
+        assert mock_log.warning.call_count == 1
+        assert 'missing layers' in mock_log.warning.call_args[0][0]
+        assert self.mock_client.pull.call_count == 1
+
+    def test_ensure_image_exists_other_inspect_error(self):
+        service = Service('foo', client=self.mock_client, image='foo')
+        self.mock_client.inspect_image.side_effect = APIError(
+            None, None, 'permission denied'
+        )
+
+        with pytest.raises(APIError):
+            service.ensure_image_exists()
+        assert not self.mock_client.pull.called
+
     def test_ensure_image_exists_force_build(self):
         service = Service('foo', client=self.mock_client, build={'context': '.'})
         self.mock_client.inspect_image.return_value = {'Id': 'abc123'}
@@ -659,6 +1054,48 @@ class ServiceTest(unittest.TestCase):
         assert called_build_args['arg1'] == build_args['arg1']
         assert called_build_args['arg2'] == 'arg2'
 
+    @mock.patch.dict(os.environ, {'VERSION': 'os'})
+    def test_build_args_are_not_the_environment(self):
+        self.mock_client.build.return_value = [
+            b'{"stream": "Successfully built 12345"}',
+        ]
+        service = Service(
+            'foo',
+            client=self.mock_client,
+            build={'context': '.', 'args': {'VERSION': '1.0', 'TARGET': 'prod'}},
+            environment={'VERSION': 'runtime', 'TARGET': None, 'DEBUG': '1'},
+        )
+
+        service.build(build_args_override={'TARGET': None, 'DEBUG': None})
+        assert self.mock_client.build.call_args[1]['buildargs'] == {
+            'VERSION': '1.0', 'TARGET': 'prod',
+        }
+
+        service.build(build_args_override={'VERSION': None})
+        assert self.mock_client.build.call_args[1]['buildargs'] == {
+            'VERSION': 'os', 'TARGET': 'prod',
+        }
+
+        service.image = lambda: {'Id': 'abc123'}
+        opts = service._get_container_create_options({}, 1)
+        assert 'VERSION=runtime' in opts['environment']
+        assert 'TARGET' in opts['environment']
+        assert 'TARGET=prod' not in opts['environment']
+
+    def test_empty_command_and_entrypoint_clear_those_of_the_image(self):
+        image = {'Id': 'abc123', 'Config': {'Entrypoint': ['/init'], 'Cmd': ['serve']}}
+        cases = [
+            ({}, (None, None)),
+            ({'entrypoint': []}, ([], None)),
+            ({'command': []}, (['/init'], [])),
+            ({'entrypoint': [], 'command': []}, ([], [])),
+        ]
+        for options, expected in cases:
+            service = Service('foo', client=self.mock_client, image='foo', **options)
+            service.image = lambda: image
+            opts = service._get_container_create_options({}, 1)
+            assert (opts.get('entrypoint'), opts.get('command')) == expected, options
+
     def test_build_with_isolation_from_service_config(self):
         self.mock_client.build.return_value = [
             b'{"stream": "Successfully built 12345"}',
@@ -686,6 +1123,91 @@ class ServiceTest(unittest.TestCase):
         called_build_args = self.mock_client.build.call_args[1]
         assert called_build_args['isolation'] == 'default'
 
+    def test_build_with_cache_through_the_api(self):
+        self.mock_client.build.return_value = [
+            b'{"stream": "Successfully built 12345"}',
+        ]
+        service = Service('foo', client=self.mock_client, build={
+            'context': '.',
+            'cache_from': ['app:cache', 'type=registry,ref=app:ci', 'type=gha'],
+            'cache_to': ['type=gha,mode=max'],
+        })
+
+        with mock.patch('compose.service.log') as mock_log:
+            service.build()
+
+        assert self.mock_client.build.call_args[1]['cache_from'] == ['app:cache', 'app:ci']
+        assert mock_log.warning.call_count == 2
+
+    def test_build_with_cache_exports_uses_buildx(self):
+        service = Service('foo', client=self.mock_client, build={
+            'context': '.',
+            'cache_from': ['type=registry,ref=registry.example.com/app:cache', 'type=gha'],
+            'cache_to': ['type=registry,ref=registry.example.com/app:cache,mode=max'],
+        })
+        iidfile = tempfile.NamedTemporaryFile('w', delete=False)
+        iidfile.write('sha256:12345')
+        iidfile.close()
+
+        with mock.patch('compose.service.subprocess.Popen') as mock_popen, \
+                mock.patch('compose.service.tempfile.mktemp', return_value=iidfile.name):
+            mock_popen.return_value.__enter__.return_value.returncode = 0
+            assert service.build(cli=True) == '12345'
+
+        args = mock_popen.call_args[0][0]
+        assert args[:3] == ['docker', 'buildx', 'build']
+        assert '--load' in args
+        assert args[args.index('--cache-to') + 1] == (
+            'type=registry,ref=registry.example.com/app:cache,mode=max'
+        )
+        assert [args[i + 1] for i, arg in enumerate(args) if arg == '--cache-from'] == [
+            'type=registry,ref=registry.example.com/app:cache', 'type=gha',
+        ]
+
+    def test_build_without_local_cache(self):
+        cache_dir = tempfile.mkdtemp()
+        service = Service('foo', client=self.mock_client, build={
+            'context': '.',
+            'cache_from': [
+                'app:cache',
+                'type=local,src={}'.format(cache_dir),
+                'type=local,src={}'.format(os.path.join(cache_dir, 'missing')),
+            ],
+        })
+
+        with mock.patch('compose.service.log') as mock_log:
+            cache_from = service.get_cache_from(service.options['build'])
+
+        assert cache_from == ['app:cache', 'type=local,src={}'.format(cache_dir)]
+        assert mock_log.warning.call_count == 1
+        assert service.get_cache_images(service.options['build']) == ['app:cache']
+        os.rmdir(cache_dir)
+
+    def test_build_base_images(self):
+        with tempfile.TemporaryDirectory() as context:
+            with open(os.path.join(context, 'app.Dockerfile'), 'w') as f:
+                f.write(
+                    'ARG REGISTRY=registry.example.com\n'
+                    'ARG BASE=${REGISTRY}/base\n'
+                    'FROM --platform=linux/amd64 ${BASE}:${TAG:-1.0} AS build\n'
+                    'COPY --from=project_tools /bin/tool /bin/\n'
+                    'from $RUNTIME\n'
+                    'COPY --from=build /app /app\n'
+                )
+            service = Service('app', build={
+                'context': context, 'dockerfile': 'app.Dockerfile', 'args': {'RUNTIME': 'alpine'},
+            })
+
+            assert service.build_base_images() == [
+                'registry.example.com/base:1.0', 'project_tools', 'alpine', 'build',
+            ]
+            assert service.build_base_images({'BASE': 'debian', 'TAG': '11'})[0] == 'debian:11'
+
+        assert Service('app', build={'context': context}).build_base_images() == []
+        assert Service('app', build={
+            'context': 'https://github.com/docker/compose.git',
+        }).build_base_images() == []
+
     def test_config_dict(self):
         self.mock_client.inspect_image.return_value = {'Id': 'abcd'}
         service = Service(
@@ -755,6 +1277,24 @@ class ServiceTest(unittest.TestCase):
                 {}, 1
             )['labels'][LABEL_CONFIG_HASH] == config_hash
 
+    def test_user_labels_survive_on_container(self):
+        self.mock_client.inspect_image.return_value = {'Id': 'abcd'}
+        service = Service(
+            'foo',
+            image='example.com/foo',
+            client=self.mock_client,
+            project='proj',
+            labels={
+                'traefik.enable': 'true',
+                LABEL_SERVICE: 'spoofed',
+            },
+        )
+
+        labels = service._get_container_create_options({}, 1)['labels']
+        assert labels['traefik.enable'] == 'true'
+        assert labels[LABEL_PROJECT] == 'proj'
+        assert labels[LABEL_SERVICE] == 'foo'
+
     def test_remove_image_none(self):
         web = Service('web', image='example', client=self.mock_client)
         assert not web.remove_image(ImageType.none)
@@ -1026,6 +1566,7 @@ class ServiceTest(unittest.TestCase):
             'https_proxy': environment['HTTPS_PROXY'],
             'FTP_PROXY': override_options['environment']['FTP_PROXY'],
             'ftp_proxy': override_options['environment']['FTP_PROXY'],
+            'COMPOSE_REPLICA_INDEX': '1',
         }))
 
     def test_create_when_removed_containers_are_listed(self):
@@ -1232,6 +1773,146 @@ class ServicePortsTest(unittest.TestCase):
         assert '20000:20000/udp' in formatted
         assert '127.0.0.1:30000:30000/tcp' in formatted
 
+    def test_bind_to_host_ip(self):
+        port_bindings = {
+            '80': ['8080', None],
+            '443': [('0.0.0.0', '8443')],
+        }
+        assert bind_to_host_ip(port_bindings, None) == port_bindings
+        assert bind_to_host_ip(port_bindings, '::1') == {
+            '80': [('::1', '8080'), ('::1', None)],
+            '443': [('0.0.0.0', '8443')],
+        }
+
+    def test_allocate_port_ranges(self):
+        client = FakeDockerClient(images=['busybox'])
+        other = client.create_container(
+            'busybox', name='other',
+            host_config=client.create_host_config(port_bindings={'80': ['8000']}),
+        )
+        client.start(other['Id'])
+
+        ports = allocate_port_ranges(client, [
+            ServicePort(80, '8000-8002', None, None, None),
+            ServicePort(81, '8000-8002', None, None, None),
+            ServicePort(53, '8000-8002', 'udp', None, None),
+            ServicePort(443, 443, None, None, None),
+        ])
+        assert [(port.target, port.published) for port in ports] == [
+            (80, 8001), (81, 8002), (53, 8000), (443, 443),
+        ]
+
+        with pytest.raises(OperationFailedError):
+            allocate_port_ranges(client, [ServicePort(80, '8000-8000', None, None, None)])
+
+    def test_publish_all_ports_are_known_once_started(self):
+        client = FakeDockerClient(images=['busybox'])
+        service = Service('web', image='busybox', client=client, project='app', expose=['80'])
+        container = service.create_container(one_off=True, publish_all_ports=True)
+        assert container.ports == {}
+
+        service.start_container(container)
+
+        binding, = container.ports['80/tcp']
+        assert int(binding['HostPort']) > 32768
+
+
+def test_expand_hostname():
+    assert expand_hostname('db', 'app', 'db', 1) == 'db'
+    assert expand_hostname('rabbit-{replica}', 'app', 'rabbit', 3) == 'rabbit-3'
+    assert expand_hostname('es{replica:02d}', 'app', 'es', 3) == 'es03'
+    with pytest.raises(OperationFailedError):
+        expand_hostname('es-{', 'app', 'es', 1)
+    with pytest.raises(OperationFailedError):
+        expand_hostname('es-{service.name}', 'app', 'es', 1)
+
+
+class BindMountCheckTest(unittest.TestCase):
+    def setUp(self):
+        self.tmpdir = tempfile.mkdtemp()
+        self.addCleanup(shutil.rmtree, self.tmpdir)
+        os.mkdir(os.path.join(self.tmpdir, 'conf.d'))
+        open(os.path.join(self.tmpdir, 'config.yml'), 'w').close()
+
+    def path(self, name):
+        return os.path.join(self.tmpdir, name)
+
+    def service(self, *volumes, **kwargs):
+        return Service('web', volumes=[
+            VolumeSpec.parse(v) if isinstance(v, str) else v for v in volumes
+        ], **kwargs)
+
+    def test_bind_target_kind(self):
+        assert bind_target_kind('/etc/app/config.yml') == 'file'
+        assert bind_target_kind('/root/.bashrc') is None
+        assert bind_target_kind('/root/.config.json') == 'file'
+        assert bind_target_kind('/var/run/docker.sock') == 'socket'
+        assert bind_target_kind('/usr/lib/python3.9') is None
+        assert bind_target_kind('/usr/lib/libfoo.so.1') is None
+        assert bind_target_kind('/etc/nginx/conf.d') is None
+        assert bind_target_kind('/srv/site.com/') is None
+        assert bind_target_kind('/data') is None
+
+    @pytest.mark.skipif(IS_WINDOWS_PLATFORM, reason='posix paths')
+    def test_misconfigured_bind_mounts(self):
+        service = self.service(
+            # An existing file or directory at a path that looks alike
+            '{}:/etc/app/config.yml'.format(self.path('config.yml')),
+            '{}:/etc/app/conf.d'.format(self.path('conf.d')),
+            # A missing directory is created by the daemon, as expected
+            '{}:/data'.format(self.path('data')),
+            # A missing file is created as a directory by the daemon
+            '{}:/etc/app/missing.yml'.format(self.path('missing.yml')),
+            # A directory mounted where a file is expected
+            '{}:/etc/app/settings.json'.format(self.path('conf.d')),
+            '{}:/var/run/docker.sock'.format(self.path('config.yml')),
+            # The daemon refuses missing sources of long syntax mounts
+            MountSpec.parse({
+                'type': 'bind', 'source': self.path('absent.yml'), 'target': '/absent.yml',
+            }),
+            MountSpec.parse({
+                'type': 'bind', 'source': self.path('conf.d'), 'target': '/app.ini',
+            }),
+            'named:/etc/app/named.yml',
+        )
+
+        assert service.misconfigured_bind_mounts() == [
+            (self.path('missing.yml'), '/etc/app/missing.yml', 'missing'),
+            (self.path('conf.d'), '/etc/app/settings.json', 'directory'),
+            (self.path('config.yml'), '/var/run/docker.sock', 'not-socket'),
+            (self.path('conf.d'), '/app.ini', 'directory'),
+        ]
+
+    @pytest.mark.skipif(IS_WINDOWS_PLATFORM, reason='posix paths')
+    def test_create_bind_mount_directories(self):
+        service = self.service(
+            '{}:/data'.format(self.path('data/db')),
+            '{}:/etc/app/app.yml'.format(self.path('etc/app.yml')),
+            '{}:/etc/app/config.yml'.format(self.path('config.yml')),
+        )
+
+        service.create_bind_mount_directories()
+
+        assert os.path.isdir(self.path('data/db'))
+        assert os.path.isdir(self.path('etc'))
+        assert not os.path.exists(self.path('etc/app.yml'))
+        assert service.misconfigured_bind_mounts() == [
+            (self.path('etc/app.yml'), '/etc/app/app.yml', 'missing'),
+        ]
+
+    @pytest.mark.skipif(IS_WINDOWS_PLATFORM, reason='posix paths')
+    def test_bind_mounts_of_a_remote_daemon_are_left_alone(self):
+        service = self.service(
+            '{}:/data'.format(self.path('data')),
+            '{}:/etc/app/missing.yml'.format(self.path('missing.yml')),
+            client=mock.Mock(base_url='https://build.example.com:2376'),
+        )
+
+        service.create_bind_mount_directories()
+
+        assert not os.path.exists(self.path('data'))
+        assert service.misconfigured_bind_mounts() == []
+
 
 def build_mount(destination, source, mode='rw'):
     return {'Source': source, 'Destination': destination, 'Mode': mode}
@@ -1340,6 +2021,47 @@ class ServiceVolumesTest(unittest.TestCase):
         assert sorted(binds) == sorted(expected)
         assert affinity == {'affinity:container': '=cdefab'}
 
+    def test_merge_volume_bindings_declared_bind_replaces_inherited_volume(self):
+        options = [VolumeSpec.parse('/host/data:/data', True)]
+        self.mock_client.inspect_image.return_value = {
+            'ContainerConfig': {'Volumes': {'/data': {}}}
+        }
+        previous_container = Container(self.mock_client, {
+            'Id': 'cdefab',
+            'Image': 'ababab',
+            'Mounts': [{
+                'Source': '/var/lib/docker/aaaaaaaa',
+                'Destination': '/data',
+                'Mode': '',
+                'RW': True,
+                'Name': 'anonymousvolume',
+            }],
+        }, has_been_inspected=True)
+
+        binds, affinity = merge_volume_bindings(options, [], previous_container, [])
+        assert binds == ['/host/data:/data:rw']
+        assert affinity == {}
+
+    def test_merge_volume_bindings_declared_volume_replaces_previous_bind(self):
+        options = [VolumeSpec.parse('proj_data:/data', True)]
+        self.mock_client.inspect_image.return_value = {
+            'ContainerConfig': {'Volumes': {}}
+        }
+        previous_container = Container(self.mock_client, {
+            'Id': 'cdefab',
+            'Image': 'ababab',
+            'Mounts': [{
+                'Source': '/host/data',
+                'Destination': '/data',
+                'Mode': '',
+                'RW': True,
+            }],
+        }, has_been_inspected=True)
+
+        binds, affinity = merge_volume_bindings(options, [], previous_container, [])
+        assert binds == ['proj_data:/data:rw']
+        assert affinity == {}
+
     def test_mount_same_host_path_to_two_volumes(self):
         service = Service(
             'web',
@@ -1366,7 +2088,7 @@ class ServiceVolumesTest(unittest.TestCase):
         assert set(self.mock_client.create_host_config.call_args[1]['binds']) == {'/host/path:/data1:rw',
                                                                                   '/host/path:/data2:rw'}
 
-    def test_get_container_create_options_with_different_host_path_in_container_json(self):
+    def test_get_container_create_options_declared_bind_replaces_container_volume(self):
         service = Service(
             'web',
             image='busybox',
@@ -1407,54 +2129,9 @@ class ServiceVolumesTest(unittest.TestCase):
 
         assert (
             self.mock_client.create_host_config.call_args[1]['binds'] ==
-            ['{}:/data:rw'.format(volume_name)]
+            ['/host/path:/data:rw']
         )
 
-    def test_warn_on_masked_volume_no_warning_when_no_container_volumes(self):
-        volumes_option = [VolumeSpec('/home/user', '/path', 'rw')]
-        container_volumes = []
-        service = 'service_name'
-
-        with mock.patch('compose.service.log', autospec=True) as mock_log:
-            warn_on_masked_volume(volumes_option, container_volumes, service)
-
-        assert not mock_log.warning.called
-
-    def test_warn_on_masked_volume_when_masked(self):
-        volumes_option = [VolumeSpec('/home/user', '/path', 'rw')]
-        container_volumes = [
-            VolumeSpec('/var/lib/docker/path', '/path', 'rw'),
-            VolumeSpec('/var/lib/docker/path', '/other', 'rw'),
-        ]
-        service = 'service_name'
-
-        with mock.patch('compose.service.log', autospec=True) as mock_log:
-            warn_on_masked_volume(volumes_option, container_volumes, service)
-
-        mock_log.warning.assert_called_once_with(mock.ANY)
-
-    def test_warn_on_masked_no_warning_with_same_path(self):
-        volumes_option = [VolumeSpec('/home/user', '/path', 'rw')]
-        container_volumes = [VolumeSpec('/home/user', '/path', 'rw')]
-        service = 'service_name'
-
-        with mock.patch('compose.service.log', autospec=True) as mock_log:
-            warn_on_masked_volume(volumes_option, container_volumes, service)
-
-        assert not mock_log.warning.called
-
-    def test_warn_on_masked_no_warning_with_container_only_option(self):
-        volumes_option = [VolumeSpec(None, '/path', 'rw')]
-        container_volumes = [
-            VolumeSpec('/var/lib/docker/volume/path', '/path', 'rw')
-        ]
-        service = 'service_name'
-
-        with mock.patch('compose.service.log', autospec=True) as mock_log:
-            warn_on_masked_volume(volumes_option, container_volumes, service)
-
-        assert not mock_log.warning.called
-
     def test_create_with_special_volume_mode(self):
         self.mock_client.inspect_image.return_value = {'Id': 'imageid'}
 
@@ -1526,6 +2203,31 @@ class ServiceSecretTest(unittest.TestCase):
         assert volumes[0].source == secret1['file']
         assert volumes[0].target == '{}/{}'.format(SECRETS_PATH, secret1['secret'].source)
 
+    @mock.patch('compose.service.IS_WINDOWS_PLATFORM', False)
+    def test_inaccessible_bind_mounts(self):
+        private = tempfile.mkdtemp()
+        shared = tempfile.mkdtemp()
+        self.addCleanup(os.rmdir, private)
+        self.addCleanup(os.rmdir, shared)
+        os.chmod(private, 0o700)
+        os.chmod(shared, 0o777)
+        owner = os.stat(private).st_uid
+        volumes = [
+            VolumeSpec.parse('{}:/private'.format(private)),
+            MountSpec.parse({'type': 'bind', 'source': shared, 'target': '/shared'}),
+            VolumeSpec.parse('named:/named'),
+        ]
+
+        def inaccessible(userns_remap=False, **options):
+            service = Service('web', client=self.mock_client, volumes=volumes, **options)
+            return [path for path, _ in service.inaccessible_bind_mounts(userns_remap)]
+
+        assert inaccessible() == []
+        assert inaccessible(user='{}'.format(owner + 1000)) == [private]
+        assert inaccessible(user='{}:{}'.format(owner, owner)) == []
+        assert inaccessible(userns_remap=True) == [private]
+        assert inaccessible(userns_remap=True, userns_mode='host') == []
+
 
 class RewriteBuildPathTest(unittest.TestCase):
     @mock.patch('compose.service.IS_WINDOWS_PLATFORM', True)
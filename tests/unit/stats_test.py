@@ -0,0 +1,138 @@
+import time
+
+import docker
+from docker.constants import DEFAULT_DOCKER_API_VERSION
+
+from .. import mock
+from compose import stats
+from compose.service import Service
+
+
+def raw_stats(total_usage=0, pre_total_usage=0, system=0, pre_system=0, cpus=2,
+              usage=0, cache=0, limit=0, rx=0, tx=0):
+    return {
+        'cpu_stats': {
+            'cpu_usage': {'total_usage': total_usage},
+            'system_cpu_usage': system,
+            'online_cpus': cpus,
+        },
+        'precpu_stats': {
+            'cpu_usage': {'total_usage': pre_total_usage},
+            'system_cpu_usage': pre_system,
+        },
+        'memory_stats': {'usage': usage, 'limit': limit, 'stats': {'cache': cache}},
+        'networks': {
+            'eth0': {'rx_bytes': rx, 'tx_bytes': tx},
+        },
+    }
+
+
+def test_cpu_percent():
+    sample = raw_stats(total_usage=200, pre_total_usage=100, system=2000, pre_system=1000)
+    assert stats.cpu_percent(sample) == 20.0
+
+
+def test_cpu_percent_without_previous_sample():
+    assert stats.cpu_percent(raw_stats(total_usage=200, system=2000)) == 20.0
+    assert stats.cpu_percent({}) == 0.0
+
+
+def test_memory_usage_excludes_cache():
+    assert stats.memory_usage(raw_stats(usage=1000, cache=300)) == 700
+
+
+def test_network_bytes_sums_interfaces():
+    sample = {'networks': {
+        'eth0': {'rx_bytes': 10, 'tx_bytes': 1},
+        'eth1': {'rx_bytes': 5, 'tx_bytes': 2},
+    }}
+    assert stats.network_bytes(sample) == (15, 3)
+
+
+def test_aggregator_sums_replicas():
+    aggregator = stats.ServiceStatsAggregator()
+    sample = aggregator.update({
+        'a': raw_stats(200, 100, 2000, 1000, usage=100, limit=1000, rx=10, tx=1),
+        'b': raw_stats(300, 100, 2000, 1000, usage=50, limit=1000, rx=20, tx=2),
+    }, now=1)
+
+    assert sample == stats.StatsSample(
+        time=1, replicas=2, cpu_percent=60.0, memory_usage=150,
+        memory_limit=2000, rx_bytes=30, tx_bytes=3,
+    )
+
+
+def test_aggregator_keeps_totals_when_replica_disappears():
+    aggregator = stats.ServiceStatsAggregator()
+    aggregator.update({'a': raw_stats(rx=10, tx=1), 'b': raw_stats(rx=20, tx=2)})
+    sample = aggregator.update({'a': raw_stats(rx=15, tx=1)})
+
+    assert sample.replicas == 1
+    assert sample.rx_bytes == 35
+    assert sample.tx_bytes == 3
+
+
+def test_aggregator_counts_new_replica():
+    aggregator = stats.ServiceStatsAggregator()
+    aggregator.update({'a': raw_stats(rx=10)})
+    sample = aggregator.update({'a': raw_stats(rx=10), 'b': raw_stats(rx=4)})
+
+    assert sample.replicas == 2
+    assert sample.rx_bytes == 14
+
+
+def test_aggregator_handles_counter_reset_on_restart():
+    aggregator = stats.ServiceStatsAggregator()
+    aggregator.update({'a': raw_stats(rx=100, tx=50)})
+    aggregator.update({'a': raw_stats(rx=120, tx=60)})
+    sample = aggregator.update({'a': raw_stats(rx=5, tx=2)})
+
+    assert sample.rx_bytes == 125
+    assert sample.tx_bytes == 62
+
+
+def test_service_stats_streams_aggregated_samples():
+    client = mock.create_autospec(docker.APIClient)
+    client.api_version = DEFAULT_DOCKER_API_VERSION
+    client.containers.return_value = [
+        {'Id': 'a', 'Image': 'foo', 'Name': '/proj_web_1'},
+        {'Id': 'b', 'Image': 'foo', 'Name': '/proj_web_2'},
+    ]
+    client.stats.side_effect = [
+        raw_stats(usage=10, rx=1), raw_stats(usage=20, rx=2),
+        raw_stats(usage=30, rx=3), raw_stats(usage=40, rx=4),
+    ]
+    service = Service('web', client=client, project='proj', image='foo')
+
+    with mock.patch('compose.service.time.sleep'):
+        samples = service.stats(interval=0)
+        first, second = next(samples), next(samples)
+
+    assert (first.replicas, first.memory_usage, first.rx_bytes) == (2, 30, 3)
+    assert (second.replicas, second.memory_usage, second.rx_bytes) == (2, 70, 7)
+    client.stats.assert_any_call('a', stream=False)
+
+
+def test_container_stats():
+    sample = raw_stats(total_usage=1500, usage=300, cache=100, limit=1000)
+    sample['pids_stats'] = {'current': 3, 'limit': 64}
+
+    assert stats.container_stats(sample) == stats.ContainerStats(
+        populated=True, cpu_time=1500, memory_usage=200, memory_limit=1000,
+        pids_current=3, pids_limit=64,
+    )
+
+
+def test_fetch_container_stats_times_out():
+    client = mock.Mock()
+    client.stats.side_effect = lambda *args, **kwargs: time.sleep(1)
+
+    assert stats.fetch_container_stats(client, 'a', timeout=0.01) == stats.NO_STATS
+
+
+def test_fetch_container_stats_fails():
+    client = mock.Mock()
+    client.stats.side_effect = docker.errors.NotFound('gone')
+
+    assert stats.fetch_container_stats(client, 'a') == stats.NO_STATS
+
@@ -0,0 +1,44 @@
+from .. import mock
+from compose.const import LABEL_CONFIG_DATA
+from compose.const import LABEL_PROJECT
+from compose.stored_config import load_stored_config
+from compose.stored_config import remove_stored_config
+from compose.stored_config import state_file_path
+from compose.stored_config import store_config
+from compose.testutil import FakeDockerClient
+
+CONFIG_YAML = 'services:\n  web:\n    image: busybox\n'
+
+
+def create_project_container(client, labels):
+    labels = dict(labels, **{LABEL_PROJECT: 'app'})
+    client.create_container('busybox', name='app_web_1', labels=labels)
+
+
+def test_small_config_is_stored_in_label(tmpdir):
+    client = FakeDockerClient(images=['busybox'])
+    labels = store_config('app', client.base_url, CONFIG_YAML, state_dir=str(tmpdir))
+
+    assert len(labels) == 1
+    assert labels[0].startswith(LABEL_CONFIG_DATA + '=')
+    assert tmpdir.listdir() == []
+
+    create_project_container(client, dict([labels[0].split('=', 1)]))
+    assert load_stored_config(client, 'app', state_dir=str(tmpdir)) == CONFIG_YAML
+
+
+def test_large_config_is_stored_in_state_file(tmpdir):
+    client = FakeDockerClient(images=['busybox'])
+    with mock.patch('compose.stored_config.MAX_LABEL_SIZE', 10):
+        labels = store_config('app', client.base_url, CONFIG_YAML, state_dir=str(tmpdir))
+
+    assert labels == []
+    path = state_file_path('app', client.base_url, state_dir=str(tmpdir))
+    with open(path) as f:
+        assert f.read() == CONFIG_YAML
+
+    create_project_container(client, {})
+    assert load_stored_config(client, 'app', state_dir=str(tmpdir)) == CONFIG_YAML
+
+    remove_stored_config('app', client.base_url, state_dir=str(tmpdir))
+    assert load_stored_config(client, 'app', state_dir=str(tmpdir)) is None
@@ -0,0 +1,56 @@
+import pytest
+from docker.errors import APIError
+from docker.errors import ImageNotFound
+from docker.errors import NotFound
+
+from compose.testutil import FakeDockerClient
+
+
+def test_create_requires_image():
+    client = FakeDockerClient()
+    with pytest.raises(ImageNotFound):
+        client.create_container('busybox', name='web')
+
+    client.pull('busybox', tag='latest', stream=True)
+    assert client.create_container('busybox', name='web')['Id']
+
+
+def test_containers_filters_by_state_and_label():
+    client = FakeDockerClient(images=['busybox'])
+    web = client.create_container('busybox', name='web', labels={'app': 'web'})
+    client.create_container('busybox', name='db', labels={'app': 'db'})
+    client.start(web)
+
+    assert [c['Names'] for c in client.containers()] == [['/web']]
+    assert len(client.containers(all=True)) == 2
+    assert [c['Names'] for c in client.containers(all=True, filters={'label': ['app=db']})] == [
+        ['/db']
+    ]
+    assert [c['Names'] for c in client.containers(all=True, filters={'status': 'created'})] == [
+        ['/db']
+    ]
+
+
+def test_remove_running_container_requires_force():
+    client = FakeDockerClient(images=['busybox'])
+    container = client.create_container('busybox', name='web')
+    client.start(container)
+
+    with pytest.raises(APIError):
+        client.remove_container(container)
+    client.remove_container(container, force=True)
+
+    with pytest.raises(NotFound):
+        client.inspect_container('web')
+
+
+def test_fail_injects_errors():
+    client = FakeDockerClient()
+    client.fail('create_network', APIError('boom'), times=1)
+
+    with pytest.raises(APIError):
+        client.create_network('app_default')
+    client.create_network('app_default')
+
+    assert client.inspect_network('app_default')['Driver'] == 'bridge'
+    assert len(client.called('create_network')) == 2
@@ -0,0 +1,84 @@
+import docker
+import pytest
+from docker.constants import DEFAULT_DOCKER_API_VERSION
+
+from .. import mock
+from compose import tracing
+from compose.container import Container
+from compose.parallel import parallel_execute
+from compose.service import Service
+
+
+@pytest.fixture
+def exporter(monkeypatch):
+    sdk_trace = pytest.importorskip('opentelemetry.sdk.trace')
+    sdk_export = pytest.importorskip('opentelemetry.sdk.trace.export')
+    in_memory = pytest.importorskip('opentelemetry.sdk.trace.export.in_memory_span_exporter')
+
+    exporter = in_memory.InMemorySpanExporter()
+    provider = sdk_trace.TracerProvider()
+    provider.add_span_processor(sdk_export.SimpleSpanProcessor(exporter))
+    monkeypatch.setattr(tracing.trace, 'get_tracer', provider.get_tracer)
+    monkeypatch.setattr(tracing.trace, 'get_tracer_provider', lambda: provider)
+    return exporter
+
+
+def test_span_hierarchy_across_parallel_workers(exporter):
+    client = mock.create_autospec(docker.APIClient)
+    client.api_version = DEFAULT_DOCKER_API_VERSION
+    services = [
+        Service('web', client=client, project='proj', image='nginx'),
+        Service('db', client=client, project='proj', image='postgres'),
+    ]
+    containers = {
+        service.name: Container(client, {
+            'Id': service.name + '-id', 'Name': '/proj_{}_1'.format(service.name),
+        }, has_been_inspected=True)
+        for service in services
+    }
+
+    with tracing.span('compose.up', {'compose.project': 'proj'}):
+        parallel_execute(
+            services,
+            lambda service: service.start_container(containers[service.name]),
+            lambda service: service.name,
+            None,
+        )
+
+    spans = {s.name + ':' + s.attributes.get('compose.service', ''): s
+             for s in exporter.get_finished_spans()}
+    root = spans['compose.up:']
+    assert root.parent is None
+
+    for name in ('web', 'db'):
+        start = spans['service.start:' + name]
+        assert start.parent.span_id == root.context.span_id
+        assert start.attributes['compose.project'] == 'proj'
+        assert start.attributes['container.id'] == name + '-id'
+
+
+def test_noop_without_opentelemetry(monkeypatch):
+    monkeypatch.setattr(tracing, 'trace', None)
+    monkeypatch.setattr(tracing, 'context', None)
+
+    def fn():
+        return 'ok'
+
+    assert tracing.propagate_context(fn) is fn
+    with tracing.span('compose.up', {'compose.project': 'proj'}):
+        assert fn() == 'ok'
+
+
+def test_traced_skips_attributes_without_tracer_provider(monkeypatch):
+    pytest.importorskip('opentelemetry.trace')
+    monkeypatch.setattr(
+        tracing.trace, 'get_tracer_provider', lambda: tracing.trace.NoOpTracerProvider()
+    )
+    get_attributes = mock.Mock()
+
+    @tracing.traced('compose.up', get_attributes)
+    def fn(project):
+        return 'ok'
+
+    assert fn('proj') == 'ok'
+    assert not get_attributes.called
@@ -1,4 +1,5 @@
 from compose import utils
+from tests import mock
 
 
 class TestJsonSplitter:
@@ -72,3 +73,16 @@ class TestMoreItertools:
         assert list(unique([2, 1, 2, 1])) == [2, 1]
         assert list(unique([2, 1, 2, 1], hash)) == [2, 1]
         assert list(unique([2, 1, 2, 1], lambda x: 'key_%s' % x)) == [2, 1]
+
+
+class TestIsLocalDaemon:
+    def test_is_local_daemon(self):
+        def client(base_url):
+            return mock.Mock(base_url=base_url)
+
+        assert utils.is_local_daemon(None)
+        assert utils.is_local_daemon(client('http+docker://localhost'))
+        assert utils.is_local_daemon(client('http+docker://localnpipe'))
+        assert utils.is_local_daemon(client('http://127.0.0.1:2375'))
+        assert not utils.is_local_daemon(client('https://build.example.com:2376'))
+        assert not utils.is_local_daemon(client('http+docker://ssh'))
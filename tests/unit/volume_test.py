@@ -2,6 +2,9 @@ import docker
 import pytest
 
 from compose import volume
+from compose.const import LABEL_PROJECT
+from compose.const import LABEL_TENANT
+from compose.const import LABEL_VOLUME
 from tests import mock
 
 
@@ -21,3 +24,27 @@ class TestVolume:
         vol = volume.Volume(mock_client, 'foo', 'project', external=True)
         vol.remove()
         assert not mock_client.remove_volume.called
+
+    def test_create_keeps_user_labels(self, mock_client):
+        mock_client._version = '1.41'
+        vol = volume.Volume(mock_client, 'project', 'foo', labels={
+            'backup': 'daily',
+            LABEL_PROJECT: 'spoofed',
+        })
+        vol.create()
+        labels = mock_client.create_volume.call_args[1]['labels']
+        assert labels['backup'] == 'daily'
+        assert labels[LABEL_PROJECT] == 'project'
+        assert labels[LABEL_VOLUME] == 'foo'
+
+    def test_remove_skips_other_tenants_volume(self, mock_client):
+        mock_client.inspect_volume.return_value = {'Labels': {LABEL_TENANT: 'team-a'}}
+        vol = volume.Volume(mock_client, 'project', 'foo', tenant='team-b')
+        vol.remove()
+        assert not mock_client.remove_volume.called
+
+    def test_create_adds_tenant_label(self, mock_client):
+        mock_client._version = '1.41'
+        vol = volume.Volume(mock_client, 'project', 'foo', tenant='team-a')
+        vol.create()
+        assert mock_client.create_volume.call_args[1]['labels'][LABEL_TENANT] == 'team-a'
@@ -0,0 +1,89 @@
+import socket
+
+import pytest
+
+from compose.errors import WaitTimeoutError
+from compose.wait import Backoff
+from compose.wait import dial_tcp
+from compose.wait import parse_target
+from compose.wait import ProbeError
+from compose.wait import Target
+from compose.wait import wait_for
+
+
+class FakeClock:
+    def __init__(self):
+        self.now = 0
+        self.sleeps = []
+
+    def __call__(self):
+        return self.now
+
+    def sleep(self, seconds):
+        self.sleeps.append(seconds)
+        self.now += seconds
+
+
+def failing(times):
+    calls = []
+
+    def check():
+        calls.append(None)
+        if len(calls) <= times:
+            raise ProbeError('attempt {}'.format(len(calls)))
+        return 'ready'
+    return check
+
+
+def test_backoff_delays():
+    delays = Backoff(initial=1, factor=3, cap=10).delays()
+    assert [next(delays) for _ in range(5)] == [1, 3, 9, 10, 10]
+
+
+def test_wait_for_returns_once_check_succeeds():
+    clock = FakeClock()
+    assert wait_for(failing(3), 60, clock=clock, sleep=clock.sleep) == 'ready'
+    assert clock.sleeps == [0.1, 0.2, 0.4]
+
+
+def test_wait_for_times_out_with_last_error():
+    clock = FakeClock()
+    with pytest.raises(WaitTimeoutError) as excinfo:
+        wait_for(
+            failing(100), 10, backoff=Backoff(initial=1, factor=2, cap=4),
+            clock=clock, sleep=clock.sleep,
+        )
+
+    # Delays double up to the cap, the last one cut to the deadline
+    assert clock.sleeps == [1, 2, 4, 3]
+    assert excinfo.value.timeout == 10
+    assert str(excinfo.value.error) == 'attempt 5'
+    assert excinfo.value.msg == 'Timed out after 10s: attempt 5'
+
+
+def test_dial_tcp():
+    server = socket.socket()
+    server.bind(('127.0.0.1', 0))
+    server.listen(1)
+    port = server.getsockname()[1]
+    dial_tcp('127.0.0.1', port, timeout=1)
+
+    server.close()
+    with pytest.raises(ProbeError):
+        dial_tcp('127.0.0.1', port, timeout=1)
+
+
+@pytest.mark.parametrize('target, expected', [
+    ('5432', Target('tcp', 5432, '/')),
+    ('tls://443', Target('tls', 443, '/')),
+    ('http://8080/health', Target('http', 8080, '/health')),
+    ('https://8443/', Target('https', 8443, '/')),
+])
+def test_parse_target(target, expected):
+    assert parse_target(target) == expected
+
+
+@pytest.mark.parametrize('target', ['', 'db', 'udp://53', 'http://', 'http://port/health'])
+def test_parse_target_invalid(target):
+    with pytest.raises(ValueError):
+        parse_target(target)
@@ -0,0 +1,41 @@
+import pytest
+
+from compose.config.environment import Environment
+from compose.warning import BIND_MOUNT_ACCESS
+from compose.warning import LABEL_ADOPTION
+from compose.warning import ORPHANS
+from compose.warning import PLATFORM_MISMATCH
+from compose.warning import Warnings
+from tests import mock
+
+
+def test_warnings_from_environment():
+    warnings = Warnings.from_environment(Environment({
+        'COMPOSE_IGNORE_WARNINGS': 'platform-mismatch, label-adoption',
+    }))
+    assert warnings.ignored == {PLATFORM_MISMATCH, LABEL_ADOPTION}
+
+
+def test_conventional_variables():
+    warnings = Warnings.from_environment(Environment({
+        'COMPOSE_IGNORE_ORPHANS': 'true',
+        'COMPOSE_IGNORE_BIND_MOUNT_ACCESS': '0',
+    }))
+    assert warnings.ignored == {ORPHANS}
+    assert not warnings.is_ignored(BIND_MOUNT_ACCESS)
+
+
+def test_unknown_warning_class():
+    with pytest.raises(ValueError) as excinfo:
+        Warnings.from_environment(Environment({'COMPOSE_IGNORE_WARNINGS': 'orphan'}))
+    assert 'orphan ' in str(excinfo.value)
+
+
+def test_ignored_warnings_are_logged_at_debug_level():
+    warnings = Warnings([ORPHANS])
+    with mock.patch('compose.warning.log') as mock_log:
+        warnings.warn(ORPHANS, 'Found orphan containers')
+        warnings.warn(PLATFORM_MISMATCH, 'Image busybox is for linux/arm64')
+
+    mock_log.warning.assert_called_once_with('Image busybox is for linux/arm64')
+    assert mock_log.debug.call_count == 1